@@ -0,0 +1,93 @@
+package lua
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sort"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+var abFuncs = map[string]lua.LGFunction{
+	"bucket": abBucket,
+}
+
+// abBucket implements caddy.ab.bucket(key, weights[, opts]). It assigns key
+// to one of the buckets in weights (a table of bucket name to positive
+// weight) using consistent hashing, so that the same key always lands in the
+// same bucket for a given set of weights. The opts table supports:
+//   - name: the experiment name, used to salt the hash so that the same key
+//     gets independent assignments in different experiments.
+//   - cookie: the name of a cookie used to persist the assignment. If the
+//     request has this cookie set to a valid bucket, it is returned as-is,
+//     otherwise the cookie is set on the response.
+//   - max_age: the max age of the cookie in seconds.
+func abBucket(L *lua.LState) int {
+	key := L.CheckString(1)
+	weights := L.CheckTable(2)
+	opts := L.OptTable(3, L.NewTable())
+
+	var (
+		names []string
+		total uint64
+	)
+	byName := make(map[string]uint64)
+	weights.ForEach(func(k, v lua.LValue) {
+		n, ok := v.(lua.LNumber)
+		if !ok || n < 1 || k.Type() != lua.LTString {
+			L.ArgError(2, "weights must map bucket names to numbers of 1 or more")
+		}
+		name := k.String()
+		names = append(names, name)
+		byName[name] = uint64(n)
+		total += uint64(n)
+	})
+	if len(names) == 0 || total == 0 {
+		L.ArgError(2, "at least one bucket is required")
+	}
+	sort.Strings(names)
+
+	experiment := lua.LVAsString(opts.RawGetString("name"))
+	cookieName := lua.LVAsString(opts.RawGetString("cookie"))
+	maxAge := int(lua.LVAsNumber(opts.RawGetString("max_age")))
+
+	var rc *requestContext
+	if cookieName != "" {
+		rc = checkRequestContext(L)
+		if c, err := rc.r.Cookie(cookieName); err == nil {
+			if _, ok := byName[c.Value]; ok {
+				L.Push(lua.LString(c.Value))
+				return 1
+			}
+		}
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(experiment))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	point := h.Sum64() % total
+
+	var bucket string
+	for _, name := range names {
+		w := byName[name]
+		if point < w {
+			bucket = name
+			break
+		}
+		point -= w
+	}
+
+	if rc != nil && rc.w != nil {
+		http.SetCookie(rc.w, &http.Cookie{
+			Name:     cookieName,
+			Value:    bucket,
+			Path:     "/",
+			MaxAge:   maxAge,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	L.Push(lua.LString(bucket))
+	return 1
+}
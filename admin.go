@@ -0,0 +1,263 @@
+package lua
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// adminAPIBase is the path prefix of the Lua admin endpoints.
+const adminAPIBase = "/lua/"
+
+// adminAPI is a module that serves the admin endpoints used to manage the Lua
+// handlers at runtime.
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.lua",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes implements caddy.AdminRouter.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: adminAPIBase,
+			Handler: caddy.AdminHandlerFunc(a.handleAPIEndpoints),
+		},
+	}
+}
+
+// handleAPIEndpoints routes API requests within adminAPIBase.
+func (a adminAPI) handleAPIEndpoints(w http.ResponseWriter, r *http.Request) error {
+	uri := strings.TrimPrefix(r.URL.Path, adminAPIBase)
+	parts := strings.Split(uri, "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "traffic":
+		return a.handleTrafficList(w, r)
+	case len(parts) == 2 && parts[0] == "traffic" && parts[1] != "":
+		return a.handleTraffic(w, r, parts[1])
+	case len(parts) == 1 && parts[0] == "handlers":
+		return a.handleHandlerList(w, r)
+	case len(parts) >= 2 && parts[0] == "handlers" && parts[1] != "":
+		return a.handleHandler(w, r, parts[1], parts[2:])
+	case len(parts) == 1 && parts[0] == "maintenance":
+		return a.handleMaintenanceList(w, r)
+	case len(parts) == 2 && parts[0] == "maintenance" && parts[1] != "":
+		return a.handleMaintenance(w, r, parts[1])
+	}
+	return caddy.APIError{
+		HTTPStatus: http.StatusNotFound,
+		Err:        fmt.Errorf("resource not found: %v", r.URL.Path),
+	}
+}
+
+// handleTrafficList reports the traffic split of all named handlers.
+func (a adminAPI) handleTrafficList(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	return writeJSON(w, trafficSplits.list())
+}
+
+// handleTraffic reports (GET) or changes (PUT, POST) the traffic split of the
+// named handler.
+func (a adminAPI) handleTraffic(w http.ResponseWriter, r *http.Request, name string) error {
+	ts := trafficSplits.get(name)
+	if ts == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no handler named %q", name),
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var body struct {
+			GreenPercent *int `json:"green_percent"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("decoding request body: %w", err),
+			}
+		}
+		if body.GreenPercent == nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("green_percent is required"),
+			}
+		}
+		if err := ts.setGreenPercent(*body.GreenPercent); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        err,
+			}
+		}
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	return writeJSON(w, ts.status())
+}
+
+// handleMaintenanceList reports the state of all maintenance flags.
+func (a adminAPI) handleMaintenanceList(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	return writeJSON(w, maintenanceFlags.list())
+}
+
+// handleMaintenance reports (GET) or changes (PUT, POST) the state of the
+// named maintenance flag.
+func (a adminAPI) handleMaintenance(w http.ResponseWriter, r *http.Request, name string) error {
+	switch r.Method {
+	case http.MethodGet:
+		if f := maintenanceFlags.lookup(name); f != nil {
+			return writeJSON(w, f.status())
+		}
+		return writeJSON(w, maintenanceStatus{Name: name})
+	case http.MethodPut, http.MethodPost:
+		var body struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("decoding request body: %w", err),
+			}
+		}
+		if body.Enabled == nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("enabled is required"),
+			}
+		}
+		f := maintenanceFlags.get(name)
+		f.setEnabled(*body.Enabled)
+		return writeJSON(w, f.status())
+	}
+	return caddy.APIError{
+		HTTPStatus: http.StatusMethodNotAllowed,
+		Err:        fmt.Errorf("method not allowed"),
+	}
+}
+
+// handleHandlerList reports the status of all named handlers.
+func (a adminAPI) handleHandlerList(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	return writeJSON(w, luaHandlers.list())
+}
+
+// handleHandler reports the status of the named handler (GET), recompiles
+// its scripts (POST reload) or calls a function of its admin script (POST
+// call/<function>).
+func (a adminAPI) handleHandler(w http.ResponseWriter, r *http.Request, name string, action []string) error {
+	hi := luaHandlers.get(name)
+	if hi == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no handler named %q", name),
+		}
+	}
+
+	switch {
+	case len(action) == 0 && r.Method == http.MethodGet:
+		st := hi.status()
+		if hi.handler.AdminScript != "" {
+			fns, err := hi.adminFunctions()
+			if err != nil {
+				return caddy.APIError{
+					HTTPStatus: http.StatusInternalServerError,
+					Err:        fmt.Errorf("running the admin script: %w", err),
+				}
+			}
+			st.Functions = fns
+		}
+		return writeJSON(w, st)
+
+	case len(action) == 1 && action[0] == "reload" && r.Method == http.MethodPost:
+		if err := hi.reload(); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        err,
+			}
+		}
+		return writeJSON(w, hi.status())
+
+	case len(action) == 2 && action[0] == "call" && action[1] != "" && r.Method == http.MethodPost:
+		var arg interface{}
+		if err := json.NewDecoder(r.Body).Decode(&arg); err != nil && !errors.Is(err, io.EOF) {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("decoding request body: %w", err),
+			}
+		}
+		res, err := hi.call(action[1], arg)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errNoAdminFunction) {
+				status = http.StatusNotFound
+			}
+			return caddy.APIError{
+				HTTPStatus: status,
+				Err:        fmt.Errorf("calling %s: %w", action[1], err),
+			}
+		}
+		return writeJSON(w, map[string]interface{}{"result": res})
+
+	case len(action) == 0, len(action) == 1 && action[0] == "reload", len(action) == 2 && action[0] == "call" && action[1] != "":
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	return caddy.APIError{
+		HTTPStatus: http.StatusNotFound,
+		Err:        fmt.Errorf("resource not found: %v", r.URL.Path),
+	}
+}
+
+// writeJSON writes v as a JSON response body.
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("encoding response: %w", err),
+		}
+	}
+	return nil
+}
+
+// interface guards
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
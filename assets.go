@@ -0,0 +1,143 @@
+package lua
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// assetHashLen is the number of hex characters of the content hash added to
+// the fingerprinted asset names.
+const assetHashLen = 12
+
+// Assets configures the fingerprinting of the static files under Root. At
+// provision time, each file is hashed and a manifest maps its path to a
+// fingerprinted name, e.g. js/app.js to js/app.3f2a9c1b0d4e.js, which
+// scripts resolve with caddy.assets.url. Requests for a fingerprinted
+// name under the Prefix URL path (default "/") are rewritten to the actual
+// file and marked as cacheable forever, so that the next handler (e.g.
+// file_server) serves it.
+type Assets struct {
+	Root   string `json:"root,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// unmarshalCaddyfile sets up the assets from the option's tokens.
+func (a *Assets) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.Args(&a.Root) {
+		return d.Errf("assets: %w", d.ArgErr())
+	}
+	d.Args(&a.Prefix)
+	if d.NextArg() {
+		return d.Errf("assets: %w", d.ArgErr())
+	}
+	return nil
+}
+
+// assetManifest is the runtime state of Assets.
+type assetManifest struct {
+	prefix string
+	urls   map[string]string // asset path to fingerprinted path
+	files  map[string]string // fingerprinted path to asset path
+}
+
+// newAssetManifest hashes the files under cfg.Root and returns the
+// resulting manifest.
+func newAssetManifest(cfg *Assets) (*assetManifest, error) {
+	prefix := "/" + strings.Trim(cfg.Prefix, "/")
+	m := &assetManifest{
+		prefix: strings.TrimSuffix(prefix, "/") + "/",
+		urls:   make(map[string]string),
+		files:  make(map[string]string),
+	}
+	err := filepath.WalkDir(cfg.Root, func(p string, de fs.DirEntry, err error) error {
+		if err != nil || de.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(cfg.Root, p)
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		hashed := fingerprint(name, sum)
+		m.urls[name] = hashed
+		m.files[hashed] = name
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// hashFile returns the hex-encoded SHA-256 hash of the file at p.
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fingerprint inserts the truncated hash sum before the extension of name.
+func fingerprint(name, sum string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + sum[:assetHashLen] + ext
+}
+
+// url returns the fingerprinted URL of the asset name, or its
+// non-fingerprinted URL if it is not in the manifest.
+func (m *assetManifest) url(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	if hashed, ok := m.urls[name]; ok {
+		return m.prefix + hashed
+	}
+	return m.prefix + name
+}
+
+// rewrite rewrites the URL path of r to the actual asset if it is a
+// fingerprinted asset URL, and sets the far-future caching headers on w.
+func (m *assetManifest) rewrite(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, m.prefix) {
+		return
+	}
+	name, ok := m.files[strings.TrimPrefix(r.URL.Path, m.prefix)]
+	if !ok {
+		return
+	}
+	r.URL.Path = m.prefix + name
+	r.URL.RawPath = ""
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+}
+
+var assetsFuncs = map[string]lua.LGFunction{
+	"url": assetsURL,
+}
+
+// assetsURL implements caddy.assets.url(name).
+func assetsURL(L *lua.LState) int {
+	m := checkRequestContext(L).handler.assets
+	if m == nil {
+		L.RaiseError("no assets are configured for this handler")
+	}
+	L.Push(lua.LString(m.url(L.CheckString(1))))
+	return 1
+}
@@ -0,0 +1,206 @@
+package lua
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// preloadAuthModule registers the auth module, loaded by scripts with
+// require("auth"), which helps to implement the authentication of the
+// requests with custom backends, e.g. the users of a database:
+//
+//	auth.basic([r]): the user and password of the basic authentication of
+//	r, the request or the value of an Authorization header (default the
+//	request), or nil
+//	auth.bearer([r]): the token of the bearer authentication of r, or nil
+//	auth.check_password(hash, password): true if password matches the bcrypt
+//	($2a$, $2b$ or $2y$) or argon2 ($argon2id$ or $argon2i$, in the PHC
+//	string format) hash, or nil and an error message if hash is not valid
+//	auth.hash_password(password[, cost]): the bcrypt hash of password, with
+//	the cost (default 10)
+//	auth.challenge(realm[, scheme]): responds with a 401 status and the
+//	WWW-Authenticate header of the scheme (default "Basic") and realm
+//
+// Checking a password is slow by design, from milliseconds to tens of
+// milliseconds depending on the parameters of the hash, so the scripts
+// should cache the users that successfully authenticated (e.g. in kv, by a
+// digest of their credentials) rather than check their password on each
+// request.
+func preloadAuthModule(L *lua.LState) {
+	L.PreloadModule("auth", func(L *lua.LState) int {
+		L.Push(L.SetFuncs(L.NewTable(), authFuncs))
+		return 1
+	})
+}
+
+var authFuncs = map[string]lua.LGFunction{
+	"basic":          authBasic,
+	"bearer":         authBearer,
+	"check_password": authCheckPassword,
+	"hash_password":  authHashPassword,
+	"challenge":      authChallenge,
+}
+
+// optAuthorization returns the value of the Authorization header at index
+// n of the stack: a string, or the request (the default).
+func optAuthorization(L *lua.LState, n int) string {
+	if s, ok := L.Get(n).(lua.LString); ok {
+		return string(s)
+	}
+	return checkRequestContext(L).r.Header.Get("Authorization")
+}
+
+// authCredentials returns the credentials of the scheme in the Authorization
+// header value h, or false if h has another scheme.
+func authCredentials(h, scheme string) (string, bool) {
+	if len(h) <= len(scheme) || !strings.EqualFold(h[:len(scheme)], scheme) || h[len(scheme)] != ' ' {
+		return "", false
+	}
+	return strings.TrimSpace(h[len(scheme)+1:]), true
+}
+
+// authBasic implements auth.basic([r]).
+func authBasic(L *lua.LState) int {
+	creds, ok := authCredentials(optAuthorization(L, 1), "Basic")
+	if ok {
+		var b []byte
+		if b, ok = decodeBase64(creds); ok {
+			if user, pass, found := strings.Cut(string(b), ":"); found {
+				L.Push(lua.LString(user))
+				L.Push(lua.LString(pass))
+				return 2
+			}
+		}
+	}
+	L.Push(lua.LNil)
+	return 1
+}
+
+// decodeBase64 decodes s with the standard encoding, with or without
+// padding.
+func decodeBase64(s string) ([]byte, bool) {
+	b, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+	return b, err == nil
+}
+
+// authBearer implements auth.bearer([r]).
+func authBearer(L *lua.LState) int {
+	token, ok := authCredentials(optAuthorization(L, 1), "Bearer")
+	if !ok || token == "" {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(lua.LString(token))
+	return 1
+}
+
+// authCheckPassword implements auth.check_password(hash, password).
+func authCheckPassword(L *lua.LState) int {
+	hash := L.CheckString(1)
+	password := L.CheckString(2)
+	ok, err := checkPassword(hash, password)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LBool(ok))
+	return 1
+}
+
+var errUnknownHash = errors.New("unknown password hash format")
+
+// checkPassword reports whether password matches the bcrypt or argon2 hash.
+func checkPassword(hash, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hash, "$argon2id$"), strings.HasPrefix(hash, "$argon2i$"):
+		return checkArgon2(hash, password)
+	}
+	return false, errUnknownHash
+}
+
+// checkArgon2 reports whether password matches the argon2 hash in the PHC
+// string format, e.g. $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>.
+func checkArgon2(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, errors.New("invalid argon2 hash")
+	}
+	if parts[2] != "v="+strconv.Itoa(argon2.Version) {
+		return false, fmt.Errorf("unsupported argon2 version: %s", parts[2])
+	}
+	var (
+		memory  uint32
+		time    uint32
+		threads uint8
+	)
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, fmt.Errorf("invalid argon2 parameters: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("invalid argon2 salt: %w", err)
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(want) == 0 {
+		return false, errors.New("invalid argon2 hash")
+	}
+
+	var got []byte
+	if parts[1] == "argon2id" {
+		got = argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(want)))
+	} else {
+		got = argon2.Key([]byte(password), salt, time, memory, threads, uint32(len(want)))
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
+
+// authHashPassword implements auth.hash_password(password[, cost]).
+func authHashPassword(L *lua.LState) int {
+	password := L.CheckString(1)
+	cost := L.OptInt(2, bcrypt.DefaultCost)
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		L.ArgError(2, "invalid cost")
+	}
+	b, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LString(b))
+	return 1
+}
+
+// authChallenge implements auth.challenge(realm[, scheme]).
+func authChallenge(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	realm := L.CheckString(1)
+	scheme := L.OptString(2, "Basic")
+	if rc.wroteHeader {
+		L.RaiseError("auth.challenge: the response header is already written")
+	}
+	challenge := fmt.Sprintf("%s realm=%s", scheme, strconv.Quote(realm))
+	if strings.EqualFold(scheme, "Basic") {
+		challenge += `, charset="UTF-8"`
+	}
+	rc.w.Header().Set("WWW-Authenticate", challenge)
+	rc.status = http.StatusUnauthorized
+	rc.responded = true
+	return 0
+}
@@ -0,0 +1,243 @@
+package lua
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// defaultBodyFilterMaxSize is the maximum size of the bodies buffered by a
+// BodyFilter without a MaxSize.
+const defaultBodyFilterMaxSize = 10 << 20
+
+// BodyFilter configures the filtering of the response bodies of the next
+// handler (e.g. a reverse_proxy or a file_server) through the global Lua
+// function Function, e.g. to rewrite HTML or redact data. By default the
+// body is buffered and the function is called once with the body and the
+// status code, and returns the new body. Bodies larger than MaxSize (default
+// 10MB) are sent unfiltered. If Stream is set, the function is instead
+// called with each chunk of the body as it is written and false, then with
+// an empty string and true at the end of the body, and returns the chunk to
+// send. A nil return value is an empty body or chunk.
+//
+// Like the sub_filter, only responses with one of Types (text/html by
+// default) and without a Content-Encoding are filtered, and the
+// Accept-Encoding and Range headers of the request are removed.
+type BodyFilter struct {
+	Function string   `json:"function,omitempty"`
+	Types    []string `json:"types,omitempty"`
+	Stream   bool     `json:"stream,omitempty"`
+	MaxSize  int64    `json:"max_size,omitempty"`
+}
+
+// validate returns an error if the body filter configuration is invalid.
+func (bf *BodyFilter) validate() error {
+	if bf.Function == "" {
+		return errors.New("filter_body_by_lua: the function is required")
+	}
+	if bf.MaxSize < 0 {
+		return errors.New("filter_body_by_lua: max_size must not be negative")
+	}
+	return nil
+}
+
+// unmarshalCaddyfile sets up the body filter from the block's tokens.
+func (bf *BodyFilter) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch field := d.Val(); field {
+		case "types":
+			bf.Types = append(bf.Types, d.RemainingArgs()...)
+			if len(bf.Types) == 0 {
+				return d.Errf("filter_body_by_lua %s: %w", field, d.ArgErr())
+			}
+
+		case "stream":
+			if d.NextArg() {
+				return d.Errf("filter_body_by_lua %s: %w", field, d.ArgErr())
+			}
+			bf.Stream = true
+
+		case "max_size":
+			var v string
+			if !d.Args(&v) || d.NextArg() {
+				return d.Errf("filter_body_by_lua %s: %w", field, d.ArgErr())
+			}
+			n, err := humanize.ParseBytes(v)
+			if err != nil {
+				return d.Errf("filter_body_by_lua %s: %w", field, err)
+			}
+			bf.MaxSize = int64(n)
+
+		default:
+			return d.Errf("filter_body_by_lua %s: unknown configuration option", field)
+		}
+	}
+	return nil
+}
+
+// bodyFilterWriter applies a BodyFilter to the response body written to it.
+type bodyFilterWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	filter *BodyFilter
+	L      *lua.LState
+	fn     *lua.LFunction
+
+	wroteHeader bool
+	status      int
+	active      bool
+	buf         bytes.Buffer
+	err         error
+}
+
+// newBodyFilterWriter returns a writer that filters the body written to w
+// through the function of bf, resolved in L.
+func newBodyFilterWriter(w http.ResponseWriter, bf *BodyFilter, L *lua.LState) (*bodyFilterWriter, error) {
+	fn, ok := L.GetGlobal(bf.Function).(*lua.LFunction)
+	if !ok {
+		return nil, fmt.Errorf("filter_body_by_lua: %s is not a function", bf.Function)
+	}
+	return &bodyFilterWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		filter:                bf,
+		L:                     L,
+		fn:                    fn,
+	}, nil
+}
+
+func (bw *bodyFilterWriter) maxSize() int64 {
+	if bw.filter.MaxSize > 0 {
+		return bw.filter.MaxSize
+	}
+	return defaultBodyFilterMaxSize
+}
+
+// WriteHeader implements http.ResponseWriter. The header of the buffered
+// responses is written once the body is filtered.
+func (bw *bodyFilterWriter) WriteHeader(status int) {
+	if bw.wroteHeader {
+		return
+	}
+	bw.wroteHeader = true
+	bw.status = status
+	h := bw.Header()
+	bw.active = status != http.StatusNoContent && status != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" &&
+		contentTypeMatches(h.Get("Content-Type"), bw.filter.Types, "text/html")
+	if bw.active && !bw.filter.Stream {
+		if n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil && n > bw.maxSize() {
+			bw.active = false
+		}
+	}
+	if !bw.active {
+		bw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	h.Del("Content-Length")
+	h.Del("Etag")
+	if bw.filter.Stream {
+		bw.ResponseWriter.WriteHeader(status)
+	}
+}
+
+// Write implements http.ResponseWriter.
+func (bw *bodyFilterWriter) Write(p []byte) (int, error) {
+	if !bw.wroteHeader {
+		bw.WriteHeader(http.StatusOK)
+	}
+	if !bw.active {
+		return bw.ResponseWriter.Write(p)
+	}
+	if bw.err != nil {
+		return 0, bw.err
+	}
+
+	if bw.filter.Stream {
+		out, err := bw.call(lua.LString(p), lua.LFalse)
+		if err != nil {
+			bw.err = err
+			return 0, err
+		}
+		if _, err := bw.ResponseWriter.Write([]byte(out)); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	if int64(bw.buf.Len()+len(p)) > bw.maxSize() {
+		// too large to be filtered, send what was buffered as is
+		bw.active = false
+		bw.ResponseWriter.WriteHeader(bw.status)
+		if _, err := bw.ResponseWriter.Write(bw.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		bw.buf.Reset()
+		return bw.ResponseWriter.Write(p)
+	}
+	return bw.buf.Write(p)
+}
+
+// Flush implements http.Flusher. The buffered responses are only flushed
+// once they are filtered.
+func (bw *bodyFilterWriter) Flush() {
+	if !bw.active || bw.filter.Stream {
+		bw.ResponseWriterWrapper.Flush()
+	}
+}
+
+// call calls the filter function with args and returns its result.
+func (bw *bodyFilterWriter) call(args ...lua.LValue) (string, error) {
+	defer enterState(bw.L)()
+	if err := bw.L.CallByParam(lua.P{Fn: bw.fn, NRet: 1, Protect: true}, args...); err != nil {
+		return "", fmt.Errorf("filter_body_by_lua: %w", err)
+	}
+	ret := bw.L.Get(-1)
+	bw.L.Pop(1)
+	if ret == lua.LNil {
+		return "", nil
+	}
+	return ret.String(), nil
+}
+
+// finish filters the buffered body and writes it, or completes the streamed
+// body.
+func (bw *bodyFilterWriter) finish() error {
+	if bw.err != nil {
+		return bw.err
+	}
+	if !bw.wroteHeader || !bw.active {
+		return nil
+	}
+
+	if bw.filter.Stream {
+		out, err := bw.call(lua.LString(""), lua.LTrue)
+		if err != nil {
+			return err
+		}
+		if out != "" {
+			_, err = bw.ResponseWriter.Write([]byte(out))
+		}
+		return err
+	}
+
+	out, err := bw.call(lua.LString(bw.buf.String()), lua.LNumber(bw.status))
+	if err != nil {
+		return err
+	}
+	bw.buf.Reset()
+	bw.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	bw.ResponseWriter.WriteHeader(bw.status)
+	_, err = bw.ResponseWriter.Write([]byte(out))
+	return err
+}
+
+// interface guards
+var (
+	_ caddyhttp.HTTPInterfaces = (*bodyFilterWriter)(nil)
+)
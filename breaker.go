@@ -0,0 +1,185 @@
+package lua
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultMaxConsecutiveErrors = 5
+	defaultBreakerOpenDuration  = 30 * time.Second
+)
+
+// errCircuitOpen is the error of the requests rejected by an open circuit
+// breaker.
+var errCircuitOpen = errors.New("the scripts of the handler keep failing, the circuit breaker is open")
+
+// CircuitBreaker configures the circuit breaker of the handler, which stops
+// running the scripts when they keep failing, to protect the latency of the
+// rest of the site. Once the scripts failed for MaxConsecutiveErrors requests
+// in a row (default 5), the circuit opens: the handler responds with a 503
+// status and a Retry-After header, without running the scripts, for
+// OpenDuration (default 30s). The next request then runs the scripts as a
+// trial, while the other ones are still rejected: the circuit closes if it
+// succeeds, and opens again otherwise.
+//
+// The failures are the runtime errors of the scripts, including the panics
+// of the Go functions that they call, their timeouts, the handler errors
+// with a 5xx status and the panics recovered by the handler, but not the
+// errors returned by the next handler nor those of the requests canceled by
+// the clients.
+type CircuitBreaker struct {
+	MaxConsecutiveErrors int            `json:"max_consecutive_errors,omitempty"`
+	OpenDuration         caddy.Duration `json:"open_duration,omitempty"`
+}
+
+// validate returns an error if the configuration is not valid.
+func (cb *CircuitBreaker) validate() error {
+	if cb.MaxConsecutiveErrors < 0 {
+		return errors.New("circuit_breaker: max_consecutive_errors must not be negative")
+	}
+	if cb.OpenDuration < 0 {
+		return errors.New("circuit_breaker: open_duration must not be negative")
+	}
+	return nil
+}
+
+// unmarshalCaddyfile sets up the circuit breaker from the block's tokens.
+func (cb *CircuitBreaker) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch field := d.Val(); field {
+		case "max_consecutive_errors":
+			var v string
+			if !d.Args(&v) || d.NextArg() {
+				return d.Errf("circuit_breaker %s: %w", field, d.ArgErr())
+			}
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return d.Errf("circuit_breaker %s: %w", field, err)
+			}
+			cb.MaxConsecutiveErrors = n
+
+		case "open_duration":
+			var v string
+			if !d.Args(&v) || d.NextArg() {
+				return d.Errf("circuit_breaker %s: %w", field, d.ArgErr())
+			}
+			dur, err := caddy.ParseDuration(v)
+			if err != nil {
+				return d.Errf("circuit_breaker %s: %w", field, err)
+			}
+			cb.OpenDuration = caddy.Duration(dur)
+
+		default:
+			return d.Errf("circuit_breaker %s: unknown configuration option", field)
+		}
+	}
+	return nil
+}
+
+// circuitBreaker is the runtime state of a CircuitBreaker.
+type circuitBreaker struct {
+	maxErrors    int
+	openDuration time.Duration
+	logger       *zap.Logger
+
+	mu       sync.Mutex
+	errors   int
+	openedAt time.Time // zero if the circuit is closed
+	trial    bool      // set while the trial request of the open circuit runs
+}
+
+// newCircuitBreaker returns the circuit breaker configured by cfg.
+func newCircuitBreaker(cfg *CircuitBreaker, logger *zap.Logger) *circuitBreaker {
+	cb := &circuitBreaker{
+		maxErrors:    cfg.MaxConsecutiveErrors,
+		openDuration: time.Duration(cfg.OpenDuration),
+		logger:       logger,
+	}
+	if cb.maxErrors == 0 {
+		cb.maxErrors = defaultMaxConsecutiveErrors
+	}
+	if cb.openDuration == 0 {
+		cb.openDuration = defaultBreakerOpenDuration
+	}
+	return cb
+}
+
+// allow returns the function to call with the outcome of the request once
+// it is handled, whether its scripts ran and failed, or the 503 error of the
+// request if the circuit is open, in which case it sets the Retry-After
+// header.
+func (cb *circuitBreaker) allow(w http.ResponseWriter) (func(ran, failed bool), error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.openedAt.IsZero() {
+		return cb.done(false), nil
+	}
+	if remaining := cb.openDuration - time.Since(cb.openedAt); remaining > 0 || cb.trial {
+		if remaining < time.Second {
+			remaining = time.Second
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(remaining.Seconds()))))
+		return nil, caddyhttp.Error(http.StatusServiceUnavailable, errCircuitOpen)
+	}
+	cb.trial = true
+	return cb.done(true), nil
+}
+
+// done returns the function that records the outcome of a request, the
+// trial of the open circuit if trial is set. The requests whose scripts did
+// not run, e.g. rejected by max_concurrent, are not counted.
+func (cb *circuitBreaker) done(trial bool) func(ran, failed bool) {
+	return func(ran, failed bool) {
+		cb.mu.Lock()
+		defer cb.mu.Unlock()
+		if trial {
+			cb.trial = false
+		}
+		if !ran {
+			return
+		}
+		if !failed {
+			cb.errors = 0
+			if trial {
+				cb.openedAt = time.Time{}
+				cb.logger.Info("circuit breaker closed, the scripts succeeded")
+			}
+			return
+		}
+		if !cb.openedAt.IsZero() && !trial {
+			// a request allowed before the circuit opened
+			return
+		}
+		cb.errors++
+		if trial || cb.errors >= cb.maxErrors {
+			cb.logger.Warn("circuit breaker opened, the scripts keep failing",
+				zap.Int("consecutive_errors", cb.errors),
+				zap.Duration("open_duration", cb.openDuration))
+			cb.errors = 0
+			cb.openedAt = time.Now()
+		}
+	}
+}
+
+// isOpen reports whether the circuit is open.
+func (cb *circuitBreaker) isOpen() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return !cb.openedAt.IsZero()
+}
+
+// isFailure reports whether err, the error of the scripts that handled r, is
+// a failure for the circuit breaker.
+func isFailure(r *http.Request, err error) bool {
+	return err != nil && r.Context().Err() == nil && errorStatus(err) >= 500
+}
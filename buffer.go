@@ -0,0 +1,45 @@
+package lua
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// responseBuffer is an http.ResponseWriter that buffers the response in
+// memory, used to capture responses on behalf of scripts.
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{header: make(http.Header)}
+}
+
+// Header implements http.ResponseWriter.
+func (rb *responseBuffer) Header() http.Header {
+	return rb.header
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (rb *responseBuffer) WriteHeader(status int) {
+	if rb.status == 0 {
+		rb.status = status
+	}
+}
+
+// Write implements http.ResponseWriter.
+func (rb *responseBuffer) Write(p []byte) (int, error) {
+	rb.WriteHeader(http.StatusOK)
+	return rb.body.Write(p)
+}
+
+// statusCode returns the status code of the response, which defaults to 200
+// if nothing was written.
+func (rb *responseBuffer) statusCode() int {
+	if rb.status == 0 {
+		return http.StatusOK
+	}
+	return rb.status
+}
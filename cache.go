@@ -0,0 +1,892 @@
+package lua
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
+	lua "github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultCacheMaxEntries  = 1000
+	defaultCacheMaxBodySize = 1 << 20
+)
+
+// cacheableStatus are the status codes of the responses that can be cached.
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// MicroCache configures an in-memory cache of the responses of the handler.
+// Scripts call caddy.cache.serve(key[, opts]), which responds with the
+// response cached under key, a string chosen by the script (e.g. the path and
+// the relevant query string parameters, a header or cookie the response
+// varies on, or the tenant), and returns true, in which case the next handler
+// is not called. Otherwise it returns false, and the response of this GET
+// request is cached under key once complete. The opts.vary array names the
+// request headers that the response varies on, whose values are added to the
+// key (see caddy.cache.key), and caddy.cache.purge(key) removes all the
+// variants of key.
+//
+// The response is cached for opts.ttl seconds if set, otherwise for the
+// max-age (or s-maxage) of its Cache-Control header, or for TTL if it has
+// none (not cached if TTL is not set), and it
+// is not cached if it sets a cookie, has a status other than 200, 203, 204,
+// 300, 301, 404 or 410, is larger than MaxBodySize (default 1MB) or has the
+// no-store, no-cache or private directives. During the stale-while-revalidate
+// period of the Cache-Control header, the first request regenerates the
+// response while the others are served the stale one. An ETag and a
+// Last-Modified header are added if missing, and conditional requests are
+// answered with a 304 status code.
+//
+// Scripts may also cache values with caddy.cache.get, set and delete, and
+// store the responses they build (e.g. from caddy.fetch) with
+// caddy.cache.store, to be served by caddy.cache.serve. The values and the
+// responses share the keys of the cache, which holds MaxEntries entries
+// (default 1000) and, if MaxSize is set, approximately MaxSize bytes of
+// keys, values and responses, evicting the least recently used ones (the
+// entries larger than MaxSize are not cached). If Dir
+// is set, the entries are also written to files in that directory, from
+// which the entries evicted from memory are read back, so that they survive
+// the evictions and the restarts of Caddy until they expire.
+type MicroCache struct {
+	MaxEntries  int            `json:"max_entries,omitempty"`
+	MaxBodySize int64          `json:"max_body_size,omitempty"`
+	TTL         caddy.Duration `json:"ttl,omitempty"`
+	MaxSize     int64          `json:"max_size,omitempty"`
+	Dir         string         `json:"dir,omitempty"`
+}
+
+// unmarshalCaddyfile sets up the cache from the block's tokens.
+func (mc *MicroCache) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		field := d.Val()
+		var v string
+		if !d.Args(&v) || d.NextArg() {
+			return d.Errf("micro_cache %s: %w", field, d.ArgErr())
+		}
+		switch field {
+		case "max_entries":
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return d.Errf("micro_cache %s: %w", field, err)
+			}
+			mc.MaxEntries = n
+
+		case "max_body_size", "max_size":
+			n, err := humanize.ParseBytes(v)
+			if err != nil {
+				return d.Errf("micro_cache %s: %w", field, err)
+			}
+			if field == "max_size" {
+				mc.MaxSize = int64(n)
+			} else {
+				mc.MaxBodySize = int64(n)
+			}
+
+		case "ttl":
+			dur, err := caddy.ParseDuration(v)
+			if err != nil {
+				return d.Errf("micro_cache %s: %w", field, err)
+			}
+			mc.TTL = caddy.Duration(dur)
+
+		case "dir":
+			mc.Dir = v
+
+		default:
+			return d.Errf("micro_cache %s: unknown configuration option", field)
+		}
+	}
+	return nil
+}
+
+// cacheEntry is a cached response, or a value set by a script, which has no
+// status.
+type cacheEntry struct {
+	key          string
+	status       int
+	header       http.Header
+	body         []byte
+	value        interface{}
+	size         int64
+	stored       time.Time
+	expires      time.Time // zero if the entry does not expire
+	staleUntil   time.Time
+	revalidating bool
+}
+
+// isValue returns true if e is a value set by a script.
+func (e *cacheEntry) isValue() bool {
+	return e.status == 0
+}
+
+// expired returns true if e cannot be served at now, not even stale.
+func (e *cacheEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.staleUntil)
+}
+
+// microCache is the runtime state of MicroCache.
+type microCache struct {
+	maxEntries  int
+	maxBodySize int64
+	maxSize     int64
+	ttl         time.Duration
+	dir         string
+	logger      *zap.Logger
+
+	mu        sync.Mutex
+	lru       *list.List // of *cacheEntry, most recently used first
+	entries   map[string]*list.Element
+	size      int64
+	nextSweep time.Time
+}
+
+func newMicroCache(cfg *MicroCache, logger *zap.Logger) (*microCache, error) {
+	mc := &microCache{
+		maxEntries:  cfg.MaxEntries,
+		maxBodySize: cfg.MaxBodySize,
+		maxSize:     cfg.MaxSize,
+		ttl:         time.Duration(cfg.TTL),
+		dir:         cfg.Dir,
+		logger:      logger,
+		lru:         list.New(),
+		entries:     make(map[string]*list.Element),
+	}
+	if mc.maxEntries <= 0 {
+		mc.maxEntries = defaultCacheMaxEntries
+	}
+	if mc.maxBodySize <= 0 {
+		mc.maxBodySize = defaultCacheMaxBodySize
+	}
+	if mc.dir != "" {
+		if err := os.MkdirAll(mc.dir, 0o700); err != nil {
+			return nil, err
+		}
+	}
+	return mc, nil
+}
+
+// lookup returns the entry to serve for key, or nil if the response must be
+// generated. If regenerate is true, a stale entry is returned only if
+// another request is already regenerating it, otherwise the caller must
+// regenerate it and call release if it does not store it.
+func (mc *microCache) lookup(key string, regenerate bool) *cacheEntry {
+	mc.load(key)
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	el := mc.entries[key]
+	if el == nil {
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	now := time.Now()
+	switch {
+	case e.expires.IsZero() || now.Before(e.expires):
+	case now.Before(e.staleUntil) && (e.revalidating || !regenerate):
+	case now.Before(e.staleUntil):
+		e.revalidating = true
+		return nil
+	default:
+		mc.remove(el)
+		mc.removeFile(key)
+		return nil
+	}
+	mc.lru.MoveToFront(el)
+	return e
+}
+
+// release marks the entry of key as no longer being regenerated.
+func (mc *microCache) release(key string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if el := mc.entries[key]; el != nil {
+		el.Value.(*cacheEntry).revalidating = false
+	}
+}
+
+// store caches e, evicting the least recently used entries if the cache is
+// full, and writes it to the cache's directory if it has one.
+func (mc *microCache) store(e *cacheEntry) {
+	mc.insert(e)
+	if mc.dir == "" {
+		return
+	}
+	if err := mc.writeFile(e); err != nil {
+		mc.logger.Error("writing the cache entry", zap.String("key", e.key), zap.Error(err))
+	}
+	mc.mu.Lock()
+	now := time.Now()
+	sweep := !now.Before(mc.nextSweep)
+	if sweep {
+		mc.nextSweep = now.Add(kvSweepInterval)
+	}
+	mc.mu.Unlock()
+	if sweep {
+		go mc.sweepDir(now)
+	}
+}
+
+// insert caches e in memory.
+func (mc *microCache) insert(e *cacheEntry) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if el := mc.entries[e.key]; el != nil {
+		mc.remove(el)
+	}
+	mc.entries[e.key] = mc.lru.PushFront(e)
+	mc.size += e.size
+	for mc.lru.Len() > mc.maxEntries || mc.maxSize > 0 && mc.size > mc.maxSize {
+		mc.remove(mc.lru.Back())
+	}
+}
+
+// remove removes the entry of el from memory. The lock must be held.
+func (mc *microCache) remove(el *list.Element) {
+	e := mc.lru.Remove(el).(*cacheEntry)
+	delete(mc.entries, e.key)
+	mc.size -= e.size
+}
+
+// delete removes the entry of key.
+func (mc *microCache) delete(key string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if el := mc.entries[key]; el != nil {
+		mc.remove(el)
+	}
+	mc.removeFile(key)
+}
+
+// purge removes the entry of key and the entries of its variants (see
+// varyKey). The files of the cache's directory are read to find the
+// variants that are not in memory.
+func (mc *microCache) purge(key string) {
+	prefix := key + cacheVarySep
+	mc.mu.Lock()
+	for k, el := range mc.entries {
+		if k == key || strings.HasPrefix(k, prefix) {
+			mc.remove(el)
+		}
+	}
+	mc.mu.Unlock()
+	if mc.dir == "" {
+		return
+	}
+	mc.removeFile(key)
+	paths, err := filepath.Glob(filepath.Join(mc.dir, "*.json"))
+	if err != nil {
+		return
+	}
+	for _, path := range paths {
+		if e, err := readCacheFile(path); err == nil && strings.HasPrefix(e.key, prefix) {
+			os.Remove(path)
+		}
+	}
+}
+
+// cacheVarySep separates the key of a response from the values of the
+// request headers that it varies on.
+const cacheVarySep = "\x00"
+
+// varyKey returns key followed by the names and values of the request
+// headers of r named by vary, in the order of the names.
+func varyKey(r *http.Request, key string, vary []string) string {
+	if len(vary) == 0 {
+		return key
+	}
+	names := make([]string, len(vary))
+	for i, name := range vary {
+		names[i] = http.CanonicalHeaderKey(name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	sb.WriteString(key)
+	for _, name := range names {
+		sb.WriteString(cacheVarySep)
+		sb.WriteString(name)
+		sb.WriteByte('=')
+		sb.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return sb.String()
+}
+
+// get returns the value cached under key, or false if there is none.
+func (mc *microCache) get(key string) (interface{}, bool) {
+	e := mc.lookup(key, false)
+	if e == nil || !e.isValue() {
+		return nil, false
+	}
+	return e.value, true
+}
+
+// set caches value under key for ttl, or for the cache's TTL if ttl is not
+// positive, or until it is evicted if neither is set.
+func (mc *microCache) set(key string, value interface{}, ttl time.Duration) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		ttl = mc.ttl
+	}
+	now := time.Now()
+	e := &cacheEntry{
+		key:     key,
+		value:   value,
+		size:    int64(len(key) + len(b)),
+		stored:  now,
+		expires: expiresAt(now, ttl),
+	}
+	e.staleUntil = e.expires
+	mc.store(e)
+	return nil
+}
+
+// newEntry returns the cache entry for the response recorded by rec, or nil
+// if it cannot be cached.
+func (mc *microCache) newEntry(rec *cacheRecorder) *cacheEntry {
+	if rec.overflow {
+		return nil
+	}
+	status := rec.statusCode()
+	if rec.ttl > 0 {
+		if !cacheableStatus[status] || rec.header.Get("Set-Cookie") != "" {
+			return nil
+		}
+		return newResponseEntry(rec.key, status, rec.header, rec.body.Bytes(), rec.ttl, 0)
+	}
+	return mc.responseEntry(rec.key, status, rec.header, rec.body.Bytes())
+}
+
+// responseEntry returns the cache entry of the response, or nil if it
+// cannot be cached.
+func (mc *microCache) responseEntry(key string, status int, header http.Header, body []byte) *cacheEntry {
+	if !cacheableStatus[status] || header.Get("Set-Cookie") != "" {
+		return nil
+	}
+	ttl, stale, ok := parseCacheControl(header.Get("Cache-Control"))
+	if !ok {
+		return nil
+	}
+	if ttl < 0 {
+		ttl = mc.ttl
+	}
+	if ttl <= 0 {
+		return nil
+	}
+	return newResponseEntry(key, status, header, body, ttl, stale)
+}
+
+// newResponseEntry returns the cache entry of the response, fresh for ttl
+// and then stale for stale.
+func newResponseEntry(key string, status int, header http.Header, body []byte, ttl, stale time.Duration) *cacheEntry {
+	now := time.Now()
+	e := &cacheEntry{
+		key:        key,
+		status:     status,
+		header:     header,
+		body:       body,
+		stored:     now,
+		expires:    now.Add(ttl),
+		staleUntil: now.Add(ttl + stale),
+	}
+	if e.header.Get("Etag") == "" {
+		sum := sha256.Sum256(e.body)
+		e.header.Set("Etag", `"`+hex.EncodeToString(sum[:12])+`"`)
+	}
+	if e.header.Get("Last-Modified") == "" {
+		e.header.Set("Last-Modified", now.UTC().Format(http.TimeFormat))
+	}
+	e.size = int64(len(key) + len(body))
+	for name, vals := range header {
+		for _, v := range vals {
+			e.size += int64(len(name) + len(v))
+		}
+	}
+	return e
+}
+
+// cacheFile is the representation of a cache entry in the files of the
+// cache's directory.
+type cacheFile struct {
+	Key        string      `json:"key"`
+	Status     int         `json:"status,omitempty"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       []byte      `json:"body,omitempty"`
+	Value      interface{} `json:"value,omitempty"`
+	Size       int64       `json:"size"`
+	Stored     time.Time   `json:"stored"`
+	Expires    time.Time   `json:"expires"`
+	StaleUntil time.Time   `json:"stale_until"`
+}
+
+// filePath returns the path of the file of the entry of key.
+func (mc *microCache) filePath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(mc.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// writeFile writes e to its file, atomically replacing the previous one.
+func (mc *microCache) writeFile(e *cacheEntry) error {
+	b, err := json.Marshal(cacheFile{
+		Key:        e.key,
+		Status:     e.status,
+		Header:     e.header,
+		Body:       e.body,
+		Value:      e.value,
+		Size:       e.size,
+		Stored:     e.stored,
+		Expires:    e.expires,
+		StaleUntil: e.staleUntil,
+	})
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(mc.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), mc.filePath(e.key))
+}
+
+// readCacheFile reads the entry of the file at path.
+func readCacheFile(path string) (*cacheEntry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cf cacheFile
+	if err := json.Unmarshal(b, &cf); err != nil {
+		return nil, err
+	}
+	return &cacheEntry{
+		key:        cf.Key,
+		status:     cf.Status,
+		header:     cf.Header,
+		body:       cf.Body,
+		value:      cf.Value,
+		size:       cf.Size,
+		stored:     cf.Stored,
+		expires:    cf.Expires,
+		staleUntil: cf.StaleUntil,
+	}, nil
+}
+
+// removeFile removes the file of the entry of key, if the cache has a
+// directory.
+func (mc *microCache) removeFile(key string) {
+	if mc.dir == "" {
+		return
+	}
+	if err := os.Remove(mc.filePath(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		mc.logger.Error("removing the cache entry", zap.String("key", key), zap.Error(err))
+	}
+}
+
+// load reads the entry of key from its file into memory if it is not
+// there, and if the cache has a directory.
+func (mc *microCache) load(key string) {
+	if mc.dir == "" {
+		return
+	}
+	mc.mu.Lock()
+	_, ok := mc.entries[key]
+	mc.mu.Unlock()
+	if ok {
+		return
+	}
+
+	e, err := readCacheFile(mc.filePath(key))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			mc.logger.Error("reading the cache entry", zap.String("key", key), zap.Error(err))
+		}
+		return
+	}
+	if e.key != key || e.expired(time.Now()) {
+		return
+	}
+	mc.mu.Lock()
+	_, ok = mc.entries[key]
+	mc.mu.Unlock()
+	if !ok {
+		mc.insert(e)
+	}
+}
+
+// sweepDir removes the files of the entries expired at now.
+func (mc *microCache) sweepDir(now time.Time) {
+	paths, err := filepath.Glob(filepath.Join(mc.dir, "*.json"))
+	if err != nil {
+		return
+	}
+	for _, path := range paths {
+		if e, err := readCacheFile(path); err == nil && e.expired(now) {
+			os.Remove(path)
+		}
+	}
+}
+
+// parseCacheControl returns the max-age (-1 if unset) and
+// stale-while-revalidate durations of the Cache-Control header value cc, and
+// false if the response must not be cached.
+func parseCacheControl(cc string) (ttl, stale time.Duration, ok bool) {
+	ttl = -1
+	var sharedTTL time.Duration = -1
+	for _, dir := range strings.Split(cc, ",") {
+		name, val := strings.TrimSpace(dir), ""
+		if i := strings.Index(name, "="); i >= 0 {
+			name, val = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
+		}
+		secs := func() time.Duration {
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return 0
+			}
+			return time.Duration(n) * time.Second
+		}
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache", "private":
+			return 0, 0, false
+		case "max-age":
+			ttl = secs()
+		case "s-maxage":
+			sharedTTL = secs()
+		case "stale-while-revalidate":
+			stale = secs()
+		}
+	}
+	if sharedTTL >= 0 {
+		ttl = sharedTTL
+	}
+	return ttl, stale, true
+}
+
+// serve writes the cached response e to w, or a 304 status code if the
+// conditional headers of r match it.
+func (e *cacheEntry) serve(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	for name, vals := range e.header {
+		h[name] = append([]string(nil), vals...)
+	}
+	h.Set("Age", strconv.Itoa(int(time.Since(e.stored)/time.Second)))
+
+	if e.notModified(r) {
+		h.Del("Content-Length")
+		h.Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Length", strconv.Itoa(len(e.body)))
+	w.WriteHeader(e.status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(e.body)
+	}
+}
+
+// notModified returns true if the conditional headers of r match e.
+func (e *cacheEntry) notModified(r *http.Request) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(e.header.Get("Etag"), "W/")
+		for _, v := range strings.Split(inm, ",") {
+			v = strings.TrimSpace(v)
+			if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		lm, err := http.ParseTime(e.header.Get("Last-Modified"))
+		return err == nil && !lm.After(t)
+	}
+	return false
+}
+
+// cacheRecorder records the response written to the client so that it can
+// be cached under key, for ttl if it is set.
+type cacheRecorder struct {
+	*caddyhttp.ResponseWriterWrapper
+	cache *microCache
+	key   string
+	ttl   time.Duration
+
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	overflow bool
+	stored   bool
+}
+
+func newCacheRecorder(w http.ResponseWriter, mc *microCache, key string, ttl time.Duration) *cacheRecorder {
+	return &cacheRecorder{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		cache:                 mc,
+		key:                   key,
+		ttl:                   ttl,
+	}
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (rec *cacheRecorder) WriteHeader(status int) {
+	if rec.status != 0 {
+		return
+	}
+	rec.status = status
+	rec.header = rec.Header().Clone()
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter.
+func (rec *cacheRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.overflow {
+		if int64(rec.body.Len()+len(p)) > rec.cache.maxBodySize {
+			rec.overflow = true
+			rec.body = bytes.Buffer{}
+		} else {
+			rec.body.Write(p)
+		}
+	}
+	return rec.ResponseWriter.Write(p)
+}
+
+// statusCode returns the status code of the response, which defaults to 200
+// if nothing was written.
+func (rec *cacheRecorder) statusCode() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+// commit caches the recorded response, which is complete, if it can be
+// cached.
+func (rec *cacheRecorder) commit() {
+	if rec.header == nil {
+		rec.header = rec.Header().Clone()
+	}
+	if e := rec.cache.newEntry(rec); e != nil {
+		rec.cache.store(e)
+		rec.stored = true
+	}
+}
+
+// done must be called once the request is handled, so that the response
+// cached under key can be regenerated by another request if it was not
+// committed.
+func (rec *cacheRecorder) done() {
+	if !rec.stored {
+		rec.cache.release(rec.key)
+	}
+}
+
+var cacheFuncs = map[string]lua.LGFunction{
+	"serve":  cacheServe,
+	"key":    cacheKey,
+	"purge":  cachePurge,
+	"get":    cacheGet,
+	"set":    cacheSet,
+	"delete": cacheDelete,
+	"store":  cacheStore,
+}
+
+// checkMicroCache returns the cache of the handler, raising a Lua error if
+// it has none.
+func checkMicroCache(L *lua.LState) *microCache {
+	l := checkHandler(L)
+	if l.cache == nil {
+		L.RaiseError("no micro_cache is configured for this handler")
+	}
+	return l.cache
+}
+
+// cacheServe implements caddy.cache.serve(key[, opts]), which responds with
+// the response cached under key and returns true, or returns false and caches
+// the response of the request under key if it is a GET request. The opts
+// table supports:
+//
+//	ttl: the number of seconds to cache the response for, instead of the
+//	max-age of its Cache-Control header or the ttl of the micro_cache
+//	vary: the name or the array of names of the request headers that the
+//	response varies on, whose values are added to key
+func cacheServe(L *lua.LState) int {
+	mc := checkMicroCache(L)
+	rc := checkRequestContext(L)
+	opts := L.OptTable(2, L.NewTable())
+	key := varyKey(rc.r, L.CheckString(1), stringList(opts.RawGetString("vary")))
+	ttl := time.Duration(float64(lua.LVAsNumber(opts.RawGetString("ttl"))) * float64(time.Second))
+	if ttl < 0 {
+		L.ArgError(2, "the ttl must not be negative")
+	}
+	if rc.cacheRecorder != nil {
+		L.RaiseError("caddy.cache.serve: already called for this request")
+	}
+	if rc.r.Method != http.MethodGet && rc.r.Method != http.MethodHead {
+		L.Push(lua.LFalse)
+		return 1
+	}
+
+	get := rc.r.Method == http.MethodGet
+	if e := mc.lookup(key, get); e != nil && !e.isValue() {
+		names := append(append([]string(nil), rc.handler.HeaderCase...), rc.headerCase...)
+		e.serve(newHeaderCaseWriter(rc.w, names), rc.r)
+		rc.responded = true
+		rc.wroteHeader = true
+		L.Push(lua.LTrue)
+		return 1
+	}
+	if get {
+		rc.cacheRecorder = newCacheRecorder(rc.w, mc, key, ttl)
+		rc.w = rc.cacheRecorder
+	}
+	L.Push(lua.LFalse)
+	return 1
+}
+
+// cacheKey implements caddy.cache.key(key, vary), which returns the key under
+// which caddy.cache.serve(key, {vary = vary}) caches the response of the
+// request, e.g. to get or set the values of that variant of the response.
+func cacheKey(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	key := L.CheckString(1)
+	L.Push(lua.LString(varyKey(rc.r, key, stringList(L.CheckAny(2)))))
+	return 1
+}
+
+// cachePurge implements caddy.cache.purge(key), which removes the response
+// or value cached under key and the responses of its variants.
+func cachePurge(L *lua.LState) int {
+	mc := checkMicroCache(L)
+	key := L.CheckString(1)
+	unlocked(L, func() { mc.purge(key) })
+	return 0
+}
+
+// cacheDelete implements caddy.cache.delete(key), which removes the response
+// or value cached under key.
+func cacheDelete(L *lua.LState) int {
+	checkMicroCache(L).delete(L.CheckString(1))
+	return 0
+}
+
+// cacheGet implements caddy.cache.get(key), which returns the value cached
+// under key, or nil if there is none.
+func cacheGet(L *lua.LState) int {
+	v, ok := checkMicroCache(L).get(L.CheckString(1))
+	if !ok {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(fromGo(L, v))
+	return 1
+}
+
+// cacheSet implements caddy.cache.set(key, value[, ttl]), which caches value
+// under key for ttl seconds, or for the ttl of the micro_cache if not set. A
+// nil value deletes the key. Values may be strings, numbers, booleans or
+// tables of those, which are copied in and out of the cache.
+func cacheSet(L *lua.LState) int {
+	mc := checkMicroCache(L)
+	key := L.CheckString(1)
+	if L.Get(2) == lua.LNil {
+		mc.delete(key)
+		return 0
+	}
+	v, err := toGo(L.CheckAny(2))
+	if err != nil {
+		L.ArgError(2, err.Error())
+	}
+	if err := mc.set(key, v, optSeconds(L, 3)); err != nil {
+		L.ArgError(2, err.Error())
+	}
+	return 0
+}
+
+// cacheStore implements caddy.cache.store(key, response[, ttl]), which caches
+// the response, a table with the status (default 200), headers and body, to
+// be served by caddy.cache.serve(key). It is cached for ttl seconds if set,
+// otherwise under the same conditions as the responses of the requests, and
+// the function returns true if it is cached, false otherwise.
+func cacheStore(L *lua.LState) int {
+	mc := checkMicroCache(L)
+	key := L.CheckString(1)
+	resp := L.CheckTable(2)
+	ttl := optSeconds(L, 3)
+
+	status := http.StatusOK
+	if v, ok := resp.RawGetString("status").(lua.LNumber); ok {
+		status = int(v)
+	}
+	if status < 100 || status > 999 {
+		L.ArgError(2, "invalid status code")
+	}
+	header := make(http.Header)
+	if t, ok := resp.RawGetString("headers").(*lua.LTable); ok {
+		tableToHeader(t, header)
+	}
+	body := []byte(lua.LVAsString(resp.RawGetString("body")))
+
+	var e *cacheEntry
+	switch {
+	case int64(len(body)) > mc.maxBodySize:
+	case ttl > 0:
+		e = newResponseEntry(key, status, header, body, ttl, 0)
+	default:
+		e = mc.responseEntry(key, status, header, body)
+	}
+	if e == nil {
+		L.Push(lua.LFalse)
+		return 1
+	}
+	mc.store(e)
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// interface guards
+var (
+	_ caddyhttp.HTTPInterfaces = (*cacheRecorder)(nil)
+)
@@ -0,0 +1,58 @@
+package lua
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestMicroCacheVary(t *testing.T) {
+	tr, err := NewTester(&Lua{
+		MicroCache: &MicroCache{},
+		Script: `
+			if request.path == "/purge" then
+				caddy.cache.purge("page")
+				return "done"
+			end
+			if request.path == "/key" then
+				response:write((caddy.cache.key("page", {"x-tier"}):gsub("%z", "|")))
+				return "done"
+			end
+			-- the micro_cache has no ttl and the response no Cache-Control
+			if caddy.cache.serve("page", {vary = "X-Tier", ttl = 60}) then
+				return "done"
+			end`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	var calls int
+	tr.Next = caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		calls++
+		_, err := w.Write([]byte(strconv.Itoa(calls)))
+		return err
+	})
+
+	cases := []struct {
+		path, tier, want string
+	}{
+		{"/", "gold", "1"},
+		{"/", "gold", "1"},
+		{"/", "free", "2"},
+		{"/", "free", "2"},
+		{"/key", "gold", "page|X-Tier=gold"},
+		// all the variants are purged
+		{"/purge", "", ""},
+		{"/", "gold", "3"},
+		{"/", "free", "4"},
+	}
+	for _, c := range cases {
+		res := tr.Do(TestRequest{Path: c.path, Header: http.Header{"X-Tier": {c.tier}}})
+		if res.Err != nil || res.Body != c.want {
+			t.Errorf("%s %s: got %q (%v), want %q", c.path, c.tier, res.Body, res.Err, c.want)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package lua
+
+import (
+	lua "github.com/yuin/gopher-lua"
+)
+
+// openCaddyLib registers the caddy global table in L, which holds the
+// Caddy-specific APIs available to scripts.
+func openCaddyLib(L *lua.LState) {
+	openIPSetType(L)
+	openImageType(L)
+	openSitemapType(L)
+	openWebSocketType(L)
+
+	mod := L.NewTable()
+	mod.RawSetString("ab", L.SetFuncs(L.NewTable(), abFuncs))
+	mod.RawSetString("handler", L.NewFunction(caddyHandler))
+	mod.RawSetString("fetch_local", L.NewFunction(caddyFetchLocal))
+	mod.RawSetString("subrequest", L.NewFunction(caddySubrequest))
+	mod.RawSetString("keys", L.SetFuncs(L.NewTable(), keysFuncs))
+	mod.RawSetString("cookie", L.SetFuncs(L.NewTable(), cookieFuncs))
+	mod.RawSetString("ipset", L.NewFunction(caddyIPSet))
+	mod.RawSetString("image", L.SetFuncs(L.NewTable(), imageFuncs))
+	mod.RawSetString("qrcode", L.NewFunction(caddyQRCode))
+	mod.RawSetString("assets", L.SetFuncs(L.NewTable(), assetsFuncs))
+	mod.RawSetString("sitemap", L.SetFuncs(L.NewTable(), sitemapFuncs))
+	mod.RawSetString("robots", L.NewFunction(caddyRobots))
+	mod.RawSetString("health", L.SetFuncs(L.NewTable(), healthFuncs))
+	mod.RawSetString("maintenance", L.SetFuncs(L.NewTable(), maintenanceFuncs))
+	mod.RawSetString("flags", L.SetFuncs(L.NewTable(), flagsFuncs))
+	mod.RawSetString("forward_auth", L.NewFunction(caddyForwardAuth))
+	mod.RawSetString("jwt", L.SetFuncs(L.NewTable(), jwtFuncs))
+	mod.RawSetString("header_case", L.NewFunction(caddyHeaderCase))
+	mod.RawSetString("ctx", newCtxTable(L))
+	mod.RawSetString("cache", L.SetFuncs(L.NewTable(), cacheFuncs))
+	mod.RawSetString("next", L.NewFunction(caddyNext))
+	mod.RawSetString("placeholder", L.NewFunction(caddyPlaceholder))
+	mod.RawSetString("set_placeholder", L.NewFunction(caddySetPlaceholder))
+	mod.RawSetString("websocket", L.NewFunction(caddyWebSocket))
+	mod.RawSetString("on_shutdown", L.NewFunction(caddyOnShutdown))
+	mod.RawSetString("limit", L.NewFunction(caddyLimit))
+	L.SetGlobal("caddy", mod)
+}
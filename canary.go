@@ -0,0 +1,69 @@
+package lua
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// Canary configures an alternate script that handles the requests that have
+// a specific header or cookie set. If the corresponding value is empty, any
+// non-empty header or cookie value matches.
+type Canary struct {
+	HandlerPath string `json:"handler_path,omitempty"`
+	Header      string `json:"header,omitempty"`
+	HeaderValue string `json:"header_value,omitempty"`
+	Cookie      string `json:"cookie,omitempty"`
+	CookieValue string `json:"cookie_value,omitempty"`
+}
+
+// matches returns true if r should be handled by the canary script.
+func (c *Canary) matches(r *http.Request) bool {
+	if c.Header != "" {
+		if v := r.Header.Get(c.Header); v != "" && (c.HeaderValue == "" || v == c.HeaderValue) {
+			return true
+		}
+	}
+	if c.Cookie != "" {
+		if ck, err := r.Cookie(c.Cookie); err == nil && ck.Value != "" && (c.CookieValue == "" || ck.Value == c.CookieValue) {
+			return true
+		}
+	}
+	return false
+}
+
+// unmarshalCaddyfile sets up the canary from the block's tokens.
+func (c *Canary) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch field := d.Val(); field {
+		case "handler_path":
+			if !d.Args(&c.HandlerPath) {
+				return d.Errf("canary %s: %w", field, d.ArgErr())
+			}
+
+		case "header":
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return d.Errf("canary %s: %w", field, d.ArgErr())
+			}
+			c.Header = args[0]
+			if len(args) > 1 {
+				c.HeaderValue = args[1]
+			}
+
+		case "cookie":
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return d.Errf("canary %s: %w", field, d.ArgErr())
+			}
+			c.Cookie = args[0]
+			if len(args) > 1 {
+				c.CookieValue = args[1]
+			}
+
+		default:
+			return d.Errf("canary %s: unknown configuration option", field)
+		}
+	}
+	return nil
+}
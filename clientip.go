@@ -0,0 +1,131 @@
+package lua
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// defaultClientIPHeaders are the headers of the client addresses without
+// client_ip_headers.
+var defaultClientIPHeaders = []string{"X-Forwarded-For"}
+
+// privateRanges are the ranges added by the private_ranges shortcut of the
+// trusted_proxies Caddyfile option, the same as reverse_proxy's.
+var privateRanges = []string{
+	"192.168.0.0/16",
+	"172.16.0.0/12",
+	"10.0.0.0/8",
+	"127.0.0.1/8",
+	"fd00::/8",
+	"::1",
+}
+
+// newTrustedProxies returns the ranges of the trusted_proxies, addresses or
+// CIDR ranges.
+func newTrustedProxies(proxies []string) (ipRanges, error) {
+	prefixes, err := parseIPList(strings.NewReader(strings.Join(proxies, "\n")))
+	if err != nil {
+		return nil, fmt.Errorf("trusted_proxies: %w", err)
+	}
+	return newIPRanges(prefixes), nil
+}
+
+// remoteIP returns the address of the peer of r, without its port and zone.
+func remoteIP(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.WithZone("").Unmap(), true
+}
+
+// clientIP returns the address of the client of r. If the peer of r is one
+// of the trusted proxies, it is the rightmost address of the first of the
+// client IP headers that is not a trusted proxy, the addresses on its left
+// being set by the client. The header values stop at the first address that
+// is not valid, the client being the last address before it, and if all the
+// addresses are trusted proxies the client is the leftmost one. Otherwise,
+// or without the headers, it is the peer. It returns the invalid address
+// if the peer has one, which is not a trusted proxy.
+func (l *Lua) clientIP(r *http.Request) string {
+	peer, ok := remoteIP(r)
+	if !ok {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		return host
+	}
+	if !l.trustedProxies.contains(peer) {
+		return peer.String()
+	}
+
+	headers := l.ClientIPHeaders
+	if len(headers) == 0 {
+		headers = defaultClientIPHeaders
+	}
+	for _, name := range headers {
+		var addrs []string
+		for _, v := range r.Header.Values(name) {
+			addrs = append(addrs, strings.Split(v, ",")...)
+		}
+		if len(addrs) == 0 {
+			continue
+		}
+		client := peer
+		for i := len(addrs) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(addrs[i]))
+			if err != nil {
+				break
+			}
+			client = addr.WithZone("").Unmap()
+			if !l.trustedProxies.contains(client) {
+				break
+			}
+		}
+		return client.String()
+	}
+	return peer.String()
+}
+
+// requestClientIP implements request:client_ip(), which returns the address
+// of the client, without the port, from the headers of the trusted_proxies,
+// see Lua.clientIP.
+func requestClientIP(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	L.Push(lua.LString(rc.handler.clientIP(rc.r)))
+	return 1
+}
+
+// requestIsTrustedProxy implements request:is_trusted_proxy([ip]), which
+// reports whether ip, or the peer of the request without ip, is one of the
+// trusted_proxies.
+func requestIsTrustedProxy(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	var addr netip.Addr
+	if L.Get(2) == lua.LNil {
+		peer, ok := remoteIP(rc.r)
+		if !ok {
+			L.Push(lua.LFalse)
+			return 1
+		}
+		addr = peer
+	} else {
+		a, err := netip.ParseAddr(L.CheckString(2))
+		if err != nil {
+			L.ArgError(2, err.Error())
+		}
+		addr = a.WithZone("").Unmap()
+	}
+	L.Push(lua.LBool(rc.handler.trustedProxies.contains(addr)))
+	return 1
+}
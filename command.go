@@ -0,0 +1,89 @@
+package lua
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "lua-test",
+		Func:  cmdLuaTest,
+		Usage: "[--run <regexp>] <spec.lua>...",
+		Short: "Runs the tests of Lua handler scripts",
+		Long: `
+Runs the tests of the spec files, Lua scripts that return the configuration
+of a handler and the requests to send it, with the expected responses. The
+handler runs outside of a server, and the requests are fabricated, so the
+scripts can be unit-tested, e.g. in CI. See RunTestFile for the format of
+the spec files.
+
+The relative paths of the handler configuration, e.g. its handler_path, are
+relative to the current directory, as with a Caddy configuration. With
+--run, only the tests whose name matches the regular expression run.
+
+The command exits with the status 1 if a test fails, and 2 if a spec file
+cannot be loaded or the arguments are not valid.`,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("lua-test", flag.ExitOnError)
+			fs.String("run", "", "Run only the tests whose name matches the regular expression")
+			return fs
+		}(),
+	})
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "lua-worker",
+		Func:  cmdLuaWorker,
+		Short: "Runs a worker process of a Lua handler",
+		Long: `
+Runs a worker process of a Lua handler in the process isolation mode, which
+is started by the handler: it reads the configuration of the handler and the
+requests on its standard input, and writes the responses on its standard
+output. It is not meant to be run manually.`,
+	})
+}
+
+// cmdLuaTest implements the lua-test command.
+func cmdLuaTest(fl caddycmd.Flags) (int, error) {
+	paths := fl.Args()
+	if len(paths) == 0 {
+		return 2, fmt.Errorf("at least one spec file is required")
+	}
+	var filter *regexp.Regexp
+	if run := fl.String("run"); run != "" {
+		re, err := regexp.Compile(run)
+		if err != nil {
+			return 2, fmt.Errorf("--run: %w", err)
+		}
+		filter = re
+	}
+
+	status := 0
+	for _, path := range paths {
+		passed, failed, err := RunTestFile(path, filter, os.Stdout)
+		switch {
+		case err != nil:
+			fmt.Printf("FAIL\t%s: %s\n", path, err)
+			status = 2
+		case failed > 0:
+			fmt.Printf("FAIL\t%s: %d passed, %d failed\n", path, passed, failed)
+			if status == 0 {
+				status = 1
+			}
+		default:
+			fmt.Printf("ok\t%s: %d passed\n", path, passed)
+		}
+	}
+	return status, nil
+}
+
+// cmdLuaWorker implements the lua-worker command.
+func cmdLuaWorker(fl caddycmd.Flags) (int, error) {
+	if err := runWorker(os.Stdin, os.Stdout); err != nil {
+		return 1, err
+	}
+	return 0, nil
+}
@@ -0,0 +1,82 @@
+package lua
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// compileFile parses and compiles the Lua script at path.
+func compileFile(path string) (*lua.FunctionProto, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return compileReader(bufio.NewReader(f), path)
+}
+
+// compileString parses and compiles the Lua script src, named name in error
+// messages.
+func compileString(src, name string) (*lua.FunctionProto, error) {
+	return compileReader(strings.NewReader(src), name)
+}
+
+// compileExpression compiles src as an expression whose value the script
+// returns, or if it is not an expression, as a chunk.
+func compileExpression(src, name string) (*lua.FunctionProto, error) {
+	proto, err := compileString("return "+src, name)
+	if err != nil {
+		proto, err = compileString(src, name)
+	}
+	return proto, err
+}
+
+func compileReader(r io.Reader, name string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(r, name)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, name)
+}
+
+// compileScripts compiles all distinct, non-empty script paths and returns
+// the compiled functions keyed by path.
+func compileScripts(paths ...string) (map[string]*lua.FunctionProto, error) {
+	protos := make(map[string]*lua.FunctionProto, len(paths))
+	for _, path := range paths {
+		if path == "" || protos[path] != nil {
+			continue
+		}
+		proto, err := compileFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("compiling %s: %w", path, err)
+		}
+		protos[path] = proto
+	}
+	return protos, nil
+}
+
+// runProto executes the compiled script proto in L with args, available to
+// the script as "...", and returns its first return value. A script ended by
+// ngx.exit returns nothing or "done" (see ngxExitResult).
+func runProto(L *lua.LState, proto *lua.FunctionProto, args ...lua.LValue) (lua.LValue, error) {
+	L.Push(L.NewFunctionFromProto(proto))
+	for _, arg := range args {
+		L.Push(arg)
+	}
+	if err := L.PCall(len(args), 1, nil); err != nil {
+		if ret, ok := ngxExitResult(err); ok {
+			return ret, nil
+		}
+		return lua.LNil, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	return ret, nil
+}
@@ -0,0 +1,176 @@
+package lua
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// defaultMaxDecompressedSize is the maximum size of the data decompressed
+// by the compress module when the call sets no maximum.
+const defaultMaxDecompressedSize = 10 << 20
+
+// preloadCompressModule registers the compress module, loaded by scripts
+// with require("compress"), which compresses and decompresses strings with
+// the encodings of the Content-Encoding header, e.g. to inspect a
+// compressed request body or to compress a generated response:
+//
+//	compress.gzip(s[, level]), compress.gunzip(s[, max])
+//	compress.deflate(s[, level]), compress.inflate(s[, max]): the zlib
+//	format of the deflate content encoding
+//	compress.zstd(s[, level]), compress.unzstd(s[, max])
+//	compress.encode(s, encoding[, level]), compress.decode(s, encoding[,
+//	max]): with the encoding "gzip", "deflate" or "zstd", or "identity"
+//	(or "") to return s as is, e.g. compress.decode(request:body(),
+//	request:header("Content-Encoding"))
+//
+// The level is from 1 (fastest) to 9 (smallest) for gzip and deflate, and
+// from 1 to 22 for zstd, the default being the usual compromise of each
+// encoding. The decompression stops when the result exceeds max bytes
+// (default 10MB), to protect against the decompression bombs. The functions
+// return nil and an error message if the data or the encoding is not
+// valid, or the result is too large. Brotli is not supported.
+func preloadCompressModule(L *lua.LState) {
+	L.PreloadModule("compress", func(L *lua.LState) int {
+		L.Push(L.SetFuncs(L.NewTable(), compressFuncs))
+		return 1
+	})
+}
+
+var compressFuncs = map[string]lua.LGFunction{
+	"gzip":    compressWith("gzip"),
+	"gunzip":  decompressWith("gzip"),
+	"deflate": compressWith("deflate"),
+	"inflate": decompressWith("deflate"),
+	"zstd":    compressWith("zstd"),
+	"unzstd":  decompressWith("zstd"),
+	"encode":  compressEncode,
+	"decode":  compressDecode,
+}
+
+// compressWith returns the function that compresses with enc.
+func compressWith(enc string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		return pushCompressed(L, L.CheckString(1), enc, 2)
+	}
+}
+
+// decompressWith returns the function that decompresses enc.
+func decompressWith(enc string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		return pushDecompressed(L, L.CheckString(1), enc, 2)
+	}
+}
+
+// compressEncode implements compress.encode(s, encoding[, level]).
+func compressEncode(L *lua.LState) int {
+	return pushCompressed(L, L.CheckString(1), L.OptString(2, ""), 3)
+}
+
+// compressDecode implements compress.decode(s, encoding[, max]).
+func compressDecode(L *lua.LState) int {
+	return pushDecompressed(L, L.CheckString(1), L.OptString(2, ""), 3)
+}
+
+// pushCompressed pushes s compressed with enc at the level at index n of the
+// stack.
+func pushCompressed(L *lua.LState, s, enc string, n int) int {
+	enc = strings.ToLower(strings.TrimSpace(enc))
+	level := L.OptInt(n, 0)
+	maxLevel := 9
+	if enc == "zstd" {
+		maxLevel = 22
+	}
+	if level < 0 || level > maxLevel {
+		L.ArgError(n, "invalid level")
+	}
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch enc {
+	case "", "identity":
+		L.Push(lua.LString(s))
+		return 1
+	case "gzip":
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		w, err = gzip.NewWriterLevel(&buf, level)
+	case "deflate":
+		if level == 0 {
+			level = zlib.DefaultCompression
+		}
+		w, err = zlib.NewWriterLevel(&buf, level)
+	case "zstd":
+		zl := zstd.SpeedDefault
+		if level > 0 {
+			zl = zstd.EncoderLevelFromZstd(level)
+		}
+		w, err = zstd.NewWriter(&buf, zstd.WithEncoderLevel(zl))
+	default:
+		err = fmt.Errorf("unsupported encoding: %s", enc)
+	}
+	if err == nil {
+		if _, err = io.WriteString(w, s); err == nil {
+			err = w.Close()
+		}
+	}
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LString(buf.String()))
+	return 1
+}
+
+// pushDecompressed pushes s decompressed from enc, up to the maximum size at
+// index n of the stack.
+func pushDecompressed(L *lua.LState, s, enc string, n int) int {
+	enc = strings.ToLower(strings.TrimSpace(enc))
+	max := L.OptInt64(n, defaultMaxDecompressedSize)
+	if max <= 0 {
+		L.ArgError(n, "the maximum size must be positive")
+	}
+
+	var r io.Reader
+	var err error
+	switch enc {
+	case "", "identity":
+		r = strings.NewReader(s)
+	case "gzip":
+		r, err = gzip.NewReader(strings.NewReader(s))
+	case "deflate":
+		r, err = zlib.NewReader(strings.NewReader(s))
+	case "zstd":
+		var zr *zstd.Decoder
+		if zr, err = zstd.NewReader(strings.NewReader(s)); err == nil {
+			defer zr.Close()
+			r = zr
+		}
+	default:
+		err = fmt.Errorf("unsupported encoding: %s", enc)
+	}
+
+	var b []byte
+	if err == nil {
+		b, err = io.ReadAll(io.LimitReader(r, max+1))
+		if err == nil && int64(len(b)) > max {
+			err = fmt.Errorf("the decompressed data exceeds %d bytes", max)
+		}
+	}
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LString(b))
+	return 1
+}
@@ -0,0 +1,77 @@
+package lua
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+var errTooManyExecutions = errors.New("too many concurrent executions of the scripts")
+
+// concurrencyLimiter limits the number of requests of a handler whose
+// scripts run at once, the handler's max_concurrent. The other requests wait
+// up to the handler's queue_timeout for their turn, and are then rejected
+// with the handler's reject_status (503 by default) and a Retry-After
+// header, so that slow scripts do not pile up goroutines and memory. The
+// slot of a request is held while its scripts run, including the next
+// handler if a script calls it, and released before the response of the
+// next handler is served.
+type concurrencyLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+	status  int
+}
+
+func newConcurrencyLimiter(max int, timeout time.Duration, status int) *concurrencyLimiter {
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	return &concurrencyLimiter{
+		slots:   make(chan struct{}, max),
+		timeout: timeout,
+		status:  status,
+	}
+}
+
+// acquire waits for a slot for the request r, and returns the function that
+// releases it, which may be called more than once. If none is available
+// within the queue timeout, it sets the Retry-After header of w and returns
+// the error that rejects the request.
+func (cl *concurrencyLimiter) acquire(w http.ResponseWriter, r *http.Request) (func(), error) {
+	select {
+	case cl.slots <- struct{}{}:
+	default:
+		if err := cl.wait(r.Context()); err != nil {
+			if errors.Is(err, errTooManyExecutions) {
+				w.Header().Set("Retry-After", "1")
+				return nil, caddyhttp.Error(cl.status, err)
+			}
+			return nil, err
+		}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-cl.slots })
+	}, nil
+}
+
+// wait waits up to the queue timeout for a slot, or until ctx is done.
+func (cl *concurrencyLimiter) wait(ctx context.Context) error {
+	if cl.timeout <= 0 {
+		return errTooManyExecutions
+	}
+	timer := time.NewTimer(cl.timeout)
+	defer timer.Stop()
+	select {
+	case cl.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errTooManyExecutions
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
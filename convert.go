@@ -0,0 +1,57 @@
+package lua
+
+import (
+	"net/http"
+
+	"github.com/mna/caddy-lua/luautil"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// toGo converts a Lua value to a Go value suitable for JSON encoding, with
+// the default options of luautil: tables with only consecutive integer keys
+// starting at 1 become slices, other tables become maps with string keys.
+func toGo(v lua.LValue) (interface{}, error) {
+	return luautil.ToGo(v)
+}
+
+// fromGo converts a Go value decoded from JSON, or of the other types
+// supported by luautil.FromGo, to a Lua value. Values of other types are
+// converted to their string representation.
+func fromGo(L *lua.LState, v interface{}) lua.LValue {
+	return luautil.FromGo(L, v)
+}
+
+// headerToTable converts h to a Lua table that maps header names to their
+// value, or to an array of values if the header has more than one.
+func headerToTable(L *lua.LState, h http.Header) *lua.LTable {
+	t := L.CreateTable(0, len(h))
+	for name, vals := range h {
+		switch len(vals) {
+		case 0:
+		case 1:
+			t.RawSetString(name, lua.LString(vals[0]))
+		default:
+			arr := L.CreateTable(len(vals), 0)
+			for _, v := range vals {
+				arr.Append(lua.LString(v))
+			}
+			t.RawSetString(name, arr)
+		}
+	}
+	return t
+}
+
+// tableToHeader adds the headers in t to h. The values of t can be strings
+// or arrays of strings.
+func tableToHeader(t *lua.LTable, h http.Header) {
+	t.ForEach(func(k, v lua.LValue) {
+		name := k.String()
+		if arr, ok := v.(*lua.LTable); ok {
+			for i := 1; i <= arr.Len(); i++ {
+				h.Add(name, arr.RawGetInt(i).String())
+			}
+			return
+		}
+		h.Add(name, v.String())
+	})
+}
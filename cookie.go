@@ -0,0 +1,223 @@
+package lua
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// requestCookies implements request:cookies(), which returns a table of the
+// names of the cookies of the request to their value. If a cookie is set
+// more than once, the first value is returned.
+func requestCookies(L *lua.LState) int {
+	cookies := checkRequestContext(L).r.Cookies()
+	t := L.CreateTable(0, len(cookies))
+	for _, c := range cookies {
+		if t.RawGetString(c.Name) == lua.LNil {
+			t.RawSetString(c.Name, lua.LString(c.Value))
+		}
+	}
+	L.Push(t)
+	return 1
+}
+
+// requestCookie implements request:cookie(name), which returns the value of
+// the cookie, or nil if the request has no such cookie.
+func requestCookie(L *lua.LState) int {
+	c, err := checkRequestContext(L).r.Cookie(L.CheckString(2))
+	if err != nil {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(lua.LString(c.Value))
+	return 1
+}
+
+var sameSiteModes = map[string]http.SameSite{
+	"":       http.SameSiteDefaultMode,
+	"lax":    http.SameSiteLaxMode,
+	"strict": http.SameSiteStrictMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+// responseSetCookie implements response:set_cookie(opts), which adds a
+// Set-Cookie header to the response. The opts table supports the name,
+// value, path (default "/"), domain, max_age (in seconds, negative to delete
+// the cookie), expires (a Unix timestamp), secure, http_only and same_site
+// ("lax", "strict" or "none") fields.
+func responseSetCookie(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	opts := L.CheckTable(2)
+	if rc.wroteHeader {
+		L.RaiseError("response:set_cookie: the response header is already written")
+	}
+
+	c := &http.Cookie{
+		Name:     lua.LVAsString(opts.RawGetString("name")),
+		Value:    lua.LVAsString(opts.RawGetString("value")),
+		Path:     lua.LVAsString(opts.RawGetString("path")),
+		Domain:   lua.LVAsString(opts.RawGetString("domain")),
+		MaxAge:   int(lua.LVAsNumber(opts.RawGetString("max_age"))),
+		Secure:   lua.LVAsBool(opts.RawGetString("secure")),
+		HttpOnly: lua.LVAsBool(opts.RawGetString("http_only")),
+	}
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	if n, ok := opts.RawGetString("expires").(lua.LNumber); ok {
+		c.Expires = time.Unix(int64(n), 0)
+	}
+	sameSite, ok := sameSiteModes[strings.ToLower(lua.LVAsString(opts.RawGetString("same_site")))]
+	if !ok {
+		L.ArgError(2, "same_site must be lax, strict or none")
+	}
+	c.SameSite = sameSite
+	if err := validCookie(c); err != nil {
+		L.ArgError(2, err.Error())
+	}
+
+	http.SetCookie(rc.w, c)
+	return 0
+}
+
+// validCookie returns an error if c is not a valid cookie. Cookie.Valid
+// rejects cookies without expiration time in Go 1.18, so the expiration time
+// is only checked if set.
+func validCookie(c *http.Cookie) error {
+	if c.Expires.IsZero() {
+		cc := *c
+		cc.Expires = time.Now()
+		c = &cc
+	}
+	return c.Valid()
+}
+
+var cookieFuncs = map[string]lua.LGFunction{
+	"sign":    cookieSign,
+	"verify":  cookieVerify,
+	"encrypt": cookieEncrypt,
+	"decrypt": cookieDecrypt,
+}
+
+var (
+	errInvalidCookie = errors.New("invalid cookie value")
+	errExpiredCookie = errors.New("expired cookie value")
+)
+
+// cookieSign implements caddy.cookie.sign(name, value), which returns the
+// value signed with the handler's keyring, for the cookie name. The value
+// remains readable by the client. Like the other caddy.cookie functions, it
+// raises an error if the handler has no keyring.
+//
+// The signed and the encrypted values are bound to the name of their cookie
+// and hold the time they were created, so that caddy.cookie.verify and
+// caddy.cookie.decrypt can reject the values older than max_age seconds.
+// They are accepted as long as their key is kept by the keyring, so that
+// the cookies survive the rotations of the keys.
+func cookieSign(L *lua.LState) int {
+	kr := checkKeyring(L)
+	name, value := L.CheckString(1), L.CheckString(2)
+	payload := base64.RawURLEncoding.EncodeToString([]byte(value)) + "." +
+		strconv.FormatInt(time.Now().Unix(), 10)
+	L.Push(lua.LString(payload + "." + kr.sign([]byte(name+"="+payload))))
+	return 1
+}
+
+// cookieVerify implements caddy.cookie.verify(name, signed[, max_age]),
+// which returns the value signed by caddy.cookie.sign for the cookie name,
+// or nil and an error message if the signature is invalid or the value is
+// older than max_age seconds.
+func cookieVerify(L *lua.LState) int {
+	kr := checkKeyring(L)
+	name, signed := L.CheckString(1), L.CheckString(2)
+	maxAge := L.OptInt64(3, 0)
+
+	parts := strings.SplitN(signed, ".", 3)
+	var value []byte
+	err := errInvalidCookie
+	if len(parts) == 3 {
+		payload := parts[0] + "." + parts[1]
+		var ok bool
+		// it may load the keys from storage
+		unlocked(L, func() { ok = kr.verify([]byte(name+"="+payload), parts[2]) })
+		if ok {
+			value, err = base64.RawURLEncoding.DecodeString(parts[0])
+			if err == nil {
+				err = checkCookieAge(parts[1], maxAge)
+			}
+		}
+	}
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LString(value))
+	return 1
+}
+
+// cookieEncrypt implements caddy.cookie.encrypt(name, value), which returns
+// the value encrypted with the handler's keyring, for the cookie name.
+func cookieEncrypt(L *lua.LState) int {
+	kr := checkKeyring(L)
+	name, value := L.CheckString(1), L.CheckString(2)
+	plaintext := strconv.FormatInt(time.Now().Unix(), 10) + "." + value
+	token, err := kr.encrypt([]byte(plaintext), []byte(name))
+	if err != nil {
+		L.RaiseError("caddy.cookie.encrypt: %s", err)
+	}
+	L.Push(lua.LString(token))
+	return 1
+}
+
+// cookieDecrypt implements caddy.cookie.decrypt(name, encrypted[, max_age]),
+// which returns the value encrypted by caddy.cookie.encrypt for the cookie
+// name, or nil and an error message if it is invalid or older than max_age
+// seconds.
+func cookieDecrypt(L *lua.LState) int {
+	kr := checkKeyring(L)
+	name, token := L.CheckString(1), L.CheckString(2)
+	maxAge := L.OptInt64(3, 0)
+
+	var plaintext []byte
+	var err error
+	// it may load the keys from storage
+	unlocked(L, func() { plaintext, err = kr.decrypt(token, []byte(name)) })
+	var value string
+	if err != nil {
+		err = errInvalidCookie
+	} else {
+		var created string
+		var ok bool
+		if created, value, ok = strings.Cut(string(plaintext), "."); !ok {
+			err = errInvalidCookie
+		} else {
+			err = checkCookieAge(created, maxAge)
+		}
+	}
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LString(value))
+	return 1
+}
+
+// checkCookieAge returns an error if the Unix timestamp created is invalid,
+// or older than maxAge seconds if maxAge is positive.
+func checkCookieAge(created string, maxAge int64) error {
+	ts, err := strconv.ParseInt(created, 10, 64)
+	if err != nil {
+		return errInvalidCookie
+	}
+	if maxAge > 0 && time.Now().Unix()-ts > maxAge {
+		return errExpiredCookie
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package lua
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCookieSignEncrypt(t *testing.T) {
+	tr, err := NewTester(&Lua{
+		Keyring: &Keyring{},
+		Script: `
+			if request.path == "/set" then
+				response:write(caddy.cookie.sign("session", "user=1") .. " " .. caddy.cookie.encrypt("session", "user=2"))
+				return
+			end
+			local signed, encrypted = request:cookie("signed"), request:cookie("encrypted")
+			local out = {}
+			local function add(v, err) out[#out + 1] = tostring(v or err) end
+			add(caddy.cookie.verify("session", signed))
+			add(caddy.cookie.decrypt("session", encrypted, 60))
+			-- the values are bound to the name of their cookie
+			add(caddy.cookie.verify("other", signed))
+			add(caddy.cookie.decrypt("other", encrypted))
+			add(caddy.cookie.verify("session", "x" .. signed))
+			add(caddy.cookie.decrypt("session", encrypted .. "x"))
+			response:write(table.concat(out, "|"))`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	res := tr.Do(TestRequest{Path: "/set"})
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	values := strings.Fields(res.Body)
+	if len(values) != 2 || strings.Contains(values[1], "user=2") {
+		t.Fatalf("got %q, want a signed and an encrypted value", res.Body)
+	}
+	cookie := "signed=" + values[0] + "; encrypted=" + values[1]
+	want := "user=1|user=2|invalid cookie value|invalid cookie value|invalid cookie value|invalid cookie value"
+	if res := tr.Do(TestRequest{Header: http.Header{"Cookie": {cookie}}}); res.Body != want {
+		t.Errorf("got %q, want %q", res.Body, want)
+	}
+
+	// the values of the kept keys remain valid once the keys are rotated
+	kr := tr.handler.keyring
+	kr.rotation = time.Nanosecond
+	if err := kr.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if res := tr.Do(TestRequest{Header: http.Header{"Cookie": {cookie}}}); res.Body != want {
+		t.Errorf("rotated: got %q, want %q", res.Body, want)
+	}
+}
+
+func TestCheckCookieAge(t *testing.T) {
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	if err := checkCookieAge(old, 0); err != nil {
+		t.Errorf("no max_age: got %v", err)
+	}
+	if err := checkCookieAge(old, 7200); err != nil {
+		t.Errorf("got %v, want the value to be valid", err)
+	}
+	if err := checkCookieAge(old, 60); err != errExpiredCookie {
+		t.Errorf("got %v, want %v", err, errExpiredCookie)
+	}
+	if err := checkCookieAge("x", 60); err != errInvalidCookie {
+		t.Errorf("got %v, want %v", err, errInvalidCookie)
+	}
+}
@@ -0,0 +1,152 @@
+package lua
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// maxRandomBytes is the maximum number of bytes returned by
+// crypto.random_bytes.
+const maxRandomBytes = 1 << 20
+
+// preloadCryptoModule registers the crypto module, loaded by scripts with
+// require("crypto"), e.g. to verify the signatures of webhooks:
+//
+//	crypto.sha1(s), crypto.sha256(s), crypto.sha512(s): the digest of s
+//	crypto.hmac(alg, key, msg): the HMAC of msg with key, where alg is
+//	"sha1", "sha256" or "sha512"
+//	crypto.hex_encode(s), crypto.hex_decode(s)
+//	crypto.base64_encode(s[, url]), crypto.base64_decode(s[, url]): with
+//	the standard encoding, or the URL-safe encoding without padding if url
+//	is true. Decoding accepts the encodings with or without padding.
+//	crypto.constant_time_compare(a, b): true if a and b are equal,
+//	compared in a time that does not depend on their contents
+//	crypto.random_bytes(n): n cryptographically secure random bytes
+//
+// The digests are returned as binary strings, and crypto.hex_encode returns
+// their usual hexadecimal form. The decoding functions return nil and an
+// error message if s is not valid.
+func preloadCryptoModule(L *lua.LState) {
+	L.PreloadModule("crypto", func(L *lua.LState) int {
+		L.Push(L.SetFuncs(L.NewTable(), cryptoFuncs))
+		return 1
+	})
+}
+
+var cryptoFuncs = map[string]lua.LGFunction{
+	"sha1":                  cryptoDigest(sha1.New),
+	"sha256":                cryptoDigest(sha256.New),
+	"sha512":                cryptoDigest(sha512.New),
+	"hmac":                  cryptoHMAC,
+	"hex_encode":            cryptoHexEncode,
+	"hex_decode":            cryptoHexDecode,
+	"base64_encode":         cryptoBase64Encode,
+	"base64_decode":         cryptoBase64Decode,
+	"constant_time_compare": cryptoConstantTimeCompare,
+	"random_bytes":          cryptoRandomBytes,
+}
+
+var cryptoHashes = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// cryptoDigest returns the function that implements the digest of newHash.
+func cryptoDigest(newHash func() hash.Hash) lua.LGFunction {
+	return func(L *lua.LState) int {
+		h := newHash()
+		h.Write([]byte(L.CheckString(1)))
+		L.Push(lua.LString(h.Sum(nil)))
+		return 1
+	}
+}
+
+// cryptoHMAC implements crypto.hmac(alg, key, msg).
+func cryptoHMAC(L *lua.LState) int {
+	newHash, ok := cryptoHashes[L.CheckString(1)]
+	if !ok {
+		L.ArgError(1, `"sha1", "sha256" or "sha512" expected`)
+	}
+	mac := hmac.New(newHash, []byte(L.CheckString(2)))
+	mac.Write([]byte(L.CheckString(3)))
+	L.Push(lua.LString(mac.Sum(nil)))
+	return 1
+}
+
+// cryptoHexEncode implements crypto.hex_encode(s).
+func cryptoHexEncode(L *lua.LState) int {
+	L.Push(lua.LString(hex.EncodeToString([]byte(L.CheckString(1)))))
+	return 1
+}
+
+// cryptoHexDecode implements crypto.hex_decode(s).
+func cryptoHexDecode(L *lua.LState) int {
+	b, err := hex.DecodeString(L.CheckString(1))
+	if err != nil {
+		return pushCryptoError(L, err)
+	}
+	L.Push(lua.LString(b))
+	return 1
+}
+
+// cryptoBase64Encode implements crypto.base64_encode(s[, url]).
+func cryptoBase64Encode(L *lua.LState) int {
+	enc := base64.StdEncoding
+	if L.OptBool(2, false) {
+		enc = base64.RawURLEncoding
+	}
+	L.Push(lua.LString(enc.EncodeToString([]byte(L.CheckString(1)))))
+	return 1
+}
+
+// cryptoBase64Decode implements crypto.base64_decode(s[, url]).
+func cryptoBase64Decode(L *lua.LState) int {
+	enc := base64.RawStdEncoding
+	if L.OptBool(2, false) {
+		enc = base64.RawURLEncoding
+	}
+	b, err := enc.DecodeString(strings.TrimRight(L.CheckString(1), "="))
+	if err != nil {
+		return pushCryptoError(L, err)
+	}
+	L.Push(lua.LString(b))
+	return 1
+}
+
+// cryptoConstantTimeCompare implements crypto.constant_time_compare(a, b).
+func cryptoConstantTimeCompare(L *lua.LState) int {
+	a, b := L.CheckString(1), L.CheckString(2)
+	L.Push(lua.LBool(subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1))
+	return 1
+}
+
+// cryptoRandomBytes implements crypto.random_bytes(n).
+func cryptoRandomBytes(L *lua.LState) int {
+	n := L.CheckInt(1)
+	if n < 0 || n > maxRandomBytes {
+		L.ArgError(1, "invalid number of bytes")
+	}
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		L.RaiseError("crypto.random_bytes: %s", err)
+	}
+	L.Push(lua.LString(b))
+	return 1
+}
+
+func pushCryptoError(L *lua.LState, err error) int {
+	L.Push(lua.LNil)
+	L.Push(lua.LString(err.Error()))
+	return 2
+}
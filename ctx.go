@@ -0,0 +1,61 @@
+package lua
+
+import (
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// ctxVarName is the name of the request variable that holds the values of
+// the caddy.ctx table.
+const ctxVarName = "lua_ctx"
+
+// newCtxTable returns the caddy.ctx table, which stores its fields in the
+// request's variables so that they are shared by all the Lua handlers that
+// handle the request, in the order in which they run (see priorityGroup),
+// e.g. to pass the user authenticated by a handler to the next ones.
+// Values are copied on assignment and on access: they must be nil,
+// booleans, numbers, strings or tables of such values, and modifying a
+// table read from caddy.ctx has no effect until it is assigned again.
+func newCtxTable(L *lua.LState) *lua.LTable {
+	t := L.NewTable()
+	mt := L.NewTable()
+	mt.RawSetString("__index", L.NewFunction(ctxIndex))
+	mt.RawSetString("__newindex", L.NewFunction(ctxNewIndex))
+	L.SetMetatable(t, mt)
+	return t
+}
+
+// ctxValues returns the values of caddy.ctx for the current request,
+// creating them if create is true.
+func ctxValues(L *lua.LState, create bool) map[string]interface{} {
+	rc := checkRequestContext(L)
+	m, _ := caddyhttp.GetVar(rc.r.Context(), ctxVarName).(map[string]interface{})
+	if m == nil && create {
+		m = make(map[string]interface{})
+		caddyhttp.SetVar(rc.r.Context(), ctxVarName, m)
+	}
+	return m
+}
+
+// ctxIndex implements the __index metamethod of caddy.ctx.
+func ctxIndex(L *lua.LState) int {
+	key := L.CheckString(2)
+	L.Push(fromGo(L, ctxValues(L, false)[key]))
+	return 1
+}
+
+// ctxNewIndex implements the __newindex metamethod of caddy.ctx.
+func ctxNewIndex(L *lua.LState) int {
+	key := L.CheckString(2)
+	v, err := toGo(L.Get(3))
+	if err != nil {
+		L.ArgError(3, err.Error())
+	}
+	m := ctxValues(L, true)
+	if v == nil {
+		delete(m, key)
+	} else {
+		m[key] = v
+	}
+	return 0
+}
@@ -0,0 +1,376 @@
+package lua
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	_ "github.com/go-sql-driver/mysql" // the mysql driver
+	_ "github.com/jackc/pgx/v4/stdlib" // the postgres driver, as pgx
+	lua "github.com/yuin/gopher-lua"
+)
+
+const dbStatementTypeName = "caddy.db_statement"
+
+// dbDriverNames maps the names of the drivers in the configuration to the
+// names they are registered with in database/sql.
+var dbDriverNames = map[string]string{
+	"postgres":   "pgx",
+	"postgresql": "pgx",
+}
+
+// Database configures the SQL database of the db module, used by scripts to
+// query it:
+//
+//	local db = require("db")
+//	local rows, err = db.query(sql, args...)
+//	local res, err = db.exec(sql, args...)
+//	local stmt, err = db.prepare(sql)
+//
+// The Driver is postgres or mysql, or the name of another driver registered
+// in database/sql, and DSN is the data source name in the driver's format.
+// Up to MaxOpenConns connections are opened (unlimited if 0), MaxIdleConns
+// of them are kept idle (default 2), and they are closed after
+// ConnMaxLifetime if it is set.
+//
+// The placeholders of the arguments in the SQL statements depend on the
+// driver ($1 for postgres, ? for mysql), and the arguments may be strings,
+// numbers, booleans or nil. db.query returns an array of rows, each a table
+// of the column names to their values, and db.exec returns a table with the
+// rows_affected and last_insert_id fields (when supported by the driver). On
+// failure, both return nil and an error message. db.prepare returns a
+// prepared statement with the query(args...) and exec(args...) methods;
+// statements are prepared once per handler and reused across requests.
+type Database struct {
+	Driver          string         `json:"driver,omitempty"`
+	DSN             string         `json:"dsn,omitempty"`
+	MaxOpenConns    int            `json:"max_open_conns,omitempty"`
+	MaxIdleConns    int            `json:"max_idle_conns,omitempty"`
+	ConnMaxLifetime caddy.Duration `json:"conn_max_lifetime,omitempty"`
+}
+
+// unmarshalCaddyfile sets up the database from the block's tokens.
+func (db *Database) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		field := d.Val()
+		var v string
+		if !d.Args(&v) || d.NextArg() {
+			return d.Errf("database %s: %w", field, d.ArgErr())
+		}
+		var err error
+		switch field {
+		case "driver":
+			db.Driver = v
+		case "dsn":
+			db.DSN = v
+		case "max_open_conns":
+			db.MaxOpenConns, err = strconv.Atoi(v)
+		case "max_idle_conns":
+			db.MaxIdleConns, err = strconv.Atoi(v)
+		case "conn_max_lifetime":
+			err = parseCaddyDuration(v, &db.ConnMaxLifetime)
+		default:
+			return d.Errf("database %s: unknown configuration option", field)
+		}
+		if err != nil {
+			return d.Errf("database %s: %w", field, err)
+		}
+	}
+	return nil
+}
+
+// validate returns an error if the database configuration is invalid.
+func (db *Database) validate() error {
+	if db.Driver == "" || db.DSN == "" {
+		return errors.New("database: the driver and dsn configuration options are required")
+	}
+	if db.MaxOpenConns < 0 || db.MaxIdleConns < 0 {
+		return errors.New("database: the numbers of connections must not be negative")
+	}
+	return nil
+}
+
+// sqlDB is the database of a handler with its prepared statements.
+type sqlDB struct {
+	db *sql.DB
+
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+// openDatabase opens the database configured by cfg. The connections are
+// opened when needed.
+func openDatabase(cfg *Database) (*sqlDB, error) {
+	driver := cfg.Driver
+	if name, ok := dbDriverNames[driver]; ok {
+		driver = name
+	}
+	db, err := sql.Open(driver, cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	if cfg.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(time.Duration(cfg.ConnMaxLifetime))
+	return &sqlDB{db: db, stmts: make(map[string]*sql.Stmt)}, nil
+}
+
+// prepare returns the prepared statement for query, preparing it if it is
+// not prepared yet.
+func (s *sqlDB) prepare(ctx context.Context, query string) (*sql.Stmt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stmt := s.stmts[query]; stmt != nil {
+		return stmt, nil
+	}
+	stmt, err := s.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	s.stmts[query] = stmt
+	return stmt, nil
+}
+
+// close closes the prepared statements and the database.
+func (s *sqlDB) close() error {
+	s.mu.Lock()
+	for _, stmt := range s.stmts {
+		stmt.Close()
+	}
+	s.stmts = nil
+	s.mu.Unlock()
+	return s.db.Close()
+}
+
+// preloadDBModule registers the db module, loaded by scripts with
+// require("db").
+func preloadDBModule(L *lua.LState) {
+	mt := L.NewTypeMetatable(dbStatementTypeName)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), dbStatementMethods))
+
+	L.PreloadModule("db", func(L *lua.LState) int {
+		L.Push(L.SetFuncs(L.NewTable(), dbFuncs))
+		return 1
+	})
+}
+
+var dbFuncs = map[string]lua.LGFunction{
+	"query":   dbQuery,
+	"exec":    dbExec,
+	"prepare": dbPrepare,
+}
+
+var dbStatementMethods = map[string]lua.LGFunction{
+	"query": dbStatementQuery,
+	"exec":  dbStatementExec,
+}
+
+// sqlQueryer is implemented by *sql.DB and *sql.Stmt, with the query bound
+// for the latter.
+type sqlQueryer interface {
+	QueryContext(ctx context.Context, args ...interface{}) (*sql.Rows, error)
+	ExecContext(ctx context.Context, args ...interface{}) (sql.Result, error)
+}
+
+// dbQueryer binds a query to a *sql.DB to implement sqlQueryer.
+type dbQueryer struct {
+	db    *sql.DB
+	query string
+}
+
+func (q dbQueryer) QueryContext(ctx context.Context, args ...interface{}) (*sql.Rows, error) {
+	return q.db.QueryContext(ctx, q.query, args...)
+}
+
+func (q dbQueryer) ExecContext(ctx context.Context, args ...interface{}) (sql.Result, error) {
+	return q.db.ExecContext(ctx, q.query, args...)
+}
+
+// checkDB returns the database of the handler and the context of the
+// queries, raising a Lua error if the handler has no database.
+func checkDB(L *lua.LState, fnName string) (*sqlDB, context.Context) {
+	l := checkHandler(L)
+	if l.db == nil {
+		L.RaiseError("%s: no database is configured", fnName)
+	}
+	return l.db, checkContext(L)
+}
+
+// dbQuery implements db.query(sql, args...).
+func dbQuery(L *lua.LState) int {
+	db, ctx := checkDB(L, "db.query")
+	return doDBQuery(L, ctx, dbQueryer{db: db.db, query: L.CheckString(1)}, 2)
+}
+
+// dbExec implements db.exec(sql, args...).
+func dbExec(L *lua.LState) int {
+	db, ctx := checkDB(L, "db.exec")
+	return doDBExec(L, ctx, dbQueryer{db: db.db, query: L.CheckString(1)}, 2)
+}
+
+// dbPrepare implements db.prepare(sql).
+func dbPrepare(L *lua.LState) int {
+	db, ctx := checkDB(L, "db.prepare")
+	stmt, err := db.prepare(ctx, L.CheckString(1))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	ud := L.NewUserData()
+	ud.Value = stmt
+	L.SetMetatable(ud, L.GetTypeMetatable(dbStatementTypeName))
+	L.Push(ud)
+	return 1
+}
+
+func checkDBStatement(L *lua.LState) *sql.Stmt {
+	if stmt, ok := L.CheckUserData(1).Value.(*sql.Stmt); ok {
+		return stmt
+	}
+	L.ArgError(1, "statement expected")
+	return nil
+}
+
+// dbStatementQuery implements stmt:query(args...).
+func dbStatementQuery(L *lua.LState) int {
+	stmt := checkDBStatement(L)
+	_, ctx := checkDB(L, "stmt:query")
+	return doDBQuery(L, ctx, stmt, 2)
+}
+
+// dbStatementExec implements stmt:exec(args...).
+func dbStatementExec(L *lua.LState) int {
+	stmt := checkDBStatement(L)
+	_, ctx := checkDB(L, "stmt:exec")
+	return doDBExec(L, ctx, stmt, 2)
+}
+
+// dbArgs returns the arguments of the statement, from index n of the stack.
+func dbArgs(L *lua.LState, n int) []interface{} {
+	var args []interface{}
+	for i := n; i <= L.GetTop(); i++ {
+		switch v := L.Get(i).(type) {
+		case *lua.LNilType:
+			args = append(args, nil)
+		case lua.LBool:
+			args = append(args, bool(v))
+		case lua.LNumber:
+			if f := float64(v); f == float64(int64(f)) {
+				args = append(args, int64(f))
+			} else {
+				args = append(args, f)
+			}
+		case lua.LString:
+			args = append(args, string(v))
+		default:
+			L.ArgError(i, "string, number, boolean or nil expected")
+		}
+	}
+	return args
+}
+
+func doDBQuery(L *lua.LState, ctx context.Context, q sqlQueryer, n int) int {
+	args := dbArgs(L, n)
+	var rows *sql.Rows
+	var err error
+	unlocked(L, func() { rows, err = q.QueryContext(ctx, args...) })
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	defer rows.Close()
+
+	t, err := dbRowsToTable(L, rows)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(t)
+	return 1
+}
+
+func doDBExec(L *lua.LState, ctx context.Context, q sqlQueryer, n int) int {
+	args := dbArgs(L, n)
+	var res sql.Result
+	var err error
+	unlocked(L, func() { res, err = q.ExecContext(ctx, args...) })
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	t := L.CreateTable(0, 2)
+	if n, err := res.RowsAffected(); err == nil {
+		t.RawSetString("rows_affected", lua.LNumber(n))
+	}
+	if id, err := res.LastInsertId(); err == nil {
+		t.RawSetString("last_insert_id", lua.LNumber(id))
+	}
+	L.Push(t)
+	return 1
+}
+
+// dbRowsToTable reads rows into an array of tables of the column names to
+// their values.
+func dbRowsToTable(L *lua.LState, rows *sql.Rows) (*lua.LTable, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	vals := make([]interface{}, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+
+	t := L.NewTable()
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := L.CreateTable(0, len(cols))
+		for i, col := range cols {
+			row.RawSetString(col, dbValueToLua(vals[i]))
+		}
+		t.Append(row)
+	}
+	return t, rows.Err()
+}
+
+// dbValueToLua converts a value scanned from a row to a Lua value.
+func dbValueToLua(v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return lua.LNil
+	case []byte:
+		return lua.LString(v)
+	case string:
+		return lua.LString(v)
+	case int64:
+		return lua.LNumber(v)
+	case int32:
+		return lua.LNumber(v)
+	case float64:
+		return lua.LNumber(v)
+	case float32:
+		return lua.LNumber(v)
+	case bool:
+		return lua.LBool(v)
+	case time.Time:
+		return lua.LString(v.Format(time.RFC3339Nano))
+	default:
+		return lua.LString(fmt.Sprint(v))
+	}
+}
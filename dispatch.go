@@ -0,0 +1,71 @@
+package lua
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// defaultIndexNames are the scripts run for the requests of a directory
+// under the handler's root when it has no index_names.
+var defaultIndexNames = []string{"index.lua"}
+
+// scriptRoot maps the requests to the Lua scripts under the root directory
+// of the handler, like PHP files: the request of /a/b.lua runs the script
+// b.lua of the a directory of the root, and the request of a directory runs
+// its first index script that exists. The requests of other files, and of
+// directories without an index script, are passed to the next handler (e.g.
+// a file_server), and the requests of .lua files that do not exist fail
+// with a 404 status code. The scripts are compiled when they are first
+// requested, and held in the handler's cache of compiled scripts.
+type scriptRoot struct {
+	root       string
+	indexNames []string
+	cache      *protoCache
+}
+
+func newScriptRoot(root string, indexNames []string, cache *protoCache) *scriptRoot {
+	if len(indexNames) == 0 {
+		indexNames = defaultIndexNames
+	}
+	return &scriptRoot{
+		root:       root,
+		indexNames: indexNames,
+		cache:      cache,
+	}
+}
+
+// resolve returns the path of the script that handles r, or an empty string
+// if the request is not handled by a script.
+func (sr *scriptRoot) resolve(r *http.Request) string {
+	// SanitizedPathJoin prevents the paths from escaping the root
+	path := caddyhttp.SanitizedPathJoin(sr.root, r.URL.Path)
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		for _, name := range sr.indexNames {
+			index := filepath.Join(path, name)
+			if fi, err := os.Stat(index); err == nil && !fi.IsDir() {
+				return index
+			}
+		}
+		return ""
+	}
+	if filepath.Ext(path) != ".lua" {
+		return ""
+	}
+	return path
+}
+
+// get returns the compiled script at path, compiling it if it is not
+// compiled yet or changed since it was.
+func (sr *scriptRoot) get(path string) (*lua.FunctionProto, error) {
+	proto, err := sr.cache.get(path)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, errScriptIsDir) {
+		return nil, caddyhttp.Error(http.StatusNotFound, err)
+	}
+	return proto, err
+}
@@ -0,0 +1,501 @@
+package lua
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	// defaultDNSTimeout is the timeout of the DNS queries of the dns module
+	// without a timeout option.
+	defaultDNSTimeout = 5 * time.Second
+
+	// defaultDNSCacheTTL is the time during which the dns module caches an
+	// answer without a cache option.
+	defaultDNSCacheTTL = time.Minute
+
+	// defaultDoTPort is the port of the DNS-over-TLS resolvers without a
+	// port.
+	defaultDoTPort = "853"
+
+	// maxDoHResponseSize is the maximum size of the responses of the
+	// DNS-over-HTTPS resolvers, the maximum size of a DNS message.
+	maxDoHResponseSize = 65535
+)
+
+// dnsCache caches the answers of the dns module, shared by all the scripts.
+var dnsCache = &kvRegistry{m: make(map[string]kvEntry)}
+
+// preloadDNSModule registers the dns module, loaded by scripts with
+// require("dns"), which resolves names with Go's resolver, e.g. for service
+// discovery or to verify the TXT records of a domain:
+//
+//	dns.lookup(host[, opts]): the array of the IP addresses of host
+//	dns.txt(name[, opts]): the array of the TXT records of name
+//	dns.mx(name[, opts]): the array of the MX records of name, tables with
+//	the host and pref, sorted by preference
+//	dns.srv(service, proto, name[, opts]): the array of the SRV records of
+//	_service._proto.name, tables with the target, port, priority and
+//	weight, sorted by priority and randomized by weight. With only the name,
+//	dns.srv(name[, opts]) looks up name as is.
+//
+// The functions return an empty array if the name does not exist, and nil
+// and an error message if the query fails. The options are:
+//
+//	timeout: the timeout of the query in seconds (default 5), which does
+//	not extend past the deadline of the request
+//	cache: the number of seconds during which the answer is cached and
+//	returned without a query (default 60), 0 to not cache it
+//	family: "ip4" or "ip6" to only look up the IPv4 or IPv6 addresses
+//	with dns.lookup
+//
+// Only the answers of the successful queries are cached. The queries are
+// sent to the handler's dns resolvers, if any (see DNS), and to Go's
+// resolver otherwise.
+func preloadDNSModule(L *lua.LState) {
+	L.PreloadModule("dns", func(L *lua.LState) int {
+		L.Push(L.SetFuncs(L.NewTable(), dnsFuncs))
+		return 1
+	})
+}
+
+var dnsFuncs = map[string]lua.LGFunction{
+	"lookup": dnsLookup,
+	"txt":    dnsTXT,
+	"mx":     dnsMX,
+	"srv":    dnsSRV,
+}
+
+// DNS configures the resolvers of the dns module, for the environments
+// where the DNS queries must be encrypted. Resolvers are the URLs of
+// DNS-over-HTTPS (e.g. https://1.1.1.1/dns-query) or DNS-over-TLS (e.g.
+// tls://9.9.9.9, on port 853 by default) resolvers, tried in order until
+// one answers: a resolver that fails is followed by the next one, and each
+// one gets its share of the remaining timeout of the query. If
+// PlaintextFallback is true, Go's resolver is tried once all of them
+// failed. The host names of the resolvers are resolved with Go's resolver,
+// so their IP addresses keep their names private. The DNS-over-HTTPS
+// queries are sent with the handler's http_client, whose connections are
+// reused, and the DNS-over-TLS connections are verified like its own, e.g.
+// with its ca_file or the settings of the resolver's destination. The
+// answers are cached like those of Go's resolver.
+//
+//	dns {
+//		resolvers https://1.1.1.1/dns-query tls://9.9.9.9
+//		plaintext_fallback
+//	}
+type DNS struct {
+	Resolvers         []string `json:"resolvers,omitempty"`
+	PlaintextFallback bool     `json:"plaintext_fallback,omitempty"`
+}
+
+// unmarshalCaddyfile sets up the resolvers from the block's tokens.
+func (dc *DNS) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch field := d.Val(); field {
+		case "resolvers":
+			urls := d.RemainingArgs()
+			if len(urls) == 0 {
+				return d.Errf("dns %s: %w", field, d.ArgErr())
+			}
+			dc.Resolvers = append(dc.Resolvers, urls...)
+		case "plaintext_fallback":
+			if d.NextArg() {
+				return d.Errf("dns %s: %w", field, d.ArgErr())
+			}
+			dc.PlaintextFallback = true
+		default:
+			return d.Errf("dns %s: unknown configuration option", field)
+		}
+	}
+	return nil
+}
+
+func (dc *DNS) validate() error {
+	if len(dc.Resolvers) == 0 {
+		return errors.New("dns: the resolvers configuration option is required")
+	}
+	for _, u := range dc.Resolvers {
+		if _, _, err := parseDNSResolver(u); err != nil {
+			return fmt.Errorf("dns: %w", err)
+		}
+	}
+	return nil
+}
+
+// parseDNSResolver returns the scheme, https or tls, and the URL of the
+// resolver at rawURL, whose host has a port if it is a DNS-over-TLS resolver.
+func parseDNSResolver(rawURL string) (string, *url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", nil, err
+	}
+	if u.Host == "" {
+		return "", nil, fmt.Errorf("the resolver %s has no host", rawURL)
+	}
+	switch u.Scheme {
+	case "https":
+	case "tls":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), defaultDoTPort)
+		}
+	default:
+		return "", nil, fmt.Errorf("the resolver %s must be an https:// or tls:// URL", rawURL)
+	}
+	return u.Scheme, u, nil
+}
+
+// newDNSResolvers returns the resolvers configured by dc, which send the
+// DNS-over-HTTPS queries with client.
+func newDNSResolvers(dc *DNS, client *http.Client) ([]*net.Resolver, error) {
+	resolvers := make([]*net.Resolver, 0, len(dc.Resolvers)+1)
+	for _, rawURL := range dc.Resolvers {
+		scheme, u, err := parseDNSResolver(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		// Go's resolver sends the queries over the stream connections
+		// returned by Dial, whatever their address, with the TCP framing
+		var dial func(ctx context.Context, network, address string) (net.Conn, error)
+		if scheme == "tls" {
+			d := &tls.Dialer{Config: clientTLSConfig(client, u)}
+			dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return d.DialContext(ctx, "tcp", u.Host)
+			}
+		} else {
+			endpoint := u.String()
+			dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return &dohConn{ctx: ctx, client: client, url: endpoint}, nil
+			}
+		}
+		resolvers = append(resolvers, &net.Resolver{PreferGo: true, StrictErrors: true, Dial: dial})
+	}
+	if dc.PlaintextFallback {
+		resolvers = append(resolvers, net.DefaultResolver)
+	}
+	return resolvers, nil
+}
+
+// clientTLSConfig returns the configuration of the TLS connections of
+// client to the host of u, with the server name of u by default.
+func clientTLSConfig(client *http.Client, u *url.URL) *tls.Config {
+	var tr *http.Transport
+	switch rt := client.Transport.(type) {
+	case *http.Transport:
+		tr = rt
+	case *destinationTransport:
+		tr = rt.transportFor(u)
+	}
+	cfg := new(tls.Config)
+	if tr != nil && tr.TLSClientConfig != nil {
+		cfg = tr.TLSClientConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = u.Hostname()
+	}
+	return cfg
+}
+
+// dohConn is the connection of a DNS-over-HTTPS query, which sends the
+// query written to it, framed like over TCP, in a POST request to url and
+// returns the response with the same framing.
+type dohConn struct {
+	ctx      context.Context
+	client   *http.Client
+	url      string
+	deadline time.Time
+
+	query    bytes.Buffer
+	response *bytes.Reader
+}
+
+// Write implements net.Conn, sending the query once it is written.
+func (c *dohConn) Write(p []byte) (int, error) {
+	if c.response != nil {
+		return 0, errors.New("the DNS-over-HTTPS query is already sent")
+	}
+	c.query.Write(p)
+	b := c.query.Bytes()
+	if len(b) < 2 || len(b) < 2+int(b[0])<<8|int(b[1]) {
+		return len(p), nil
+	}
+	resp, err := c.roundTrip(b[2:])
+	if err != nil {
+		return 0, err
+	}
+	framed := append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...)
+	c.response = bytes.NewReader(framed)
+	return len(p), nil
+}
+
+// roundTrip sends the DNS message msg and returns the message of the
+// response.
+func (c *dohConn) roundTrip(msg []byte) ([]byte, error) {
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the DNS-over-HTTPS resolver %s responded with status %d", c.url, resp.StatusCode)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxDoHResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxDoHResponseSize {
+		return nil, fmt.Errorf("the response of the DNS-over-HTTPS resolver %s is larger than %d bytes", c.url, maxDoHResponseSize)
+	}
+	return b, nil
+}
+
+// Read implements net.Conn, reading the response of the query.
+func (c *dohConn) Read(p []byte) (int, error) {
+	if c.response == nil {
+		return 0, errors.New("the DNS-over-HTTPS query is not sent")
+	}
+	return c.response.Read(p)
+}
+
+// Close implements net.Conn.
+func (c *dohConn) Close() error { return nil }
+
+// LocalAddr implements net.Conn.
+func (c *dohConn) LocalAddr() net.Addr { return dohAddr(c.url) }
+
+// RemoteAddr implements net.Conn.
+func (c *dohConn) RemoteAddr() net.Addr { return dohAddr(c.url) }
+
+// SetDeadline implements net.Conn, setting the deadline of the request.
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+// SetReadDeadline implements net.Conn.
+func (c *dohConn) SetReadDeadline(t time.Time) error { return c.SetDeadline(t) }
+
+// SetWriteDeadline implements net.Conn.
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return c.SetDeadline(t) }
+
+// dohAddr is the address of a DNS-over-HTTPS resolver, its URL.
+type dohAddr string
+
+func (a dohAddr) Network() string { return "https" }
+func (a dohAddr) String() string  { return string(a) }
+
+// dnsOptions are the options of a query of the dns module.
+type dnsOptions struct {
+	timeout time.Duration
+	cache   time.Duration
+	family  string
+}
+
+// checkDNSOptions returns the options of the table at index n of the stack.
+func checkDNSOptions(L *lua.LState, n int) dnsOptions {
+	opts := dnsOptions{timeout: defaultDNSTimeout, cache: defaultDNSCacheTTL, family: "ip"}
+	t := L.OptTable(n, nil)
+	if t == nil {
+		return opts
+	}
+	if v, ok := t.RawGetString("timeout").(lua.LNumber); ok {
+		if v <= 0 {
+			L.ArgError(n, "the timeout must be positive")
+		}
+		opts.timeout = time.Duration(float64(v) * float64(time.Second))
+	}
+	if v, ok := t.RawGetString("cache").(lua.LNumber); ok {
+		if v < 0 {
+			L.ArgError(n, "the cache duration must not be negative")
+		}
+		opts.cache = time.Duration(float64(v) * float64(time.Second))
+	}
+	switch v := lua.LVAsString(t.RawGetString("family")); v {
+	case "":
+	case "ip4", "ip6":
+		opts.family = v
+	default:
+		L.ArgError(n, "the family must be ip4 or ip6")
+	}
+	return opts
+}
+
+// dnsQuery returns the answer of the query key, from the cache or from the
+// call of query with the handler's resolvers, in order until one answers,
+// the context of the script and the timeout of opts. It returns a nil
+// answer if the name does not exist.
+func dnsQuery(L *lua.LState, key string, opts dnsOptions, query func(ctx context.Context, r *net.Resolver) (interface{}, error)) (interface{}, error) {
+	if opts.cache > 0 {
+		if v, ok := dnsCache.get(key); ok {
+			return v, nil
+		}
+	}
+	resolvers := checkHandler(L).dnsResolvers
+	if len(resolvers) == 0 {
+		resolvers = []*net.Resolver{net.DefaultResolver}
+	}
+	ctx, cancel := context.WithTimeout(checkContext(L), opts.timeout)
+	defer cancel()
+	var v interface{}
+	var err error
+	unlocked(L, func() {
+		for i, r := range resolvers {
+			rctx := ctx
+			if n := len(resolvers) - i; n > 1 {
+				// the next resolvers get their share of the timeout
+				deadline, _ := ctx.Deadline()
+				var rcancel context.CancelFunc
+				rctx, rcancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(n))
+				defer rcancel()
+			}
+			v, err = query(rctx, r)
+			if err == nil || isDNSNotFound(err) || ctx.Err() != nil {
+				return
+			}
+		}
+	})
+	if isDNSNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if opts.cache > 0 {
+		dnsCache.set(key, v, opts.cache)
+	}
+	return v, nil
+}
+
+// isDNSNotFound returns true if err is the error of a name that does not
+// exist.
+func isDNSNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// pushDNSError pushes nil and the message of err.
+func pushDNSError(L *lua.LState, err error) int {
+	L.Push(lua.LNil)
+	L.Push(lua.LString(err.Error()))
+	return 2
+}
+
+// dnsLookup implements dns.lookup(host[, opts]).
+func dnsLookup(L *lua.LState) int {
+	host := L.CheckString(1)
+	opts := checkDNSOptions(L, 2)
+	v, err := dnsQuery(L, opts.family+":"+strings.ToLower(host), opts, func(ctx context.Context, r *net.Resolver) (interface{}, error) {
+		ips, err := r.LookupIP(ctx, opts.family, host)
+		if err != nil {
+			return nil, err
+		}
+		addrs := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			addrs = append(addrs, ip.String())
+		}
+		return addrs, nil
+	})
+	if err != nil {
+		return pushDNSError(L, err)
+	}
+	addrs, _ := v.([]string)
+	L.Push(stringArray(L, addrs))
+	return 1
+}
+
+// dnsTXT implements dns.txt(name[, opts]).
+func dnsTXT(L *lua.LState) int {
+	name := L.CheckString(1)
+	opts := checkDNSOptions(L, 2)
+	v, err := dnsQuery(L, "txt:"+strings.ToLower(name), opts, func(ctx context.Context, r *net.Resolver) (interface{}, error) {
+		return r.LookupTXT(ctx, name)
+	})
+	if err != nil {
+		return pushDNSError(L, err)
+	}
+	txts, _ := v.([]string)
+	L.Push(stringArray(L, txts))
+	return 1
+}
+
+// dnsMX implements dns.mx(name[, opts]).
+func dnsMX(L *lua.LState) int {
+	name := L.CheckString(1)
+	opts := checkDNSOptions(L, 2)
+	v, err := dnsQuery(L, "mx:"+strings.ToLower(name), opts, func(ctx context.Context, r *net.Resolver) (interface{}, error) {
+		return r.LookupMX(ctx, name)
+	})
+	if err != nil {
+		return pushDNSError(L, err)
+	}
+	mxs, _ := v.([]*net.MX)
+	t := L.CreateTable(len(mxs), 0)
+	for _, mx := range mxs {
+		rec := L.CreateTable(0, 2)
+		rec.RawSetString("host", lua.LString(mx.Host))
+		rec.RawSetString("pref", lua.LNumber(mx.Pref))
+		t.Append(rec)
+	}
+	L.Push(t)
+	return 1
+}
+
+// dnsSRV implements dns.srv(service, proto, name[, opts]) and
+// dns.srv(name[, opts]).
+func dnsSRV(L *lua.LState) int {
+	var service, proto, name string
+	optsIndex := 2
+	if _, ok := L.Get(2).(lua.LString); ok {
+		service = L.CheckString(1)
+		proto = L.CheckString(2)
+		name = L.CheckString(3)
+		optsIndex = 4
+	} else {
+		name = L.CheckString(1)
+	}
+	opts := checkDNSOptions(L, optsIndex)
+	key := "srv:" + strings.ToLower(service+"."+proto+"."+name)
+	v, err := dnsQuery(L, key, opts, func(ctx context.Context, r *net.Resolver) (interface{}, error) {
+		_, srvs, err := r.LookupSRV(ctx, service, proto, name)
+		return srvs, err
+	})
+	if err != nil {
+		return pushDNSError(L, err)
+	}
+	srvs, _ := v.([]*net.SRV)
+	t := L.CreateTable(len(srvs), 0)
+	for _, srv := range srvs {
+		rec := L.CreateTable(0, 4)
+		rec.RawSetString("target", lua.LString(srv.Target))
+		rec.RawSetString("port", lua.LNumber(srv.Port))
+		rec.RawSetString("priority", lua.LNumber(srv.Priority))
+		rec.RawSetString("weight", lua.LNumber(srv.Weight))
+		t.Append(rec)
+	}
+	L.Push(t)
+	return 1
+}
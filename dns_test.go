@@ -0,0 +1,160 @@
+package lua
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// answerDNS returns the response to the DNS query msg, with an A and a TXT
+// record for svc.test and no other names.
+func answerDNS(t *testing.T, msg []byte) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	h.Response = true
+	h.RCode = dnsmessage.RCodeSuccess
+	found := q.Name.String() == "svc.test."
+	if !found {
+		h.RCode = dnsmessage.RCodeNameError
+	}
+	b := dnsmessage.NewBuilder(nil, h)
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+	switch {
+	case found && q.Type == dnsmessage.TypeA:
+		b.AResource(rh, dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}})
+	case found && q.Type == dnsmessage.TypeTXT:
+		b.TXTResource(rh, dnsmessage.TXTResource{TXT: []string{"hello"}})
+	}
+	resp, err := b.Finish()
+	if err != nil {
+		t.Error(err)
+	}
+	return resp
+}
+
+// serveDoT answers the DNS-over-TLS queries of the connections of ln.
+func serveDoT(t *testing.T, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				var n uint16
+				if err := binary.Read(conn, binary.BigEndian, &n); err != nil {
+					return
+				}
+				msg := make([]byte, n)
+				if _, err := io.ReadFull(conn, msg); err != nil {
+					return
+				}
+				resp := answerDNS(t, msg)
+				binary.Write(conn, binary.BigEndian, uint16(len(resp)))
+				conn.Write(resp)
+			}
+		}()
+	}
+}
+
+func TestDNSEncryptedResolvers(t *testing.T) {
+	var dohQueries int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt32(&dohQueries, 1)
+		msg, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(answerDNS(t, msg))
+	}))
+	defer srv.Close()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: srv.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveDoT(t, ln)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// nothing listens on the port of the closed listener
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	const script = `
+		local dns = require("dns")
+		local ips, err = dns.lookup("svc.test", {cache = 0, family = "ip4"})
+		local txt, terr = dns.txt("svc.test", {cache = 0})
+		local none, nerr = dns.lookup("none.test", {cache = 0, family = "ip4"})
+		response:write(table.concat({ips and ips[1] or err, txt and txt[1] or terr, none and #none or nerr}, " "))`
+	cases := []struct {
+		name      string
+		resolvers []string
+		doh       bool
+	}{
+		{"dot", []string{"tls://" + ln.Addr().String()}, false},
+		{"doh fallback", []string{"tls://" + closed.Addr().String(), srv.URL + "/dns-query"}, true},
+	}
+	for _, c := range cases {
+		atomic.StoreInt32(&dohQueries, 0)
+		tr, err := NewTester(&Lua{
+			HTTPClient: &HTTPClient{CAFile: caFile},
+			DNS:        &DNS{Resolvers: c.resolvers},
+			Script:     script,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := tr.Do(TestRequest{})
+		tr.Close()
+		if want := "10.0.0.1 hello 0"; res.Body != want {
+			t.Errorf("%s: got %q (%v), want %q", c.name, res.Body, res.Err, want)
+		}
+		if n := atomic.LoadInt32(&dohQueries); (n > 0) != c.doh {
+			t.Errorf("%s: got %d DNS-over-HTTPS queries", c.name, n)
+		}
+	}
+}
+
+func TestDNSValidate(t *testing.T) {
+	for _, u := range []string{"udp://1.1.1.1", "https:///dns-query", "1.1.1.1"} {
+		if err := (&DNS{Resolvers: []string{u}}).validate(); err == nil {
+			t.Errorf("%s: got no error", u)
+		}
+	}
+	if err := (&DNS{Resolvers: []string{"tls://9.9.9.9", "https://1.1.1.1/dns-query"}}).validate(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,483 @@
+package lua
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/certmagic"
+	lua "github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultEventTimeout = 30 * time.Second
+
+	// eventStarted and eventStopping are the events of the Events app
+	// itself, emitted once the configuration is loaded and when it is
+	// unloaded.
+	eventStarted  = "started"
+	eventStopping = "stopping"
+
+	// eventCertFailed is emitted by the EventsLogWriter when a certificate
+	// cannot be obtained or renewed, which certmagic does not emit.
+	eventCertFailed = "cert_failed"
+)
+
+func init() {
+	caddy.RegisterModule(Events{})
+	caddy.RegisterModule(EventsLogWriter{})
+	httpcaddyfile.RegisterGlobalOption("lua_events", parseEventsOption)
+
+	// the certificate and TLS events of certmagic are emitted to the
+	// OnEvent function of the default configuration, the template of the
+	// configurations of Caddy's TLS app.
+	prev := certmagic.Default.OnEvent
+	certmagic.Default.OnEvent = func(event string, data interface{}) {
+		if prev != nil {
+			prev(event, data)
+		}
+		eventApps.emit(event, data)
+	}
+}
+
+// Events is an app that runs Lua scripts when events occur, e.g. to send a
+// notification when a certificate is renewed or to warm a cache once the
+// configuration is loaded. The events are the ones of the certificates
+// managed by Caddy (cert_obtained, cert_renewed, cert_revoked,
+// cached_managed_cert and cached_unmanaged_cert, and cert_failed if the logs
+// of the TLS app are written to an EventsLogWriter), of the TLS handshakes
+// (tls_handshake_started and tls_handshake_completed, emitted for every
+// connection), and "started" and "stopping", emitted once the configuration
+// is loaded and when it is unloaded.
+//
+// The scripts run in their own Lua state, in the background except for the
+// "stopping" event, with the event as first argument: a table with the
+// name and the data of the event. The data of the certificate events is a
+// table with the name, issuer_key and storage_key of the certificate, and
+// its certificate, loaded from the storage, with the fields of the
+// certificates of request.tls (e.g. not_after, to track its expiry), unless
+// it cannot be loaded. The data of the cached_ events is the array of the
+// names of the certificate, the data of cert_failed a table with the name,
+// issuer_key and error of the failure, and renewal, true if the certificate
+// was renewed rather than obtained. The data of the TLS events is a table
+// with the server_name and the remote_addr of the handshake. The json,
+// http, kv, ratelimit, crypto and metrics modules are available, and the
+// scripts are stopped after Timeout (default 30s).
+type Events struct {
+	Subscriptions []EventSubscription `json:"subscriptions,omitempty"`
+	Timeout       caddy.Duration      `json:"timeout,omitempty"`
+	HTTPClient    *HTTPClient         `json:"http_client,omitempty"`
+
+	logger     *zap.Logger
+	scripts    map[string][]*lua.FunctionProto
+	httpClient *http.Client
+	storage    certmagic.Storage
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+// EventSubscription runs the script at HandlerPath when one of Events
+// occurs.
+type EventSubscription struct {
+	Events      []string `json:"events,omitempty"`
+	HandlerPath string   `json:"handler_path,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (Events) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "lua_events",
+		New: func() caddy.Module { return new(Events) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (e *Events) Provision(ctx caddy.Context) error {
+	e.logger = ctx.Logger(e)
+	e.storage = ctx.Storage()
+	protos, err := compileScripts(e.paths()...)
+	if err != nil {
+		return err
+	}
+	e.scripts = make(map[string][]*lua.FunctionProto)
+	for _, sub := range e.Subscriptions {
+		for _, event := range sub.Events {
+			e.scripts[event] = append(e.scripts[event], protos[sub.HandlerPath])
+		}
+	}
+	if e.httpClient, err = newHTTPClient(e.HTTPClient, nil); err != nil {
+		return fmt.Errorf("http_client: %w", err)
+	}
+	return nil
+}
+
+func (e *Events) paths() []string {
+	paths := make([]string, 0, len(e.Subscriptions))
+	for _, sub := range e.Subscriptions {
+		paths = append(paths, sub.HandlerPath)
+	}
+	return paths
+}
+
+// Validate implements caddy.Validator.
+func (e *Events) Validate() error {
+	for i, sub := range e.Subscriptions {
+		if sub.HandlerPath == "" {
+			return fmt.Errorf("subscription %d: the handler_path is required", i)
+		}
+		if len(sub.Events) == 0 {
+			return fmt.Errorf("subscription %d: at least one event is required", i)
+		}
+	}
+	if e.Timeout < 0 {
+		return errors.New("the timeout must not be negative")
+	}
+	return nil
+}
+
+// Start implements caddy.App.
+func (e *Events) Start() error {
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+	eventApps.add(e)
+	e.emit(eventStarted, nil)
+	return nil
+}
+
+// Stop implements caddy.App. The scripts of the "stopping" event run before
+// it returns, and the scripts still running are canceled.
+func (e *Events) Stop() error {
+	eventApps.remove(e)
+	e.run(eventStopping, nil)
+	e.cancel()
+	e.httpClient.CloseIdleConnections()
+	return nil
+}
+
+// emit runs the scripts subscribed to event in the background.
+func (e *Events) emit(event string, data interface{}) {
+	if len(e.scripts[event]) == 0 {
+		return
+	}
+	go e.run(event, data)
+}
+
+// run runs the scripts subscribed to event.
+func (e *Events) run(event string, data interface{}) {
+	if d, ok := data.(certmagic.CertificateEventData); ok {
+		data = e.loadCertificate(d)
+	}
+	for _, proto := range e.scripts[event] {
+		if err := e.runScript(proto, event, data); err != nil {
+			e.logger.Error("running the event script",
+				zap.String("event", event),
+				zap.String("path", proto.SourceName),
+				zap.Error(err))
+		}
+	}
+}
+
+// runScript runs proto in a new state for event.
+func (e *Events) runScript(proto *lua.FunctionProto, event string, data interface{}) error {
+	timeout := time.Duration(e.Timeout)
+	if timeout <= 0 {
+		timeout = defaultEventTimeout
+	}
+	ctx, cancel := context.WithTimeout(e.ctx, timeout)
+	defer cancel()
+
+	L := e.newState()
+	defer L.Close()
+	L.SetContext(ctx)
+
+	t := L.CreateTable(0, 2)
+	t.RawSetString("name", lua.LString(event))
+	t.RawSetString("data", eventData(L, data))
+	_, err := runProto(L, proto, t)
+	return err
+}
+
+// certificateEvent is the data of a certificate event, with its
+// certificate, nil if it cannot be loaded.
+type certificateEvent struct {
+	certmagic.CertificateEventData
+	cert *x509.Certificate
+}
+
+// loadCertificate returns the data of a certificate event, with the
+// certificate loaded from the storage. The certificate of a cert_revoked
+// event may already be deleted.
+func (e *Events) loadCertificate(d certmagic.CertificateEventData) certificateEvent {
+	ce := certificateEvent{CertificateEventData: d}
+	if e.storage == nil {
+		return ce
+	}
+	b, err := e.storage.Load(e.ctx, certmagic.StorageKeys.SiteCert(d.IssuerKey, d.Name))
+	if err != nil {
+		e.logger.Debug("loading the certificate of the event",
+			zap.String("name", d.Name),
+			zap.Error(err))
+		return ce
+	}
+	if block, _ := pem.Decode(b); block != nil && block.Type == "CERTIFICATE" {
+		ce.cert, _ = x509.ParseCertificate(block.Bytes)
+	}
+	return ce
+}
+
+// newState returns a new Lua state for the events' scripts.
+func (e *Events) newState() *lua.LState {
+	L := lua.NewState()
+	ud := L.NewUserData()
+	ud.Value = e.httpClient
+	L.G.Registry.RawSetString(httpClientKey, ud)
+	preloadJSONModule(L)
+	preloadHTTPModule(L)
+	preloadKVModule(L)
+	preloadRateLimitModule(L)
+	preloadCryptoModule(L)
+	preloadMetricsModule(L)
+	return L
+}
+
+// eventData returns the Lua value of the data of an event.
+func eventData(L *lua.LState, data interface{}) lua.LValue {
+	switch d := data.(type) {
+	case nil:
+		return lua.LNil
+	case certificateEvent:
+		t := L.CreateTable(0, 4)
+		t.RawSetString("name", lua.LString(d.Name))
+		t.RawSetString("issuer_key", lua.LString(d.IssuerKey))
+		t.RawSetString("storage_key", lua.LString(d.StorageKey))
+		if d.cert != nil {
+			t.RawSetString("certificate", certificateTable(L, d.cert))
+		}
+		return t
+	case certificateFailure:
+		t := L.CreateTable(0, 4)
+		t.RawSetString("name", lua.LString(d.Name))
+		t.RawSetString("issuer_key", lua.LString(d.Issuer))
+		t.RawSetString("error", lua.LString(d.Error))
+		t.RawSetString("renewal", lua.LBool(d.renewal))
+		return t
+	case []string:
+		return stringArray(L, d)
+	case *tls.ClientHelloInfo:
+		t := L.CreateTable(0, 2)
+		t.RawSetString("server_name", lua.LString(d.ServerName))
+		if d.Conn != nil {
+			t.RawSetString("remote_addr", lua.LString(d.Conn.RemoteAddr().String()))
+		}
+		return t
+	}
+	// other data is converted via its JSON encoding
+	b, err := json.Marshal(data)
+	if err != nil {
+		return lua.LNil
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return lua.LNil
+	}
+	return fromGo(L, v)
+}
+
+// eventApps holds the running Events apps, to which the events of certmagic
+// are emitted.
+var eventApps = &eventRegistry{apps: make(map[*Events]struct{})}
+
+type eventRegistry struct {
+	mu   sync.RWMutex
+	apps map[*Events]struct{}
+}
+
+func (r *eventRegistry) add(e *Events) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.apps[e] = struct{}{}
+}
+
+func (r *eventRegistry) remove(e *Events) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.apps, e)
+}
+
+func (r *eventRegistry) emit(event string, data interface{}) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for e := range r.apps {
+		e.emit(event, data)
+	}
+}
+
+// EventsLogWriter is a log writer that emits the cert_failed event to the
+// Events apps when the TLS app cannot obtain or renew a certificate, since
+// certmagic emits no event for the failures. It reads the errors logged
+// for each issuer that fails, including the retries, so the logs of the TLS
+// app must be written to it in the JSON format, e.g. with the global log
+// option:
+//
+//	log cert_failures {
+//		output lua_events
+//		format json
+//		include tls.obtain tls.renew
+//	}
+//
+// Caddy then excludes the included logs from the default log.
+type EventsLogWriter struct{}
+
+// CaddyModule returns the Caddy module information.
+func (EventsLogWriter) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.logging.writers.lua_events",
+		New: func() caddy.Module { return new(EventsLogWriter) },
+	}
+}
+
+func (EventsLogWriter) String() string { return "lua_events" }
+
+// WriterKey implements caddy.WriterOpener.
+func (EventsLogWriter) WriterKey() string { return "lua_events" }
+
+// OpenWriter implements caddy.WriterOpener.
+func (EventsLogWriter) OpenWriter() (io.WriteCloser, error) {
+	return eventsLogWriter{}, nil
+}
+
+// UnmarshalCaddyfile sets up the writer from the output subdirective of
+// the log directive, which takes no options:
+//
+//	output lua_events
+func (EventsLogWriter) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+// certFailureMessage is the message of the errors logged by certmagic when
+// an issuer cannot obtain or renew a certificate.
+const certFailureMessage = "could not get certificate from issuer"
+
+// certificateFailure is the data of a cert_failed event, decoded from the
+// error logged by certmagic.
+type certificateFailure struct {
+	Logger  string `json:"logger"`
+	Message string `json:"msg"`
+	Name    string `json:"identifier"`
+	Issuer  string `json:"issuer"`
+	Error   string `json:"error"`
+
+	renewal bool
+}
+
+// eventsLogWriter is the writer of an EventsLogWriter.
+type eventsLogWriter struct{}
+
+// Write emits the cert_failed event for the failures logged in p, a JSON
+// log entry per line. It never fails, so that the logs are not disrupted.
+func (eventsLogWriter) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(p, []byte("\n")) {
+		if !bytes.Contains(line, []byte(certFailureMessage)) {
+			continue
+		}
+		var f certificateFailure
+		if err := json.Unmarshal(line, &f); err != nil || f.Message != certFailureMessage {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(f.Logger, ".obtain"):
+		case strings.HasSuffix(f.Logger, ".renew"):
+			f.renewal = true
+		default:
+			continue
+		}
+		eventApps.emit(eventCertFailed, f)
+	}
+	return len(p), nil
+}
+
+func (eventsLogWriter) Close() error { return nil }
+
+// parseEventsOption sets up the Events app from the lua_events global
+// option:
+//
+//	lua_events {
+//		on <event...> <handler_path>
+//		timeout <duration>
+//		http_client {
+//			...
+//		}
+//	}
+func parseEventsOption(d *caddyfile.Dispenser, _ interface{}) (interface{}, error) {
+	var e Events
+	for d.Next() {
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			field := d.Val()
+			switch field {
+			case "on":
+				args := d.RemainingArgs()
+				if len(args) < 2 {
+					return nil, d.Errf("%s: %w", field, d.ArgErr())
+				}
+				e.Subscriptions = append(e.Subscriptions, EventSubscription{
+					Events:      args[:len(args)-1],
+					HandlerPath: args[len(args)-1],
+				})
+
+			case "timeout":
+				var v string
+				if !d.Args(&v) || d.NextArg() {
+					return nil, d.Errf("%s: %w", field, d.ArgErr())
+				}
+				if err := parseCaddyDuration(v, &e.Timeout); err != nil {
+					return nil, d.Errf("%s: %w", field, err)
+				}
+
+			case "http_client":
+				e.HTTPClient = new(HTTPClient)
+				if err := e.HTTPClient.unmarshalCaddyfile(d); err != nil {
+					return nil, err
+				}
+
+			default:
+				return nil, d.Errf("%s: unknown configuration option", field)
+			}
+		}
+	}
+	return httpcaddyfile.App{
+		Name:  "lua_events",
+		Value: caddyconfig.JSON(e, nil),
+	}, nil
+}
+
+// Interface guards
+var (
+	_ caddy.App         = (*Events)(nil)
+	_ caddy.Provisioner = (*Events)(nil)
+	_ caddy.Validator   = (*Events)(nil)
+
+	_ caddy.WriterOpener    = (*EventsLogWriter)(nil)
+	_ caddyfile.Unmarshaler = (*EventsLogWriter)(nil)
+)
@@ -0,0 +1,135 @@
+package lua
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	lua "github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+)
+
+// newTestEvents returns an Events app whose script subscribed to event
+// writes the string returned by expr, evaluated with the event as ev, to
+// the returned file.
+func newTestEvents(t *testing.T, event, expr string) (*Events, string) {
+	t.Helper()
+	out := filepath.Join(t.TempDir(), "out")
+	proto, err := compileString(fmt.Sprintf(`
+		local ev = ...
+		local f = assert(io.open(%q, "w"))
+		f:write(%s)
+		f:close()`, out, expr), "<event>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	e := &Events{
+		logger:  zap.NewNop(),
+		scripts: map[string][]*lua.FunctionProto{event: {proto}},
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	return e, out
+}
+
+// readEventOutput returns the content of the file written by the script
+// of newTestEvents, waiting for it if wait is true.
+func readEventOutput(t *testing.T, out string, wait bool) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, err := os.ReadFile(out)
+		if err == nil && len(b) > 0 {
+			return string(b)
+		}
+		if !wait || time.Now().After(deadline) {
+			t.Fatalf("the event script did not run: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEventsCertificateData(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Now().Add(90 * 24 * time.Hour).Truncate(time.Second)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	data := certmagic.CertificateEventData{Name: "example.com", IssuerKey: "acme-test"}
+	certKey := certmagic.StorageKeys.SiteCert(data.IssuerKey, data.Name)
+	if err := storage.Store(context.Background(), certKey, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})); err != nil {
+		t.Fatal(err)
+	}
+
+	e, out := newTestEvents(t, "cert_renewed", `
+		ev.name .. " " .. ev.data.name .. " " .. ev.data.issuer_key .. " " ..
+		ev.data.certificate.serial .. " " .. ev.data.certificate.dns_names[1] .. " " ..
+		string.format("%d", ev.data.certificate.not_after)`)
+	e.storage = storage
+	e.run("cert_renewed", data)
+	want := fmt.Sprintf("cert_renewed example.com acme-test 2a example.com %d", notAfter.Unix())
+	if got := readEventOutput(t, out, false); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// the certificate of a revoked certificate may be deleted
+	e, out = newTestEvents(t, "cert_revoked", `tostring(ev.data.certificate)`)
+	e.storage = storage
+	e.run("cert_revoked", certmagic.CertificateEventData{Name: "deleted.example.com", IssuerKey: "acme-test"})
+	if got := readEventOutput(t, out, false); got != "nil" {
+		t.Errorf("got %q, want nil", got)
+	}
+}
+
+func TestEventsLogWriterCertFailed(t *testing.T) {
+	e, out := newTestEvents(t, eventCertFailed, `
+		ev.data.name .. " " .. ev.data.issuer_key .. " " .. ev.data.error .. " " .. tostring(ev.data.renewal)`)
+	eventApps.add(e)
+	defer eventApps.remove(e)
+
+	w, err := EventsLogWriter{}.OpenWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	logs := []string{
+		// not failures of the obtain or renew loggers
+		`{"level":"info","logger":"tls.renew","msg":"certificate renewed successfully","identifier":"example.com"}`,
+		`{"level":"error","logger":"http","msg":"could not get certificate from issuer","identifier":"other.example.com"}`,
+		`{"level":"error","logger":"tls.renew","msg":"could not get certificate from issuer","identifier":"example.com","issuer":"acme-test","error":"rate limited"}`,
+	}
+	for _, line := range logs {
+		if n, err := w.Write([]byte(line + "\n")); err != nil || n != len(line)+1 {
+			t.Fatalf("got %d, %v", n, err)
+		}
+	}
+	if got, want := readEventOutput(t, out, true), "example.com acme-test rate limited true"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,220 @@
+package lua
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// maxLocalFetchDepth limits the nesting of local fetches, so that a script
+// that fetches its own route fails instead of recursing forever.
+const maxLocalFetchDepth = 8
+
+var (
+	errNoServer   = errors.New("no server is handling the request")
+	errFetchDepth = errors.New("too many nested local fetches")
+)
+
+// fetchDepthCtxKey is the context key of the local fetch nesting depth of a
+// request.
+const fetchDepthCtxKey caddy.CtxKey = "lua_fetch_depth"
+
+// caddyFetchLocal implements caddy.fetch_local(uri[, opts]), which sends a
+// request through the current server's routes without a network round trip
+// and returns a table with the status, headers and body of the response.
+// The opts table supports the method (default GET), headers (table of names
+// to string or array of strings), body and host (default to the current
+// request's host) of the request.
+func caddyFetchLocal(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	uri := L.CheckString(1)
+	opts := L.OptTable(2, L.NewTable())
+
+	fo := fetchOptions{
+		uri:     uri,
+		method:  lua.LVAsString(opts.RawGetString("method")),
+		host:    lua.LVAsString(opts.RawGetString("host")),
+		body:    lua.LVAsString(opts.RawGetString("body")),
+		headers: optHeader(opts.RawGetString("headers")),
+	}
+	var resp *responseBuffer
+	var err error
+	unlocked(L, func() { resp, err = fetchLocal(rc.r, fo) })
+	if err != nil {
+		L.RaiseError("caddy.fetch_local: %s", err)
+	}
+
+	L.Push(fetchResult(L, resp))
+	return 1
+}
+
+// caddySubrequest implements caddy.subrequest(method, uri[, opts]), which
+// sends an internal request through the current server's routes, like
+// caddy.fetch_local, to compose or aggregate the responses of other routes.
+// Unlike caddy.fetch_local, the subrequest has the headers of the current
+// request by default (except for Accept-Encoding, so that the body is not
+// compressed), which the headers of opts replace. The opts table supports
+// headers, query (a table of names to string or array of strings, added to
+// the query string of uri), body (a string, or a table sent as JSON), host
+// and copy_headers (true by default). It returns a table with the status,
+// headers and body of the response, or nil and an error message if the
+// subrequest cannot be sent.
+func caddySubrequest(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	method := L.CheckString(1)
+	uri := L.CheckString(2)
+	opts := L.OptTable(3, L.NewTable())
+
+	fo := fetchOptions{
+		uri:         uri,
+		method:      method,
+		host:        lua.LVAsString(opts.RawGetString("host")),
+		headers:     optHeader(opts.RawGetString("headers")),
+		copyHeaders: opts.RawGetString("copy_headers") != lua.LFalse,
+	}
+	switch body := opts.RawGetString("body").(type) {
+	case *lua.LTable:
+		v, err := toGo(body)
+		if err == nil {
+			var b []byte
+			if b, err = json.Marshal(v); err == nil {
+				fo.body = string(b)
+				fo.contentType = "application/json"
+			}
+		}
+		if err != nil {
+			L.ArgError(3, fmt.Sprintf("encoding the body: %s", err))
+		}
+	case lua.LString:
+		fo.body = string(body)
+	}
+	if t := optTable(opts.RawGetString("query")); t != nil {
+		fo.query = make(url.Values)
+		t.ForEach(func(k, v lua.LValue) {
+			if arr, ok := v.(*lua.LTable); ok {
+				fo.query[k.String()] = append(fo.query[k.String()], tableStrings(arr)...)
+				return
+			}
+			fo.query.Add(k.String(), v.String())
+		})
+	}
+
+	var resp *responseBuffer
+	var err error
+	unlocked(L, func() { resp, err = fetchLocal(rc.r, fo) })
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(fetchResult(L, resp))
+	return 1
+}
+
+// fetchResult returns the table of the status, headers and body of resp.
+func fetchResult(L *lua.LState, resp *responseBuffer) *lua.LTable {
+	t := L.CreateTable(0, 3)
+	t.RawSetString("status", lua.LNumber(resp.statusCode()))
+	t.RawSetString("headers", headerToTable(L, resp.header))
+	t.RawSetString("body", lua.LString(resp.body.String()))
+	return t
+}
+
+// fetchOptions are the options of a local fetch.
+type fetchOptions struct {
+	uri         string
+	method      string
+	host        string
+	body        string
+	contentType string
+	headers     http.Header
+	query       url.Values
+
+	// copyHeaders sets the headers of the current request on the fetch's
+	// request, before the headers of the options.
+	copyHeaders bool
+}
+
+// fetchLocal sends a request built from opts through the routes of the
+// server that handles r, and returns the buffered response.
+func fetchLocal(r *http.Request, opts fetchOptions) (*responseBuffer, error) {
+	// the server, or the Tester's handler
+	srv, ok := r.Context().Value(caddyhttp.ServerCtxKey).(http.Handler)
+	if !ok {
+		return nil, errNoServer
+	}
+	depth, _ := r.Context().Value(fetchDepthCtxKey).(int)
+	if depth >= maxLocalFetchDepth {
+		return nil, errFetchDepth
+	}
+
+	method := opts.method
+	if method == "" {
+		method = http.MethodGet
+	}
+	ctx := context.WithValue(r.Context(), fetchDepthCtxKey, depth+1)
+	req, err := http.NewRequestWithContext(ctx, strings.ToUpper(method), opts.uri, strings.NewReader(opts.body))
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Host == "" {
+		req.URL.Scheme = ""
+	}
+	req.RequestURI = req.URL.RequestURI()
+	req.Host = r.Host
+	if opts.host != "" {
+		req.Host = opts.host
+	}
+	req.RemoteAddr = r.RemoteAddr
+	req.TLS = r.TLS
+	req.Proto, req.ProtoMajor, req.ProtoMinor = r.Proto, r.ProtoMajor, r.ProtoMinor
+	if len(opts.query) > 0 {
+		q := req.URL.Query()
+		for k, vs := range opts.query {
+			q[k] = append(q[k], vs...)
+		}
+		req.URL.RawQuery = q.Encode()
+		req.RequestURI = req.URL.RequestURI()
+	}
+	if opts.copyHeaders {
+		req.Header = r.Header.Clone()
+		for _, name := range []string{"Accept-Encoding", "Content-Length", "Content-Type", "Transfer-Encoding"} {
+			req.Header.Del(name)
+		}
+	}
+	if opts.contentType != "" {
+		req.Header.Set("Content-Type", opts.contentType)
+	}
+	for k, vs := range opts.headers {
+		req.Header[k] = vs
+	}
+
+	resp := newResponseBuffer()
+	srv.ServeHTTP(resp, req)
+	return resp, nil
+}
+
+// optHeader returns the header of the table v, or nil if it is not a table.
+func optHeader(v lua.LValue) http.Header {
+	t := optTable(v)
+	if t == nil {
+		return nil
+	}
+	h := make(http.Header)
+	tableToHeader(t, h)
+	return h
+}
+
+// optTable returns v as a table, or nil if it is not a table.
+func optTable(v lua.LValue) *lua.LTable {
+	t, _ := v.(*lua.LTable)
+	return t
+}
@@ -0,0 +1,78 @@
+package lua
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// wrapResponseWriter wraps w with the response filters configured on the
+// handler. The returned finish function must be called after the next
+// handler returned, to complete the filtered responses.
+func (l *Lua) wrapResponseWriter(w http.ResponseWriter, r *http.Request, L *lua.LState) (http.ResponseWriter, func() error, error) {
+	var finishers []func() error
+
+	if l.SubFilter != nil || l.SSI != nil || l.BodyFilter != nil {
+		// the filters need uncompressed, full responses
+		r.Header.Del("Accept-Encoding")
+		r.Header.Del("Range")
+	}
+
+	// the header casing applies last, to the headers set by all the filters
+	names := append(append([]string(nil), l.HeaderCase...), checkRequestContext(L).headerCase...)
+	if len(names) > 0 {
+		w = newHeaderCaseWriter(w, names)
+	}
+	if l.Phases != nil && l.Phases.Header != "" {
+		// the header script runs when the header is sent, once the other
+		// filters modified it
+		w = &headerPhaseWriter{
+			ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+			l:                     l,
+			L:                     L,
+			r:                     r,
+		}
+	}
+	if l.BodyFilter != nil {
+		// the Lua filter receives the body produced by the other filters
+		bw, err := newBodyFilterWriter(w, l.BodyFilter, L)
+		if err != nil {
+			return nil, nil, err
+		}
+		w = bw
+		finishers = append(finishers, bw.finish)
+	}
+	if l.SubFilter != nil {
+		sw, err := newSubFilterWriter(w, l.SubFilter, L)
+		if err != nil {
+			return nil, nil, err
+		}
+		w = sw
+		finishers = append(finishers, sw.finish)
+	}
+	if l.HTMLInject != nil {
+		iw := newInjectWriter(w, l.HTMLInject, L)
+		w = iw
+		finishers = append(finishers, iw.finish)
+	}
+	if l.SSI != nil {
+		// the includes are processed first, so that the other filters apply
+		// to the included content.
+		ssw := newSSIWriter(w, r, l.SSI, L)
+		w = ssw
+		finishers = append(finishers, ssw.finish)
+	}
+
+	finish := func() error {
+		// the outermost writer must be finished first, as it writes what it
+		// held back to the ones it wraps.
+		for i := len(finishers) - 1; i >= 0; i-- {
+			if err := finishers[i](); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return w, finish, nil
+}
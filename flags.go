@@ -0,0 +1,325 @@
+package lua
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	lua "github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultFlagsFileRefresh   = 5 * time.Second
+	defaultFlagsRemoteRefresh = time.Minute
+
+	// defaultFlagBucketBy is the context attribute used to assign requests to
+	// the percentage rollout of a flag when none is configured.
+	defaultFlagBucketBy = "id"
+)
+
+// FeatureFlags configures the feature flags available to scripts via
+// caddy.flags.enabled(name[, context]). The flags are defined in a JSON or
+// YAML document (based on the .yaml or .yml extension, or the Content-Type
+// for URLs) loaded from Source, a file path or http(s) URL. Files are
+// reloaded when their modification time changes and URLs are fetched again,
+// every RefreshInterval (default 5s for files, 1m for URLs). The document
+// maps the flag names to their definition, e.g.:
+//
+//	new-checkout:
+//	  enabled: true
+//	  rollout: 20       # percentage of contexts, by the bucket_by attribute
+//	  bucket_by: user   # default "id"
+//	  rules:            # all rules must match
+//	    - attribute: country
+//	      in: [CA, US]
+//	    - attribute: plan
+//	      not_in: [free]
+type FeatureFlags struct {
+	Source          string         `json:"source,omitempty"`
+	RefreshInterval caddy.Duration `json:"refresh_interval,omitempty"`
+}
+
+// unmarshalCaddyfile sets up the feature flags from the option's tokens.
+func (ff *FeatureFlags) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.Args(&ff.Source) || d.NextArg() {
+		return d.Errf("flags: %w", d.ArgErr())
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch field := d.Val(); field {
+		case "refresh_interval":
+			var v string
+			if !d.Args(&v) || d.NextArg() {
+				return d.Errf("flags %s: %w", field, d.ArgErr())
+			}
+			dur, err := caddy.ParseDuration(v)
+			if err != nil {
+				return d.Errf("flags %s: %w", field, err)
+			}
+			ff.RefreshInterval = caddy.Duration(dur)
+
+		default:
+			return d.Errf("flags %s: unknown configuration option", field)
+		}
+	}
+	return nil
+}
+
+// isRemote returns true if the source of the flags is a URL.
+func (ff *FeatureFlags) isRemote() bool {
+	return strings.HasPrefix(ff.Source, "http://") || strings.HasPrefix(ff.Source, "https://")
+}
+
+// flagDef is the definition of a feature flag.
+type flagDef struct {
+	Enabled  bool       `json:"enabled" yaml:"enabled"`
+	Rollout  *float64   `json:"rollout,omitempty" yaml:"rollout,omitempty"`
+	BucketBy string     `json:"bucket_by,omitempty" yaml:"bucket_by,omitempty"`
+	Rules    []flagRule `json:"rules,omitempty" yaml:"rules,omitempty"`
+}
+
+// flagRule targets the contexts whose attribute is (or is not) one of a list
+// of values.
+type flagRule struct {
+	Attribute string   `json:"attribute" yaml:"attribute"`
+	In        []string `json:"in,omitempty" yaml:"in,omitempty"`
+	NotIn     []string `json:"not_in,omitempty" yaml:"not_in,omitempty"`
+}
+
+// parseFlagDefs parses the flag definitions in data, in YAML if isYAML is
+// true, JSON otherwise.
+func parseFlagDefs(data []byte, isYAML bool) (map[string]*flagDef, error) {
+	var defs map[string]*flagDef
+	var err error
+	if isYAML {
+		err = yaml.UnmarshalStrict(data, &defs)
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&defs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for name, def := range defs {
+		if def == nil {
+			return nil, fmt.Errorf("flag %s: definition is empty", name)
+		}
+		if def.Rollout != nil && (*def.Rollout < 0 || *def.Rollout > 100) {
+			return nil, fmt.Errorf("flag %s: rollout must be between 0 and 100, got %v", name, *def.Rollout)
+		}
+		for i, rule := range def.Rules {
+			if rule.Attribute == "" {
+				return nil, fmt.Errorf("flag %s: rule %d: the attribute is required", name, i)
+			}
+		}
+	}
+	return defs, nil
+}
+
+// enabled evaluates the flag named name for the context attributes attrs.
+func (def *flagDef) enabled(name string, attrs map[string]string) bool {
+	if !def.Enabled {
+		return false
+	}
+	for _, rule := range def.Rules {
+		v, ok := attrs[rule.Attribute]
+		if rule.In != nil && (!ok || !containsString(rule.In, v)) {
+			return false
+		}
+		if rule.NotIn != nil && ok && containsString(rule.NotIn, v) {
+			return false
+		}
+	}
+	if def.Rollout == nil || *def.Rollout >= 100 {
+		return true
+	}
+
+	by := def.BucketBy
+	if by == "" {
+		by = defaultFlagBucketBy
+	}
+	key, ok := attrs[by]
+	if !ok {
+		return false
+	}
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	return float64(h.Sum64()%10000) < *def.Rollout*100
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// featureFlags is the runtime state of FeatureFlags.
+type featureFlags struct {
+	cfg     *FeatureFlags
+	logger  *zap.Logger
+	defs    atomic.Value // map[string]*flagDef
+	modTime time.Time
+	cancel  context.CancelFunc
+}
+
+// newFeatureFlags loads the flags described by cfg and starts their
+// background refresh.
+func newFeatureFlags(cfg *FeatureFlags, logger *zap.Logger) (*featureFlags, error) {
+	ff := &featureFlags{cfg: cfg, logger: logger}
+	if err := ff.load(context.Background()); err != nil {
+		return nil, fmt.Errorf("loading flags from %s: %w", cfg.Source, err)
+	}
+
+	period := time.Duration(cfg.RefreshInterval)
+	if period <= 0 {
+		period = defaultFlagsFileRefresh
+		if cfg.isRemote() {
+			period = defaultFlagsRemoteRefresh
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ff.cancel = cancel
+	go ff.refreshEvery(ctx, period)
+	return ff, nil
+}
+
+// stop stops the background refresh of the flags.
+func (ff *featureFlags) stop() {
+	ff.cancel()
+}
+
+func (ff *featureFlags) refreshEvery(ctx context.Context, period time.Duration) {
+	t := time.NewTicker(period)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := ff.load(ctx); err != nil {
+				ff.logger.Error("reloading flags, keeping the previous definitions",
+					zap.String("source", ff.cfg.Source), zap.Error(err))
+			}
+		}
+	}
+}
+
+// load reads the flag definitions from the source, if it changed.
+func (ff *featureFlags) load(ctx context.Context) error {
+	var (
+		data    []byte
+		isYAML  bool
+		modTime time.Time
+		err     error
+	)
+	if ff.cfg.isRemote() {
+		data, isYAML, err = fetchFlagDefs(ctx, ff.cfg.Source)
+	} else {
+		var fi os.FileInfo
+		if fi, err = os.Stat(ff.cfg.Source); err != nil {
+			return err
+		}
+		if fi.ModTime().Equal(ff.modTime) {
+			return nil
+		}
+		modTime = fi.ModTime()
+		data, err = os.ReadFile(ff.cfg.Source)
+		isYAML = isYAMLPath(ff.cfg.Source)
+	}
+	if err != nil {
+		return err
+	}
+
+	defs, err := parseFlagDefs(data, isYAML)
+	if err != nil {
+		return err
+	}
+	ff.defs.Store(defs)
+	ff.modTime = modTime
+	return nil
+}
+
+func isYAMLPath(p string) bool {
+	ext := strings.ToLower(path.Ext(p))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// flagSourceClient is the HTTP client used to fetch remote flags.
+var flagSourceClient = &http.Client{Timeout: time.Minute}
+
+// fetchFlagDefs fetches the flag definitions document at u.
+func fetchFlagDefs(ctx context.Context, u string) ([]byte, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	resp, err := flagSourceClient.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+
+	isYAML := strings.Contains(resp.Header.Get("Content-Type"), "yaml")
+	if pu, err := url.Parse(u); err == nil && isYAMLPath(pu.Path) {
+		isYAML = true
+	}
+	return data, isYAML, nil
+}
+
+// enabled evaluates the flag named name for the context attributes attrs.
+// Unknown flags are disabled.
+func (ff *featureFlags) enabled(name string, attrs map[string]string) bool {
+	def := ff.defs.Load().(map[string]*flagDef)[name]
+	return def != nil && def.enabled(name, attrs)
+}
+
+var flagsFuncs = map[string]lua.LGFunction{
+	"enabled": flagsEnabled,
+}
+
+// flagsEnabled implements caddy.flags.enabled(name[, context]), context
+// being a table of the attributes used by the flag's rules and rollout.
+func flagsEnabled(L *lua.LState) int {
+	ff := checkRequestContext(L).handler.flags
+	if ff == nil {
+		L.RaiseError("no flags are configured for this handler")
+	}
+	name := L.CheckString(1)
+	var attrs map[string]string
+	if t := L.OptTable(2, nil); t != nil {
+		attrs = make(map[string]string)
+		t.ForEach(func(k, v lua.LValue) {
+			if ks, ok := k.(lua.LString); ok {
+				attrs[string(ks)] = v.String()
+			}
+		})
+	}
+	L.Push(lua.LBool(ff.enabled(name, attrs)))
+	return 1
+}
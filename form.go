@@ -0,0 +1,331 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	multipartPartTypeName = "caddy.multipart_part"
+
+	// defaultMaxMultipartParts is the maximum number of parts of the
+	// multipart bodies read by request:multipart() without a max_parts.
+	defaultMaxMultipartParts = 1000
+)
+
+// requestForm implements request:form(), which returns the table of the
+// first value of each field of the application/x-www-form-urlencoded body,
+// or nil and an error message. Like request:body(), the body is read in
+// memory up to the handler's max_body_size and remains available to the
+// next handler.
+func requestForm(L *lua.LState) int {
+	form, err := parseRequestForm(L)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	t := L.CreateTable(0, len(form))
+	for name, vals := range form {
+		if len(vals) > 0 {
+			t.RawSetString(name, lua.LString(vals[0]))
+		}
+	}
+	L.Push(t)
+	return 1
+}
+
+// requestFormValues implements request:form_values(name), which returns the
+// array of the values of the field of the urlencoded body, or nil and an
+// error message.
+func requestFormValues(L *lua.LState) int {
+	name := L.CheckString(2)
+	form, err := parseRequestForm(L)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(stringArray(L, form[name]))
+	return 1
+}
+
+// parseRequestForm returns the fields of the urlencoded body of the request
+// of L.
+func parseRequestForm(L *lua.LState) (url.Values, error) {
+	rc := checkRequestContext(L)
+	if ct := rc.r.Header.Get("Content-Type"); ct != "" {
+		mt, _, err := mime.ParseMediaType(ct)
+		if err != nil {
+			return nil, err
+		}
+		if mt != "application/x-www-form-urlencoded" {
+			return nil, fmt.Errorf("unexpected content type %s", mt)
+		}
+	}
+	if rc.body == nil {
+		var body []byte
+		var err error
+		unlocked(L, func() { body, err = readRequestBody(rc.r, rc.maxBodySize()) })
+		if err != nil {
+			return nil, err
+		}
+		rc.body = body
+	}
+	return url.ParseQuery(string(rc.body))
+}
+
+// requestMultipart implements request:multipart([opts]), which returns an
+// iterator over the parts of the multipart body, or nil and an error message
+// if the body is not multipart:
+//
+//	for part in request:multipart({max_file_size = 50 * 1024 * 1024}) do
+//		...
+//	end
+//
+// Each part has the name, filename (nil if it is not a file), content_type
+// and headers fields, and the methods read([n]), which streams its content
+// like the body reader, body(), which reads it in memory and returns it as
+// a string, and spool(), which reads it in memory up to the spool_threshold
+// and in a temporary file beyond, and returns its upload (see
+// newUploadValue). They return nil and an error message on failure. A part
+// can only be read until the iterator returns the next one, and the
+// iterator raises an error if the body is malformed.
+//
+// The opts table supports max_file_size, the maximum size of each part
+// (default to the handler's max_body_size), max_memory, the maximum number
+// of bytes read in memory by the body() method of all the parts (default to
+// max_file_size), max_parts (default 1000) and spool_threshold (default to
+// the handler's spool_threshold, or 1MB). Like the body reader, the
+// multipart reader consumes the body.
+func requestMultipart(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	opts := L.OptTable(2, L.NewTable())
+
+	var mt string
+	var params map[string]string
+	var err error
+	if ct := rc.r.Header.Get("Content-Type"); ct != "" {
+		mt, params, err = mime.ParseMediaType(ct)
+	}
+	if err == nil && (mt != "multipart/form-data" && mt != "multipart/mixed" || params["boundary"] == "") {
+		err = errors.New("the request body is not multipart")
+	}
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	mr := &multipartReader{
+		mr:          multipart.NewReader(rc.r.Body, params["boundary"]),
+		maxFileSize: int64(lua.LVAsNumber(opts.RawGetString("max_file_size"))),
+		maxMemory:   int64(lua.LVAsNumber(opts.RawGetString("max_memory"))),
+		maxParts:    int(lua.LVAsNumber(opts.RawGetString("max_parts"))),
+	}
+	if mr.maxFileSize <= 0 {
+		mr.maxFileSize = rc.maxBodySize()
+	}
+	if mr.maxMemory <= 0 {
+		mr.maxMemory = mr.maxFileSize
+	}
+	if mr.maxParts <= 0 {
+		mr.maxParts = defaultMaxMultipartParts
+	}
+	mr.spoolThreshold, mr.spoolDir = rc.spoolOptions(opts)
+	// the body read so far is no longer the body seen by the next handler
+	rc.body = nil
+
+	L.Push(L.NewFunction(func(L *lua.LState) int {
+		var part *multipartPart
+		var err error
+		unlocked(L, func() { part, err = mr.next() })
+		if err != nil {
+			L.RaiseError("request:multipart: %s", err)
+		}
+		if part == nil {
+			L.Push(lua.LNil)
+			return 1
+		}
+		ud := L.NewUserData()
+		ud.Value = part
+		L.SetMetatable(ud, L.GetTypeMetatable(multipartPartTypeName))
+		L.Push(ud)
+		return 1
+	}))
+	return 1
+}
+
+// multipartReader reads the parts of a multipart body within its limits.
+type multipartReader struct {
+	mr          *multipart.Reader
+	maxFileSize int64
+	maxMemory   int64
+	maxParts    int
+
+	// spoolThreshold and spoolDir are the options of part:spool().
+	spoolThreshold int64
+	spoolDir       string
+
+	parts   int
+	memory  int64
+	current *multipartPart
+	done    bool
+}
+
+// next returns the next part of the body, or nil at the end of the body.
+func (mr *multipartReader) next() (*multipartPart, error) {
+	if mr.current != nil {
+		mr.current.closed = true
+		mr.current = nil
+	}
+	if mr.done {
+		return nil, nil
+	}
+	p, err := mr.mr.NextPart()
+	if err == io.EOF {
+		mr.done = true
+		return nil, nil
+	}
+	if err != nil {
+		mr.done = true
+		return nil, err
+	}
+	if mr.parts++; mr.parts > mr.maxParts {
+		mr.done = true
+		return nil, fmt.Errorf("the body has more than %d parts", mr.maxParts)
+	}
+	mr.current = &multipartPart{reader: mr, part: p}
+	return mr.current, nil
+}
+
+// multipartPart is a part of a multipart body.
+type multipartPart struct {
+	reader *multipartReader
+	part   *multipart.Part
+	read   int64
+	closed bool
+}
+
+// readPart reads up to n bytes of the part, returning nil at the end of the
+// part.
+func (mp *multipartPart) readPart(n int) ([]byte, error) {
+	if mp.closed {
+		return nil, errors.New("the part is no longer readable")
+	}
+	if mp.read > mp.reader.maxFileSize {
+		return nil, fmt.Errorf("the part is larger than %d bytes", mp.reader.maxFileSize)
+	}
+	if remaining := mp.reader.maxFileSize - mp.read + 1; int64(n) > remaining {
+		n = int(remaining)
+	}
+	buf := make([]byte, n)
+	read, err := io.ReadFull(mp.part, buf)
+	if mp.read += int64(read); mp.read > mp.reader.maxFileSize {
+		return nil, fmt.Errorf("the part is larger than %d bytes", mp.reader.maxFileSize)
+	}
+	if read > 0 {
+		return buf[:read], nil
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return nil, nil
+}
+
+var multipartPartMethods = map[string]lua.LGFunction{
+	"read":  multipartPartRead,
+	"body":  multipartPartBody,
+	"spool": multipartPartSpool,
+}
+
+// multipartPartIndex implements the __index metamethod of the parts.
+func multipartPartIndex(L *lua.LState) int {
+	mp := checkMultipartPart(L)
+	key := L.CheckString(2)
+	if fn := multipartPartMethods[key]; fn != nil {
+		L.Push(L.NewFunction(fn))
+		return 1
+	}
+	switch key {
+	case "name":
+		L.Push(lua.LString(mp.part.FormName()))
+	case "filename":
+		if name := mp.part.FileName(); name != "" {
+			L.Push(lua.LString(name))
+		} else {
+			L.Push(lua.LNil)
+		}
+	case "content_type":
+		L.Push(lua.LString(mp.part.Header.Get("Content-Type")))
+	case "headers":
+		L.Push(headerToTable(L, http.Header(mp.part.Header)))
+	default:
+		L.Push(lua.LNil)
+	}
+	return 1
+}
+
+func checkMultipartPart(L *lua.LState) *multipartPart {
+	if mp, ok := L.CheckUserData(1).Value.(*multipartPart); ok {
+		return mp
+	}
+	L.ArgError(1, "multipart part expected")
+	return nil
+}
+
+// multipartPartRead implements part:read([n]).
+func multipartPartRead(L *lua.LState) int {
+	mp := checkMultipartPart(L)
+	n := L.OptInt(2, defaultBodyChunkSize)
+	if n <= 0 {
+		L.ArgError(2, "size must be positive")
+	}
+	var b []byte
+	var err error
+	unlocked(L, func() { b, err = mp.readPart(n) })
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	if b == nil {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(lua.LString(b))
+	return 1
+}
+
+// multipartPartBody implements part:body().
+func multipartPartBody(L *lua.LState) int {
+	mp := checkMultipartPart(L)
+	var body []byte
+	for {
+		var b []byte
+		var err error
+		unlocked(L, func() { b, err = mp.readPart(defaultBodyChunkSize) })
+		if err == nil && mp.reader.memory+int64(len(b)) > mp.reader.maxMemory {
+			err = fmt.Errorf("the parts read in memory are larger than %d bytes", mp.reader.maxMemory)
+		}
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		if b == nil {
+			break
+		}
+		mp.reader.memory += int64(len(b))
+		body = append(body, b...)
+	}
+	L.Push(lua.LString(body))
+	return 1
+}
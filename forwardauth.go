@@ -0,0 +1,125 @@
+package lua
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// forwardAuthClient is the HTTP client used to call authentication
+// services. Redirects are not followed, so that redirections to a login page
+// are returned to the client.
+var forwardAuthClient = &http.Client{
+	Timeout: 30 * time.Second,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// hopHeaders are the hop-by-hop headers that are not copied between the
+// requests and responses of the authentication service.
+var hopHeaders = []string{
+	"Connection",
+	"Content-Length",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// caddyForwardAuth implements caddy.forward_auth(url[, copy_headers]), which
+// sends a GET request with the headers of the current request to the
+// authentication service at url, along with the X-Forwarded-Method,
+// X-Forwarded-Uri, X-Forwarded-Host, X-Forwarded-Proto and X-Forwarded-For
+// headers. If the service responds with a 2xx status, the copy_headers of
+// its response (an array of names, or "From>To" to rename them) are set on
+// the current request, removing them if absent, and true is returned.
+// Otherwise, the service's response is sent to the client, the next handler
+// is not called, and false and the status code are returned.
+func caddyForwardAuth(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	authURL := L.CheckString(1)
+	copyHeaders := stringList(L.OptTable(2, L.NewTable()))
+
+	req, err := newForwardAuthRequest(rc.r, authURL)
+	if err != nil {
+		L.ArgError(1, err.Error())
+	}
+	var resp *http.Response
+	unlocked(L, func() { resp, err = forwardAuthClient.Do(req) })
+	if err != nil {
+		L.RaiseError("caddy.forward_auth: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		for _, name := range copyHeaders {
+			from, to := name, name
+			if i := strings.Index(name, ">"); i >= 0 {
+				from, to = strings.TrimSpace(name[:i]), strings.TrimSpace(name[i+1:])
+			}
+			rc.r.Header.Del(to)
+			for _, v := range resp.Header.Values(from) {
+				rc.r.Header.Add(to, v)
+			}
+		}
+		L.Push(lua.LTrue)
+		return 1
+	}
+
+	h := rc.w.Header()
+	for name, vals := range resp.Header {
+		h[name] = vals
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+	rc.w.WriteHeader(resp.StatusCode)
+	rc.wroteHeader = true
+	unlocked(L, func() { _, err = io.Copy(rc.w, resp.Body) })
+	if err != nil {
+		L.RaiseError("caddy.forward_auth: %s", err)
+	}
+	rc.responded = true
+
+	L.Push(lua.LFalse)
+	L.Push(lua.LNumber(resp.StatusCode))
+	return 2
+}
+
+// newForwardAuthRequest returns the request to send to the authentication
+// service at authURL for r.
+func newForwardAuthRequest(r *http.Request, authURL string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, authURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, vals := range r.Header {
+		req.Header[name] = append([]string(nil), vals...)
+	}
+	for _, name := range hopHeaders {
+		req.Header.Del(name)
+	}
+	req.Header.Del("Accept-Encoding")
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Proto", proto)
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+	return req, nil
+}
@@ -0,0 +1,223 @@
+package lua
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// luaHandlers holds the provisioned handlers that have a name, keyed by
+// name, which are managed with the admin API:
+//
+//	GET /lua/handlers: the status of the handlers
+//	GET /lua/handlers/<name>: the status of the handler
+//	POST /lua/handlers/<name>/reload: recompiles the scripts of the handler
+//	POST /lua/handlers/<name>/call/<function>: calls the function of the
+//	admin script of the handler
+//
+// The status of a handler has its scripts, the number of scripts cached from
+// its root and package path, the names of the functions of its admin script
+// and the last error of its scripts, with its traceback.
+//
+// The reload compiles the handler_path and the other scripts of the
+// handler, keeping the previous versions if one of them fails to compile,
+// and drops the cached scripts and the idle states of its pool, so that the
+// modules are loaded again.
+//
+// The admin script of the handler (admin_script) returns a table of
+// maintenance functions, e.g. to flush a cache or rotate data. The call runs
+// the function in its own state, like the timers, with the JSON body of the
+// request (if any) as argument, and responds with its JSON result.
+var luaHandlers = &handlerRegistry{m: make(map[string]*handlerInfo)}
+
+// handlerInfo is the runtime information of a named handler.
+type handlerInfo struct {
+	name    string
+	handler *Lua
+
+	mu        sync.Mutex
+	lastError *lastScriptError
+}
+
+// lastScriptError is the admin API representation of the last error of the
+// scripts of a handler.
+type lastScriptError struct {
+	Time      time.Time `json:"time"`
+	Path      string    `json:"path"`
+	Message   string    `json:"message"`
+	Traceback string    `json:"traceback"`
+}
+
+// handlerStatus is the admin API representation of a handler.
+type handlerStatus struct {
+	Name          string           `json:"name"`
+	Scripts       []string         `json:"scripts"`
+	Root          string           `json:"root,omitempty"`
+	Runtime       string           `json:"runtime,omitempty"`
+	CachedScripts int              `json:"cached_scripts"`
+	Functions     []string         `json:"functions,omitempty"`
+	LastError     *lastScriptError `json:"last_error,omitempty"`
+	CircuitOpen   bool             `json:"circuit_open,omitempty"`
+}
+
+// recordError sets the last error of the handler's scripts.
+func (hi *handlerInfo) recordError(path string, se *scriptError) {
+	hi.mu.Lock()
+	defer hi.mu.Unlock()
+	hi.lastError = &lastScriptError{
+		Time:      time.Now().UTC(),
+		Path:      path,
+		Message:   se.msg,
+		Traceback: se.traceback,
+	}
+}
+
+func (hi *handlerInfo) status() handlerStatus {
+	l := hi.handler
+	st := handlerStatus{Name: hi.name, Scripts: l.scripts.paths(), Root: l.Root, Runtime: l.Runtime}
+	st.CachedScripts = l.protoCache.len()
+	st.CircuitOpen = l.breaker != nil && l.breaker.isOpen()
+	hi.mu.Lock()
+	st.LastError = hi.lastError
+	hi.mu.Unlock()
+	return st
+}
+
+// reload recompiles the scripts of the handler.
+func (hi *handlerInfo) reload() error {
+	l := hi.handler
+	if err := l.scripts.recompile(); err != nil {
+		return err
+	}
+	l.protoCache.clear()
+	if l.pool != nil {
+		l.pool.close()
+	}
+	if l.sharedState != nil {
+		l.sharedState.reset()
+	}
+	return nil
+}
+
+// errNoAdminFunction is returned when the admin script of a handler has no
+// function of the requested name.
+var errNoAdminFunction = errors.New("no such function")
+
+// adminFunctions returns the sorted names of the functions of the handler's
+// admin script.
+func (hi *handlerInfo) adminFunctions() ([]string, error) {
+	var names []string
+	err := hi.withAdminScript(func(L *lua.LState, fns *lua.LTable) error {
+		fns.ForEach(func(k, v lua.LValue) {
+			if _, ok := v.(*lua.LFunction); ok {
+				names = append(names, k.String())
+			}
+		})
+		return nil
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+// call calls the function name of the handler's admin script with arg and
+// returns its result.
+func (hi *handlerInfo) call(name string, arg interface{}) (interface{}, error) {
+	var res interface{}
+	err := hi.withAdminScript(func(L *lua.LState, fns *lua.LTable) error {
+		fn, ok := fns.RawGetString(name).(*lua.LFunction)
+		if !ok {
+			return fmt.Errorf("%w: %s", errNoAdminFunction, name)
+		}
+		if err := L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, fromGo(L, arg)); err != nil {
+			return err
+		}
+		v, err := toGo(L.Get(-1))
+		if err != nil {
+			return fmt.Errorf("the result of %s cannot be converted: %w", name, err)
+		}
+		res = v
+		return nil
+	})
+	return res, err
+}
+
+// withAdminScript runs the handler's admin script in a new state and calls
+// fn with its table of functions.
+func (hi *handlerInfo) withAdminScript(fn func(L *lua.LState, fns *lua.LTable) error) error {
+	l := hi.handler
+	if l.AdminScript == "" {
+		return errors.New("the handler has no admin_script")
+	}
+	timeout := time.Duration(l.ExecutionTimeout)
+	if timeout <= 0 {
+		timeout = defaultTimerTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	L := l.newBaseState()
+	defer L.Close()
+	setBackgroundHandler(L, l)
+	L.SetContext(ctx)
+
+	ret, err := runProto(L, l.scripts.get(l.AdminScript))
+	if err != nil {
+		return err
+	}
+	fns, ok := ret.(*lua.LTable)
+	if !ok {
+		return fmt.Errorf("the admin script must return a table of functions, got %s", ret.Type())
+	}
+	return fn(L, fns)
+}
+
+// handlerRegistry is a concurrency-safe set of handlerInfo keyed by name.
+type handlerRegistry struct {
+	mu sync.Mutex
+	m  map[string]*handlerInfo
+}
+
+// register adds hi to the registry, replacing any existing handler with the
+// same name (e.g. from the configuration being replaced by a reload).
+func (hr *handlerRegistry) register(hi *handlerInfo) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	hr.m[hi.name] = hi
+}
+
+// unregister removes hi from the registry if it is still the registered
+// handler for its name.
+func (hr *handlerRegistry) unregister(hi *handlerInfo) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	if hr.m[hi.name] == hi {
+		delete(hr.m, hi.name)
+	}
+}
+
+func (hr *handlerRegistry) get(name string) *handlerInfo {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	return hr.m[name]
+}
+
+func (hr *handlerRegistry) list() []handlerStatus {
+	hr.mu.Lock()
+	infos := make([]*handlerInfo, 0, len(hr.m))
+	for _, hi := range hr.m {
+		infos = append(infos, hi)
+	}
+	hr.mu.Unlock()
+
+	list := make([]handlerStatus, 0, len(infos))
+	for _, hi := range infos {
+		list = append(list, hi.status())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
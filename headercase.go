@@ -0,0 +1,75 @@
+package lua
+
+import (
+	"net/http"
+	"net/textproto"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// headerCaseWriter writes the response header names listed in names with
+// their exact casing instead of Go's canonical MIME casing, e.g. X-API-Key
+// instead of X-Api-Key. Only HTTP/1.x responses are affected, as HTTP/2 and
+// HTTP/3 header names are always lowercase.
+type headerCaseWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	names       []string
+	wroteHeader bool
+}
+
+func newHeaderCaseWriter(w http.ResponseWriter, names []string) *headerCaseWriter {
+	return &headerCaseWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		names:                 names,
+	}
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (hw *headerCaseWriter) WriteHeader(status int) {
+	if hw.wroteHeader {
+		return
+	}
+	hw.wroteHeader = true
+	setHeaderCase(hw.Header(), hw.names)
+	hw.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter.
+func (hw *headerCaseWriter) Write(p []byte) (int, error) {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return hw.ResponseWriter.Write(p)
+}
+
+// setHeaderCase moves the values of the headers in h to the exact casing of
+// names.
+func setHeaderCase(h http.Header, names []string) {
+	for _, name := range names {
+		canonical := textproto.CanonicalMIMEHeaderKey(name)
+		if canonical == name {
+			continue
+		}
+		if vals, ok := h[canonical]; ok {
+			delete(h, canonical)
+			h[name] = append(h[name], vals...)
+		}
+	}
+}
+
+// caddyHeaderCase implements caddy.header_case(name...), which sets the exact
+// casing of the names of response headers, in addition to the header_case
+// option of the handler.
+func caddyHeaderCase(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	for i := 1; i <= L.GetTop(); i++ {
+		rc.headerCase = append(rc.headerCase, L.CheckString(i))
+	}
+	return 0
+}
+
+// interface guards
+var (
+	_ caddyhttp.HTTPInterfaces = (*headerCaseWriter)(nil)
+)
@@ -0,0 +1,202 @@
+package lua
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	defaultHealthCacheTTL = 5 * time.Second
+	defaultHealthTimeout  = 5 * time.Second
+)
+
+// Health configures a composite health endpoint. Requests to Path run the
+// handler's script, which registers its checks with
+// caddy.health.register(name, fn), then each check is called and the
+// aggregated status is returned as JSON, with a 503 status code if any
+// check failed. A check succeeds if it returns a true value; it fails if it
+// returns false or nil and an optional error message, raises an error or
+// runs longer than Timeout (default 5s). Results are cached for CacheTTL
+// (default 5s, negative to disable).
+type Health struct {
+	Path     string         `json:"path,omitempty"`
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+	Timeout  caddy.Duration `json:"timeout,omitempty"`
+}
+
+// unmarshalCaddyfile sets up the health endpoint from the option's tokens.
+func (h *Health) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.Args(&h.Path) || d.NextArg() {
+		return d.Errf("health: %w", d.ArgErr())
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var dst *caddy.Duration
+		switch field := d.Val(); field {
+		case "cache_ttl":
+			dst = &h.CacheTTL
+		case "timeout":
+			dst = &h.Timeout
+		default:
+			return d.Errf("health %s: unknown configuration option", field)
+		}
+		var v string
+		if !d.Args(&v) || d.NextArg() {
+			return d.Errf("health %s: %w", d.Val(), d.ArgErr())
+		}
+		dur, err := caddy.ParseDuration(v)
+		if err != nil {
+			return d.Errf("health %s: %w", d.Val(), err)
+		}
+		*dst = caddy.Duration(dur)
+	}
+	return nil
+}
+
+// healthCheck is a check registered by a script.
+type healthCheck struct {
+	name string
+	fn   *lua.LFunction
+}
+
+// healthCheckResult is the JSON representation of the result of a check.
+type healthCheckResult struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// healthReport is the JSON representation of the aggregated status.
+type healthReport struct {
+	Status string                       `json:"status"`
+	Checks map[string]healthCheckResult `json:"checks"`
+}
+
+// healthEndpoint is the runtime state of Health.
+type healthEndpoint struct {
+	cfg *Health
+
+	mu      sync.Mutex
+	expires time.Time
+	status  int
+	body    []byte
+}
+
+// serve writes the aggregated status of the checks registered in L.
+func (he *healthEndpoint) serve(w http.ResponseWriter, L *lua.LState, checks []healthCheck) error {
+	he.mu.Lock()
+	defer he.mu.Unlock()
+
+	if time.Now().After(he.expires) {
+		report := runHealthChecks(L, checks, he.timeout())
+		body, err := json.Marshal(report)
+		if err != nil {
+			return err
+		}
+		he.status, he.body = http.StatusOK, append(body, '\n')
+		if report.Status != "ok" {
+			he.status = http.StatusServiceUnavailable
+		}
+		he.expires = time.Now().Add(he.cacheTTL())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(he.status)
+	_, err := w.Write(he.body)
+	return err
+}
+
+func (he *healthEndpoint) cacheTTL() time.Duration {
+	if he.cfg.CacheTTL == 0 {
+		return defaultHealthCacheTTL
+	}
+	return time.Duration(he.cfg.CacheTTL)
+}
+
+func (he *healthEndpoint) timeout() time.Duration {
+	if he.cfg.Timeout <= 0 {
+		return defaultHealthTimeout
+	}
+	return time.Duration(he.cfg.Timeout)
+}
+
+// runHealthChecks calls each check in L and returns the report.
+func runHealthChecks(L *lua.LState, checks []healthCheck, timeout time.Duration) healthReport {
+	report := healthReport{Status: "ok", Checks: make(map[string]healthCheckResult, len(checks))}
+	sort.SliceStable(checks, func(i, j int) bool { return checks[i].name < checks[j].name })
+	for _, c := range checks {
+		start := time.Now()
+		errMsg := runHealthCheck(L, c.fn, timeout)
+		res := healthCheckResult{
+			Status:    "ok",
+			LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			Error:     errMsg,
+		}
+		if errMsg != "" {
+			res.Status = "fail"
+			report.Status = "fail"
+		}
+		report.Checks[c.name] = res
+	}
+	return report
+}
+
+// runHealthCheck calls fn and returns the error message of the failure, or
+// an empty string if the check succeeded.
+func runHealthCheck(L *lua.LState, fn *lua.LFunction, timeout time.Duration) string {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	prev := L.RemoveContext()
+	L.SetContext(ctx)
+	defer func() {
+		if L.RemoveContext(); prev != nil {
+			L.SetContext(prev)
+		}
+	}()
+
+	if err := L.CallByParam(lua.P{Fn: fn, NRet: 2, Protect: true}); err != nil {
+		if ctx.Err() != nil {
+			return "check timed out"
+		}
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			return lua.LVAsString(apiErr.Object)
+		}
+		return err.Error()
+	}
+	ok, msg := L.Get(-2), L.Get(-1)
+	L.Pop(2)
+	if lua.LVAsBool(ok) {
+		return ""
+	}
+	if msg != lua.LNil {
+		return lua.LVAsString(msg)
+	}
+	return "check failed"
+}
+
+var healthFuncs = map[string]lua.LGFunction{
+	"register": healthRegister,
+}
+
+// healthRegister implements caddy.health.register(name, fn). Registering a
+// name again replaces its check.
+func healthRegister(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	c := healthCheck{name: L.CheckString(1), fn: L.CheckFunction(2)}
+	for i := range rc.healthChecks {
+		if rc.healthChecks[i].name == c.name {
+			rc.healthChecks[i] = c
+			return 0
+		}
+	}
+	rc.healthChecks = append(rc.healthChecks, c)
+	return 0
+}
@@ -0,0 +1,543 @@
+package lua
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func init() {
+	caddy.RegisterModule(GlobalHTTPClient{})
+	httpcaddyfile.RegisterGlobalOption("lua_http_client", parseGlobalHTTPClientOption)
+}
+
+const (
+	defaultHTTPClientTimeout = 30 * time.Second
+
+	// httpClientKey is the registry key of the HTTP client of the states
+	// that do not handle requests.
+	httpClientKey = "caddy.http_client"
+
+	// maxHTTPResponseSize is the maximum size of the response bodies read by
+	// the http module.
+	maxHTTPResponseSize = 10 << 20
+)
+
+// HTTPClient configures the HTTP client of the http module, used by scripts
+// to call other services:
+//
+//	local http = require("http")
+//	local resp, err = http.get(url[, opts])
+//	local resp, err = http.post(url, body[, opts])
+//	local resp, err = http.request(opts)
+//
+// The opts table supports the method (default GET), url, headers (table of
+// names to string or array of strings), body and timeout (in seconds,
+// default Timeout or 30s) of the request, which is canceled if the client's
+// request is or if the script's execution_timeout expires. The response is
+// returned as a table with the status, headers and body fields, or nil and
+// an error message on failure. Redirects are followed.
+//
+// The connections are pooled per handler, with up to MaxIdleConns idle
+// connections (MaxIdleConnsPerHost per host) kept for IdleConnTimeout. The
+// servers' certificates are verified with the certificates of the PEM file
+// CAFile if set, instead of the system's, or not at all if
+// InsecureSkipVerify is true. The TLS connections to the hosts of
+// Destinations use the client certificate, root CAs and server name of
+// their destination, e.g. to call the internal services that require mTLS.
+// The destinations of the lua_http_client app apply to the clients of all
+// the handlers, after their own (see GlobalHTTPClient).
+type HTTPClient struct {
+	Timeout             caddy.Duration    `json:"timeout,omitempty"`
+	MaxIdleConns        int               `json:"max_idle_conns,omitempty"`
+	MaxIdleConnsPerHost int               `json:"max_idle_conns_per_host,omitempty"`
+	IdleConnTimeout     caddy.Duration    `json:"idle_conn_timeout,omitempty"`
+	CAFile              string            `json:"ca_file,omitempty"`
+	InsecureSkipVerify  bool              `json:"insecure_skip_verify,omitempty"`
+	Destinations        []HTTPDestination `json:"destinations,omitempty"`
+}
+
+// HTTPDestination configures the TLS connections of the HTTP client to
+// Hosts, which are host names (e.g. api.internal, or *.internal for its
+// subdomains), optionally with a port. The client presents the certificate
+// of the PEM files CertFile and KeyFile, if set, and verifies the servers'
+// certificates with those of CAFile, if set, instead of the client's CAs.
+// ServerName overrides the name sent with SNI and verified in the server's
+// certificate, which is the host of the URL by default. The files are
+// loaded when the client is provisioned. The first destination with a
+// matching host applies. In the Caddyfile, the destinations are blocks of
+// http_client:
+//
+//	http_client {
+//		destination api.internal:8443 *.svc.internal {
+//			cert_file /etc/caddy/client.pem
+//			key_file /etc/caddy/client.key
+//			ca_file /etc/caddy/internal-ca.pem
+//			server_name api.internal
+//		}
+//	}
+type HTTPDestination struct {
+	Hosts      []string `json:"hosts,omitempty"`
+	CertFile   string   `json:"cert_file,omitempty"`
+	KeyFile    string   `json:"key_file,omitempty"`
+	CAFile     string   `json:"ca_file,omitempty"`
+	ServerName string   `json:"server_name,omitempty"`
+}
+
+// unmarshalCaddyfile sets up the HTTP client from the block's tokens.
+func (hc *HTTPClient) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		field := d.Val()
+		if field == "insecure_skip_verify" {
+			if d.NextArg() {
+				return d.Errf("http_client %s: %w", field, d.ArgErr())
+			}
+			hc.InsecureSkipVerify = true
+			continue
+		}
+		if field == "destination" {
+			var dest HTTPDestination
+			if err := dest.unmarshalCaddyfile(d); err != nil {
+				return err
+			}
+			hc.Destinations = append(hc.Destinations, dest)
+			continue
+		}
+
+		var v string
+		if !d.Args(&v) || d.NextArg() {
+			return d.Errf("http_client %s: %w", field, d.ArgErr())
+		}
+		var err error
+		switch field {
+		case "timeout":
+			err = parseCaddyDuration(v, &hc.Timeout)
+		case "idle_conn_timeout":
+			err = parseCaddyDuration(v, &hc.IdleConnTimeout)
+		case "max_idle_conns":
+			hc.MaxIdleConns, err = strconv.Atoi(v)
+		case "max_idle_conns_per_host":
+			hc.MaxIdleConnsPerHost, err = strconv.Atoi(v)
+		case "ca_file":
+			hc.CAFile = v
+		default:
+			return d.Errf("http_client %s: unknown configuration option", field)
+		}
+		if err != nil {
+			return d.Errf("http_client %s: %w", field, err)
+		}
+	}
+	return nil
+}
+
+// unmarshalCaddyfile sets up the destination from the tokens of its
+// block, whose arguments are its hosts.
+func (dest *HTTPDestination) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	dest.Hosts = d.RemainingArgs()
+	if len(dest.Hosts) == 0 {
+		return d.Errf("http_client destination: %w", d.ArgErr())
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		field := d.Val()
+		var v string
+		if !d.Args(&v) || d.NextArg() {
+			return d.Errf("http_client destination %s: %w", field, d.ArgErr())
+		}
+		switch field {
+		case "cert_file":
+			dest.CertFile = v
+		case "key_file":
+			dest.KeyFile = v
+		case "ca_file":
+			dest.CAFile = v
+		case "server_name":
+			dest.ServerName = v
+		default:
+			return d.Errf("http_client destination %s: unknown configuration option", field)
+		}
+	}
+	return nil
+}
+
+func parseCaddyDuration(s string, dst *caddy.Duration) error {
+	dur, err := caddy.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*dst = caddy.Duration(dur)
+	return nil
+}
+
+// newHTTPClient returns the client configured by cfg, which may be nil,
+// with the destinations of cfg and then global.
+func newHTTPClient(cfg *HTTPClient, global []HTTPDestination) (*http.Client, error) {
+	if cfg == nil {
+		cfg = new(HTTPClient)
+	}
+	tr := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       time.Duration(cfg.IdleConnTimeout),
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	if tr.MaxIdleConns == 0 {
+		tr.MaxIdleConns = 100
+	}
+	if tr.IdleConnTimeout == 0 {
+		tr.IdleConnTimeout = 90 * time.Second
+	}
+	if cfg.CAFile != "" || cfg.InsecureSkipVerify {
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+		if cfg.CAFile != "" {
+			pool, err := loadCertPool(cfg.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			tr.TLSClientConfig.RootCAs = pool
+		}
+	}
+
+	var rt http.RoundTripper = tr
+	dests := append(append([]HTTPDestination(nil), cfg.Destinations...), global...)
+	if len(dests) > 0 {
+		dt := &destinationTransport{base: tr}
+		for i, dest := range dests {
+			dtr, err := dest.transport(tr)
+			if err != nil {
+				return nil, fmt.Errorf("destination %d: %w", i, err)
+			}
+			dt.destinations = append(dt.destinations, destinationRoute{hosts: dest.Hosts, transport: dtr})
+		}
+		rt = dt
+	}
+
+	timeout := time.Duration(cfg.Timeout)
+	if timeout <= 0 {
+		timeout = defaultHTTPClientTimeout
+	}
+	return &http.Client{Transport: rt, Timeout: timeout}, nil
+}
+
+// loadCertPool returns the pool of the certificates of the PEM file path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate in %s", path)
+	}
+	return pool, nil
+}
+
+// GlobalHTTPClient is an app that holds the settings of the HTTP clients of
+// all the Lua handlers: the TLS connections of the clients to the hosts of
+// its Destinations use their destination (see HTTPDestination), after the
+// destinations of the http_client of the handler. In the Caddyfile, it is
+// the lua_http_client global option, whose blocks are the destinations:
+//
+//	{
+//		lua_http_client {
+//			destination *.svc.internal {
+//				cert_file /etc/caddy/client.pem
+//				key_file /etc/caddy/client.key
+//				ca_file /etc/caddy/internal-ca.pem
+//			}
+//		}
+//	}
+type GlobalHTTPClient struct {
+	Destinations []HTTPDestination `json:"destinations,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (GlobalHTTPClient) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "lua_http_client",
+		New: func() caddy.Module { return new(GlobalHTTPClient) },
+	}
+}
+
+// Start implements caddy.App.
+func (*GlobalHTTPClient) Start() error { return nil }
+
+// Stop implements caddy.App.
+func (*GlobalHTTPClient) Stop() error { return nil }
+
+var _ caddy.App = (*GlobalHTTPClient)(nil)
+
+// parseGlobalHTTPClientOption sets up the GlobalHTTPClient app from the
+// lua_http_client global option.
+func parseGlobalHTTPClientOption(d *caddyfile.Dispenser, _ interface{}) (interface{}, error) {
+	var hc GlobalHTTPClient
+	for d.Next() {
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			if field := d.Val(); field != "destination" {
+				return nil, d.Errf("%s: unknown configuration option", field)
+			}
+			var dest HTTPDestination
+			if err := dest.unmarshalCaddyfile(d); err != nil {
+				return nil, err
+			}
+			hc.Destinations = append(hc.Destinations, dest)
+		}
+	}
+	return httpcaddyfile.App{
+		Name:  "lua_http_client",
+		Value: caddyconfig.JSON(hc, nil),
+	}, nil
+}
+
+// globalHTTPDestinations returns the destinations of the lua_http_client
+// app, if it is configured.
+func globalHTTPDestinations(ctx caddy.Context) ([]HTTPDestination, error) {
+	if !ctx.AppIsConfigured("lua_http_client") {
+		return nil, nil
+	}
+	app, err := ctx.App("lua_http_client")
+	if err != nil {
+		return nil, err
+	}
+	return app.(*GlobalHTTPClient).Destinations, nil
+}
+
+// transport returns a clone of base whose TLS connections are configured by
+// the destination.
+func (dest HTTPDestination) transport(base *http.Transport) (*http.Transport, error) {
+	if len(dest.Hosts) == 0 {
+		return nil, errors.New("the hosts are required")
+	}
+	if (dest.CertFile == "") != (dest.KeyFile == "") {
+		return nil, errors.New("the cert_file and key_file must be set together")
+	}
+	cfg := new(tls.Config)
+	if base.TLSClientConfig != nil {
+		cfg = base.TLSClientConfig.Clone()
+	}
+	if dest.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(dest.CertFile, dest.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if dest.CAFile != "" {
+		pool, err := loadCertPool(dest.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	cfg.ServerName = dest.ServerName
+	tr := base.Clone()
+	tr.TLSClientConfig = cfg
+	return tr, nil
+}
+
+// destinationTransport sends the requests to the hosts of its destinations
+// with the transport of their destination, and the others with base. Each
+// transport pools its own connections.
+type destinationTransport struct {
+	base         *http.Transport
+	destinations []destinationRoute
+}
+
+// destinationRoute is the transport of the hosts of a destination.
+type destinationRoute struct {
+	hosts     []string
+	transport *http.Transport
+}
+
+// RoundTrip implements http.RoundTripper.
+func (dt *destinationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return dt.transportFor(req.URL).RoundTrip(req)
+}
+
+// transportFor returns the transport of the first destination with a host
+// that matches u, or the base transport.
+func (dt *destinationTransport) transportFor(u *url.URL) *http.Transport {
+	name := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	for _, dest := range dt.destinations {
+		for _, h := range dest.hosts {
+			if matchDestinationHost(strings.ToLower(h), name, port) {
+				return dest.transport
+			}
+		}
+	}
+	return dt.base
+}
+
+// matchDestinationHost returns true if the host pattern of a destination
+// matches the host name and port of a URL.
+func matchDestinationHost(pattern, name, port string) bool {
+	if h, p, err := net.SplitHostPort(pattern); err == nil {
+		if p != port {
+			return false
+		}
+		pattern = h
+	}
+	if suffix := strings.TrimPrefix(pattern, "*"); suffix != pattern {
+		return strings.HasPrefix(suffix, ".") && strings.HasSuffix(name, suffix) && len(name) > len(suffix)
+	}
+	return pattern == name
+}
+
+// CloseIdleConnections closes the idle connections of all the transports.
+func (dt *destinationTransport) CloseIdleConnections() {
+	dt.base.CloseIdleConnections()
+	for _, dest := range dt.destinations {
+		dest.transport.CloseIdleConnections()
+	}
+}
+
+// preloadHTTPModule registers the http module, loaded by scripts with
+// require("http").
+func preloadHTTPModule(L *lua.LState) {
+	L.PreloadModule("http", func(L *lua.LState) int {
+		L.Push(L.SetFuncs(L.NewTable(), httpFuncs))
+		return 1
+	})
+}
+
+var httpFuncs = map[string]lua.LGFunction{
+	"get":     httpGet,
+	"post":    httpPost,
+	"request": httpRequest,
+}
+
+// httpGet implements http.get(url[, opts]).
+func httpGet(L *lua.LState) int {
+	opts := L.OptTable(2, L.NewTable())
+	opts.RawSetString("method", lua.LString(http.MethodGet))
+	opts.RawSetString("url", lua.LString(L.CheckString(1)))
+	return doHTTPRequest(L, opts)
+}
+
+// httpPost implements http.post(url, body[, opts]).
+func httpPost(L *lua.LState) int {
+	opts := L.OptTable(3, L.NewTable())
+	opts.RawSetString("method", lua.LString(http.MethodPost))
+	opts.RawSetString("url", lua.LString(L.CheckString(1)))
+	opts.RawSetString("body", lua.LString(L.CheckString(2)))
+	return doHTTPRequest(L, opts)
+}
+
+// httpRequest implements http.request(opts).
+func httpRequest(L *lua.LState) int {
+	return doHTTPRequest(L, L.CheckTable(1))
+}
+
+// doHTTPRequest sends the request described by opts with the handler's
+// client, or the client stored under httpClientKey in the registry of L if
+// it does not handle requests, and pushes the response table, or nil and an
+// error message.
+func doHTTPRequest(L *lua.LState, opts *lua.LTable) int {
+	ctx := stateContext(L)
+	var client *http.Client
+	if ud, ok := L.G.Registry.RawGetString(httpClientKey).(*lua.LUserData); ok {
+		client = ud.Value.(*http.Client)
+	} else {
+		client = checkHandler(L).httpClient
+		ctx = checkContext(L)
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	resp, err := sendHTTPRequest(L, ctx, client, opts)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	t := L.CreateTable(0, 3)
+	t.RawSetString("status", lua.LNumber(resp.statusCode()))
+	t.RawSetString("headers", headerToTable(L, resp.header))
+	t.RawSetString("body", lua.LString(resp.body.String()))
+	L.Push(t)
+	return 1
+}
+
+// sendHTTPRequest sends the request described by opts with client, and
+// returns the buffered response. The other requests of the shared state of L
+// run while it waits for the response.
+func sendHTTPRequest(L *lua.LState, ctx context.Context, client *http.Client, opts *lua.LTable) (*responseBuffer, error) {
+	u := lua.LVAsString(opts.RawGetString("url"))
+	if u == "" {
+		return nil, errors.New("the url is required")
+	}
+	method := strings.ToUpper(lua.LVAsString(opts.RawGetString("method")))
+	if method == "" {
+		method = http.MethodGet
+	}
+	if n, ok := opts.RawGetString("timeout").(lua.LNumber); ok && n > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(float64(n)*float64(time.Second)))
+		defer cancel()
+	}
+
+	var body io.Reader
+	if b, ok := opts.RawGetString("body").(lua.LString); ok {
+		body = strings.NewReader(string(b))
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if h := optTable(opts.RawGetString("headers")); h != nil {
+		tableToHeader(h, req.Header)
+	}
+	injectTraceContext(ctx, req.Header)
+
+	rb := newResponseBuffer()
+	unlocked(L, func() {
+		var resp *http.Response
+		if resp, err = client.Do(req); err != nil {
+			return
+		}
+		defer resp.Body.Close()
+		rb.header = resp.Header
+		rb.status = resp.StatusCode
+		_, err = io.Copy(&rb.body, io.LimitReader(resp.Body, maxHTTPResponseSize+1))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if rb.body.Len() > maxHTTPResponseSize {
+		return nil, fmt.Errorf("response body is larger than %d bytes", maxHTTPResponseSize)
+	}
+	return rb, nil
+}
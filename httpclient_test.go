@@ -0,0 +1,218 @@
+package lua
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+// writeClientCert writes a self-signed client certificate and its key to
+// dir, and returns the paths of their PEM files.
+func writeClientCert(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestHTTPClientDestinations(t *testing.T) {
+	var serverName string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+		}
+	}))
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAnyClientCert,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, nil
+		},
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	certFile, keyFile := writeClientCert(t, dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := HTTPDestination{
+		Hosts:      []string{u.Host},
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		CAFile:     caFile,
+		ServerName: "example.com",
+	}
+
+	for name, client := range map[string]func() (*http.Client, error){
+		"handler": func() (*http.Client, error) {
+			return newHTTPClient(&HTTPClient{Destinations: []HTTPDestination{dest}}, nil)
+		},
+		"global": func() (*http.Client, error) {
+			return newHTTPClient(&HTTPClient{Destinations: []HTTPDestination{{Hosts: []string{"other.internal"}}}}, []HTTPDestination{dest})
+		},
+	} {
+		c, err := client()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != "client" || serverName != "example.com" {
+			t.Errorf("%s: got the client %q and the server name %q", name, b, serverName)
+		}
+		c.CloseIdleConnections()
+	}
+
+	// the other hosts are verified with the system's CAs
+	c, err := newHTTPClient(&HTTPClient{Destinations: []HTTPDestination{{Hosts: []string{"other.internal"}, CAFile: caFile}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := c.Get(srv.URL); err == nil {
+		resp.Body.Close()
+		t.Error("got a response, want the certificate of the server to be unknown")
+	}
+
+	if _, err := newHTTPClient(&HTTPClient{Destinations: []HTTPDestination{{Hosts: []string{"x"}, CertFile: certFile}}}, nil); err == nil {
+		t.Error("got no error for a cert_file without key_file")
+	}
+}
+
+func TestMatchDestinationHost(t *testing.T) {
+	cases := []struct {
+		pattern, name, port string
+		want                bool
+	}{
+		{"api.internal", "api.internal", "443", true},
+		{"api.internal:8443", "api.internal", "443", false},
+		{"api.internal:8443", "api.internal", "8443", true},
+		{"*.internal", "api.internal", "443", true},
+		{"*.internal", "internal", "443", false},
+		{"*.internal:443", "a.b.internal", "443", true},
+		{"api.internal", "web.internal", "443", false},
+	}
+	for _, c := range cases {
+		if got := matchDestinationHost(c.pattern, c.name, c.port); got != c.want {
+			t.Errorf("%s %s:%s: got %t, want %t", c.pattern, c.name, c.port, got, c.want)
+		}
+	}
+}
+
+func TestHTTPClientDestinationCaddyfile(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`lua {
+		http_client {
+			timeout 5s
+			destination api.internal:8443 *.svc.internal {
+				cert_file client.pem
+				key_file client.key
+				ca_file ca.pem
+				server_name api.internal
+			}
+		}
+	}`)
+	var l Lua
+	if err := l.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	want := []HTTPDestination{{
+		Hosts:      []string{"api.internal:8443", "*.svc.internal"},
+		CertFile:   "client.pem",
+		KeyFile:    "client.key",
+		CAFile:     "ca.pem",
+		ServerName: "api.internal",
+	}}
+	if l.HTTPClient == nil || !reflect.DeepEqual(l.HTTPClient.Destinations, want) {
+		t.Errorf("got %+v, want %+v", l.HTTPClient, want)
+	}
+
+	d = caddyfile.NewTestDispenser(`lua {
+		http_client {
+			destination {
+				ca_file ca.pem
+			}
+		}
+	}`)
+	if err := new(Lua).UnmarshalCaddyfile(d); err == nil {
+		t.Error("got no error for a destination without hosts")
+	}
+}
+
+func TestGlobalHTTPClientOption(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`lua_http_client {
+		destination *.svc.internal {
+			cert_file client.pem
+			key_file client.key
+		}
+		destination api.internal {
+			server_name api
+		}
+	}`)
+	v, err := parseGlobalHTTPClientOption(d, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := v.(httpcaddyfile.App)
+	want := `{"destinations":[{"hosts":["*.svc.internal"],"cert_file":"client.pem","key_file":"client.key"},{"hosts":["api.internal"],"server_name":"api"}]}`
+	if app.Name != "lua_http_client" || string(app.Value) != want {
+		t.Errorf("got the app %s %s, want lua_http_client %s", app.Name, app.Value, want)
+	}
+
+	d = caddyfile.NewTestDispenser(`lua_http_client {
+		timeout 5s
+	}`)
+	if _, err := parseGlobalHTTPClientOption(d, nil); err == nil {
+		t.Error("got no error for an unknown option")
+	}
+}
@@ -0,0 +1,169 @@
+package lua
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+
+	lua "github.com/yuin/gopher-lua"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // register the webp decoder
+)
+
+const (
+	imageTypeName = "caddy.image"
+
+	// maxImagePixels is the maximum number of pixels of the images that can
+	// be decoded or created by resizing, to protect against decompression
+	// bombs.
+	maxImagePixels = 50_000_000
+
+	defaultJPEGQuality = 85
+)
+
+var imageFuncs = map[string]lua.LGFunction{
+	"decode": imageDecode,
+}
+
+var imageMethods = map[string]lua.LGFunction{
+	"size":   imageSize,
+	"resize": imageResize,
+	"crop":   imageCrop,
+	"encode": imageEncode,
+}
+
+// openImageType registers the metatable of the image userdata in L.
+func openImageType(L *lua.LState) {
+	mt := L.NewTypeMetatable(imageTypeName)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), imageMethods))
+}
+
+// pushImage pushes img as an image userdata on the stack of L.
+func pushImage(L *lua.LState, img image.Image) {
+	ud := L.NewUserData()
+	ud.Value = img
+	L.SetMetatable(ud, L.GetTypeMetatable(imageTypeName))
+	L.Push(ud)
+}
+
+// checkImage returns the image at position n of the stack of L.
+func checkImage(L *lua.LState, n int) image.Image {
+	ud := L.CheckUserData(n)
+	img, ok := ud.Value.(image.Image)
+	if !ok {
+		L.ArgError(n, "image expected")
+	}
+	return img
+}
+
+// decodeImage decodes a JPEG, PNG or WebP image from data.
+func decodeImage(data []byte) (image.Image, string, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return nil, "", fmt.Errorf("image too large: %dx%d", cfg.Width, cfg.Height)
+	}
+	return image.Decode(bytes.NewReader(data))
+}
+
+// imageDecode implements caddy.image.decode(data), returning the image and
+// its format, or nil and an error message if data is not a supported image.
+func imageDecode(L *lua.LState) int {
+	img, format, err := decodeImage([]byte(L.CheckString(1)))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	pushImage(L, img)
+	L.Push(lua.LString(format))
+	return 2
+}
+
+// imageSize implements img:size(), returning the width and height.
+func imageSize(L *lua.LState) int {
+	b := checkImage(L, 1).Bounds()
+	L.Push(lua.LNumber(b.Dx()))
+	L.Push(lua.LNumber(b.Dy()))
+	return 2
+}
+
+// imageResize implements img:resize(width, height), returning a new image
+// scaled to that size. If either dimension is 0, it is computed to preserve
+// the aspect ratio.
+func imageResize(L *lua.LState) int {
+	img := checkImage(L, 1)
+	w, h := L.CheckInt(2), L.OptInt(3, 0)
+	b := img.Bounds()
+	switch {
+	case w < 0 || h < 0 || (w == 0 && h == 0):
+		L.RaiseError("caddy.image: invalid size %dx%d", w, h)
+	case w == 0:
+		w = max(1, b.Dx()*h/b.Dy())
+	case h == 0:
+		h = max(1, b.Dy()*w/b.Dx())
+	}
+	if w > maxImagePixels || h > maxImagePixels || w*h > maxImagePixels {
+		L.RaiseError("caddy.image: size too large: %dx%d", w, h)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.BiLinear.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	pushImage(L, dst)
+	return 1
+}
+
+// imageCrop implements img:crop(x, y, width, height), returning a new image
+// with the pixels of that rectangle, relative to the top-left corner of img
+// and clipped to its bounds.
+func imageCrop(L *lua.LState) int {
+	img := checkImage(L, 1)
+	x, y, w, h := L.CheckInt(2), L.CheckInt(3), L.CheckInt(4), L.CheckInt(5)
+	b := img.Bounds()
+	r := image.Rect(x, y, x+w, y+h).Add(b.Min).Intersect(b)
+	if r.Empty() {
+		L.RaiseError("caddy.image: empty crop rectangle")
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+	pushImage(L, dst)
+	return 1
+}
+
+// imageEncode implements img:encode(format[, quality]), returning the image
+// encoded as "jpeg" (with quality between 1 and 100) or "png". WebP images
+// can be decoded but not encoded, as there is no pure Go encoder.
+func imageEncode(L *lua.LState) int {
+	img := checkImage(L, 1)
+	var buf bytes.Buffer
+	var err error
+	switch format := L.CheckString(2); format {
+	case "jpeg", "jpg":
+		q := L.OptInt(3, defaultJPEGQuality)
+		if q < 1 || q > 100 {
+			L.ArgError(3, "quality must be between 1 and 100")
+		}
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: q})
+	case "png":
+		err = png.Encode(&buf, img)
+	default:
+		L.ArgError(2, fmt.Sprintf("unsupported encoding format %q", format))
+	}
+	if err != nil {
+		L.RaiseError("caddy.image: %s", err)
+	}
+	L.Push(lua.LString(buf.String()))
+	return 1
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
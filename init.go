@@ -0,0 +1,175 @@
+package lua
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+)
+
+// shutdownHooksKey is the registry key of the functions registered with
+// caddy.on_shutdown, set in the state of the init script.
+const shutdownHooksKey = "caddy.shutdown_hooks"
+
+// initGlobal is a global defined by the init script.
+type initGlobal struct {
+	name  string
+	value interface{}
+}
+
+// runInitScript runs the init script of the handler (init_path) once, and
+// saves the globals that it defines or modifies, which are then defined in
+// all the states of the handler, before the scripts run. It does the
+// expensive setup of the scripts once rather than for each request, e.g.
+// loading lookup tables, building the patterns or preparing the templates:
+//
+//	-- init.lua
+//	local json = require("json")
+//	-- the countries var of the handler, e.g. {env.COUNTRIES}
+//	COUNTRIES = json.decode(config.countries)
+//	function country_name(code) return COUNTRIES[code] or "unknown" end
+//
+// The script runs like the timers, in a state with the handler's modules
+// and the caddy table but no request, and is stopped after the handler's
+// execution_timeout (default 30s). Its error fails the provisioning of the
+// handler. It runs in the sandbox of the handler, if any, so it reads files
+// with io.open only if the sandbox allows io.
+//
+// The globals must be nil, booleans, numbers, strings, tables or Lua
+// functions whose values and upvalues satisfy the same condition, or values
+// of the modules and of the caddy table. Each state gets its own copy of the
+// tables and functions, so the changes that a request makes to them are not
+// seen by the other states (see state_pool for the states that are reused),
+// and the modules are loaded again in each state. The changes to the tables
+// of the standard library and of the caddy table are not kept. The init
+// script is not run again when the scripts are reloaded or watched.
+//
+// The init script registers the functions that release what it acquires,
+// e.g. closes its files, with caddy.on_shutdown(fn). They are called in
+// the state of the init script, kept until then, in the reverse order of
+// their registration when the handler is unloaded, e.g. when the
+// configuration is reloaded, after its timers are stopped and before its
+// database and Redis connections are closed. Each of them is stopped after
+// the handler's execution_timeout (default 30s), and its error is logged.
+//
+// The init script also declares the limits of the requests with
+// caddy.limit(paths, limits), enforced before the scripts run.
+func (l *Lua) runInitScript() error {
+	proto, err := compileFile(l.InitPath)
+	if err != nil {
+		return fmt.Errorf("compiling %s: %w", l.InitPath, err)
+	}
+
+	timeout := time.Duration(l.ExecutionTimeout)
+	if timeout <= 0 {
+		timeout = defaultTimerTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	L := l.newBaseState()
+	hooks := L.NewTable()
+	L.G.Registry.RawSetString(shutdownHooksKey, hooks)
+	defer func() {
+		if hooks.Len() == 0 {
+			L.Close()
+			return
+		}
+		l.initState = L
+	}()
+	setBackgroundHandler(L, l)
+	L.SetContext(ctx)
+
+	libraries := globalNames(L)
+	before := make(map[string]lua.LValue, len(libraries))
+	for _, name := range libraries {
+		before[name] = L.GetGlobal(name)
+	}
+	c := newValueCopier(L, libraries)
+	if _, err := runProto(L, proto); err != nil {
+		return err
+	}
+	c.indexModules(L)
+
+	var globals []initGlobal
+	var cerr error
+	L.G.Global.ForEach(func(k, v lua.LValue) {
+		name, ok := k.(lua.LString)
+		if !ok || cerr != nil || v == before[string(name)] {
+			return
+		}
+		cv, err := c.copy(v)
+		if err != nil {
+			cerr = fmt.Errorf("the global %s cannot be copied: %w", name, err)
+			return
+		}
+		globals = append(globals, initGlobal{name: string(name), value: cv})
+	})
+	if cerr != nil {
+		return cerr
+	}
+	l.initGlobals = globals
+	return nil
+}
+
+// setInitGlobals defines the globals of the init script in L.
+func (l *Lua) setInitGlobals(L *lua.LState) {
+	if len(l.initGlobals) == 0 {
+		return
+	}
+	m := newValueMaker(L)
+	for _, g := range l.initGlobals {
+		L.SetGlobal(g.name, m.value(g.value))
+	}
+}
+
+// caddyOnShutdown implements caddy.on_shutdown(fn).
+func caddyOnShutdown(L *lua.LState) int {
+	fn := L.CheckFunction(1)
+	if fn.IsG {
+		L.ArgError(1, "Lua function expected")
+	}
+	hooks, ok := L.G.Registry.RawGetString(shutdownHooksKey).(*lua.LTable)
+	if !ok {
+		L.RaiseError("caddy.on_shutdown can only be called by the init script")
+	}
+	hooks.Append(fn)
+	return 0
+}
+
+// isInitState returns true if L is the state of the init script.
+func isInitState(L *lua.LState) bool {
+	_, ok := L.G.Registry.RawGetString(shutdownHooksKey).(*lua.LTable)
+	return ok
+}
+
+// runShutdownHooks calls the functions registered by the init script with
+// caddy.on_shutdown and closes its state.
+func (l *Lua) runShutdownHooks() {
+	L := l.initState
+	if L == nil {
+		return
+	}
+	l.initState = nil
+	defer L.Close()
+
+	timeout := time.Duration(l.ExecutionTimeout)
+	if timeout <= 0 {
+		timeout = defaultTimerTimeout
+	}
+	hooks, _ := L.G.Registry.RawGetString(shutdownHooksKey).(*lua.LTable)
+	for i := hooks.Len(); i >= 1; i-- {
+		fn, _ := hooks.RawGetInt(i).(*lua.LFunction)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		L.SetContext(ctx)
+		if err := L.CallByParam(lua.P{Fn: fn, NRet: 0, Protect: true}); err != nil {
+			l.logger.Error("running the shutdown function",
+				zap.String("source", fn.Proto.SourceName),
+				zap.Int("line", fn.Proto.LineDefined),
+				zap.Error(err))
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,347 @@
+package lua
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/klauspost/compress/zstd"
+	lua "github.com/yuin/gopher-lua"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// HTMLInject configures the injection of an HTML snippet in the HTML
+// responses of the next handler, right before the first closing </body> tag,
+// or </head> if Position is "head". The snippet is either static (Snippet)
+// or returned by the global Lua function Function, which is called once per
+// response. The snippet is converted to the charset of the response, and
+// responses compressed with gzip, deflate or zstd are decompressed and
+// compressed again transparently; responses with other encodings are left
+// untouched.
+type HTMLInject struct {
+	Position string `json:"position,omitempty"`
+	Snippet  string `json:"snippet,omitempty"`
+	Function string `json:"function,omitempty"`
+}
+
+// validate returns an error if the HTML injection configuration is invalid.
+func (hi *HTMLInject) validate() error {
+	if hi.Position != "" && hi.Position != "head" && hi.Position != "body" {
+		return fmt.Errorf("html_inject: position must be head or body, got %q", hi.Position)
+	}
+	if (hi.Snippet == "") == (hi.Function == "") {
+		return fmt.Errorf("html_inject: exactly one of snippet or function is required")
+	}
+	return nil
+}
+
+// unmarshalCaddyfile sets up the HTML injection from the block's tokens.
+func (hi *HTMLInject) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var dst *string
+		switch field := d.Val(); field {
+		case "position":
+			dst = &hi.Position
+		case "snippet":
+			dst = &hi.Snippet
+		case "function":
+			dst = &hi.Function
+		default:
+			return d.Errf("html_inject %s: unknown configuration option", field)
+		}
+		if !d.Args(dst) || d.NextArg() {
+			return d.Errf("html_inject %s: %w", d.Val(), d.ArgErr())
+		}
+	}
+	return nil
+}
+
+// marker returns the closing tag before which the snippet is injected.
+func (hi *HTMLInject) marker() string {
+	if hi.Position == "head" {
+		return "</head>"
+	}
+	return "</body>"
+}
+
+// injector inserts a snippet once, before the first case-insensitive
+// occurrence of a marker in a stream of data.
+type injector struct {
+	marker  []byte
+	snippet []byte
+	done    bool
+	tail    []byte
+}
+
+// process returns the data to output for p.
+func (in *injector) process(p []byte) []byte {
+	if in.done {
+		return p
+	}
+	data := append(in.tail, p...)
+	if i := indexFoldASCII(data, in.marker); i >= 0 {
+		in.done = true
+		in.tail = nil
+		out := make([]byte, 0, len(data)+len(in.snippet))
+		out = append(out, data[:i]...)
+		out = append(out, in.snippet...)
+		return append(out, data[i:]...)
+	}
+
+	keep := len(in.marker) - 1
+	if keep > len(data) {
+		keep = len(data)
+	}
+	in.tail = append([]byte(nil), data[len(data)-keep:]...)
+	return data[:len(data)-keep]
+}
+
+// indexFoldASCII returns the index of the first occurrence of the lowercase
+// ASCII marker in data, ignoring ASCII case, or -1.
+func indexFoldASCII(data, marker []byte) int {
+	for i := 0; i+len(marker) <= len(data); i++ {
+		j := 0
+		for ; j < len(marker); j++ {
+			c := data[i+j]
+			if 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			if c != marker[j] {
+				break
+			}
+		}
+		if j == len(marker) {
+			return i
+		}
+	}
+	return -1
+}
+
+// flush returns the data held back.
+func (in *injector) flush() []byte {
+	tail := in.tail
+	in.tail = nil
+	return tail
+}
+
+// injectWriter applies an HTMLInject to the response body written to it.
+type injectWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	cfg *HTMLInject
+	L   *lua.LState
+
+	wroteHeader bool
+	active      bool
+	in          *injector
+	err         error
+
+	// set for compressed responses, the body is decompressed and compressed
+	// again in a goroutine that reads from pw.
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func newInjectWriter(w http.ResponseWriter, cfg *HTMLInject, L *lua.LState) *injectWriter {
+	return &injectWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		cfg:                   cfg,
+		L:                     L,
+	}
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (iw *injectWriter) WriteHeader(status int) {
+	if iw.wroteHeader {
+		return
+	}
+	iw.wroteHeader = true
+
+	h := iw.Header()
+	enc := strings.ToLower(h.Get("Content-Encoding"))
+	if status != http.StatusNoContent && status != http.StatusNotModified &&
+		contentTypeMatches(h.Get("Content-Type"), nil, "text/html") && isInjectableEncoding(enc) {
+		snippet, err := iw.snippet(h.Get("Content-Type"))
+		if err != nil {
+			iw.err = err
+		} else if snippet != nil {
+			iw.active = true
+			iw.in = &injector{marker: []byte(iw.cfg.marker()), snippet: snippet}
+			h.Del("Content-Length")
+			h.Del("Etag")
+			if enc != "" {
+				iw.startTranscoder(enc)
+			}
+		}
+	}
+	iw.ResponseWriter.WriteHeader(status)
+}
+
+// snippet returns the snippet to inject encoded in the charset of the
+// response, or nil if it cannot be represented in that charset.
+func (iw *injectWriter) snippet(contentType string) ([]byte, error) {
+	s := iw.cfg.Snippet
+	if iw.cfg.Function != "" {
+		defer enterState(iw.L)()
+		fn, ok := iw.L.GetGlobal(iw.cfg.Function).(*lua.LFunction)
+		if !ok {
+			return nil, fmt.Errorf("html_inject: %s is not a function", iw.cfg.Function)
+		}
+		if err := iw.L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}); err != nil {
+			return nil, fmt.Errorf("html_inject: %w", err)
+		}
+		ret := iw.L.Get(-1)
+		iw.L.Pop(1)
+		if ret == lua.LNil || lua.LVAsString(ret) == "" {
+			return nil, nil
+		}
+		s = lua.LVAsString(ret)
+	}
+
+	_, params, _ := mime.ParseMediaType(contentType)
+	cs := strings.ToLower(params["charset"])
+	if cs == "" || cs == "utf-8" || cs == "us-ascii" {
+		return []byte(s), nil
+	}
+	if strings.HasPrefix(cs, "utf-16") {
+		// the markers cannot be matched byte-wise
+		return nil, nil
+	}
+	e, err := htmlindex.Get(cs)
+	if err != nil {
+		return nil, nil
+	}
+	b, err := encoding.HTMLEscapeUnsupported(e.NewEncoder()).Bytes([]byte(s))
+	if err != nil {
+		return nil, nil
+	}
+	return b, nil
+}
+
+// isInjectableEncoding returns true if the content encoding enc can be
+// decoded and encoded again.
+func isInjectableEncoding(enc string) bool {
+	switch enc {
+	case "", "identity", "gzip", "deflate", "zstd":
+		return true
+	}
+	return false
+}
+
+// startTranscoder starts the goroutine that decompresses the written body,
+// injects the snippet and compresses the result to the underlying writer.
+func (iw *injectWriter) startTranscoder(enc string) {
+	if enc == "identity" {
+		return
+	}
+	pr, pw := io.Pipe()
+	iw.pw = pw
+	iw.done = make(chan error, 1)
+	go func() {
+		err := iw.transcode(enc, pr)
+		pr.CloseWithError(err)
+		iw.done <- err
+	}()
+}
+
+func (iw *injectWriter) transcode(enc string, r io.Reader) error {
+	var (
+		dec io.Reader
+		cw  io.WriteCloser
+		err error
+	)
+	switch enc {
+	case "gzip":
+		gr, gerr := gzip.NewReader(r)
+		dec, err = gr, gerr
+		cw = gzip.NewWriter(iw.ResponseWriter)
+	case "deflate":
+		dec, err = zlib.NewReader(r)
+		cw = zlib.NewWriter(iw.ResponseWriter)
+	case "zstd":
+		zr, zerr := zstd.NewReader(r)
+		if zerr == nil {
+			defer zr.Close()
+		}
+		dec, err = zr, zerr
+		cw, _ = zstd.NewWriter(iw.ResponseWriter)
+	}
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, bodyFilterChunkSize)
+	for {
+		n, rerr := dec.Read(buf)
+		if n > 0 {
+			if _, err := cw.Write(iw.in.process(buf[:n])); err != nil {
+				return err
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+	if _, err := cw.Write(iw.in.flush()); err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// Write implements http.ResponseWriter.
+func (iw *injectWriter) Write(p []byte) (int, error) {
+	if !iw.wroteHeader {
+		iw.WriteHeader(http.StatusOK)
+	}
+	if iw.err != nil {
+		return 0, iw.err
+	}
+	if !iw.active {
+		return iw.ResponseWriter.Write(p)
+	}
+	if iw.pw != nil {
+		return iw.pw.Write(p)
+	}
+	if _, err := iw.ResponseWriter.Write(iw.in.process(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush implements http.Flusher. Compressed responses are only flushed when
+// the body is complete.
+func (iw *injectWriter) Flush() {
+	if iw.pw == nil {
+		iw.ResponseWriterWrapper.Flush()
+	}
+}
+
+// finish completes the body once the next handler has returned.
+func (iw *injectWriter) finish() error {
+	if iw.err != nil {
+		return iw.err
+	}
+	if !iw.active {
+		return nil
+	}
+	if iw.pw != nil {
+		iw.pw.Close()
+		return <-iw.done
+	}
+	_, err := iw.ResponseWriter.Write(iw.in.flush())
+	return err
+}
+
+// interface guards
+var (
+	_ caddyhttp.HTTPInterfaces = (*injectWriter)(nil)
+)
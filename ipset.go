@@ -0,0 +1,279 @@
+package lua
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	lua "github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+)
+
+const ipSetTypeName = "caddy.ipset"
+
+// IPSet configures a named set of IP addresses and CIDR ranges that is
+// available to scripts via caddy.ipset(name). The addresses are loaded at
+// provision time from files or http(s) URLs, one address or range per line
+// (blank lines and # comments are ignored), and are reloaded every
+// RefreshInterval if it is set.
+type IPSet struct {
+	Name            string         `json:"name,omitempty"`
+	Sources         []string       `json:"sources,omitempty"`
+	RefreshInterval caddy.Duration `json:"refresh_interval,omitempty"`
+}
+
+// unmarshalCaddyfile sets up the IP set from the option's tokens.
+func (s *IPSet) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	args := d.RemainingArgs()
+	if len(args) < 2 {
+		return d.Errf("ipset: %w", d.ArgErr())
+	}
+	s.Name, s.Sources = args[0], args[1:]
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch field := d.Val(); field {
+		case "refresh_interval":
+			var v string
+			if !d.Args(&v) {
+				return d.Errf("ipset %s: %w", field, d.ArgErr())
+			}
+			dur, err := caddy.ParseDuration(v)
+			if err != nil {
+				return d.Errf("ipset %s: %w", field, err)
+			}
+			s.RefreshInterval = caddy.Duration(dur)
+
+		default:
+			return d.Errf("ipset %s: unknown configuration option", field)
+		}
+	}
+	return nil
+}
+
+// ipRange is an inclusive range of IP addresses, in their 16-byte form.
+type ipRange struct {
+	start, end [16]byte
+}
+
+// ipRanges is a sorted list of non-overlapping IP ranges. Membership is
+// checked with a binary search, which keeps large block lists compact in
+// memory compared to a bit-level trie.
+type ipRanges []ipRange
+
+func (rs ipRanges) contains(addr netip.Addr) bool {
+	ip := addr.Unmap().As16()
+	i := sort.Search(len(rs), func(i int) bool {
+		return bytes.Compare(rs[i].start[:], ip[:]) > 0
+	})
+	return i > 0 && bytes.Compare(ip[:], rs[i-1].end[:]) <= 0
+}
+
+// newIPRanges returns the sorted and merged ranges covering prefixes.
+func newIPRanges(prefixes []netip.Prefix) ipRanges {
+	rs := make(ipRanges, 0, len(prefixes))
+	for _, p := range prefixes {
+		rs = append(rs, prefixRange(p))
+	}
+	sort.Slice(rs, func(i, j int) bool {
+		return bytes.Compare(rs[i].start[:], rs[j].start[:]) < 0
+	})
+
+	merged := rs[:0]
+	for _, r := range rs {
+		if n := len(merged); n > 0 && bytes.Compare(r.start[:], merged[n-1].end[:]) <= 0 {
+			if bytes.Compare(r.end[:], merged[n-1].end[:]) > 0 {
+				merged[n-1].end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// prefixRange returns the range of addresses in p.
+func prefixRange(p netip.Prefix) ipRange {
+	p = p.Masked()
+	bits := p.Bits()
+	if p.Addr().Is4() {
+		bits += 96
+	}
+	start := p.Addr().As16()
+	end := start
+	for i := bits; i < 128; i++ {
+		end[i/8] |= 1 << (7 - i%8)
+	}
+	return ipRange{start: start, end: end}
+}
+
+// parseIPList parses the addresses and CIDR ranges in r.
+func parseIPList(r io.Reader) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		s := strings.TrimSpace(sc.Text())
+		if i := strings.IndexByte(s, '#'); i >= 0 {
+			s = strings.TrimSpace(s[:i])
+		}
+		if s == "" {
+			continue
+		}
+
+		if strings.Contains(s, "/") {
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			prefixes = append(prefixes, p)
+			continue
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, sc.Err()
+}
+
+// ipSet is the runtime state of an IPSet.
+type ipSet struct {
+	cfg    *IPSet
+	logger *zap.Logger
+	ranges atomic.Value // ipRanges
+	cancel context.CancelFunc
+}
+
+// newIPSet loads the IP set described by cfg and starts its background
+// refresh, if any.
+func newIPSet(cfg *IPSet, logger *zap.Logger) (*ipSet, error) {
+	s := &ipSet{cfg: cfg, logger: logger, cancel: func() {}}
+	if err := s.load(context.Background()); err != nil {
+		return nil, fmt.Errorf("loading ipset %s: %w", cfg.Name, err)
+	}
+	if cfg.RefreshInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.cancel = cancel
+		go s.refreshEvery(ctx, time.Duration(cfg.RefreshInterval))
+	}
+	return s, nil
+}
+
+// stop stops the background refresh of the IP set.
+func (s *ipSet) stop() {
+	s.cancel()
+}
+
+func (s *ipSet) refreshEvery(ctx context.Context, period time.Duration) {
+	t := time.NewTicker(period)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := s.load(ctx); err != nil {
+				s.logger.Error("refreshing ipset, keeping the previous addresses",
+					zap.String("name", s.cfg.Name), zap.Error(err))
+			}
+		}
+	}
+}
+
+// load reads all sources of the IP set and replaces its ranges.
+func (s *ipSet) load(ctx context.Context) error {
+	var prefixes []netip.Prefix
+	for _, src := range s.cfg.Sources {
+		ps, err := loadIPSource(ctx, src)
+		if err != nil {
+			return fmt.Errorf("%s: %w", src, err)
+		}
+		prefixes = append(prefixes, ps...)
+	}
+	s.ranges.Store(newIPRanges(prefixes))
+	return nil
+}
+
+func (s *ipSet) contains(addr netip.Addr) bool {
+	return s.ranges.Load().(ipRanges).contains(addr)
+}
+
+// ipSourceClient is the HTTP client used to fetch IP lists.
+var ipSourceClient = &http.Client{Timeout: time.Minute}
+
+// loadIPSource loads the IP list from src, a file path or http(s) URL.
+func loadIPSource(ctx context.Context, src string) ([]netip.Prefix, error) {
+	if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+		f, err := os.Open(src)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return parseIPList(f)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ipSourceClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return parseIPList(resp.Body)
+}
+
+var ipSetMethods = map[string]lua.LGFunction{
+	"contains": ipSetContains,
+}
+
+// openIPSetType registers the metatable of the IP set userdata in L.
+func openIPSetType(L *lua.LState) {
+	mt := L.NewTypeMetatable(ipSetTypeName)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), ipSetMethods))
+}
+
+// caddyIPSet implements caddy.ipset(name), which returns the named IP set.
+func caddyIPSet(L *lua.LState) int {
+	name := L.CheckString(1)
+	s := checkRequestContext(L).handler.ipsets[name]
+	if s == nil {
+		L.ArgError(1, fmt.Sprintf("no ipset named %q", name))
+	}
+	ud := L.NewUserData()
+	ud.Value = s
+	L.SetMetatable(ud, L.GetTypeMetatable(ipSetTypeName))
+	L.Push(ud)
+	return 1
+}
+
+// ipSetContains implements ipset:contains(ip).
+func ipSetContains(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	s, ok := ud.Value.(*ipSet)
+	if !ok {
+		L.ArgError(1, "ipset expected")
+	}
+	addr, err := netip.ParseAddr(L.CheckString(2))
+	if err != nil {
+		L.ArgError(2, err.Error())
+	}
+	L.Push(lua.LBool(s.contains(addr)))
+	return 1
+}
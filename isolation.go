@@ -0,0 +1,189 @@
+package lua
+
+import (
+	"fmt"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// The isolation modes of the requests, set by the isolation option of the
+// handler, from the safest to the fastest:
+//
+//	per_request: each request runs in a new state, closed once the request
+//	is handled. It is the default without a state_pool.
+//	pooled: the requests run in the states of the state_pool, whose globals
+//	are reset between the requests, but not the modules loaded with require
+//	or the changes to the standard library tables. It is the default with a
+//	state_pool, and uses the default pool sizes without one.
+//	shared_coroutine: the requests run in coroutines of a single state of
+//	the handler, as in OpenResty, so they share its globals and modules,
+//	which persist across the requests.
+//	process: the requests run in the worker processes of the handler, in
+//	the default mode, so that a script cannot crash the Caddy process (see
+//	workerPool).
+//
+// In the shared_coroutine mode, the states of gopher-lua not being safe for
+// concurrent use, the coroutines take turns to run Lua code: a coroutine
+// holds the lock of the state while its scripts run, and releases it while
+// it blocks, i.e. while the next handler runs (with caddy.next or once the
+// script returns), during the subrequests (caddy.subrequest, fetch_local,
+// caddy.handler), the HTTP calls, the socket, redis, db and dns operations
+// and while the request body is read. The other requests run their scripts
+// in the meantime, as the coroutines of OpenResty do on their I/O, and a
+// subrequest may be handled by the same handler. The writes of the response
+// do not release the lock. The scripts should keep the request data in
+// locals, since the globals are seen by the other requests, and may change
+// while a request blocks. The state is replaced when the scripts are
+// reloaded.
+const (
+	isolationPerRequest      = "per_request"
+	isolationPooled          = "pooled"
+	isolationSharedCoroutine = "shared_coroutine"
+)
+
+// validateIsolation returns an error if the isolation mode is not valid, or
+// conflicts with the state_pool.
+func (l *Lua) validateIsolation() error {
+	switch l.Isolation {
+	case "", isolationPooled:
+	case isolationPerRequest, isolationSharedCoroutine, isolationProcess:
+		if l.StatePool != nil {
+			return fmt.Errorf("isolation: the %s mode cannot have a state_pool", l.Isolation)
+		}
+	default:
+		return fmt.Errorf("isolation: unknown mode %q, must be %s, %s, %s or %s",
+			l.Isolation, isolationPerRequest, isolationPooled, isolationSharedCoroutine, isolationProcess)
+	}
+	if l.Workers < 0 {
+		return fmt.Errorf("workers must not be negative, got %d", l.Workers)
+	}
+	if l.Workers > 0 && l.Isolation != isolationProcess {
+		return fmt.Errorf("workers requires the %s isolation mode", isolationProcess)
+	}
+	return nil
+}
+
+// sharedState is the state of a handler in the shared_coroutine mode, in
+// which the requests run in coroutines that take turns to hold its lock.
+type sharedState struct {
+	mu       sync.Mutex
+	L        *lua.LState
+	newState func() *lua.LState
+}
+
+// coroutine is the coroutine of a request in a shared state.
+type coroutine struct {
+	s    *sharedState
+	held bool
+
+	// binding is the request context of the coroutine, saved while it does
+	// not hold the lock and another coroutine may bind its own
+	binding lua.LValue
+}
+
+// coroutines maps the coroutines of the shared states to their coroutine.
+var coroutines sync.Map // *lua.LState -> *coroutine
+
+// newSharedState returns the shared state created by newState.
+func newSharedState(newState func() *lua.LState) *sharedState {
+	return &sharedState{L: newState(), newState: newState}
+}
+
+// acquire waits for the lock of the state and returns a new coroutine of the
+// state, which holds it. It must be released with release.
+func (s *sharedState) acquire() *lua.LState {
+	s.mu.Lock()
+	// the shared state has no context, so the coroutine has no cancel
+	// function
+	co, _ := s.L.NewThread()
+	coroutines.Store(co, &coroutine{s: s, held: true})
+	return co
+}
+
+// release unbinds the coroutine co, created by acquire, from the request,
+// and releases the lock. The state is replaced if a Go function panicked in
+// co, unless it already was.
+func (s *sharedState) release(co *lua.LState, panicked bool) {
+	if v, ok := coroutines.LoadAndDelete(co); ok && !v.(*coroutine).held {
+		s.mu.Lock()
+	}
+	defer s.mu.Unlock()
+	if panicked {
+		if co.G == s.L.G {
+			s.L.Close()
+			s.L = s.newState()
+		}
+		return
+	}
+	co.SetTop(0)
+	co.G.Registry.RawSetString(requestContextKey, lua.LNil)
+}
+
+// lookupCoroutine returns the coroutine of L, or of the coroutine that
+// resumed L if the script created it, or nil if L is not a coroutine of a
+// shared state.
+func lookupCoroutine(L *lua.LState) *coroutine {
+	for ; L != nil; L = L.Parent {
+		if v, ok := coroutines.Load(L); ok {
+			return v.(*coroutine)
+		}
+	}
+	return nil
+}
+
+// unlocked calls fn without the lock of the shared state of L, if L is a
+// coroutine of a shared state that holds it, so that the other requests run
+// their scripts while fn blocks. fn must not use L.
+func unlocked(L *lua.LState, fn func()) {
+	c := lookupCoroutine(L)
+	if c == nil || !c.held {
+		fn()
+		return
+	}
+	c.binding = L.G.Registry.RawGetString(requestContextKey)
+	c.held = false
+	c.s.mu.Unlock()
+	defer func() {
+		c.s.mu.Lock()
+		c.held = true
+		L.G.Registry.RawSetString(requestContextKey, c.binding)
+	}()
+	fn()
+}
+
+// enterState takes the lock of the shared state of L, if L is a coroutine of
+// a shared state that does not hold it, e.g. to run a response filter while
+// the next handler runs, and returns the function that releases it.
+func enterState(L *lua.LState) (exit func()) {
+	c := lookupCoroutine(L)
+	if c == nil || c.held {
+		return func() {}
+	}
+	c.s.mu.Lock()
+	c.held = true
+	L.G.Registry.RawSetString(requestContextKey, c.binding)
+	return func() {
+		c.binding = L.G.Registry.RawGetString(requestContextKey)
+		c.held = false
+		c.s.mu.Unlock()
+	}
+}
+
+// reset replaces the state with a new one, e.g. once the scripts are
+// reloaded, so that their modules are loaded again.
+func (s *sharedState) reset() {
+	L := s.newState()
+	s.mu.Lock()
+	old := s.L
+	s.L = L
+	s.mu.Unlock()
+	old.Close()
+}
+
+// close closes the state.
+func (s *sharedState) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.L.Close()
+}
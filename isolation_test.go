@@ -0,0 +1,231 @@
+package lua
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// doTimeout handles req with tr, failing the test if it does not respond
+// within a few seconds, e.g. because it deadlocks.
+func doTimeout(t *testing.T, tr *Tester, req TestRequest) *TestResponse {
+	t.Helper()
+	done := make(chan *TestResponse, 1)
+	go func() { done <- tr.Do(req) }()
+	select {
+	case res := <-done:
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s: no response, the handler is deadlocked", req.Path)
+		return nil
+	}
+}
+
+func TestSharedCoroutineSubrequest(t *testing.T) {
+	tr, err := NewTester(&Lua{
+		Isolation: isolationSharedCoroutine,
+		Script: `
+			if request.path == "/inner" then
+				response:write("inner")
+				return
+			end
+			local res
+			if request.path == "/fetch" then
+				res = caddy.fetch_local("/inner")
+			else
+				res = caddy.subrequest("GET", "/inner")
+			end
+			response:write(request.path .. ":" .. res.body)`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// not deferred, closing the handler blocks if it is deadlocked
+
+	for _, path := range []string{"/subrequest", "/fetch"} {
+		res := doTimeout(t, tr, TestRequest{Path: path})
+		if res.Err != nil {
+			t.Fatalf("%s: %s", path, res.Err)
+		}
+		// the request context of the outer request is restored once the
+		// subrequest is handled
+		if want := path + ":inner"; res.Body != want {
+			t.Errorf("%s: got %q, want %q", path, res.Body, want)
+		}
+	}
+	tr.Close()
+}
+
+func TestSharedCoroutineNextUnlocked(t *testing.T) {
+	const n = 8
+	tr, err := NewTester(&Lua{
+		Isolation: isolationSharedCoroutine,
+		Script:    `requests = (requests or 0) + 1`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// not deferred, closing the handler blocks if it is deadlocked
+
+	// the next handler returns once all the requests reached it, which
+	// requires that the state is not locked while it runs
+	var arrived sync.WaitGroup
+	arrived.Add(n)
+	all := make(chan struct{})
+	go func() {
+		arrived.Wait()
+		close(all)
+	}()
+	tr.Next = caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		arrived.Done()
+		<-all
+		return nil
+	})
+
+	var wg sync.WaitGroup
+	results := make(chan *TestResponse, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- tr.Do(TestRequest{})
+		}()
+	}
+	select {
+	case <-all:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the requests are serialized while the next handler runs")
+	}
+	wg.Wait()
+	close(results)
+	for res := range results {
+		if res.Err != nil || !res.CalledNext {
+			t.Errorf("got error %v, next %t", res.Err, res.CalledNext)
+		}
+	}
+	tr.Close()
+}
+
+func TestSharedCoroutineHeaderAndBodyPhases(t *testing.T) {
+	const n = 6
+	headerPath := filepath.Join(t.TempDir(), "header.lua")
+	if err := os.WriteFile(headerPath, []byte(`response:set_status(200 + tonumber(request.query.n))`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name   string
+		lua    *Lua
+		status func(i int) int
+		body   func(i int) string
+	}{
+		{
+			name:   "header",
+			lua:    &Lua{Phases: &Phases{Header: headerPath}},
+			status: func(i int) int { return 200 + i },
+			body:   func(i int) string { return "n=" },
+		},
+		{
+			name: "body",
+			lua: &Lua{
+				BodyFilter: &BodyFilter{Function: "filter", Stream: true},
+				Script: `
+					function filter(chunk, eof)
+						if eof then
+							return request.query.n
+						end
+						return chunk
+					end`,
+			},
+			status: func(i int) int { return http.StatusOK },
+			body:   func(i int) string { return "n=" + strconv.Itoa(i) },
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.lua.Isolation = isolationSharedCoroutine
+			tr, err := NewTester(c.lua)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tr.Close()
+
+			// the next handlers write their response once all the requests
+			// reached them, so that the phases of the requests run while
+			// the others are in their next handler
+			var arrived sync.WaitGroup
+			arrived.Add(n)
+			all := make(chan struct{})
+			go func() {
+				arrived.Wait()
+				close(all)
+			}()
+			tr.Next = caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				arrived.Done()
+				<-all
+				w.Header().Set("Content-Type", "text/html")
+				w.WriteHeader(http.StatusOK)
+				_, err := w.Write([]byte("n="))
+				return err
+			})
+
+			var wg sync.WaitGroup
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					res := doTimeout(t, tr, TestRequest{Path: "/?n=" + strconv.Itoa(i)})
+					if res.Err != nil || res.Status != c.status(i) || res.Body != c.body(i) {
+						t.Errorf("request %d: got %d %q (%v), want %d %q", i, res.Status, res.Body, res.Err, c.status(i), c.body(i))
+					}
+				}(i)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestSharedCoroutineForwardAuthUnlocked(t *testing.T) {
+	const n = 6
+	// the authentication service responds once all the requests reached
+	// it, which requires that the state is not locked while they wait
+	var arrived sync.WaitGroup
+	arrived.Add(n)
+	all := make(chan struct{})
+	go func() {
+		arrived.Wait()
+		close(all)
+	}()
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived.Done()
+		<-all
+	}))
+	defer auth.Close()
+
+	tr, err := NewTester(&Lua{
+		Isolation: isolationSharedCoroutine,
+		Script:    `response:write(tostring(caddy.forward_auth("` + auth.URL + `")))`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res := doTimeout(t, tr, TestRequest{}); res.Err != nil || res.Body != "true" {
+				t.Errorf("got %q (%v)", res.Body, res.Err)
+			}
+		}()
+	}
+	wg.Wait()
+}
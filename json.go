@@ -0,0 +1,62 @@
+package lua
+
+import (
+	"encoding/json"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// preloadJSONModule registers the json module, loaded by scripts with
+// require("json"):
+//
+//	json.encode(value[, indent]): the JSON encoding of value, or nil and an
+//	error message. Tables with only consecutive integer keys starting at 1
+//	are encoded as arrays, other tables as objects.
+//	json.decode(s): the value decoded from the JSON string s, or nil and an
+//	error message. JSON null values are decoded as nil.
+func preloadJSONModule(L *lua.LState) {
+	L.PreloadModule("json", func(L *lua.LState) int {
+		L.Push(L.SetFuncs(L.NewTable(), jsonFuncs))
+		return 1
+	})
+}
+
+var jsonFuncs = map[string]lua.LGFunction{
+	"encode": jsonEncode,
+	"decode": jsonDecode,
+}
+
+// jsonEncode implements json.encode(value[, indent]).
+func jsonEncode(L *lua.LState) int {
+	v, err := toGo(L.CheckAny(1))
+	if err != nil {
+		L.ArgError(1, err.Error())
+	}
+	indent := L.OptString(2, "")
+
+	var b []byte
+	if indent != "" {
+		b, err = json.MarshalIndent(v, "", indent)
+	} else {
+		b, err = json.Marshal(v)
+	}
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LString(b))
+	return 1
+}
+
+// jsonDecode implements json.decode(s).
+func jsonDecode(L *lua.LState) int {
+	var v interface{}
+	if err := json.Unmarshal([]byte(L.CheckString(1)), &v); err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(fromGo(L, v))
+	return 1
+}
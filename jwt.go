@@ -0,0 +1,379 @@
+package lua
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	lua "github.com/yuin/gopher-lua"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	defaultJWKSCacheTTL = time.Hour
+
+	// minJWKSRefresh is the minimum delay between two fetches of the JWKS
+	// caused by tokens signed with an unknown key.
+	minJWKSRefresh = time.Minute
+)
+
+var (
+	hmacAlgorithms = []string{"HS256", "HS384", "HS512"}
+	jwksAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+)
+
+// JWT configures the validation of JSON Web Tokens, done in Go before the
+// script runs. The token is read from the TokenHeader header (default
+// Authorization, as a Bearer token), the TokenCookie cookie or the
+// TokenQuery query string parameter, and its signature is verified with the
+// HMAC Secret (HS256, HS384 or HS512) or the keys of the JWKSURL key set
+// (RSA or ECDSA, cached for JWKSCacheTTL, default 1h). The token must not be
+// expired, and must have the Issuer and one of the Audience if set, with
+// Leeway of clock skew allowed. Requests without a valid token are rejected
+// with a 401 status code.
+//
+// The claims are available to the script via caddy.jwt.claims(), and the
+// subject is set as the {http.auth.user.id} placeholder. If ClaimsFunction
+// is set, the global Lua function of that name is called with the claims
+// before the scripts run, and the request is rejected with a 403 status code
+// unless it returns true. The function must be defined before the scripts
+// run, by the init script (init_path).
+type JWT struct {
+	Issuer         string         `json:"issuer,omitempty"`
+	Audience       []string       `json:"audience,omitempty"`
+	Secret         string         `json:"secret,omitempty"`
+	JWKSURL        string         `json:"jwks_url,omitempty"`
+	JWKSCacheTTL   caddy.Duration `json:"jwks_cache_ttl,omitempty"`
+	Leeway         caddy.Duration `json:"leeway,omitempty"`
+	TokenHeader    string         `json:"token_header,omitempty"`
+	TokenCookie    string         `json:"token_cookie,omitempty"`
+	TokenQuery     string         `json:"token_query,omitempty"`
+	ClaimsFunction string         `json:"claims_function,omitempty"`
+}
+
+// validate returns an error if the JWT configuration is invalid.
+func (j *JWT) validate() error {
+	if (j.Secret == "") == (j.JWKSURL == "") {
+		return errors.New("jwt: exactly one of secret or jwks_url is required")
+	}
+	return nil
+}
+
+// unmarshalCaddyfile sets up the JWT validation from the block's tokens.
+func (j *JWT) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		field := d.Val()
+		var dst *string
+		var dur *caddy.Duration
+		switch field {
+		case "issuer":
+			dst = &j.Issuer
+		case "secret":
+			dst = &j.Secret
+		case "jwks_url":
+			dst = &j.JWKSURL
+		case "token_header":
+			dst = &j.TokenHeader
+		case "token_cookie":
+			dst = &j.TokenCookie
+		case "token_query":
+			dst = &j.TokenQuery
+		case "claims_function":
+			dst = &j.ClaimsFunction
+		case "jwks_cache_ttl":
+			dur = &j.JWKSCacheTTL
+		case "leeway":
+			dur = &j.Leeway
+		case "audience":
+			j.Audience = append(j.Audience, d.RemainingArgs()...)
+			if len(j.Audience) == 0 {
+				return d.Errf("jwt %s: %w", field, d.ArgErr())
+			}
+			continue
+		default:
+			return d.Errf("jwt %s: unknown configuration option", field)
+		}
+
+		var v string
+		if !d.Args(&v) || d.NextArg() {
+			return d.Errf("jwt %s: %w", field, d.ArgErr())
+		}
+		if dst != nil {
+			*dst = v
+			continue
+		}
+		val, err := caddy.ParseDuration(v)
+		if err != nil {
+			return d.Errf("jwt %s: %w", field, err)
+		}
+		*dur = caddy.Duration(val)
+	}
+	return nil
+}
+
+// jwtValidator is the runtime state of JWT.
+type jwtValidator struct {
+	cfg  *JWT
+	jwks *jwksCache
+}
+
+func newJWTValidator(cfg *JWT) *jwtValidator {
+	jv := &jwtValidator{cfg: cfg}
+	if cfg.JWKSURL != "" {
+		ttl := time.Duration(cfg.JWKSCacheTTL)
+		if ttl <= 0 {
+			ttl = defaultJWKSCacheTTL
+		}
+		jv.jwks = &jwksCache{url: cfg.JWKSURL, ttl: ttl}
+	}
+	return jv
+}
+
+// token returns the token of r, or an empty string if there is none.
+func (jv *jwtValidator) token(r *http.Request) string {
+	if jv.cfg.TokenQuery != "" {
+		if tok := r.URL.Query().Get(jv.cfg.TokenQuery); tok != "" {
+			return tok
+		}
+	}
+	if jv.cfg.TokenCookie != "" {
+		if c, err := r.Cookie(jv.cfg.TokenCookie); err == nil && c.Value != "" {
+			return c.Value
+		}
+	}
+	name := jv.cfg.TokenHeader
+	if name == "" {
+		name = "Authorization"
+	}
+	tok := r.Header.Get(name)
+	if len(tok) > len("bearer ") && strings.EqualFold(tok[:len("bearer ")], "bearer ") {
+		tok = tok[len("bearer "):]
+	}
+	return strings.TrimSpace(tok)
+}
+
+// authenticate validates the token of r and returns its claims, or an HTTP
+// error with a 401 status code.
+func (jv *jwtValidator) authenticate(w http.ResponseWriter, r *http.Request) (map[string]interface{}, error) {
+	claims, err := jv.validate(r.Context(), jv.token(r))
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		return nil, caddyhttp.Error(http.StatusUnauthorized, err)
+	}
+	if sub, ok := claims["sub"].(string); ok {
+		if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+			repl.Set("http.auth.user.id", sub)
+		}
+	}
+	return claims, nil
+}
+
+// validate verifies the token and returns its claims.
+func (jv *jwtValidator) validate(ctx context.Context, token string) (map[string]interface{}, error) {
+	key := func(hdr jose.Header) (interface{}, error) {
+		if jv.jwks == nil {
+			if !containsString(hmacAlgorithms, hdr.Algorithm) {
+				return nil, fmt.Errorf("unexpected signing algorithm %q", hdr.Algorithm)
+			}
+			return []byte(jv.cfg.Secret), nil
+		}
+		return jv.jwks.verificationKey(ctx, hdr)
+	}
+	exp := jwtExpected{
+		issuer:        jv.cfg.Issuer,
+		audience:      jv.cfg.Audience,
+		leeway:        time.Duration(jv.cfg.Leeway),
+		requireExpiry: true,
+	}
+	return verifyJWT(token, key, exp)
+}
+
+// jwtExpected holds the expected claims of a token.
+type jwtExpected struct {
+	issuer        string
+	audience      []string
+	leeway        time.Duration
+	requireExpiry bool
+}
+
+// verifyJWT verifies the signature of token with the key returned by key for
+// its header, validates its claims and returns them.
+func verifyJWT(token string, key func(jose.Header) (interface{}, error), exp jwtExpected) (map[string]interface{}, error) {
+	if token == "" {
+		return nil, errors.New("no token")
+	}
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, err
+	}
+	if len(tok.Headers) != 1 {
+		return nil, errors.New("token must have exactly one signature")
+	}
+	k, err := key(tok.Headers[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var std jwt.Claims
+	var claims map[string]interface{}
+	if err := tok.Claims(k, &std, &claims); err != nil {
+		return nil, err
+	}
+	if std.Expiry == nil && exp.requireExpiry {
+		return nil, errors.New("token has no expiry")
+	}
+	expected := jwt.Expected{Issuer: exp.issuer, Time: time.Now()}
+	if err := std.ValidateWithLeeway(expected, exp.leeway); err != nil {
+		return nil, err
+	}
+	if len(exp.audience) > 0 {
+		var ok bool
+		for _, aud := range exp.audience {
+			if std.Audience.Contains(aud) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return nil, jwt.ErrInvalidAudience
+		}
+	}
+	return claims, nil
+}
+
+// authorize calls the claims function of the configuration in L, and
+// returns an HTTP error with a 403 status code unless it returns true.
+func (jv *jwtValidator) authorize(L *lua.LState, claims map[string]interface{}) error {
+	if jv.cfg.ClaimsFunction == "" {
+		return nil
+	}
+	fn, ok := L.GetGlobal(jv.cfg.ClaimsFunction).(*lua.LFunction)
+	if !ok {
+		return fmt.Errorf("jwt: %s is not a function", jv.cfg.ClaimsFunction)
+	}
+	if err := L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, fromGo(L, claims)); err != nil {
+		return fmt.Errorf("jwt: %w", err)
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	if ret != lua.LTrue {
+		return caddyhttp.Error(http.StatusForbidden, errors.New("claims not authorized"))
+	}
+	return nil
+}
+
+// jwksClient is the HTTP client used to fetch key sets.
+var jwksClient = &http.Client{Timeout: 30 * time.Second}
+
+// jwksCache caches the key set published at a URL.
+type jwksCache struct {
+	url string
+	ttl time.Duration
+
+	mu      sync.Mutex
+	keys    *jose.JSONWebKeySet
+	fetched time.Time
+}
+
+// verificationKey returns the key of the set that verifies the signature of
+// a token with the header hdr.
+func (c *jwksCache) verificationKey(ctx context.Context, hdr jose.Header) (*jose.JSONWebKey, error) {
+	if !containsString(jwksAlgorithms, hdr.Algorithm) {
+		return nil, fmt.Errorf("unexpected signing algorithm %q", hdr.Algorithm)
+	}
+	jwk, err := c.key(ctx, hdr.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if jwk.Algorithm != "" && jwk.Algorithm != hdr.Algorithm {
+		return nil, fmt.Errorf("signing algorithm %q does not match the key", hdr.Algorithm)
+	}
+	return jwk, nil
+}
+
+// key returns the key identified by kid, fetching the key set if it is
+// expired or if the key is unknown. If kid is empty, the key set must have a
+// single key.
+func (c *jwksCache) key(ctx context.Context, kid string) (*jose.JSONWebKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.keys == nil || time.Since(c.fetched) > c.ttl {
+		if err := c.fetch(ctx); err != nil && c.keys == nil {
+			return nil, err
+		}
+	}
+	if k := c.lookup(kid); k != nil {
+		return k, nil
+	}
+	// the keys may have rotated
+	if time.Since(c.fetched) > minJWKSRefresh {
+		if err := c.fetch(ctx); err != nil {
+			return nil, err
+		}
+		if k := c.lookup(kid); k != nil {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("no key %q in the key set", kid)
+}
+
+func (c *jwksCache) lookup(kid string) *jose.JSONWebKey {
+	if kid == "" {
+		if len(c.keys.Keys) == 1 {
+			return &c.keys.Keys[0]
+		}
+		return nil
+	}
+	if keys := c.keys.Key(kid); len(keys) > 0 {
+		return &keys[0]
+	}
+	return nil
+}
+
+func (c *jwksCache) fetch(ctx context.Context) error {
+	c.fetched = time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := jwksClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching key set: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching key set: unexpected status: %s", resp.Status)
+	}
+	var keys jose.JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		return fmt.Errorf("decoding key set: %w", err)
+	}
+	c.keys = &keys
+	return nil
+}
+
+var jwtFuncs = map[string]lua.LGFunction{
+	"claims": jwtClaims,
+}
+
+// jwtClaims implements caddy.jwt.claims(), which returns the claims of the
+// validated token, or nil if the handler does not validate tokens.
+func jwtClaims(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	if rc.jwtClaims == nil {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(fromGo(L, rc.jwtClaims))
+	return 1
+}
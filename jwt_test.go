@@ -0,0 +1,89 @@
+package lua
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const testJWTSecret = "0123456789abcdef0123456789abcdef"
+
+// signTestJWT returns a token signed with testJWTSecret, with the role
+// claim.
+func signTestJWT(t *testing.T, role string) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte(testJWTSecret)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := map[string]interface{}{
+		"sub":  "alice",
+		"role": role,
+		"exp":  time.Now().Add(time.Hour).Unix(),
+	}
+	tok, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok
+}
+
+func TestJWTClaimsFunctionBeforeScripts(t *testing.T) {
+	dir := t.TempDir()
+	initPath := filepath.Join(dir, "init.lua")
+	if err := os.WriteFile(initPath, []byte(`function is_admin(claims) return claims.role == "admin" end`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, isolation := range []string{isolationPerRequest, isolationPooled, isolationSharedCoroutine} {
+		t.Run(isolation, func(t *testing.T) {
+			tr, err := NewTester(&Lua{
+				Isolation: isolation,
+				InitPath:  initPath,
+				JWT:       &JWT{Secret: testJWTSecret, ClaimsFunction: "is_admin"},
+				// the script responds itself, the claims must be authorized
+				// before it runs
+				Script: `response:write("secret")`,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tr.Close()
+
+			cases := []struct {
+				role   string
+				status int
+			}{
+				{"admin", http.StatusOK},
+				{"user", http.StatusForbidden},
+			}
+			for _, c := range cases {
+				res := tr.Do(TestRequest{Header: http.Header{"Authorization": {"Bearer " + signTestJWT(t, c.role)}}})
+				if res.Status != c.status {
+					t.Errorf("%s: got status %d, want %d", c.role, res.Status, c.status)
+				}
+				if c.status != http.StatusOK && strings.Contains(res.Body, "secret") {
+					t.Errorf("%s: the script ran: %q", c.role, res.Body)
+				}
+			}
+			if res := tr.Do(TestRequest{}); res.Status != http.StatusUnauthorized {
+				t.Errorf("no token: got status %d, want %d", res.Status, http.StatusUnauthorized)
+			}
+		})
+	}
+}
+
+func TestJWTClaimsFunctionRequiresInitPath(t *testing.T) {
+	_, err := NewTester(&Lua{
+		JWT:    &JWT{Secret: testJWTSecret, ClaimsFunction: "is_admin"},
+		Script: `response:write("secret")`,
+	})
+	if err == nil || !strings.Contains(err.Error(), "init_path") {
+		t.Fatalf("got error %v, want an init_path error", err)
+	}
+}
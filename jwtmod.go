@@ -0,0 +1,242 @@
+package lua
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// preloadJWTModule registers the jwt module, loaded by scripts with
+// require("jwt"), which decodes and verifies JSON Web Tokens:
+//
+//	jwt.decode(token): returns the claims and the header (alg, kid and typ)
+//	of token, without verifying it
+//	jwt.verify(token, key[, opts]): verifies the signature and the claims of
+//	token, and returns its claims
+//
+// Both return nil and an error message on failure. The key of jwt.verify is
+// the URL of a JWKS key set (http:// or https://), fetched once and cached
+// for opts.jwks_cache_ttl seconds (default 1h), a PEM encoded public key or
+// certificate (RSA, ECDSA or Ed25519), or the secret of the HMAC algorithms
+// prefixed with "hmac:", e.g. "hmac:" .. os.getenv("JWT_SECRET"), so that a
+// mangled PEM key is an error rather than a secret.
+// The opts table supports issuer, audience (a string or an array, one of
+// which the token must have), leeway (the clock skew allowed, in seconds),
+// algorithms (the array of the signing algorithms allowed, by default all
+// the algorithms of the key's type) and require_expiry (true by default).
+func preloadJWTModule(L *lua.LState) {
+	L.PreloadModule("jwt", func(L *lua.LState) int {
+		L.Push(L.SetFuncs(L.NewTable(), jwtModuleFuncs))
+		return 1
+	})
+}
+
+var jwtModuleFuncs = map[string]lua.LGFunction{
+	"decode": jwtDecode,
+	"verify": jwtVerify,
+}
+
+// jwtDecode implements jwt.decode(token).
+func jwtDecode(L *lua.LState) int {
+	tok, err := jwt.ParseSigned(L.CheckString(1))
+	if err != nil {
+		return pushJWTError(L, err)
+	}
+	var claims map[string]interface{}
+	if err := tok.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return pushJWTError(L, err)
+	}
+	hdr := L.CreateTable(0, 3)
+	if len(tok.Headers) > 0 {
+		h := tok.Headers[0]
+		hdr.RawSetString("alg", lua.LString(h.Algorithm))
+		if h.KeyID != "" {
+			hdr.RawSetString("kid", lua.LString(h.KeyID))
+		}
+		if typ, ok := h.ExtraHeaders[jose.HeaderType].(string); ok {
+			hdr.RawSetString("typ", lua.LString(typ))
+		}
+	}
+	L.Push(fromGo(L, claims))
+	L.Push(hdr)
+	return 2
+}
+
+// jwtVerify implements jwt.verify(token, key[, opts]).
+func jwtVerify(L *lua.LState) int {
+	token := L.CheckString(1)
+	keyArg := L.CheckString(2)
+	opts := L.OptTable(3, L.NewTable())
+
+	exp := jwtExpected{
+		issuer:        lua.LVAsString(opts.RawGetString("issuer")),
+		leeway:        time.Duration(float64(lua.LVAsNumber(opts.RawGetString("leeway"))) * float64(time.Second)),
+		requireExpiry: opts.RawGetString("require_expiry") != lua.LFalse,
+	}
+	switch aud := opts.RawGetString("audience").(type) {
+	case lua.LString:
+		exp.audience = []string{string(aud)}
+	case *lua.LTable:
+		exp.audience = tableStrings(aud)
+	}
+	var algorithms []string
+	if t := optTable(opts.RawGetString("algorithms")); t != nil {
+		algorithms = tableStrings(t)
+	}
+
+	ctx := stateContext(L)
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var key func(jose.Header) (interface{}, error)
+	if isJWKSURL(keyArg) {
+		ttl := time.Duration(float64(lua.LVAsNumber(opts.RawGetString("jwks_cache_ttl"))) * float64(time.Second))
+		jwks := moduleJWKS.get(keyArg, ttl)
+		key = func(hdr jose.Header) (interface{}, error) {
+			if err := checkJWTAlgorithm(algorithms, hdr.Algorithm); err != nil {
+				return nil, err
+			}
+			return jwks.verificationKey(ctx, hdr)
+		}
+	} else {
+		pub, allowed, err := parseJWTKey(keyArg)
+		if err != nil {
+			return pushJWTError(L, err)
+		}
+		key = func(hdr jose.Header) (interface{}, error) {
+			if !containsString(allowed, hdr.Algorithm) {
+				return nil, fmt.Errorf("unexpected signing algorithm %q", hdr.Algorithm)
+			}
+			if err := checkJWTAlgorithm(algorithms, hdr.Algorithm); err != nil {
+				return nil, err
+			}
+			return pub, nil
+		}
+	}
+
+	// the key set of a JWKS URL may be fetched
+	var claims map[string]interface{}
+	var err error
+	unlocked(L, func() { claims, err = verifyJWT(token, key, exp) })
+	if err != nil {
+		return pushJWTError(L, err)
+	}
+	L.Push(fromGo(L, claims))
+	return 1
+}
+
+// isJWKSURL returns true if the key s of jwt.verify is the URL of a key set.
+func isJWKSURL(s string) bool {
+	return strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://")
+}
+
+func pushJWTError(L *lua.LState, err error) int {
+	L.Push(lua.LNil)
+	L.Push(lua.LString(err.Error()))
+	return 2
+}
+
+// tableStrings returns the string values of the array t.
+func tableStrings(t *lua.LTable) []string {
+	list := make([]string, 0, t.Len())
+	for i := 1; i <= t.Len(); i++ {
+		list = append(list, lua.LVAsString(t.RawGetInt(i)))
+	}
+	return list
+}
+
+// checkJWTAlgorithm returns an error if algorithms is not empty and does not
+// contain alg.
+func checkJWTAlgorithm(algorithms []string, alg string) error {
+	if len(algorithms) > 0 && !containsString(algorithms, alg) {
+		return fmt.Errorf("signing algorithm %q not allowed", alg)
+	}
+	return nil
+}
+
+// parseJWTKey returns the verification key of s, a PEM encoded public key or
+// certificate or an HMAC secret prefixed with "hmac:", and the signing
+// algorithms of its type.
+func parseJWTKey(s string) (interface{}, []string, error) {
+	if strings.HasPrefix(s, jwtHMACKeyPrefix) {
+		secret := strings.TrimPrefix(s, jwtHMACKeyPrefix)
+		if secret == "" {
+			return nil, nil, errors.New("the HMAC secret is empty")
+		}
+		return []byte(secret), hmacAlgorithms, nil
+	}
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		if strings.HasPrefix(strings.TrimSpace(s), "-----BEGIN") {
+			return nil, nil, errors.New("the PEM encoded key cannot be decoded")
+		}
+		return nil, nil, fmt.Errorf("the key must be a JWKS URL, a PEM encoded key or a secret prefixed with %q", jwtHMACKeyPrefix)
+	}
+
+	var pub interface{}
+	var err error
+	switch block.Type {
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			pub = cert.PublicKey
+		}
+	case "RSA PUBLIC KEY":
+		pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing the key: %w", err)
+	}
+
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return pub, []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}, nil
+	case *ecdsa.PublicKey:
+		return pub, []string{"ES256", "ES384", "ES512"}, nil
+	case ed25519.PublicKey:
+		return pub, []string{"EdDSA"}, nil
+	}
+	return nil, nil, errors.New("unsupported key type")
+}
+
+// jwtHMACKeyPrefix is the prefix of the HMAC secrets of jwt.verify.
+const jwtHMACKeyPrefix = "hmac:"
+
+// moduleJWKS holds the key sets used by jwt.verify, shared by all the
+// handlers.
+var moduleJWKS = &jwksRegistry{sets: make(map[string]*jwksCache)}
+
+type jwksRegistry struct {
+	mu   sync.Mutex
+	sets map[string]*jwksCache
+}
+
+// get returns the cache of the key set at url, creating it with ttl (or the
+// default TTL if it is not positive) if it does not exist.
+func (r *jwksRegistry) get(url string, ttl time.Duration) *jwksCache {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.sets[url]
+	if c == nil {
+		if ttl <= 0 {
+			ttl = defaultJWKSCacheTTL
+		}
+		c = &jwksCache{url: url, ttl: ttl}
+		r.sets[url] = c
+	}
+	return c
+}
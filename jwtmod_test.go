@@ -0,0 +1,77 @@
+package lua
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseJWTKey(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	cases := []struct {
+		key  string
+		alg  string
+		want string // error
+	}{
+		{key: "hmac:" + testJWTSecret, alg: "HS256"},
+		{key: pemKey, alg: "ES256"},
+		{key: "hmac:", want: "secret is empty"},
+		{key: testJWTSecret, want: "prefixed with"},
+		// a truncated PEM key is not an HMAC secret
+		{key: pemKey[:len(pemKey)-30], want: "cannot be decoded"},
+	}
+	for _, c := range cases {
+		_, algs, err := parseJWTKey(c.key)
+		if c.want != "" {
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("%.20q: got error %v, want %q", c.key, err, c.want)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%.20q: %s", c.key, err)
+		} else if !containsString(algs, c.alg) {
+			t.Errorf("%.20q: got algorithms %v, want %s", c.key, algs, c.alg)
+		}
+	}
+}
+
+func TestJWTModuleVerifyHMAC(t *testing.T) {
+	tr, err := NewTester(&Lua{Script: `
+		local jwt = require("jwt")
+		local claims, err = jwt.verify(request.headers["X-Token"], request.headers["X-Key"])
+		if not claims then
+			response:set_status(401)
+			response:write(err)
+			return
+		end
+		response:write(claims.role)`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	token := signTestJWT(t, "admin")
+	res := tr.Do(TestRequest{Header: http.Header{"X-Token": {token}, "X-Key": {"hmac:" + testJWTSecret}}})
+	if res.Status != http.StatusOK || res.Body != "admin" {
+		t.Errorf("hmac: got %d %q", res.Status, res.Body)
+	}
+	res = tr.Do(TestRequest{Header: http.Header{"X-Token": {token}, "X-Key": {testJWTSecret}}})
+	if res.Status != http.StatusUnauthorized {
+		t.Errorf("secret without prefix: got %d %q", res.Status, res.Body)
+	}
+}
@@ -0,0 +1,493 @@
+package lua
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+	lua "github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultKeyringName      = "default"
+	defaultKeyringRotation  = 30 * 24 * time.Hour
+	defaultKeyringKeep      = 3
+	maxKeyringRefreshPeriod = time.Hour
+
+	// minKeyringReload is the minimum delay between two loads of the keys
+	// caused by tokens or signatures of an unknown key.
+	minKeyringReload = 10 * time.Second
+)
+
+var keyringNameRx = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Keyring configures the keyring used by the caddy.keys and caddy.cookie
+// functions. The keys are stored in Caddy's configured storage, so that all
+// Caddy instances that share the storage use the same keys, and they are
+// rotated automatically. The newest key is used to encrypt and sign, and up
+// to Keep keys are kept to decrypt and verify. The keys are loaded again from storage when a token
+// or a signature has an unknown key, e.g. one that another instance just
+// created, at most once every 10s.
+type Keyring struct {
+	Name             string         `json:"name,omitempty"`
+	RotationInterval caddy.Duration `json:"rotation_interval,omitempty"`
+	Keep             int            `json:"keep,omitempty"`
+}
+
+// validate returns an error if the keyring configuration is invalid.
+func (kr *Keyring) validate() error {
+	if kr.Name != "" && !keyringNameRx.MatchString(kr.Name) {
+		return fmt.Errorf("invalid keyring name: %q", kr.Name)
+	}
+	if kr.RotationInterval < 0 {
+		return fmt.Errorf("keyring rotation_interval must not be negative")
+	}
+	if kr.Keep < 0 {
+		return fmt.Errorf("keyring keep must not be negative")
+	}
+	return nil
+}
+
+// unmarshalCaddyfile sets up the keyring from the option's tokens.
+func (kr *Keyring) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if d.NextArg() {
+		kr.Name = d.Val()
+	}
+	if d.NextArg() {
+		return d.Errf("keyring: %w", d.ArgErr())
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch field := d.Val(); field {
+		case "rotation_interval":
+			var s string
+			if !d.Args(&s) {
+				return d.Errf("keyring %s: %w", field, d.ArgErr())
+			}
+			dur, err := caddy.ParseDuration(s)
+			if err != nil {
+				return d.Errf("keyring %s: %w", field, err)
+			}
+			kr.RotationInterval = caddy.Duration(dur)
+
+		case "keep":
+			var s string
+			if !d.Args(&s) {
+				return d.Errf("keyring %s: %w", field, d.ArgErr())
+			}
+			var n int
+			if _, err := fmt.Sscan(s, &n); err != nil {
+				return d.Errf("keyring %s: %w", field, err)
+			}
+			kr.Keep = n
+
+		default:
+			return d.Errf("keyring %s: unknown configuration option", field)
+		}
+	}
+	return nil
+}
+
+// keyringKey is a key of a keyring, as saved in storage.
+type keyringKey struct {
+	ID      string    `json:"id"`
+	Secret  []byte    `json:"secret"`
+	Created time.Time `json:"created"`
+
+	encKey []byte
+	macKey []byte
+}
+
+// derive computes the encryption and signing keys from the key's secret.
+func (k *keyringKey) derive() {
+	k.encKey = deriveKey(k.Secret, "caddy-lua encrypt")
+	k.macKey = deriveKey(k.Secret, "caddy-lua sign")
+}
+
+func deriveKey(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// keyring is the runtime state of a Keyring.
+type keyring struct {
+	storage    certmagic.Storage
+	storageKey string
+	rotation   time.Duration
+	keep       int
+	logger     *zap.Logger
+	cancel     context.CancelFunc
+
+	mu   sync.RWMutex
+	keys []*keyringKey // newest first
+
+	reloadMu sync.Mutex
+	reloaded time.Time
+}
+
+// newKeyring returns the keyring described by cfg, loading (or creating)
+// its keys from storage and starting its background refresh.
+func newKeyring(ctx context.Context, storage certmagic.Storage, cfg *Keyring, logger *zap.Logger) (*keyring, error) {
+	name := cfg.Name
+	if name == "" {
+		name = defaultKeyringName
+	}
+	kr := &keyring{
+		storage:    storage,
+		storageKey: "lua/keyrings/" + name + ".json",
+		rotation:   time.Duration(cfg.RotationInterval),
+		keep:       cfg.Keep,
+		logger:     logger,
+	}
+	if kr.rotation == 0 {
+		kr.rotation = defaultKeyringRotation
+	}
+	if kr.keep == 0 {
+		kr.keep = defaultKeyringKeep
+	}
+	if err := kr.refresh(ctx); err != nil {
+		return nil, fmt.Errorf("loading keyring %s: %w", name, err)
+	}
+
+	period := kr.rotation / 4
+	if period > maxKeyringRefreshPeriod {
+		period = maxKeyringRefreshPeriod
+	}
+	bgctx, cancel := context.WithCancel(context.Background())
+	kr.cancel = cancel
+	go kr.refreshEvery(bgctx, period)
+	return kr, nil
+}
+
+// stop stops the background refresh of the keyring.
+func (kr *keyring) stop() {
+	kr.cancel()
+}
+
+func (kr *keyring) refreshEvery(ctx context.Context, period time.Duration) {
+	t := time.NewTicker(period)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := kr.refresh(ctx); err != nil {
+				kr.logger.Error("refreshing keyring", zap.String("key", kr.storageKey), zap.Error(err))
+			}
+		}
+	}
+}
+
+// refresh loads the keys from storage, rotating them if the newest key is
+// older than the rotation interval.
+func (kr *keyring) refresh(ctx context.Context) error {
+	keys, err := kr.load(ctx)
+	if err != nil {
+		return err
+	}
+	if kr.needsRotation(keys) {
+		if keys, err = kr.rotate(ctx); err != nil {
+			return err
+		}
+	}
+
+	kr.mu.Lock()
+	kr.keys = keys
+	kr.mu.Unlock()
+	return nil
+}
+
+func (kr *keyring) needsRotation(keys []*keyringKey) bool {
+	return len(keys) == 0 || time.Since(keys[0].Created) >= kr.rotation
+}
+
+// rotate adds a new key to the keyring in storage, holding the storage lock
+// so that concurrent Caddy instances don't rotate at the same time.
+func (kr *keyring) rotate(ctx context.Context) ([]*keyringKey, error) {
+	if err := kr.storage.Lock(ctx, kr.storageKey); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := kr.storage.Unlock(ctx, kr.storageKey); err != nil {
+			kr.logger.Error("unlocking keyring", zap.String("key", kr.storageKey), zap.Error(err))
+		}
+	}()
+
+	// another instance may have rotated while we were waiting for the lock
+	keys, err := kr.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !kr.needsRotation(keys) {
+		return keys, nil
+	}
+
+	k := &keyringKey{
+		Secret:  make([]byte, 32),
+		Created: time.Now().UTC(),
+	}
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(k.Secret); err != nil {
+		return nil, err
+	}
+	k.ID = hex.EncodeToString(id)
+	k.derive()
+
+	keys = append([]*keyringKey{k}, keys...)
+	if len(keys) > kr.keep {
+		keys = keys[:kr.keep]
+	}
+	b, err := json.Marshal(keys)
+	if err != nil {
+		return nil, err
+	}
+	if err := kr.storage.Store(ctx, kr.storageKey, b); err != nil {
+		return nil, err
+	}
+	kr.logger.Info("rotated keyring", zap.String("key", kr.storageKey), zap.String("id", k.ID))
+	return keys, nil
+}
+
+// load returns the keys saved in storage, which may be empty.
+func (kr *keyring) load(ctx context.Context) ([]*keyringKey, error) {
+	b, err := kr.storage.Load(ctx, kr.storageKey)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var keys []*keyringKey
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		k.derive()
+	}
+	return keys, nil
+}
+
+// current returns the newest key.
+func (kr *keyring) current() *keyringKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.keys[0]
+}
+
+// lookup returns the key with the specified id, or nil.
+func (kr *keyring) lookup(id string) *keyringKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	for _, k := range kr.keys {
+		if k.ID == id {
+			return k
+		}
+	}
+	return nil
+}
+
+// find returns the key with the specified id, loading the keys from storage
+// if it is not one of them, or nil.
+func (kr *keyring) find(id string) *keyringKey {
+	if k := kr.lookup(id); k != nil {
+		return k
+	}
+	kr.reload()
+	return kr.lookup(id)
+}
+
+// reload loads the keys from storage, unless they were loaded by reload less
+// than minKeyringReload ago, so that the tokens of unknown keys do not load
+// them for each request.
+func (kr *keyring) reload() {
+	kr.reloadMu.Lock()
+	defer kr.reloadMu.Unlock()
+	if time.Since(kr.reloaded) < minKeyringReload {
+		return
+	}
+	kr.reloaded = time.Now()
+	keys, err := kr.load(context.Background())
+	if err != nil {
+		kr.logger.Error("reloading keyring", zap.String("key", kr.storageKey), zap.Error(err))
+		return
+	}
+	if len(keys) == 0 {
+		return
+	}
+	kr.mu.Lock()
+	kr.keys = keys
+	kr.mu.Unlock()
+}
+
+var errInvalidToken = errors.New("invalid or expired token")
+
+// encrypt encrypts and authenticates plaintext and the additional data ad,
+// which is not part of the token, with the newest key. The returned token is
+// the key id and the base64-encoded nonce and ciphertext, separated by a dot.
+func (kr *keyring) encrypt(plaintext, ad []byte) (string, error) {
+	k := kr.current()
+	aead, err := newAEAD(k.encKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, append([]byte(k.ID), ad...))
+	return k.ID + "." + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt decrypts a token created by encrypt with the same additional data
+// ad, with any of the kept keys.
+func (kr *keyring) decrypt(token string, ad []byte) ([]byte, error) {
+	id, payload, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errInvalidToken
+	}
+	k := kr.find(id)
+	if k == nil {
+		return nil, errInvalidToken
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	aead, err := newAEAD(k.encKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errInvalidToken
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, append([]byte(k.ID), ad...))
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	return plaintext, nil
+}
+
+// sign returns the signature of msg with the newest key, which is the key id
+// and the base64-encoded HMAC-SHA256 of msg, separated by a dot.
+func (kr *keyring) sign(msg []byte) string {
+	k := kr.current()
+	return k.ID + "." + base64.RawURLEncoding.EncodeToString(hmacSum(k.macKey, msg))
+}
+
+// verify returns true if sig is a valid signature of msg with any of the
+// kept keys.
+func (kr *keyring) verify(msg []byte, sig string) bool {
+	id, payload, ok := strings.Cut(sig, ".")
+	if !ok {
+		return false
+	}
+	k := kr.find(id)
+	if k == nil {
+		return false
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(sum, hmacSum(k.macKey, msg))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func hmacSum(key, msg []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+var keysFuncs = map[string]lua.LGFunction{
+	"encrypt": keysEncrypt,
+	"decrypt": keysDecrypt,
+	"sign":    keysSign,
+	"verify":  keysVerify,
+}
+
+// checkKeyring returns the keyring of the handler, raising a Lua error if
+// none is configured.
+func checkKeyring(L *lua.LState) *keyring {
+	kr := checkRequestContext(L).handler.keyring
+	if kr == nil {
+		L.RaiseError("no keyring is configured for this handler")
+	}
+	return kr
+}
+
+// keysEncrypt implements caddy.keys.encrypt(plaintext).
+func keysEncrypt(L *lua.LState) int {
+	kr := checkKeyring(L)
+	token, err := kr.encrypt([]byte(L.CheckString(1)), nil)
+	if err != nil {
+		L.RaiseError("caddy.keys.encrypt: %s", err)
+	}
+	L.Push(lua.LString(token))
+	return 1
+}
+
+// keysDecrypt implements caddy.keys.decrypt(token), returning the plaintext,
+// or nil and an error message if the token is invalid.
+func keysDecrypt(L *lua.LState) int {
+	kr := checkKeyring(L)
+	token := L.CheckString(1)
+	var plaintext []byte
+	var err error
+	// it may load the keys from storage
+	unlocked(L, func() { plaintext, err = kr.decrypt(token, nil) })
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LString(plaintext))
+	return 1
+}
+
+// keysSign implements caddy.keys.sign(msg).
+func keysSign(L *lua.LState) int {
+	kr := checkKeyring(L)
+	L.Push(lua.LString(kr.sign([]byte(L.CheckString(1)))))
+	return 1
+}
+
+// keysVerify implements caddy.keys.verify(msg, sig).
+func keysVerify(L *lua.LState) int {
+	kr := checkKeyring(L)
+	msg, sig := L.CheckString(1), L.CheckString(2)
+	var ok bool
+	unlocked(L, func() { ok = kr.verify([]byte(msg), sig) })
+	L.Push(lua.LBool(ok))
+	return 1
+}
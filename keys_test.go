@@ -0,0 +1,73 @@
+package lua
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+func TestKeyringProvision(t *testing.T) {
+	tr, err := NewTester(&Lua{
+		Keyring: &Keyring{},
+		Script: `
+			local token = caddy.keys.encrypt("hello")
+			local sig = caddy.keys.sign("msg")
+			response:write(caddy.keys.decrypt(token) .. " " .. tostring(caddy.keys.verify("msg", sig)))`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	res := tr.Do(TestRequest{})
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	if want := "hello true"; res.Body != want {
+		t.Errorf("got %q, want %q", res.Body, want)
+	}
+}
+
+func TestKeyringReloadUnknownKey(t *testing.T) {
+	ctx := context.Background()
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	kr1, err := newKeyring(ctx, storage, &Keyring{}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kr1.stop()
+	kr2, err := newKeyring(ctx, storage, &Keyring{}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kr2.stop()
+
+	// another instance rotates the keys
+	rotate := func() {
+		kr2.rotation = time.Nanosecond
+		if err := kr2.refresh(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotate()
+	token, err := kr2.encrypt([]byte("hello"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := kr1.decrypt(token, nil); err != nil || string(b) != "hello" {
+		t.Fatalf("got %q, %v, want the token of the new key to be decrypted", b, err)
+	}
+
+	// the keys are not loaded again right away
+	rotate()
+	if kr1.verify([]byte("msg"), kr2.sign([]byte("msg"))) {
+		t.Fatal("the keys were loaded again before minKeyringReload")
+	}
+	kr1.reloaded = time.Now().Add(-minKeyringReload)
+	if !kr1.verify([]byte("msg"), kr2.sign([]byte("msg"))) {
+		t.Fatal("the signature of the new key is not verified")
+	}
+}
@@ -0,0 +1,264 @@
+package lua
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// kvSweepInterval is the minimum interval between the removals of the
+// expired keys of the store, done when a key is set.
+const kvSweepInterval = time.Minute
+
+// kvStore is the in-process key/value store shared by all the scripts of the
+// handlers without a runtime.
+var kvStore = &kvRegistry{m: make(map[string]kvEntry)}
+
+type kvEntry struct {
+	value   interface{}
+	expires time.Time // zero if the key does not expire
+}
+
+func (e kvEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// kvRegistry is a concurrent map of keys to values with an optional
+// expiration time.
+type kvRegistry struct {
+	mu        sync.Mutex
+	m         map[string]kvEntry
+	nextSweep time.Time
+}
+
+// get returns the value of key, or false if it is not set.
+func (s *kvRegistry) get(key string) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.m[key]
+	if !ok || e.expired(time.Now()) {
+		return nil, false
+	}
+	return e.value, true
+}
+
+// set sets the value of key, expiring after ttl if it is positive.
+func (s *kvRegistry) set(key string, value interface{}, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.m[key] = kvEntry{value: value, expires: expiresAt(now, ttl)}
+	s.sweep(now)
+}
+
+// incr adds delta to the numeric value of key, which is 0 if it is not set
+// or not a number, and returns the result. If ttl is positive, the
+// expiration of key is set to ttl from now, otherwise it is left unchanged.
+func (s *kvRegistry) incr(key string, delta float64, ttl time.Duration) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	e, ok := s.m[key]
+	if !ok || e.expired(now) {
+		e = kvEntry{}
+	}
+	n, _ := e.value.(float64)
+	e.value = n + delta
+	if ttl > 0 {
+		e.expires = expiresAt(now, ttl)
+	}
+	s.m[key] = e
+	s.sweep(now)
+	return n + delta
+}
+
+// setIf sets the value of key like set if it is set (exists is true) or if
+// it is not set (exists is false), and reports whether it was set.
+func (s *kvRegistry) setIf(key string, value interface{}, ttl time.Duration, exists bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	e, ok := s.m[key]
+	if ok && e.expired(now) {
+		ok = false
+	}
+	if ok != exists {
+		return false
+	}
+	s.m[key] = kvEntry{value: value, expires: expiresAt(now, ttl)}
+	s.sweep(now)
+	return true
+}
+
+// incrFrom adds delta to the numeric value of key like incr, or to init if
+// key is not set, and returns false without setting key if neither key nor
+// init are set.
+func (s *kvRegistry) incrFrom(key string, delta float64, init *float64) (float64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	e, ok := s.m[key]
+	if !ok || e.expired(now) {
+		if init == nil {
+			return 0, false
+		}
+		e = kvEntry{value: *init}
+	}
+	n, _ := e.value.(float64)
+	e.value = n + delta
+	s.m[key] = e
+	s.sweep(now)
+	return n + delta, true
+}
+
+// update sets the value of key to the result of fn, called with the current
+// value (nil if key is not set) while the lock is held, so that fn can update
+// it atomically. The key expires after ttl if it is positive.
+func (s *kvRegistry) update(key string, ttl time.Duration, fn func(v interface{}) interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	e, ok := s.m[key]
+	if !ok || e.expired(now) {
+		e = kvEntry{}
+	}
+	s.m[key] = kvEntry{value: fn(e.value), expires: expiresAt(now, ttl)}
+	s.sweep(now)
+}
+
+// delete removes key.
+func (s *kvRegistry) delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, key)
+}
+
+// keys returns the keys that start with prefix.
+func (s *kvRegistry) keys(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var keys []string
+	for k, e := range s.m {
+		if strings.HasPrefix(k, prefix) && !e.expired(now) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sweep removes the expired keys if the last sweep is older than
+// kvSweepInterval. The lock must be held.
+func (s *kvRegistry) sweep(now time.Time) {
+	if now.Before(s.nextSweep) {
+		return
+	}
+	s.nextSweep = now.Add(kvSweepInterval)
+	for k, e := range s.m {
+		if e.expired(now) {
+			delete(s.m, k)
+		}
+	}
+}
+
+func expiresAt(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+// preloadKVModule registers the kv module, loaded by scripts with
+// require("kv"). It gives access to a key/value store shared by all the
+// requests and handlers of the process, or of the runtime of the handler
+// (see luaRuntimes), kept in memory until Caddy exits:
+//
+//	kv.get(key): the value of key, or nil if it is not set
+//	kv.set(key, value[, ttl]): sets the value of key, expiring after ttl
+//	seconds if set; a nil value deletes the key
+//	kv.delete(key): deletes key
+//	kv.incr(key[, delta[, ttl]]): atomically adds delta (default 1) to the
+//	numeric value of key and returns the result
+//	kv.keys([prefix]): a sorted array of the keys that start with prefix
+//
+// Values may be strings, numbers, booleans or tables of those, which are
+// copied in and out of the store.
+func preloadKVModule(L *lua.LState) {
+	L.PreloadModule("kv", func(L *lua.LState) int {
+		L.Push(L.SetFuncs(L.NewTable(), kvFuncs))
+		return 1
+	})
+}
+
+var kvFuncs = map[string]lua.LGFunction{
+	"get":    kvGet,
+	"set":    kvSet,
+	"delete": kvDelete,
+	"incr":   kvIncr,
+	"keys":   kvKeys,
+}
+
+// kvGet implements kv.get(key).
+func kvGet(L *lua.LState) int {
+	kv := checkKVStore(L)
+	v, ok := kv.get(L.CheckString(1))
+	if !ok {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(fromGo(L, v))
+	return 1
+}
+
+// kvSet implements kv.set(key, value[, ttl]).
+func kvSet(L *lua.LState) int {
+	kv := checkKVStore(L)
+	key := L.CheckString(1)
+	if L.Get(2) == lua.LNil {
+		kv.delete(key)
+		return 0
+	}
+	v, err := toGo(L.CheckAny(2))
+	if err != nil {
+		L.ArgError(2, err.Error())
+	}
+	kv.set(key, v, optSeconds(L, 3))
+	return 0
+}
+
+// kvDelete implements kv.delete(key).
+func kvDelete(L *lua.LState) int {
+	kv := checkKVStore(L)
+	kv.delete(L.CheckString(1))
+	return 0
+}
+
+// kvIncr implements kv.incr(key[, delta[, ttl]]).
+func kvIncr(L *lua.LState) int {
+	kv := checkKVStore(L)
+	key := L.CheckString(1)
+	delta := L.OptNumber(2, 1)
+	L.Push(lua.LNumber(kv.incr(key, float64(delta), optSeconds(L, 3))))
+	return 1
+}
+
+// kvKeys implements kv.keys([prefix]).
+func kvKeys(L *lua.LState) int {
+	kv := checkKVStore(L)
+	L.Push(stringArray(L, kv.keys(L.OptString(1, ""))))
+	return 1
+}
+
+// optSeconds returns the optional duration in seconds at index n of the
+// stack, or 0 if it is not set.
+func optSeconds(L *lua.LState, n int) time.Duration {
+	secs := L.OptNumber(n, 0)
+	if secs < 0 {
+		L.ArgError(n, "the duration must not be negative")
+	}
+	return time.Duration(float64(secs) * float64(time.Second))
+}
@@ -0,0 +1,254 @@
+package lua
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// The names of the limits of caddy.limit, which are also the keys of their
+// error responses.
+const (
+	limitMaxBody     = "max_body"
+	limitMaxHeaders  = "max_headers"
+	limitMaxDuration = "max_duration"
+)
+
+// routeLimit is a set of request limits declared by the init script with
+// caddy.limit, enforced for the requests whose path matches before the
+// handler runs.
+type routeLimit struct {
+	paths       caddyhttp.MatchPath
+	maxBody     int64
+	maxHeaders  int
+	maxDuration time.Duration
+
+	// errors are the responses of the exceeded limits, by limit name.
+	errors map[string]*limitResponse
+}
+
+// limitResponse is the response of an exceeded limit.
+type limitResponse struct {
+	status int
+	header http.Header
+	body   string
+}
+
+// caddyLimit implements caddy.limit(paths, limits), which declares the
+// limits of the requests whose path matches paths, a path pattern like those
+// of the route option (e.g. "/api/*", or "*" for all the requests) or an
+// array of patterns. It can only be called by the init script:
+//
+//	-- init.lua
+//	caddy.limit("/upload/*", {
+//		max_body = 10 * 1024 * 1024,
+//		max_duration = 30,
+//		errors = {
+//			max_body = {status = 413, body = '{"error":"too large"}',
+//				headers = {["Content-Type"] = "application/json"}},
+//		},
+//	})
+//	caddy.limit("*", {max_body = 64 * 1024, max_headers = 50})
+//
+// The limits table supports:
+//
+//	max_body: the maximum size of the request body in bytes
+//	max_headers: the maximum number of request header values
+//	max_duration: the maximum time in seconds to handle the request,
+//	including the time spent in the next handlers
+//	errors: the responses of the exceeded limits, by limit name, tables
+//	with the status, body and headers of the response
+//
+// The limits of the first declaration whose paths match the request apply,
+// before the scripts run and the JWT is checked. A request whose
+// Content-Length or header count exceeds its limits is rejected with the
+// response of the limit, or the 413 and 431 errors by default. A body that
+// is larger than max_body once read fails the reads of the scripts and of
+// the next handlers, and a request still handled after max_duration is
+// canceled. Both respond with the response of the limit, or the 413 and
+// 503 errors by default, unless the response is already written.
+func caddyLimit(L *lua.LState) int {
+	if !isInitState(L) {
+		L.RaiseError("caddy.limit can only be called by the init script")
+	}
+	var paths caddyhttp.MatchPath
+	switch v := L.CheckAny(1).(type) {
+	case lua.LString:
+		paths = append(paths, string(v))
+	case *lua.LTable:
+		for i := 1; i <= v.Len(); i++ {
+			paths = append(paths, lua.LVAsString(v.RawGetInt(i)))
+		}
+	default:
+		L.ArgError(1, "path pattern or array of path patterns expected")
+	}
+	for i, p := range paths {
+		if p != "*" && !strings.HasPrefix(p, "/") {
+			L.ArgError(1, fmt.Sprintf("invalid path pattern: %q", p))
+		}
+		paths[i] = strings.ToLower(p)
+	}
+	opts := L.CheckTable(2)
+
+	lim := &routeLimit{
+		paths:       paths,
+		maxBody:     int64(lua.LVAsNumber(opts.RawGetString(limitMaxBody))),
+		maxHeaders:  int(lua.LVAsNumber(opts.RawGetString(limitMaxHeaders))),
+		maxDuration: time.Duration(float64(lua.LVAsNumber(opts.RawGetString(limitMaxDuration))) * float64(time.Second)),
+		errors:      make(map[string]*limitResponse),
+	}
+	if lim.maxBody < 0 || lim.maxHeaders < 0 || lim.maxDuration < 0 {
+		L.ArgError(2, "the limits must not be negative")
+	}
+	if errs := optTable(opts.RawGetString("errors")); errs != nil {
+		var err error
+		errs.ForEach(func(k, v lua.LValue) {
+			name := k.String()
+			if err != nil {
+				return
+			}
+			if name != limitMaxBody && name != limitMaxHeaders && name != limitMaxDuration {
+				err = fmt.Errorf("unknown limit in errors: %s", name)
+				return
+			}
+			t := optTable(v)
+			if t == nil {
+				err = fmt.Errorf("the error response of %s must be a table", name)
+				return
+			}
+			resp := &limitResponse{
+				status: int(lua.LVAsNumber(t.RawGetString("status"))),
+				header: optHeader(t.RawGetString("headers")),
+				body:   lua.LVAsString(t.RawGetString("body")),
+			}
+			if resp.status != 0 && (resp.status < 100 || resp.status > 999) {
+				err = fmt.Errorf("invalid status of the error response of %s: %d", name, resp.status)
+				return
+			}
+			lim.errors[name] = resp
+		})
+		if err != nil {
+			L.ArgError(2, err.Error())
+		}
+	}
+	l := checkHandler(L)
+	l.limits = append(l.limits, lim)
+	return 0
+}
+
+// matchLimit returns the first limit whose paths match r, or nil.
+func (l *Lua) matchLimit(r *http.Request) *routeLimit {
+	for _, lim := range l.limits {
+		for _, p := range lim.paths {
+			if p == "*" {
+				return lim
+			}
+		}
+		if lim.paths.Match(r) {
+			return lim
+		}
+	}
+	return nil
+}
+
+// serve enforces the limits of lim on r, which is handled by serve unless
+// its Content-Length or header count exceeds them.
+func (lim *routeLimit) serve(w http.ResponseWriter, r *http.Request, serve func(http.ResponseWriter, *http.Request) error) error {
+	if lim.maxHeaders > 0 {
+		n := 0
+		for _, vals := range r.Header {
+			n += len(vals)
+		}
+		if n > lim.maxHeaders {
+			return lim.exceeded(w, limitMaxHeaders, http.StatusRequestHeaderFieldsTooLarge,
+				fmt.Errorf("the request has more than %d header values", lim.maxHeaders))
+		}
+	}
+	var body *limitedBody
+	if lim.maxBody > 0 {
+		errBody := fmt.Errorf("the request body is larger than %d bytes", lim.maxBody)
+		if r.ContentLength > lim.maxBody {
+			return lim.exceeded(w, limitMaxBody, http.StatusRequestEntityTooLarge, errBody)
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			body = &limitedBody{ReadCloser: r.Body, n: lim.maxBody, err: errBody}
+			r.Body = body
+		}
+	}
+	if body == nil && lim.maxDuration <= 0 {
+		return serve(w, r)
+	}
+
+	ctx := r.Context()
+	if lim.maxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, lim.maxDuration)
+		defer cancel()
+	}
+	tw := &writeTracker{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w}}
+	err := serve(tw, r.WithContext(ctx))
+	if tw.wrote {
+		return err
+	}
+	switch {
+	case body != nil && body.exceeded:
+		return lim.exceeded(w, limitMaxBody, http.StatusRequestEntityTooLarge, body.err)
+	case r.Context().Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return lim.exceeded(w, limitMaxDuration, http.StatusServiceUnavailable,
+			fmt.Errorf("the request was not handled within %s", lim.maxDuration))
+	}
+	return err
+}
+
+// exceeded writes the response of the exceeded limit name, or returns the
+// err error with status if the limit has no response.
+func (lim *routeLimit) exceeded(w http.ResponseWriter, name string, status int, err error) error {
+	resp := lim.errors[name]
+	if resp == nil {
+		return caddyhttp.Error(status, err)
+	}
+	for k, vals := range resp.header {
+		w.Header()[k] = vals
+	}
+	if resp.status != 0 {
+		status = resp.status
+	}
+	w.WriteHeader(status)
+	_, werr := io.WriteString(w, resp.body)
+	return werr
+}
+
+// limitedBody is a request body that fails with err once more than n bytes
+// are read from it.
+type limitedBody struct {
+	io.ReadCloser
+	n        int64
+	err      error
+	exceeded bool
+}
+
+// Read implements io.Reader.
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.exceeded {
+		return 0, b.err
+	}
+	// read one more byte than the limit to detect the larger bodies
+	if int64(len(p)) > b.n+1 {
+		p = p[:b.n+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.n {
+		b.exceeded = true
+		// the reader gets the bytes within the limit with the error
+		return int(b.n), b.err
+	}
+	b.n -= int64(n)
+	return n, err
+}
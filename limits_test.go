@@ -0,0 +1,118 @@
+package lua
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInitScriptLimits(t *testing.T) {
+	initPath := filepath.Join(t.TempDir(), "init.lua")
+	if err := os.WriteFile(initPath, []byte(`
+		caddy.limit({"/upload/*"}, {
+			max_body = 16,
+			errors = {max_body = {status = 400, body = "too large", headers = {["X-Limit"] = "max_body"}}},
+		})
+		caddy.limit("/slow", {max_duration = 0.05})
+		caddy.limit("*", {max_body = 64, max_headers = 3})`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, isolation := range []string{isolationPerRequest, isolationPooled, isolationSharedCoroutine} {
+		t.Run(isolation, func(t *testing.T) {
+			tr, err := NewTester(&Lua{
+				Isolation: isolation,
+				InitPath:  initPath,
+				Script: `
+					if request.path == "/slow" then
+						while true do end
+					end
+					local body, err = request:body()
+					response:write(body or err)`,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tr.Close()
+
+			cases := []struct {
+				name   string
+				req    TestRequest
+				status int
+				body   string
+			}{
+				{"within", TestRequest{Method: http.MethodPost, Path: "/upload/a", Body: "small"}, http.StatusOK, "small"},
+				{"custom", TestRequest{Method: http.MethodPost, Path: "/upload/a", Body: strings.Repeat("x", 17)}, 400, "too large"},
+				{"default", TestRequest{Method: http.MethodPost, Body: strings.Repeat("x", 65)}, http.StatusRequestEntityTooLarge, ""},
+				{"headers", TestRequest{Header: http.Header{"A": {"1", "2"}, "B": {"3", "4"}}}, http.StatusRequestHeaderFieldsTooLarge, ""},
+				{"duration", TestRequest{Path: "/slow"}, http.StatusServiceUnavailable, ""},
+			}
+			for _, c := range cases {
+				res := tr.Do(c.req)
+				if res.Status != c.status || res.Body != c.body {
+					t.Errorf("%s: got %d %q (%v), want %d %q", c.name, res.Status, res.Body, res.Err, c.status, c.body)
+				}
+				if c.name == "custom" && res.Header.Get("X-Limit") != "max_body" {
+					t.Errorf("custom: got the headers %v", res.Header)
+				}
+			}
+		})
+	}
+}
+
+func TestLimitOutsideInitScript(t *testing.T) {
+	tr, err := NewTester(&Lua{Script: `caddy.limit("*", {max_body = 1})`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	res := tr.Do(TestRequest{})
+	if res.Err == nil || !strings.Contains(res.Err.Error(), "can only be called by the init script") {
+		t.Errorf("got %v, want the init script error", res.Err)
+	}
+}
+
+func TestRouteLimitStreamedBody(t *testing.T) {
+	lim := &routeLimit{maxBody: 4, errors: map[string]*limitResponse{
+		limitMaxBody: {body: "too large"},
+	}}
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("12345"))
+	// the size of the body is not known before it is read
+	r.ContentLength = -1
+	w := httptest.NewRecorder()
+	var read string
+	var rerr error
+	err := lim.serve(w, r, func(w http.ResponseWriter, r *http.Request) error {
+		b, err := io.ReadAll(r.Body)
+		read, rerr = string(b), err
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != "1234" || rerr == nil {
+		t.Errorf("got %q, %v, want the bytes within the limit and an error", read, rerr)
+	}
+	if w.Code != http.StatusRequestEntityTooLarge || w.Body.String() != "too large" {
+		t.Errorf("got %d %q, want the response of the limit", w.Code, w.Body.String())
+	}
+
+	// the response written by the handler is kept
+	r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader("12345"))
+	r.ContentLength = -1
+	w = httptest.NewRecorder()
+	errRead := errors.New("read")
+	err = lim.serve(w, r, func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusAccepted)
+		io.ReadAll(r.Body)
+		return errRead
+	})
+	if err != errRead || w.Code != http.StatusAccepted {
+		t.Errorf("got %d, %v, want the response of the handler", w.Code, err)
+	}
+}
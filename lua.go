@@ -1,14 +1,21 @@
 package lua
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/certmagic"
+	"github.com/dustin/go-humanize"
 	lua "github.com/yuin/gopher-lua"
 	"go.uber.org/zap"
 )
@@ -19,15 +26,118 @@ func init() {
 }
 
 // Lua implements an HTTP handler that runs a Lua script to handle the request.
+// The Lua handlers of the routes of a route list run in the order of their
+// Priority, the highest first, if one of them has one (see priorityGroup).
 type Lua struct {
-	CallStackSize       int    `json:"call_stack_size,omitempty"`
-	RegistrySize        int    `json:"registry_size,omitempty"`
-	RegistryMaxSize     int    `json:"registry_max_size,omitempty"`
-	RegistryGrowStep    int    `json:"registry_grow_step,omitempty"`
-	MinimizeStackMemory bool   `json:"minimize_stack_memory,omitempty"`
-	HandlerPath         string `json:"handler_path,omitempty"`
+	CallStackSize       int                `json:"call_stack_size,omitempty"`
+	RegistrySize        int                `json:"registry_size,omitempty"`
+	RegistryMaxSize     int                `json:"registry_max_size,omitempty"`
+	RegistryGrowStep    int                `json:"registry_grow_step,omitempty"`
+	MinimizeStackMemory bool               `json:"minimize_stack_memory,omitempty"`
+	HandlerPath         string             `json:"handler_path,omitempty"`
+	Script              string             `json:"script,omitempty"`
+	Root                string             `json:"root,omitempty"`
+	IndexNames          []string           `json:"index_names,omitempty"`
+	Watch               caddy.Duration     `json:"watch,omitempty"`
+	ExecutionTimeout    caddy.Duration     `json:"execution_timeout,omitempty"`
+	MemoryLimit         int64              `json:"memory_limit,omitempty"`
+	MaxBodySize         int64              `json:"max_body_size,omitempty"`
+	SpoolThreshold      int64              `json:"spool_threshold,omitempty"`
+	SpoolDir            string             `json:"spool_dir,omitempty"`
+	ErrorStatus         int                `json:"error_status,omitempty"`
+	Debug               bool               `json:"debug,omitempty"`
+	Name                string             `json:"name,omitempty"`
+	Priority            int                `json:"priority,omitempty"`
+	GreenHandlerPath    string             `json:"green_handler_path,omitempty"`
+	GreenPercent        int                `json:"green_percent,omitempty"`
+	Canary              *Canary            `json:"canary,omitempty"`
+	Routes              []Route            `json:"routes,omitempty"`
+	Keyring             *Keyring           `json:"keyring,omitempty"`
+	Placeholders        map[string]string  `json:"placeholders,omitempty"`
+	IPSets              []*IPSet           `json:"ipsets,omitempty"`
+	RequestBodyFilter   *RequestBodyFilter `json:"request_body_filter,omitempty"`
+	SubFilter           *SubFilter         `json:"sub_filter,omitempty"`
+	BodyFilter          *BodyFilter        `json:"body_filter,omitempty"`
+	HTMLInject          *HTMLInject        `json:"html_inject,omitempty"`
+	SSI                 *SSI               `json:"ssi,omitempty"`
+	Assets              *Assets            `json:"assets,omitempty"`
+	Health              *Health            `json:"health,omitempty"`
+	Maintenance         *Maintenance       `json:"maintenance,omitempty"`
+	Flags               *FeatureFlags      `json:"flags,omitempty"`
+	JWT                 *JWT               `json:"jwt,omitempty"`
+	HeaderCase          []string           `json:"header_case,omitempty"`
+	Preflight           *Preflight         `json:"preflight,omitempty"`
+	MicroCache          *MicroCache        `json:"micro_cache,omitempty"`
+	StatePool           *StatePool         `json:"state_pool,omitempty"`
+	HTTPClient          *HTTPClient        `json:"http_client,omitempty"`
+	DNS                 *DNS               `json:"dns,omitempty"`
+	Sandbox             *Sandbox           `json:"sandbox,omitempty"`
+	Phases              *Phases            `json:"phases,omitempty"`
+	Redis               *Redis             `json:"redis,omitempty"`
+	Database            *Database          `json:"database,omitempty"`
+	TemplateRoot        string             `json:"template_root,omitempty"`
+	ErrorHandlerPath    string             `json:"error_handler_path,omitempty"`
+	PackagePath         []string           `json:"package_path,omitempty"`
+	Vars                map[string]string  `json:"vars,omitempty"`
+	CacheSize           int                `json:"cache_size,omitempty"`
+	CacheTTL            caddy.Duration     `json:"cache_ttl,omitempty"`
+	MaxTimers           int                `json:"max_timers,omitempty"`
+	MaxConcurrent       int                `json:"max_concurrent,omitempty"`
+	QueueTimeout        caddy.Duration     `json:"queue_timeout,omitempty"`
+	RejectStatus        int                `json:"reject_status,omitempty"`
+	Quota               *Quota             `json:"quota,omitempty"`
+	AdminScript         string             `json:"admin_script,omitempty"`
+	InitPath            string             `json:"init_path,omitempty"`
+	Runtime             string             `json:"runtime,omitempty"`
+	FileRoot            string             `json:"file_root,omitempty"`
+	Isolation           string             `json:"isolation,omitempty"`
+	Workers             int                `json:"workers,omitempty"`
+	TrustedProxies      []string           `json:"trusted_proxies,omitempty"`
+	ClientIPHeaders     []string           `json:"client_ip_headers,omitempty"`
+	CircuitBreaker      *CircuitBreaker    `json:"circuit_breaker,omitempty"`
 
-	logger *zap.Logger
+	logger  *zap.Logger
+	traffic *trafficSplit
+	scripts *scriptSet
+	root    *scriptRoot
+	modules *moduleHandlers
+	keyring *keyring
+	ipsets  map[string]*ipSet
+	assets  *assetManifest
+	health  *healthEndpoint
+
+	maintenance *maintenanceMode
+	flags       *featureFlags
+	jwt         *jwtValidator
+	cache       *microCache
+	pool        *statePool
+	exprStates  *statePool
+	workers     *workerPool
+	sharedState *sharedState
+	httpClient  *http.Client
+	redis       *redisPool
+	db          *sqlDB
+	templates   *templateCache
+
+	packagePathPrefix  string
+	vars               map[string]string
+	protoCache         *protoCache
+	timers             *timerManager
+	limiter            *concurrencyLimiter
+	quotas             *tenantQuotas
+	storage            certmagic.Storage
+	info               *handlerInfo
+	initGlobals        []initGlobal
+	initState          *lua.LState
+	limits             []*routeLimit
+	globalDestinations []HTTPDestination
+	dnsResolvers       []*net.Resolver
+	priorityGroup      *priorityGroup
+	libraries          []string
+	runtime            *luaRuntime
+	shared             []string
+	trustedProxies     ipRanges
+	breaker            *circuitBreaker
 }
 
 // CaddyModule returns the Caddy module information.
@@ -40,26 +150,705 @@ func (Lua) CaddyModule() caddy.ModuleInfo {
 
 // Provision implements caddy.Provisioner.
 func (l *Lua) Provision(ctx caddy.Context) error {
-	l.logger = ctx.Logger(l)
+	dests, err := globalHTTPDestinations(ctx)
+	if err != nil {
+		return fmt.Errorf("http_client destinations: %w", err)
+	}
+	l.globalDestinations = dests
+	return l.provision(ctx, ctx.Storage(), ctx.Logger(l))
+}
+
+// provision provisions the handler with the storage of the storage module
+// and the logger, which are not those of ctx for the handlers of a Tester.
+func (l *Lua) provision(ctx caddy.Context, storage certmagic.Storage, logger *zap.Logger) error {
+	l.logger = logger
+	l.priorityGroup = new(priorityGroup)
+	l.modules = newModuleHandlers(ctx)
+	l.storage = storage
+	if l.Isolation == isolationProcess {
+		// the handler is provisioned by its workers
+		workers, err := newWorkerPool(l)
+		if err != nil {
+			return err
+		}
+		l.workers = workers
+		return nil
+	}
+
+	for i := range l.Routes {
+		if err := l.Routes[i].provision(ctx); err != nil {
+			return fmt.Errorf("route %d: %w", i, err)
+		}
+	}
+	scripts, err := compileScripts(l.scriptPaths()...)
+	if err != nil {
+		return err
+	}
+	if l.Script != "" {
+		// the inline script is the main script, selected by its empty
+		// HandlerPath.
+		proto, err := compileString(l.Script, "<script>")
+		if err != nil {
+			return fmt.Errorf("compiling the inline script: %w", err)
+		}
+		scripts[l.HandlerPath] = proto
+	}
+	l.scripts = newScriptSet(scripts)
+	l.packagePathPrefix = l.packagePath()
+	l.vars = l.expandVars()
+	l.protoCache = newProtoCache(l.CacheSize, time.Duration(l.CacheTTL))
+	l.exprStates = newStatePool(new(StatePool), newMatcherState)
+	l.timers = newTimerManager(l)
+	if l.Root != "" {
+		l.root = newScriptRoot(l.Root, l.IndexNames, l.protoCache)
+	}
+	if l.Watch > 0 {
+		l.scripts.watch(time.Duration(l.Watch), l.logger)
+	}
+
+	if l.Name != "" {
+		l.info = &handlerInfo{name: l.Name, handler: l}
+		luaHandlers.register(l.info)
+	}
+
+	if l.GreenHandlerPath != "" {
+		l.traffic = &trafficSplit{
+			name:         l.Name,
+			blue:         l.HandlerPath,
+			green:        l.GreenHandlerPath,
+			greenPercent: int32(l.GreenPercent),
+		}
+		trafficSplits.register(l.traffic)
+	}
+
+	if l.Keyring != nil {
+		if err := l.Keyring.validate(); err != nil {
+			return err
+		}
+		kr, err := newKeyring(ctx, l.storage, l.Keyring, l.logger)
+		if err != nil {
+			return err
+		}
+		l.keyring = kr
+	}
+
+	trusted, err := newTrustedProxies(l.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	l.trustedProxies = trusted
+
+	l.ipsets = make(map[string]*ipSet, len(l.IPSets))
+	for _, cfg := range l.IPSets {
+		if _, ok := l.ipsets[cfg.Name]; ok {
+			return fmt.Errorf("ipset %s is defined more than once", cfg.Name)
+		}
+		s, err := newIPSet(cfg, l.logger)
+		if err != nil {
+			return err
+		}
+		l.ipsets[cfg.Name] = s
+	}
+
+	if l.Assets != nil {
+		m, err := newAssetManifest(l.Assets)
+		if err != nil {
+			return fmt.Errorf("hashing assets: %w", err)
+		}
+		l.assets = m
+	}
+
+	if l.Health != nil {
+		l.health = &healthEndpoint{cfg: l.Health}
+	}
+
+	if l.Maintenance != nil {
+		mm, err := newMaintenanceMode(l.Maintenance)
+		if err != nil {
+			return err
+		}
+		l.maintenance = mm
+	}
+
+	if l.Flags != nil {
+		ff, err := newFeatureFlags(l.Flags, l.logger)
+		if err != nil {
+			return err
+		}
+		l.flags = ff
+	}
+
+	if l.JWT != nil {
+		l.jwt = newJWTValidator(l.JWT)
+	}
+	if l.MicroCache != nil {
+		mc, err := newMicroCache(l.MicroCache, l.logger)
+		if err != nil {
+			return fmt.Errorf("micro_cache: %w", err)
+		}
+		l.cache = mc
+	}
+	if l.CircuitBreaker != nil {
+		l.breaker = newCircuitBreaker(l.CircuitBreaker, l.logger)
+	}
+	if l.MaxConcurrent > 0 {
+		l.limiter = newConcurrencyLimiter(l.MaxConcurrent, time.Duration(l.QueueTimeout), l.RejectStatus)
+	}
+	if l.Quota != nil {
+		l.quotas = newTenantQuotas(l.Quota, l.metricsName())
+	}
+	hc, err := newHTTPClient(l.HTTPClient, l.globalDestinations)
+	if err != nil {
+		return fmt.Errorf("http_client: %w", err)
+	}
+	l.httpClient = hc
+	if l.DNS != nil {
+		if l.dnsResolvers, err = newDNSResolvers(l.DNS, hc); err != nil {
+			return fmt.Errorf("dns: %w", err)
+		}
+	}
+	if l.Runtime != "" {
+		l.runtime = luaRuntimes.acquire(l.Runtime)
+	}
+	if l.Redis != nil {
+		if err := l.openRedis(); err != nil {
+			return fmt.Errorf("redis: %w", err)
+		}
+	}
+	if l.TemplateRoot != "" {
+		l.templates = newTemplateCache(l.TemplateRoot)
+		if l.Watch > 0 {
+			l.templates.watch(time.Duration(l.Watch), l.logger)
+		}
+	}
+	if l.Database != nil {
+		if err := l.openDatabase(); err != nil {
+			return fmt.Errorf("database: %w", err)
+		}
+	}
+
+	if l.InitPath != "" {
+		if err := l.runInitScript(); err != nil {
+			return fmt.Errorf("init_path: %w", err)
+		}
+	}
+	// the globals of the base states, whose values are referenced rather
+	// than copied to the states of the timers
+	L := l.newBaseState()
+	l.libraries = globalNames(L)
+	L.Close()
+	switch {
+	case l.Isolation == isolationSharedCoroutine:
+		l.sharedState = newSharedState(l.newBaseState)
+	case l.StatePool != nil:
+		l.pool = newStatePool(l.StatePool, l.newBaseState)
+		l.instrumentPool(l.pool)
+	case l.Isolation == isolationPooled:
+		l.pool = newStatePool(new(StatePool), l.newBaseState)
+		l.instrumentPool(l.pool)
+	}
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (l *Lua) Cleanup() error {
+	if l.timers != nil {
+		l.timers.close()
+	}
+	l.runShutdownHooks()
+	if l.traffic != nil {
+		trafficSplits.unregister(l.traffic)
+	}
+	if l.info != nil {
+		luaHandlers.unregister(l.info)
+	}
+	if l.keyring != nil {
+		l.keyring.stop()
+	}
+	for _, s := range l.ipsets {
+		s.stop()
+	}
+	if l.flags != nil {
+		l.flags.stop()
+	}
+	if l.pool != nil {
+		l.pool.close()
+	}
+	if l.exprStates != nil {
+		l.exprStates.close()
+	}
+	if l.workers != nil {
+		l.workers.close()
+	}
+	if l.sharedState != nil {
+		l.sharedState.close()
+	}
+	if l.scripts != nil {
+		l.scripts.stop()
+	}
+	if l.templates != nil {
+		l.templates.stop()
+	}
+	if l.httpClient != nil {
+		l.httpClient.CloseIdleConnections()
+	}
+	if l.modules != nil {
+		l.modules.cleanup()
+	}
+	if l.runtime != nil {
+		// the runtime closes the pools once they are not used
+		luaRuntimes.release(l.runtime, l.shared)
+	} else {
+		if l.redis != nil {
+			l.redis.close()
+		}
+		if l.db != nil {
+			l.db.close()
+		}
+	}
 	return nil
 }
 
 // Validate implements caddy.Validator.
 func (l *Lua) Validate() error {
-	if l.HandlerPath == "" {
-		return errors.New("the handler_path configuration option is required")
+	var mains int
+	for _, opt := range []string{l.HandlerPath, l.Script, l.Root} {
+		if opt != "" {
+			mains++
+		}
+	}
+	if mains > 1 {
+		return errors.New("only one of the handler_path, script or root configuration options can be set")
+	}
+	if mains == 0 && l.Phases == nil {
+		return errors.New("the handler_path, script, root or phases configuration options are required")
+	}
+	if l.GreenHandlerPath != "" && l.Name == "" {
+		return errors.New("the name configuration option is required when green_handler_path is set")
+	}
+	if l.AdminScript != "" && l.Name == "" {
+		return errors.New("the name configuration option is required when admin_script is set")
+	}
+	if l.ErrorStatus != 0 && (l.ErrorStatus < 400 || l.ErrorStatus > 599) {
+		return fmt.Errorf("error_status must be between 400 and 599, got %d", l.ErrorStatus)
+	}
+	if l.CallStackSize < 0 || l.RegistrySize < 0 || l.RegistryMaxSize < 0 || l.RegistryGrowStep < 0 {
+		return errors.New("call_stack_size, registry_size, registry_max_size and registry_grow_step must not be negative")
+	}
+	if l.RegistryMaxSize > 0 && l.RegistryMaxSize < l.RegistrySize {
+		return fmt.Errorf("registry_max_size (%d) must not be smaller than registry_size (%d)", l.RegistryMaxSize, l.RegistrySize)
+	}
+	if l.SpoolThreshold < 0 {
+		return fmt.Errorf("spool_threshold must not be negative, got %d", l.SpoolThreshold)
+	}
+	if l.MaxTimers < 0 {
+		return fmt.Errorf("max_timers must not be negative, got %d", l.MaxTimers)
+	}
+	if l.MaxConcurrent < 0 || l.QueueTimeout < 0 {
+		return errors.New("max_concurrent and queue_timeout must not be negative")
+	}
+	if l.RejectStatus != 0 && (l.RejectStatus < 400 || l.RejectStatus > 599) {
+		return fmt.Errorf("reject_status must be between 400 and 599, got %d", l.RejectStatus)
+	}
+	if l.CacheSize < 0 || l.CacheTTL < 0 {
+		return errors.New("cache_size and cache_ttl must not be negative")
+	}
+	if l.GreenPercent < 0 || l.GreenPercent > 100 {
+		return fmt.Errorf("green_percent must be between 0 and 100, got %d", l.GreenPercent)
+	}
+	if l.Canary != nil {
+		if l.Canary.HandlerPath == "" {
+			return errors.New("the canary handler_path configuration option is required")
+		}
+		if l.Canary.Header == "" && l.Canary.Cookie == "" {
+			return errors.New("the canary requires a header or a cookie to match on")
+		}
+	}
+	if l.BodyFilter != nil {
+		if err := l.BodyFilter.validate(); err != nil {
+			return err
+		}
+	}
+	if l.SubFilter != nil {
+		if err := l.SubFilter.validate(); err != nil {
+			return err
+		}
+	}
+	if l.HTMLInject != nil {
+		if err := l.HTMLInject.validate(); err != nil {
+			return err
+		}
+	}
+	if l.JWT != nil {
+		if err := l.JWT.validate(); err != nil {
+			return err
+		}
+		if l.JWT.ClaimsFunction != "" && l.InitPath == "" {
+			return errors.New("jwt: claims_function requires an init_path that defines the function")
+		}
+	}
+	if l.StatePool != nil {
+		if err := l.StatePool.validate(); err != nil {
+			return err
+		}
+	}
+	if err := l.validateIsolation(); err != nil {
+		return err
+	}
+	if l.CircuitBreaker != nil {
+		if err := l.CircuitBreaker.validate(); err != nil {
+			return err
+		}
+	}
+	if l.Quota != nil {
+		if err := l.Quota.validate(); err != nil {
+			return err
+		}
+	}
+	if l.Sandbox != nil {
+		if err := l.Sandbox.validate(); err != nil {
+			return err
+		}
+	}
+	if l.Redis != nil {
+		if err := l.Redis.validate(); err != nil {
+			return err
+		}
+	}
+	if l.Database != nil {
+		if err := l.Database.validate(); err != nil {
+			return err
+		}
+	}
+	if l.DNS != nil {
+		if err := l.DNS.validate(); err != nil {
+			return err
+		}
+	}
+	if l.Assets != nil && l.Assets.Root == "" {
+		return errors.New("the assets root configuration option is required")
+	}
+	if l.Health != nil && !strings.HasPrefix(l.Health.Path, "/") {
+		return fmt.Errorf("the health path must start with /, got %q", l.Health.Path)
+	}
+	for i, rt := range l.Routes {
+		if rt.HandlerPath == "" {
+			return fmt.Errorf("route %d: the handler_path configuration option is required", i)
+		}
 	}
 	return nil
 }
 
 // ServeHTTP implements caddyhttp.MiddlewareHandler.
 func (l Lua) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	L := lua.NewState()
-	defer L.Close()
-	if err := L.DoFile(l.HandlerPath); err != nil {
+	if pg := l.priorityGroup.resolve(r); pg != nil {
+		return pg.serve(w, r, next)
+	}
+	return l.serve(w, r, next)
+}
+
+// serve handles r within the limits of the init script.
+func (l *Lua) serve(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if l.workers != nil {
+		return l.workers.serve(w, r, next)
+	}
+	if lim := l.matchLimit(r); lim != nil {
+		return lim.serve(w, r, func(w http.ResponseWriter, r *http.Request) error {
+			return l.serveRequest(w, r, next)
+		})
+	}
+	return l.serveRequest(w, r, next)
+}
+
+// serveRequest handles r once it is within the limits of the init script.
+func (l *Lua) serveRequest(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) (err error) {
+	// the panics of the handler are returned as errors, except
+	// http.ErrAbortHandler which aborts the response, and are failures of
+	// the scripts for the circuit breaker
+	var breakerDone func(ran, failed bool)
+	ran, failed := false, false
+	defer func() {
+		rcv := recover()
+		if rcv != nil && rcv != http.ErrAbortHandler {
+			err = l.recovered(r, rcv)
+			ran, failed = true, true
+		}
+		if breakerDone != nil {
+			breakerDone(ran, failed)
+		}
+		if rcv == http.ErrAbortHandler {
+			panic(rcv)
+		}
+	}()
+
+	l.provideExpressions(r)
+	if l.maintenance != nil {
+		if done, err := l.maintenance.respond(w); done || err != nil {
+			return err
+		}
+	}
+	if l.assets != nil {
+		l.assets.rewrite(w, r)
+	}
+	if l.breaker != nil {
+		if breakerDone, err = l.breaker.allow(w); err != nil {
+			return err
+		}
+	}
+	if l.Preflight != nil && r.Method == http.MethodOptions {
+		err = l.servePreflight(w, r)
+		ran, failed = true, isFailure(r, err)
+		return err
+	}
+
+	var claims map[string]interface{}
+	if l.jwt != nil {
+		var err error
+		if claims, err = l.jwt.authenticate(w, r); err != nil {
+			return err
+		}
+	}
+
+	// the quotas of the tenant are checked before the request waits for a
+	// slot of the handler, so that the requests of a tenant that exceeded
+	// them do not take the slots of the other tenants
+	var tenant *tenantRequest
+	releaseTenant := func() {}
+	if l.quotas != nil {
+		var err error
+		if tenant, releaseTenant, err = l.quotas.acquire(w, r); err != nil {
+			return err
+		}
+		defer releaseTenant()
+	}
+	release := func() {}
+	if l.limiter != nil {
+		var err error
+		if release, err = l.limiter.acquire(w, r); err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	L := l.newState(w, r)
+	defer l.releaseState(L)
+	rc := checkRequestContext(L)
+	rc.jwtClaims = claims
+	rc.tenant = tenant
+	rc.next = next
+	defer rc.stopSSE()
+	defer rc.closeSockets()
+	defer rc.removeUploads()
+
+	defer l.runLogPhase(L, r)
+
+	// the claims are authorized before the scripts run, so that they do not
+	// handle the requests that are not authorized
+	if l.jwt != nil {
+		if err := l.jwt.authorize(L, claims); err != nil {
+			ran, failed = true, isFailure(r, err)
+			return err
+		}
+	}
+
+	done, err := l.runPhases(L, r)
+	release()
+	releaseTenant()
+	ran, failed = true, isFailure(r, err)
+	if rc.cacheRecorder != nil {
+		defer rc.cacheRecorder.done()
+		w = rc.w
+	}
+	if err != nil {
+		return l.handleScriptError(L, w, r, err)
+	}
+	if done {
+		rc.writeHeader()
+		if rc.cacheRecorder != nil {
+			rc.cacheRecorder.commit()
+		}
+		return nil
+	}
+	if l.health != nil && r.URL.Path == l.Health.Path {
+		return l.health.serve(w, L, rc.healthChecks)
+	}
+	if err := l.serveNext(w, r, L, next); err != nil {
 		return err
 	}
-	return next.ServeHTTP(w, r)
+	if rc.cacheRecorder != nil {
+		rc.cacheRecorder.commit()
+	}
+	return nil
+}
+
+// serveNext calls the next handler with the request and response filters of
+// the handler, once the script ran in L.
+func (l *Lua) serveNext(w http.ResponseWriter, r *http.Request, L *lua.LState, next caddyhttp.Handler) error {
+	if err := l.setPlaceholders(L, r); err != nil {
+		return err
+	}
+	detach, err := l.filterRequestBody(L, r)
+	if err != nil {
+		return err
+	}
+	defer detach()
+
+	w, finish, err := l.wrapResponseWriter(w, r, L)
+	if err != nil {
+		return err
+	}
+	// the other requests of a shared state run while the next handler does
+	unlocked(L, func() { err = next.ServeHTTP(w, r) })
+	if err != nil {
+		return err
+	}
+	return finish()
+}
+
+// scriptDone returns true if the return value ret of the script terminates
+// the handling of the request, which is the case for false and "done". The
+// next handler is called if it returns nothing, true or "next", unless the
+// script wrote the response.
+func scriptDone(ret lua.LValue) (bool, error) {
+	switch ret {
+	case lua.LNil, lua.LTrue, lua.LString("next"):
+		return false, nil
+	case lua.LFalse, lua.LString("done"):
+		return true, nil
+	}
+	return false, fmt.Errorf("the script must return nothing, a boolean, \"next\" or \"done\", got %s", ret)
+}
+
+// runScript runs the script at path in L to handle r, with args passed to
+// the script as "...". The script is stopped if
+// the client's request is canceled, or if it runs for longer than the
+// ExecutionTimeout, in which case a 503 error is returned. The time spent in
+// caddy.next counts towards the timeout. If a MemoryLimit is set, the script
+// is also stopped once the size of the values of L exceeds it, in which case
+// a 500 error is returned and L is not reused (see memoryContext). The
+// quotas of the tenant of the request, if any, lower those limits (see
+// Quota).
+func (l *Lua) runScript(L *lua.LState, r *http.Request, path string, args ...lua.LValue) (lua.LValue, error) {
+	// e.g. the header phase, run by the next handler
+	defer enterState(L)()
+	ctx := r.Context()
+	timeout, limit := time.Duration(l.ExecutionTimeout), l.MemoryLimit
+	tenant, cpuQuota := boundTenant(L), false
+	if tenant != nil {
+		if left, ok := tenant.usage.remaining(); ok && (timeout <= 0 || left < timeout) {
+			timeout, cpuQuota = left, true
+		}
+		limit = tenant.usage.memoryLimit(limit)
+	}
+	if timeout > 0 || cpuQuota {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var mc *memoryContext
+	if limit > 0 {
+		mc = newMemoryContext(ctx, L, limit)
+		defer mc.cancel()
+		ctx = mc
+	}
+	// the scripts may run while another one runs, e.g. the header script
+	// during caddy.next
+	prev := L.Context()
+	if prev == nil {
+		prev = r.Context()
+	}
+	L.SetContext(ctx)
+	defer L.SetContext(prev)
+
+	proto, err := l.script(path)
+	if err != nil {
+		return nil, err
+	}
+	nested := tenant != nil && tenant.running
+	if tenant != nil {
+		tenant.running = true
+	}
+	start := time.Now()
+	ret, err := runProto(L, proto, args...)
+	elapsed := time.Since(start)
+	observeScript(path, elapsed, err != nil)
+	if tenant != nil && !nested {
+		tenant.running = false
+		tenant.usage.addCPUTime(elapsed)
+	}
+	markPanicked(L, err)
+	if mc != nil && !mc.exceeded {
+		// e.g. the globals set by the script
+		mc.check()
+	}
+	if mc != nil && mc.exceeded {
+		// the state is replaced like the states in which a Go function
+		// panicked
+		L.G.Registry.RawSetString(statePanickedKey, lua.LTrue)
+		l.logger.Error("the Lua state exceeded the memory limit while the script ran",
+			zap.String("path", path), zap.Int64("memory_limit", limit))
+		if tenant != nil && limit != l.MemoryLimit {
+			observeTenantRejection(l.quotas.handler, tenant.usage.name, quotaMemoryLimit)
+		}
+		return nil, caddyhttp.Error(http.StatusInternalServerError,
+			fmt.Errorf("the Lua state exceeded the memory limit of %s", humanize.Bytes(uint64(limit))))
+	}
+	if err != nil && r.Context().Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		if cpuQuota {
+			return nil, tenant.usage.exceeded(quotaMaxCPUTime)
+		}
+		return nil, caddyhttp.Error(http.StatusServiceUnavailable,
+			fmt.Errorf("script execution timed out after %s", time.Duration(l.ExecutionTimeout)))
+	}
+	if err != nil {
+		return nil, l.scriptFailed(r, path, err)
+	}
+	return ret, nil
+}
+
+// scriptPaths returns the paths of the scripts of the handler, some of which
+// may be empty.
+func (l *Lua) scriptPaths() []string {
+	paths := []string{l.HandlerPath, l.GreenHandlerPath}
+	if l.Canary != nil {
+		paths = append(paths, l.Canary.HandlerPath)
+	}
+	for _, rt := range l.Routes {
+		paths = append(paths, rt.HandlerPath)
+	}
+	if l.Phases != nil {
+		paths = append(paths, l.Phases.paths()...)
+	}
+	return append(paths, l.ErrorHandlerPath, l.AdminScript)
+}
+
+// script returns the compiled script at path, which is one of the handler's
+// scripts or a script under its root.
+func (l *Lua) script(path string) (*lua.FunctionProto, error) {
+	if proto := l.scripts.get(path); proto != nil || l.root == nil {
+		return proto, nil
+	}
+	return l.root.get(path)
+}
+
+// scriptPath returns the path of the script that handles r.
+func (l *Lua) scriptPath(r *http.Request) string {
+	for _, rt := range l.Routes {
+		if rt.matcherSets.AnyMatch(r) {
+			return rt.HandlerPath
+		}
+	}
+
+	path := l.HandlerPath
+	switch {
+	case l.root != nil:
+		path = l.root.resolve(r)
+	case l.Canary != nil && l.Canary.matches(r):
+		path = l.Canary.HandlerPath
+	case l.traffic != nil:
+		path = l.traffic.path()
+	}
+	return path
 }
 
 // UnmarshalCaddyfile implements caddyfile.Unmarshaler.
@@ -76,8 +865,16 @@ func (l *Lua) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		return int(i), nil
 	}
 
+	matcherDefs := make(map[string]caddy.ModuleMap)
 	for d.Next() {
 		for d.NextBlock(0) {
+			if strings.HasPrefix(d.Val(), "@") {
+				if err := parseMatcherDefinition(d, matcherDefs); err != nil {
+					return err
+				}
+				continue
+			}
+
 			switch field := d.Val(); field {
 			case "call_stack_size":
 				i, err := asInt()
@@ -111,12 +908,526 @@ func (l *Lua) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				if d.CountRemainingArgs() > 0 {
 					return d.Errf("%s: %w", field, d.ArgErr())
 				}
+				l.MinimizeStackMemory = true
 
-			case "handler_path":
+			case "package_path":
+				// templates separated by spaces or ";", as in LUA_PATH
+				for _, arg := range d.RemainingArgs() {
+					for _, t := range strings.Split(arg, lua.LuaPathSep) {
+						if t != "" {
+							l.PackagePath = append(l.PackagePath, t)
+						}
+					}
+				}
+				if len(l.PackagePath) == 0 {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+
+			case "vars":
+				// either vars <name> <value> or a block of names and values
+				if l.Vars == nil {
+					l.Vars = make(map[string]string)
+				}
+				var name, v string
+				if d.Args(&name, &v) {
+					if d.NextArg() {
+						return d.Errf("%s: %w", field, d.ArgErr())
+					}
+					l.Vars[name] = v
+					break
+				}
+				if d.NextArg() {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					name := d.Val()
+					if !d.Args(&v) || d.NextArg() {
+						return d.Errf("%s %s: %w", field, name, d.ArgErr())
+					}
+					l.Vars[name] = v
+				}
+				if len(l.Vars) == 0 {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+
+			case "error_handler_path":
+				if !d.Args(&l.ErrorHandlerPath) || d.NextArg() {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+
+			case "admin_script":
+				if !d.Args(&l.AdminScript) || d.NextArg() {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+
+			case "init_path":
+				if !d.Args(&l.InitPath) || d.NextArg() {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+
+			case "runtime":
+				if !d.Args(&l.Runtime) || d.NextArg() {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+
+			case "file_root":
+				if !d.Args(&l.FileRoot) || d.NextArg() {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+
+			case "isolation":
+				if !d.Args(&l.Isolation) || d.NextArg() {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+
+			case "workers":
+				i, err := asInt()
+				if err != nil {
+					return d.Errf("%s: %w", field, err)
+				}
+				l.Workers = i
+
+			case "trusted_proxies":
+				// addresses or CIDR ranges, or private_ranges
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				for _, arg := range args {
+					if arg == "private_ranges" {
+						l.TrustedProxies = append(l.TrustedProxies, privateRanges...)
+						continue
+					}
+					l.TrustedProxies = append(l.TrustedProxies, arg)
+				}
+
+			case "client_ip_headers":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				l.ClientIPHeaders = append(l.ClientIPHeaders, args...)
+
+			case "root":
+				if !d.Args(&l.Root) || d.NextArg() {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+
+			case "template_root":
+				if !d.Args(&l.TemplateRoot) || d.NextArg() {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+
+			case "index":
+				l.IndexNames = d.RemainingArgs()
+				if len(l.IndexNames) == 0 {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+
+			case "handler_path", "content_by_lua":
 				if !d.Args(&l.HandlerPath) {
 					return d.Errf("%s: %w", field, d.ArgErr())
 				}
 
+			case "script":
+				if !d.Args(&l.Script) || d.NextArg() {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+
+			case "rewrite_by_lua", "access_by_lua", "header_filter_by_lua", "log_by_lua":
+				if l.Phases == nil {
+					l.Phases = new(Phases)
+				}
+				dst := map[string]*string{
+					"rewrite_by_lua":       &l.Phases.Rewrite,
+					"access_by_lua":        &l.Phases.Access,
+					"header_filter_by_lua": &l.Phases.Header,
+					"log_by_lua":           &l.Phases.Log,
+				}[field]
+				if !d.Args(dst) || d.NextArg() {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+
+			case "watch":
+				l.Watch = caddy.Duration(defaultWatchInterval)
+				var v string
+				if d.Args(&v) {
+					dur, err := caddy.ParseDuration(v)
+					if err != nil {
+						return d.Errf("%s: %w", field, err)
+					}
+					l.Watch = caddy.Duration(dur)
+				}
+				if d.NextArg() {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+
+			case "cache_size":
+				i, err := asInt()
+				if err != nil {
+					return d.Errf("%s: %w", field, err)
+				}
+				l.CacheSize = i
+
+			case "max_timers":
+				i, err := asInt()
+				if err != nil {
+					return d.Errf("%s: %w", field, err)
+				}
+				l.MaxTimers = i
+
+			case "priority":
+				i, err := asInt()
+				if err != nil {
+					return d.Errf("%s: %w", field, err)
+				}
+				l.Priority = i
+
+			case "max_concurrent":
+				i, err := asInt()
+				if err != nil {
+					return d.Errf("%s: %w", field, err)
+				}
+				l.MaxConcurrent = i
+
+			case "queue_timeout":
+				var v string
+				if !d.Args(&v) || d.NextArg() {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				if err := parseCaddyDuration(v, &l.QueueTimeout); err != nil {
+					return d.Errf("%s: %w", field, err)
+				}
+
+			case "reject_status":
+				i, err := asInt()
+				if err != nil {
+					return d.Errf("%s: %w", field, err)
+				}
+				l.RejectStatus = i
+
+			case "cache_ttl":
+				var v string
+				if !d.Args(&v) || d.NextArg() {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				if err := parseCaddyDuration(v, &l.CacheTTL); err != nil {
+					return d.Errf("%s: %w", field, err)
+				}
+
+			case "execution_timeout":
+				var v string
+				if !d.Args(&v) || d.NextArg() {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				if err := parseCaddyDuration(v, &l.ExecutionTimeout); err != nil {
+					return d.Errf("%s: %w", field, err)
+				}
+
+			case "error_status":
+				var v string
+				if !d.Args(&v) || d.NextArg() {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return d.Errf("%s: %w", field, err)
+				}
+				l.ErrorStatus = n
+
+			case "debug":
+				if d.NextArg() {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				l.Debug = true
+
+			case "memory_limit":
+				var v string
+				if !d.Args(&v) || d.NextArg() {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				n, err := humanize.ParseBytes(v)
+				if err != nil {
+					return d.Errf("%s: %w", field, err)
+				}
+				l.MemoryLimit = int64(n)
+
+			case "max_body_size":
+				var v string
+				if !d.Args(&v) || d.NextArg() {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				n, err := humanize.ParseBytes(v)
+				if err != nil {
+					return d.Errf("%s: %w", field, err)
+				}
+				l.MaxBodySize = int64(n)
+
+			case "spool_threshold":
+				var v string
+				if !d.Args(&v) || d.NextArg() {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				n, err := humanize.ParseBytes(v)
+				if err != nil {
+					return d.Errf("%s: %w", field, err)
+				}
+				l.SpoolThreshold = int64(n)
+
+			case "spool_dir":
+				if !d.Args(&l.SpoolDir) || d.NextArg() {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+
+			case "name":
+				if !d.Args(&l.Name) {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+
+			case "green_handler_path":
+				if !d.Args(&l.GreenHandlerPath) {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+
+			case "green_percent":
+				i, err := asInt()
+				if err != nil {
+					return d.Errf("%s: %w", field, err)
+				}
+				l.GreenPercent = i
+
+			case "canary":
+				if d.CountRemainingArgs() > 0 {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				l.Canary = new(Canary)
+				if err := l.Canary.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+
+			case "keyring":
+				l.Keyring = new(Keyring)
+				if err := l.Keyring.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+
+			case "placeholder":
+				var name, fn string
+				if !d.Args(&name, &fn) || d.NextArg() {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				if l.Placeholders == nil {
+					l.Placeholders = make(map[string]string)
+				}
+				l.Placeholders[name] = fn
+
+			case "ipset":
+				s := new(IPSet)
+				if err := s.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+				l.IPSets = append(l.IPSets, s)
+
+			case "request_body_filter":
+				args := d.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 || (len(args) == 2 && args[1] != "buffer") {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				l.RequestBodyFilter = &RequestBodyFilter{
+					Function: args[0],
+					Buffer:   len(args) == 2,
+				}
+
+			case "filter_body_by_lua":
+				l.BodyFilter = new(BodyFilter)
+				if !d.Args(&l.BodyFilter.Function) || d.NextArg() {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				if err := l.BodyFilter.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+
+			case "sub_filter":
+				if d.CountRemainingArgs() > 0 {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				l.SubFilter = new(SubFilter)
+				if err := l.SubFilter.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+
+			case "html_inject":
+				if d.CountRemainingArgs() > 0 {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				l.HTMLInject = new(HTMLInject)
+				if err := l.HTMLInject.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+
+			case "ssi":
+				if d.CountRemainingArgs() > 0 {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				l.SSI = new(SSI)
+				if err := l.SSI.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+
+			case "assets":
+				l.Assets = new(Assets)
+				if err := l.Assets.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+
+			case "health":
+				l.Health = new(Health)
+				if err := l.Health.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+
+			case "maintenance":
+				l.Maintenance = new(Maintenance)
+				if err := l.Maintenance.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+
+			case "flags":
+				l.Flags = new(FeatureFlags)
+				if err := l.Flags.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+
+			case "jwt":
+				if d.CountRemainingArgs() > 0 {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				l.JWT = new(JWT)
+				if err := l.JWT.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+
+			case "header_case":
+				names := d.RemainingArgs()
+				if len(names) == 0 {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				l.HeaderCase = append(l.HeaderCase, names...)
+
+			case "redis":
+				if d.CountRemainingArgs() > 0 {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				if l.Redis == nil {
+					l.Redis = new(Redis)
+				}
+				if err := l.Redis.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+
+			case "redis_address", "redis_pool_size":
+				var v string
+				if !d.Args(&v) || d.NextArg() {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				if l.Redis == nil {
+					l.Redis = new(Redis)
+				}
+				if field == "redis_address" {
+					l.Redis.Address = v
+				} else {
+					n, err := strconv.Atoi(v)
+					if err != nil {
+						return d.Errf("%s: %w", field, err)
+					}
+					l.Redis.PoolSize = n
+				}
+
+			case "database":
+				if d.CountRemainingArgs() > 0 {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				l.Database = new(Database)
+				if err := l.Database.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+
+			case "sandbox":
+				l.Sandbox = new(Sandbox)
+				if err := l.Sandbox.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+
+			case "http_client":
+				if d.CountRemainingArgs() > 0 {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				l.HTTPClient = new(HTTPClient)
+				if err := l.HTTPClient.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+
+			case "dns":
+				if d.CountRemainingArgs() > 0 {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				l.DNS = new(DNS)
+				if err := l.DNS.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+
+			case "quota":
+				if d.CountRemainingArgs() > 0 {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				l.Quota = new(Quota)
+				if err := l.Quota.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+
+			case "circuit_breaker":
+				if d.CountRemainingArgs() > 0 {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				l.CircuitBreaker = new(CircuitBreaker)
+				if err := l.CircuitBreaker.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+
+			case "state_pool":
+				if d.CountRemainingArgs() > 0 {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				l.StatePool = new(StatePool)
+				if err := l.StatePool.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+
+			case "micro_cache":
+				if d.CountRemainingArgs() > 0 {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				l.MicroCache = new(MicroCache)
+				if err := l.MicroCache.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+
+			case "preflight":
+				if d.CountRemainingArgs() > 0 {
+					return d.Errf("%s: %w", field, d.ArgErr())
+				}
+				l.Preflight = new(Preflight)
+				if err := l.Preflight.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+
+			case "route":
+				rt, err := parseRoute(d, matcherDefs)
+				if err != nil {
+					return d.Errf("%s: %w", field, err)
+				}
+				l.Routes = append(l.Routes, rt)
+
 			default:
 				return d.Errf("%s: unknown configuration option", field)
 			}
@@ -135,6 +1446,7 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 // interface guards
 var (
 	_ caddy.Provisioner           = (*Lua)(nil)
+	_ caddy.CleanerUpper          = (*Lua)(nil)
 	_ caddyfile.Unmarshaler       = (*Lua)(nil)
 	_ caddyhttp.MiddlewareHandler = (*Lua)(nil)
 	_ caddy.Validator             = (*Lua)(nil)
@@ -0,0 +1,184 @@
+// Package luautil converts values between gopher-lua and Go, as done by the
+// json, http and kv modules of the Lua handler. It is importable by the
+// programs that embed the handler or run their own gopher-lua states and
+// need the same conversions, e.g. to pass Go configuration to scripts.
+//
+// Lua tables convert to Go slices when they only have consecutive integer
+// keys starting at 1, and to maps with string keys otherwise. Numbers
+// convert to float64, or to int64 when they have no fractional part and the
+// Int64 option is set. The tables that contain themselves cannot be
+// converted, but a table may appear more than once in a value.
+package luautil
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// ErrCycle is returned when converting a table that contains itself.
+var ErrCycle = errors.New("cannot convert a table that contains itself")
+
+// Options configures the conversion of the Lua values to Go values. The zero
+// value converts them to the types used by encoding/json to decode JSON.
+type Options struct {
+	// Int64 converts the numbers without a fractional part that fit in an
+	// int64 to int64, rather than float64.
+	Int64 bool
+
+	// EmptyArray converts the empty tables to empty slices, rather than
+	// empty maps.
+	EmptyArray bool
+}
+
+// ToGo converts v to a Go value with the default options.
+func ToGo(v lua.LValue) (interface{}, error) {
+	return Options{}.ToGo(v)
+}
+
+// ToGo converts v to a Go value: nil, bool, float64 (or int64), string,
+// []interface{} or map[string]interface{}. It returns an error if v is or
+// contains a value of another type, such as a function, or a table that
+// contains itself.
+func (o Options) ToGo(v lua.LValue) (interface{}, error) {
+	return o.toGo(v, make(map[*lua.LTable]bool))
+}
+
+func (o Options) toGo(v lua.LValue, visited map[*lua.LTable]bool) (interface{}, error) {
+	switch v := v.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		f := float64(v)
+		if o.Int64 && f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+			return int64(f), nil
+		}
+		return f, nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LTable:
+		if visited[v] {
+			return nil, ErrCycle
+		}
+		visited[v] = true
+		defer delete(visited, v)
+
+		n := v.Len()
+		if n > 0 && CountKeys(v) == n {
+			s := make([]interface{}, 0, n)
+			for i := 1; i <= n; i++ {
+				gv, err := o.toGo(v.RawGetInt(i), visited)
+				if err != nil {
+					return nil, err
+				}
+				s = append(s, gv)
+			}
+			return s, nil
+		}
+		if n == 0 && o.EmptyArray && CountKeys(v) == 0 {
+			return []interface{}{}, nil
+		}
+
+		m := make(map[string]interface{})
+		var err error
+		v.ForEach(func(k, val lua.LValue) {
+			if err != nil {
+				return
+			}
+			var gv interface{}
+			if gv, err = o.toGo(val, visited); err == nil {
+				m[k.String()] = gv
+			}
+		})
+		return m, err
+	default:
+		return nil, fmt.Errorf("cannot convert a Lua %s", v.Type())
+	}
+}
+
+// FromGo converts the Go value v to a Lua value created in L. It supports
+// the values decoded by encoding/json, the integer and float types,
+// json.Number, []byte (converted to a string), slices of strings and maps of
+// strings, as well as Lua values, which are returned as is. Values of other
+// types are converted to their string representation.
+func FromGo(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return lua.LNil
+	case lua.LValue:
+		return v
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case float32:
+		return lua.LNumber(v)
+	case int:
+		return lua.LNumber(v)
+	case int8:
+		return lua.LNumber(v)
+	case int16:
+		return lua.LNumber(v)
+	case int32:
+		return lua.LNumber(v)
+	case int64:
+		return lua.LNumber(v)
+	case uint:
+		return lua.LNumber(v)
+	case uint8:
+		return lua.LNumber(v)
+	case uint16:
+		return lua.LNumber(v)
+	case uint32:
+		return lua.LNumber(v)
+	case uint64:
+		return lua.LNumber(v)
+	case json.Number:
+		if f, err := v.Float64(); err == nil {
+			return lua.LNumber(f)
+		}
+		return lua.LString(v)
+	case string:
+		return lua.LString(v)
+	case []byte:
+		return lua.LString(v)
+	case []interface{}:
+		t := L.CreateTable(len(v), 0)
+		for _, e := range v {
+			t.Append(FromGo(L, e))
+		}
+		return t
+	case []string:
+		t := L.CreateTable(len(v), 0)
+		for _, e := range v {
+			t.Append(lua.LString(e))
+		}
+		return t
+	case map[string]interface{}:
+		t := L.CreateTable(0, len(v))
+		for k, e := range v {
+			t.RawSetString(k, FromGo(L, e))
+		}
+		return t
+	case map[string]string:
+		t := L.CreateTable(0, len(v))
+		for k, e := range v {
+			t.RawSetString(k, lua.LString(e))
+		}
+		return t
+	default:
+		return lua.LString(fmt.Sprint(v))
+	}
+}
+
+// CountKeys returns the number of keys in t.
+func CountKeys(t *lua.LTable) int {
+	var n int
+	t.ForEach(func(_, _ lua.LValue) { n++ })
+	return n
+}
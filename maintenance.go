@@ -0,0 +1,208 @@
+package lua
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// defaultMaintenanceFlag is the name of the maintenance flag used when none
+// is configured.
+const defaultMaintenanceFlag = "default"
+
+// maintenanceFlags holds the maintenance flags, keyed by name. Flags are
+// created when a handler uses them or when they are set via the admin API,
+// and survive config reloads, so that maintenance mode is not turned off by
+// a reload.
+var maintenanceFlags = &maintenanceRegistry{m: make(map[string]*maintenanceFlag)}
+
+// Maintenance configures the maintenance mode of a handler. The named Flag
+// (default "default") is shared by all handlers that use it and is toggled
+// via the admin API, at /lua/maintenance/<flag>. Scripts can check it with
+// caddy.maintenance.enabled(). If Respond is set, the handler responds with
+// a 503 status while the flag is enabled, without running its script, with
+// the content of the HTML file Page as body if set and a Retry-After header
+// if RetryAfter is set.
+type Maintenance struct {
+	Flag       string         `json:"flag,omitempty"`
+	Respond    bool           `json:"respond,omitempty"`
+	Page       string         `json:"page,omitempty"`
+	RetryAfter caddy.Duration `json:"retry_after,omitempty"`
+}
+
+// unmarshalCaddyfile sets up the maintenance mode from the option's tokens.
+func (m *Maintenance) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Args(&m.Flag)
+	if d.NextArg() {
+		return d.Errf("maintenance: %w", d.ArgErr())
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch field := d.Val(); field {
+		case "respond":
+			if d.NextArg() {
+				return d.Errf("maintenance %s: %w", field, d.ArgErr())
+			}
+			m.Respond = true
+
+		case "page":
+			if !d.Args(&m.Page) || d.NextArg() {
+				return d.Errf("maintenance %s: %w", field, d.ArgErr())
+			}
+			m.Respond = true
+
+		case "retry_after":
+			var v string
+			if !d.Args(&v) || d.NextArg() {
+				return d.Errf("maintenance %s: %w", field, d.ArgErr())
+			}
+			dur, err := caddy.ParseDuration(v)
+			if err != nil {
+				return d.Errf("maintenance %s: %w", field, err)
+			}
+			m.RetryAfter = caddy.Duration(dur)
+
+		default:
+			return d.Errf("maintenance %s: unknown configuration option", field)
+		}
+	}
+	return nil
+}
+
+// maintenanceFlag is a shared maintenance mode flag.
+type maintenanceFlag struct {
+	name    string
+	enabled int32 // accessed atomically
+}
+
+// maintenanceStatus is the admin API representation of a maintenanceFlag.
+type maintenanceStatus struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+func (f *maintenanceFlag) isEnabled() bool {
+	return atomic.LoadInt32(&f.enabled) != 0
+}
+
+func (f *maintenanceFlag) setEnabled(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&f.enabled, v)
+}
+
+func (f *maintenanceFlag) status() maintenanceStatus {
+	return maintenanceStatus{Name: f.name, Enabled: f.isEnabled()}
+}
+
+// maintenanceRegistry is a concurrency-safe set of maintenanceFlag keyed by
+// name.
+type maintenanceRegistry struct {
+	mu sync.Mutex
+	m  map[string]*maintenanceFlag
+}
+
+// get returns the flag named name, creating it if it does not exist.
+func (mr *maintenanceRegistry) get(name string) *maintenanceFlag {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	f := mr.m[name]
+	if f == nil {
+		f = &maintenanceFlag{name: name}
+		mr.m[name] = f
+	}
+	return f
+}
+
+// lookup returns the flag named name, or nil if it does not exist.
+func (mr *maintenanceRegistry) lookup(name string) *maintenanceFlag {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	return mr.m[name]
+}
+
+func (mr *maintenanceRegistry) list() []maintenanceStatus {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	list := make([]maintenanceStatus, 0, len(mr.m))
+	for _, f := range mr.m {
+		list = append(list, f.status())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// maintenanceMode is the runtime state of Maintenance.
+type maintenanceMode struct {
+	cfg  *Maintenance
+	flag *maintenanceFlag
+	page []byte
+}
+
+// newMaintenanceMode returns the maintenance mode described by cfg.
+func newMaintenanceMode(cfg *Maintenance) (*maintenanceMode, error) {
+	name := cfg.Flag
+	if name == "" {
+		name = defaultMaintenanceFlag
+	}
+	mm := &maintenanceMode{cfg: cfg, flag: maintenanceFlags.get(name)}
+	if cfg.Page != "" {
+		page, err := os.ReadFile(cfg.Page)
+		if err != nil {
+			return nil, fmt.Errorf("reading maintenance page: %w", err)
+		}
+		mm.page = page
+	}
+	return mm, nil
+}
+
+// respond writes the maintenance response and returns true if the
+// maintenance mode is enabled and configured to respond.
+func (mm *maintenanceMode) respond(w http.ResponseWriter) (bool, error) {
+	if !mm.cfg.Respond || !mm.flag.isEnabled() {
+		return false, nil
+	}
+	if mm.cfg.RetryAfter > 0 {
+		secs := int(time.Duration(mm.cfg.RetryAfter).Round(time.Second) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if mm.page == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return true, nil
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_, err := w.Write(mm.page)
+	return true, err
+}
+
+var maintenanceFuncs = map[string]lua.LGFunction{
+	"enabled": maintenanceEnabled,
+}
+
+// maintenanceEnabled implements caddy.maintenance.enabled([flag]), which
+// returns true if the flag (by default, the handler's flag) is enabled.
+func maintenanceEnabled(L *lua.LState) int {
+	name := L.OptString(1, "")
+	if name == "" {
+		if mm := checkRequestContext(L).handler.maintenance; mm != nil {
+			L.Push(lua.LBool(mm.flag.isEnabled()))
+			return 1
+		}
+		name = defaultMaintenanceFlag
+	}
+	f := maintenanceFlags.lookup(name)
+	L.Push(lua.LBool(f != nil && f.isEnabled()))
+	return 1
+}
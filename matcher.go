@@ -0,0 +1,152 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	lua "github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(MatchLua{})
+}
+
+// MatchLua matches the requests for which a Lua script returns a truthy
+// value, so that any directive can be gated by logic written in Lua:
+//
+//	@beta lua `request:header("X-Beta") == "1" or caddy.ab.bucket(request.remote_addr, {a = 90, b = 10}) == "b"`
+//
+//	@beta lua {
+//		path /etc/caddy/beta.lua
+//	}
+//
+// The inline Script may be an expression or a chunk with a return statement,
+// and Path is the path of a script file. The script has access to the
+// request global, the json and kv modules and a subset of the caddy table
+// (ab, ctx and placeholder). If the script fails, the error is logged and
+// the request does not match.
+type MatchLua struct {
+	Script string `json:"script,omitempty"`
+	Path   string `json:"path,omitempty"`
+
+	logger *zap.Logger
+	proto  *lua.FunctionProto
+	pool   *statePool
+}
+
+// CaddyModule returns the Caddy module information.
+func (MatchLua) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.lua",
+		New: func() caddy.Module { return new(MatchLua) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (m *MatchLua) Provision(ctx caddy.Context) error {
+	m.logger = ctx.Logger(m)
+	if (m.Script == "") == (m.Path == "") {
+		return errors.New("exactly one of the script or path configuration options is required")
+	}
+
+	if m.Path != "" {
+		proto, err := compileFile(m.Path)
+		if err != nil {
+			return fmt.Errorf("compiling %s: %w", m.Path, err)
+		}
+		m.proto = proto
+	} else {
+		proto, err := compileExpression(m.Script, "<matcher>")
+		if err != nil {
+			return fmt.Errorf("compiling the matcher script: %w", err)
+		}
+		m.proto = proto
+	}
+	m.pool = newStatePool(new(StatePool), newMatcherState)
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (m *MatchLua) Cleanup() error {
+	if m.pool != nil {
+		m.pool.close()
+	}
+	return nil
+}
+
+// newMatcherState returns a new Lua state with the libraries available to
+// matcher scripts loaded.
+func newMatcherState() *lua.LState {
+	L := lua.NewState()
+	mod := L.NewTable()
+	mod.RawSetString("ab", L.SetFuncs(L.NewTable(), abFuncs))
+	mod.RawSetString("ctx", newCtxTable(L))
+	mod.RawSetString("placeholder", L.NewFunction(caddyPlaceholder))
+	L.SetGlobal("caddy", mod)
+	openRequestLib(L)
+	preloadJSONModule(L)
+	preloadKVModule(L)
+	return L
+}
+
+// Match returns true if the matcher's script returns a truthy value for r.
+func (m *MatchLua) Match(r *http.Request) bool {
+	L := m.pool.get()
+	defer m.pool.put(L)
+	setRequestContext(L, &requestContext{r: r})
+	L.SetContext(r.Context())
+
+	ret, err := runProto(L, m.proto)
+	if err != nil {
+		m.logger.Error("running the matcher script", zap.Error(err))
+		return false
+	}
+	return lua.LVAsBool(ret)
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. Syntax:
+//
+//	lua [<script>] {
+//		script <script>
+//		path   <path>
+//	}
+func (m *MatchLua) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			m.Script = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			field := d.Val()
+			var dst *string
+			switch field {
+			case "script":
+				dst = &m.Script
+			case "path":
+				dst = &m.Path
+			default:
+				return d.Errf("%s: unknown configuration option", field)
+			}
+			if !d.Args(dst) || d.NextArg() {
+				return d.Errf("%s: %w", field, d.ArgErr())
+			}
+		}
+	}
+	return nil
+}
+
+// interface guards
+var (
+	_ caddy.Provisioner        = (*MatchLua)(nil)
+	_ caddy.CleanerUpper       = (*MatchLua)(nil)
+	_ caddyhttp.RequestMatcher = (*MatchLua)(nil)
+	_ caddyfile.Unmarshaler    = (*MatchLua)(nil)
+)
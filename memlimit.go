@@ -0,0 +1,179 @@
+package lua
+
+import (
+	"context"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// memoryCheckInstructions is the minimum number of instructions run by a
+// script between two measures of the size of its state.
+const memoryCheckInstructions = 1 << 14
+
+// The estimated sizes of the Lua values, in bytes. gopher-lua allocates the
+// values on the Go heap without accounting, so the size of a state is the
+// sum of the sizes of the values reachable from it, which includes the Go
+// values that hold them but not the code of the functions.
+const (
+	memTableSize    = 112
+	memEntrySize    = 40
+	memStringSize   = 16
+	memNumberSize   = 8
+	memFunctionSize = 64
+	memUpvalueSize  = 40
+	memUserDataSize = 56
+)
+
+// memoryContext is the context of a script of a handler with a MemoryLimit
+// (memory_limit), which stops the script once its state exceeds the limit.
+// gopher-lua calls Done before each instruction of a script that has a
+// context, so the state is measured there every few instructions, on the
+// goroutine of the script while it holds its state. The values reachable
+// from the globals, the registry and the locals and functions of the call
+// stack of the script are measured, the values of the coroutines that the
+// script created only if they are reachable from those.
+//
+// The functions of the handler pass the parent context to the I/O that they
+// do (see stateContext), so that Done is only called by the script.
+type memoryContext struct {
+	context.Context
+	cancel context.CancelFunc
+	L      *lua.LState
+	limit  int64
+
+	// countdown is the number of instructions until the next measure.
+	countdown int
+	exceeded  bool
+}
+
+// newMemoryContext returns the context of a script that runs in L with ctx,
+// which stops it once L exceeds limit bytes.
+func newMemoryContext(ctx context.Context, L *lua.LState, limit int64) *memoryContext {
+	mc := &memoryContext{L: L, limit: limit, countdown: memoryCheckInstructions}
+	// the context is a cancelCtx, so that the contexts of the threads of L,
+	// derived from it by gopher-lua, do not wait for Done in a goroutine
+	mc.Context, mc.cancel = context.WithCancel(ctx)
+	return mc
+}
+
+// Done implements context.Context.
+func (mc *memoryContext) Done() <-chan struct{} {
+	if mc.countdown--; mc.countdown <= 0 {
+		mc.check()
+	}
+	return mc.Context.Done()
+}
+
+// check measures the state and cancels the script if it exceeds the limit.
+// The cost of the measure is proportional to the number of values of the
+// state, so the larger ones are measured less often.
+func (mc *memoryContext) check() {
+	var ms memorySize
+	ms.limit = mc.limit
+	ms.measureState(mc.L)
+	mc.countdown = memoryCheckInstructions
+	if n := 4 * ms.values; n > mc.countdown {
+		mc.countdown = n
+	}
+	if ms.size > mc.limit {
+		mc.exceeded = true
+		mc.cancel()
+	}
+}
+
+// stateContext returns the context of the script running in L without the
+// memory limit of the script, or nil if L has no context.
+func stateContext(L *lua.LState) context.Context {
+	ctx := L.Context()
+	if mc, ok := ctx.(*memoryContext); ok {
+		return mc.Context
+	}
+	return ctx
+}
+
+// memorySize measures the size of the values of a state, until it exceeds
+// limit.
+type memorySize struct {
+	limit  int64
+	size   int64
+	values int
+	seen   map[lua.LValue]struct{}
+	queue  []lua.LValue
+}
+
+// measureState measures the values reachable from L.
+func (ms *memorySize) measureState(L *lua.LState) {
+	ms.seen = make(map[lua.LValue]struct{})
+	ms.add(L.G.Global)
+	ms.add(L.G.Registry)
+	for level := 0; ; level++ {
+		dbg, ok := L.GetStack(level)
+		if !ok {
+			break
+		}
+		if fn, err := L.GetInfo("f", dbg, lua.LNil); err == nil {
+			ms.add(fn)
+		}
+		for i := 1; ; i++ {
+			name, v := L.GetLocal(dbg, i)
+			if name == "" {
+				break
+			}
+			ms.add(v)
+		}
+	}
+	for len(ms.queue) > 0 && ms.size <= ms.limit {
+		v := ms.queue[len(ms.queue)-1]
+		ms.queue = ms.queue[:len(ms.queue)-1]
+		ms.measure(v)
+	}
+}
+
+// add adds the size of v, and queues the values that v references.
+func (ms *memorySize) add(v lua.LValue) {
+	switch v := v.(type) {
+	case lua.LString:
+		ms.size += memStringSize + int64(len(v))
+	case lua.LNumber:
+		ms.size += memNumberSize
+	case *lua.LTable, *lua.LFunction, *lua.LUserData, *lua.LState:
+		if _, ok := ms.seen[v]; ok {
+			return
+		}
+		ms.seen[v] = struct{}{}
+		ms.queue = append(ms.queue, v)
+	}
+	ms.values++
+}
+
+// measure adds the size of the table, function, userdata or thread v and
+// queues the values that it references.
+func (ms *memorySize) measure(v lua.LValue) {
+	switch v := v.(type) {
+	case *lua.LTable:
+		ms.size += memTableSize
+		ms.add(v.Metatable)
+		v.ForEach(func(k, v lua.LValue) {
+			ms.size += memEntrySize
+			ms.add(k)
+			ms.add(v)
+		})
+	case *lua.LFunction:
+		ms.size += memFunctionSize + int64(len(v.Upvalues))*memUpvalueSize
+		if v.Env != nil {
+			ms.add(v.Env)
+		}
+		for _, uv := range v.Upvalues {
+			ms.add(uv.Value())
+		}
+	case *lua.LUserData:
+		ms.size += memUserDataSize
+		ms.add(v.Metatable)
+		if v.Env != nil {
+			ms.add(v.Env)
+		}
+	case *lua.LState:
+		// the stack of a coroutine is not measured
+		ms.size += memTableSize
+	}
+}
@@ -0,0 +1,48 @@
+package lua
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMemoryLimit(t *testing.T) {
+	for _, isolation := range []string{isolationPerRequest, isolationPooled, isolationSharedCoroutine} {
+		t.Run(isolation, func(t *testing.T) {
+			tr, err := NewTester(&Lua{
+				Isolation:   isolation,
+				MemoryLimit: 1 << 20,
+				Script: `
+					if request.path == "/grow" then
+						local t = {}
+						for i = 1, 1e7 do t[i] = {i} end
+					elseif request.path == "/global" then
+						-- the limit also applies to the values kept by the state
+						big = {}
+						for i = 1, 1e4 do big[i] = {i} end
+					end
+					response:write("ok")`,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tr.Close()
+
+			cases := []struct {
+				path   string
+				status int
+			}{
+				{"/", http.StatusOK},
+				{"/grow", http.StatusInternalServerError},
+				{"/", http.StatusOK},
+				{"/global", http.StatusInternalServerError},
+				// the state that exceeded the limit is not reused
+				{"/", http.StatusOK},
+			}
+			for _, c := range cases {
+				if res := tr.Do(TestRequest{Path: c.path}); res.Status != c.status {
+					t.Errorf("%s: got status %d (%v), want %d", c.path, res.Status, res.Err, c.status)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,369 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	metricsNamespace = "caddy"
+	metricsSubsystem = "lua"
+
+	counterTypeName   = "caddy.metrics.counter"
+	gaugeTypeName     = "caddy.metrics.gauge"
+	histogramTypeName = "caddy.metrics.histogram"
+)
+
+// handlerMetrics are the metrics of the Lua handlers, registered with the
+// default Prometheus registry that Caddy's metrics endpoint exposes. The
+// metrics of the scripts are labeled with their path ("<script>" for the
+// inline script), the pool metrics with the name of the handler and the
+// tenant metrics with the name of the handler and the tenant (see Quota).
+var handlerMetrics = struct {
+	init       sync.Once
+	executions *prometheus.CounterVec
+	errors     *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+	poolIdle   *prometheus.GaugeVec
+	poolMisses *prometheus.CounterVec
+
+	tenantExecutions *prometheus.CounterVec
+	tenantCPU        *prometheus.CounterVec
+	tenantRejections *prometheus.CounterVec
+
+	customMu sync.Mutex
+	custom   map[string]*customMetric
+}{
+	custom: make(map[string]*customMetric),
+}
+
+func initHandlerMetrics() {
+	handlerMetrics.init.Do(func() {
+		handlerMetrics.executions = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "script_executions_total",
+			Help:      "Number of executions of the Lua scripts.",
+		}, []string{"path"})
+		handlerMetrics.errors = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "script_errors_total",
+			Help:      "Number of executions of the Lua scripts that failed.",
+		}, []string{"path"})
+		handlerMetrics.duration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "script_duration_seconds",
+			Help:      "Histogram of the execution durations of the Lua scripts.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"path"})
+		handlerMetrics.poolIdle = promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "pool_idle_states",
+			Help:      "Number of idle Lua states in the pool of the handler.",
+		}, []string{"handler"})
+		handlerMetrics.poolMisses = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "pool_misses_total",
+			Help:      "Number of Lua states created because the pool of the handler had no idle state.",
+		}, []string{"handler"})
+		handlerMetrics.tenantExecutions = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "tenant_executions_total",
+			Help:      "Number of requests of the tenant whose scripts ran.",
+		}, []string{"handler", "tenant"})
+		handlerMetrics.tenantCPU = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "tenant_cpu_seconds_total",
+			Help:      "Time spent running the scripts of the tenant.",
+		}, []string{"handler", "tenant"})
+		handlerMetrics.tenantRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "tenant_quota_rejections_total",
+			Help:      "Number of requests of the tenant rejected or stopped because it exceeded a quota.",
+		}, []string{"handler", "tenant", "quota"})
+	})
+}
+
+// observeScript records the execution of the script at path, which took
+// d and failed if failed is true.
+func observeScript(path string, d time.Duration, failed bool) {
+	initHandlerMetrics()
+	if path == "" {
+		path = "<script>"
+	}
+	handlerMetrics.executions.WithLabelValues(path).Inc()
+	handlerMetrics.duration.WithLabelValues(path).Observe(d.Seconds())
+	if failed {
+		handlerMetrics.errors.WithLabelValues(path).Inc()
+	}
+}
+
+// observeTenantExecution records the execution of the scripts of a request
+// of the tenant of the handler.
+func observeTenantExecution(handler, tenant string) {
+	initHandlerMetrics()
+	handlerMetrics.tenantExecutions.WithLabelValues(handler, tenant).Inc()
+}
+
+// observeTenantCPUTime records the time d spent running a script of the
+// tenant of the handler.
+func observeTenantCPUTime(handler, tenant string, d time.Duration) {
+	initHandlerMetrics()
+	handlerMetrics.tenantCPU.WithLabelValues(handler, tenant).Add(d.Seconds())
+}
+
+// observeTenantRejection records a request of the tenant of the handler
+// that exceeded the quota.
+func observeTenantRejection(handler, tenant, quota string) {
+	initHandlerMetrics()
+	handlerMetrics.tenantRejections.WithLabelValues(handler, tenant, quota).Inc()
+}
+
+// metricsName returns the value of the handler label of the handler's
+// metrics: its name, or the path of its main script or root.
+func (l *Lua) metricsName() string {
+	for _, name := range []string{l.Name, l.HandlerPath, l.Root} {
+		if name != "" {
+			return name
+		}
+	}
+	return "<script>"
+}
+
+// instrumentPool sets the metrics of the pool p of the handler.
+func (l *Lua) instrumentPool(p *statePool) {
+	initHandlerMetrics()
+	name := l.metricsName()
+	p.idleGauge = handlerMetrics.poolIdle.WithLabelValues(name)
+	p.misses = handlerMetrics.poolMisses.WithLabelValues(name)
+	p.idleGauge.Set(float64(len(p.idle)))
+}
+
+// customMetric is a metric declared by the scripts.
+type customMetric struct {
+	typeName string
+	labels   []string
+	vec      prometheus.Collector
+}
+
+// preloadMetricsModule registers the metrics module, loaded by scripts with
+// require("metrics"), which declares custom metrics exposed with the metrics
+// of Caddy:
+//
+//	metrics.counter(name, help[, labels]): returns the counter name, with
+//	the methods inc([labels]) and add(n[, labels])
+//	metrics.gauge(name, help[, labels]): returns the gauge name, with the
+//	methods set(v[, labels]), inc([labels]), dec([labels]) and
+//	add(n[, labels])
+//	metrics.histogram(name, help[, labels[, buckets]]): returns the
+//	histogram name, with the method observe(v[, labels])
+//
+// The labels of the declarations are the arrays of the names of the labels
+// of the metrics, and the labels of the methods are the tables of their
+// values by name. The metrics are shared by all the handlers: declaring a
+// metric that exists returns it if it has the same type and labels, and
+// fails otherwise. The declarations raise an error if the metric cannot be
+// registered, e.g. if its name is not valid.
+func preloadMetricsModule(L *lua.LState) {
+	for name, methods := range map[string]map[string]lua.LGFunction{
+		counterTypeName: {
+			"inc": metricInc,
+			"add": metricAdd,
+		},
+		gaugeTypeName: {
+			"set": metricSet,
+			"inc": metricInc,
+			"dec": metricDec,
+			"add": metricAdd,
+		},
+		histogramTypeName: {
+			"observe": metricObserve,
+		},
+	} {
+		mt := L.NewTypeMetatable(name)
+		L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), methods))
+	}
+
+	L.PreloadModule("metrics", func(L *lua.LState) int {
+		L.Push(L.SetFuncs(L.NewTable(), metricsFuncs))
+		return 1
+	})
+}
+
+var metricsFuncs = map[string]lua.LGFunction{
+	"counter":   metricsDeclare(counterTypeName),
+	"gauge":     metricsDeclare(gaugeTypeName),
+	"histogram": metricsDeclare(histogramTypeName),
+}
+
+// metricsDeclare returns the function that declares the metrics of type
+// typeName.
+func metricsDeclare(typeName string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		name := L.CheckString(1)
+		help := L.CheckString(2)
+		var labels []string
+		if t := optTable(L.Get(3)); t != nil {
+			labels = tableStrings(t)
+		}
+		var buckets []float64
+		if t := optTable(L.Get(4)); t != nil && typeName == histogramTypeName {
+			for i := 1; i <= t.Len(); i++ {
+				buckets = append(buckets, float64(lua.LVAsNumber(t.RawGetInt(i))))
+			}
+		}
+
+		m, err := declareMetric(typeName, name, help, labels, buckets)
+		if err != nil {
+			L.RaiseError("metrics: %s", err)
+		}
+		ud := L.NewUserData()
+		ud.Value = m
+		L.SetMetatable(ud, L.GetTypeMetatable(typeName))
+		L.Push(ud)
+		return 1
+	}
+}
+
+// declareMetric returns the custom metric name, registering it if it does
+// not exist.
+func declareMetric(typeName, name, help string, labels []string, buckets []float64) (*customMetric, error) {
+	handlerMetrics.customMu.Lock()
+	defer handlerMetrics.customMu.Unlock()
+
+	if m := handlerMetrics.custom[name]; m != nil {
+		if m.typeName != typeName || !equalStrings(m.labels, labels) {
+			return nil, fmt.Errorf("%s is already declared with another type or labels", name)
+		}
+		return m, nil
+	}
+
+	var vec prometheus.Collector
+	switch typeName {
+	case counterTypeName:
+		vec = prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+	case gaugeTypeName:
+		vec = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels)
+	case histogramTypeName:
+		if !sort.Float64sAreSorted(buckets) {
+			return nil, errors.New("the buckets must be in increasing order")
+		}
+		vec = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labels)
+	}
+	if err := prometheus.DefaultRegisterer.Register(vec); err != nil {
+		return nil, err
+	}
+	m := &customMetric{typeName: typeName, labels: labels, vec: vec}
+	handlerMetrics.custom[name] = m
+	return m, nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func checkMetric(L *lua.LState) *customMetric {
+	if m, ok := L.CheckUserData(1).Value.(*customMetric); ok {
+		return m
+	}
+	L.ArgError(1, "metric expected")
+	return nil
+}
+
+// metricLabels returns the label values at index n of the stack for m.
+func metricLabels(L *lua.LState, m *customMetric, n int) prometheus.Labels {
+	labels := prometheus.Labels{}
+	t := L.OptTable(n, L.NewTable())
+	for _, name := range m.labels {
+		labels[name] = lua.LVAsString(t.RawGetString(name))
+	}
+	return labels
+}
+
+// metricAdder returns the counter or gauge of m with the labels at index n
+// of the stack.
+func metricAdder(L *lua.LState, m *customMetric, n int) interface{ Add(float64) } {
+	labels := metricLabels(L, m, n)
+	var c interface{ Add(float64) }
+	var err error
+	switch vec := m.vec.(type) {
+	case *prometheus.CounterVec:
+		c, err = vec.GetMetricWith(labels)
+	case *prometheus.GaugeVec:
+		c, err = vec.GetMetricWith(labels)
+	}
+	if err != nil {
+		L.RaiseError("metrics: %s", err)
+	}
+	return c
+}
+
+// metricInc implements metric:inc([labels]).
+func metricInc(L *lua.LState) int {
+	metricAdder(L, checkMetric(L), 2).Add(1)
+	return 0
+}
+
+// metricDec implements gauge:dec([labels]).
+func metricDec(L *lua.LState) int {
+	metricAdder(L, checkMetric(L), 2).Add(-1)
+	return 0
+}
+
+// metricAdd implements metric:add(n[, labels]). Counters only accept
+// positive values.
+func metricAdd(L *lua.LState) int {
+	m := checkMetric(L)
+	n := float64(L.CheckNumber(2))
+	if m.typeName == counterTypeName && n < 0 {
+		L.ArgError(2, "counters cannot decrease")
+	}
+	metricAdder(L, m, 3).Add(n)
+	return 0
+}
+
+// metricSet implements gauge:set(v[, labels]).
+func metricSet(L *lua.LState) int {
+	m := checkMetric(L)
+	v := float64(L.CheckNumber(2))
+	g, err := m.vec.(*prometheus.GaugeVec).GetMetricWith(metricLabels(L, m, 3))
+	if err != nil {
+		L.RaiseError("metrics: %s", err)
+	}
+	g.Set(v)
+	return 0
+}
+
+// metricObserve implements histogram:observe(v[, labels]).
+func metricObserve(L *lua.LState) int {
+	m := checkMetric(L)
+	v := float64(L.CheckNumber(2))
+	o, err := m.vec.(*prometheus.HistogramVec).GetMetricWith(metricLabels(L, m, 3))
+	if err != nil {
+		L.RaiseError("metrics: %s", err)
+	}
+	o.Observe(v)
+	return 0
+}
@@ -0,0 +1,182 @@
+package lua
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// maxModuleHandlers is the maximum number of distinct handler configurations
+// that a Lua handler can provision via caddy.handler.
+const maxModuleHandlers = 64
+
+// moduleLoadMu serializes the loading of the handler modules invoked by
+// scripts, which happens while the requests are handled and shares the
+// Caddy configuration with the other handlers, e.g. to load its apps.
+var moduleLoadMu sync.Mutex
+
+// moduleHandlers provisions and caches the Caddy HTTP handler modules invoked
+// by scripts, keyed by their JSON configuration. Each module is loaded in a
+// context of its own, canceled by cleanup.
+type moduleHandlers struct {
+	ctx caddy.Context
+
+	mu       sync.Mutex
+	handlers map[string]caddyhttp.MiddlewareHandler
+	cancels  []context.CancelFunc
+}
+
+func newModuleHandlers(ctx caddy.Context) *moduleHandlers {
+	// the contexts of the modules derive from a new context, since
+	// canceling a context also calls the cancel functions registered on its
+	// parent, e.g. the one that closes the logs of the configuration
+	base, _ := caddy.NewContext(ctx)
+	return &moduleHandlers{
+		ctx:      base,
+		handlers: make(map[string]caddyhttp.MiddlewareHandler),
+	}
+}
+
+// get returns the handler module with the specified name and JSON
+// configuration, provisioning it if it is not cached yet.
+func (mh *moduleHandlers) get(name string, cfg json.RawMessage) (caddyhttp.MiddlewareHandler, error) {
+	key := name + " " + string(cfg)
+
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+
+	if h := mh.handlers[key]; h != nil {
+		return h, nil
+	}
+	if len(mh.handlers) >= maxModuleHandlers {
+		return nil, errors.New("too many distinct handler configurations")
+	}
+
+	ctx, cancel := caddy.NewContext(mh.ctx)
+	moduleLoadMu.Lock()
+	mod, err := ctx.LoadModuleByID("http.handlers."+name, cfg)
+	moduleLoadMu.Unlock()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	h, ok := mod.(caddyhttp.MiddlewareHandler)
+	if !ok {
+		cancel()
+		return nil, errors.New("module " + name + " is not an HTTP handler")
+	}
+	mh.handlers[key] = h
+	mh.cancels = append(mh.cancels, cancel)
+	return h, nil
+}
+
+// cleanup cancels the contexts of the modules, which cleans them up.
+func (mh *moduleHandlers) cleanup() {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	for _, cancel := range mh.cancels {
+		cancel()
+	}
+	mh.cancels = nil
+	mh.handlers = make(map[string]caddyhttp.MiddlewareHandler)
+}
+
+// noopHandler is the next handler of the modules invoked by scripts.
+var noopHandler = caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+
+// errorStatus returns the HTTP status code of the handler error err.
+func errorStatus(err error) int {
+	var herr caddyhttp.HandlerError
+	if errors.As(err, &herr) && herr.StatusCode != 0 {
+		return herr.StatusCode
+	}
+	return http.StatusInternalServerError
+}
+
+// writeTracker records whether the response was written to, and its status
+// code.
+type writeTracker struct {
+	*caddyhttp.ResponseWriterWrapper
+	wrote  bool
+	status int
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (tw *writeTracker) WriteHeader(status int) {
+	if !tw.wrote {
+		tw.wrote = true
+		tw.status = status
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter.
+func (tw *writeTracker) Write(p []byte) (int, error) {
+	if !tw.wrote {
+		tw.wrote = true
+		tw.status = http.StatusOK
+	}
+	return tw.ResponseWriter.Write(p)
+}
+
+// caddyHandler implements caddy.handler(cfg). The cfg table holds the name
+// of the handler module in its handler field and the module's configuration
+// in its other fields, e.g. {handler="file_server", root="/srv"}. It returns
+// a function that invokes the handler for the current request, returning
+// true on success or false, the error message and the HTTP status code of
+// the error on failure.
+func caddyHandler(L *lua.LState) int {
+	cfg := L.CheckTable(1)
+	name, ok := cfg.RawGetString("handler").(lua.LString)
+	if !ok || name == "" {
+		L.ArgError(1, "the handler field is required")
+	}
+
+	v, err := toGo(cfg)
+	if err != nil {
+		L.ArgError(1, err.Error())
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		L.ArgError(1, "the handler configuration must be a table of fields")
+	}
+	delete(m, "handler")
+	raw, err := json.Marshal(m)
+	if err != nil {
+		L.ArgError(1, err.Error())
+	}
+
+	rc := checkRequestContext(L)
+	h, err := rc.handler.modules.get(string(name), raw)
+	if err != nil {
+		L.RaiseError("caddy.handler: %s", err)
+	}
+
+	L.Push(L.NewFunction(func(L *lua.LState) int {
+		rc := checkRequestContext(L)
+		tw := &writeTracker{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: rc.w}}
+		var err error
+		unlocked(L, func() { err = h.ServeHTTP(tw, rc.r, noopHandler) })
+		if tw.wrote {
+			// the handler wrote the response, the next handler must not be
+			// called.
+			rc.responded = true
+			rc.wroteHeader = true
+		}
+		if err != nil {
+			L.Push(lua.LFalse)
+			L.Push(lua.LString(err.Error()))
+			L.Push(lua.LNumber(errorStatus(err)))
+			return 3
+		}
+		L.Push(lua.LTrue)
+		return 1
+	}))
+	return 1
+}
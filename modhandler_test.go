@@ -0,0 +1,48 @@
+package lua
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+func TestModuleHandlersSharedContext(t *testing.T) {
+	// the handlers of a configuration are provisioned with the same context
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	var testers []*Tester
+	for i := 0; i < 2; i++ {
+		l := &Lua{Script: `
+			local ok, err = caddy.handler({handler = "static_response", body = request.query.n})()
+			if not ok then error(err) end`}
+		if err := l.provision(ctx, &certmagic.FileStorage{Path: t.TempDir()}, zap.NewNop()); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		defer l.Cleanup()
+		testers = append(testers, &Tester{handler: l, cancel: func() {}})
+	}
+
+	var wg sync.WaitGroup
+	for _, tr := range testers {
+		for i := 0; i < maxModuleHandlers; i++ {
+			wg.Add(1)
+			go func(tr *Tester, n int) {
+				defer wg.Done()
+				want := fmt.Sprint(n)
+				res := tr.Do(TestRequest{Path: "/?n=" + want})
+				if res.Err != nil || res.Body != want {
+					t.Errorf("%d: got %q, %v, want %q", n, res.Body, res.Err, want)
+				}
+			}(tr, i)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,78 @@
+package lua
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// caddyNext implements caddy.next([opts]), which calls the next handler from
+// the script, with the request and response filters of the handler, so that
+// the script can run code after it. The next handler is not called again
+// once the script returns.
+//
+// By default the response of the next handler is sent to the client, and
+// true and its status code are returned. If opts.buffer is true, the
+// response is buffered instead and returned as a table with the status,
+// headers and body fields, and the script must write the response itself,
+// e.g. with response:write. On failure, false (nil if buffered), the error
+// message and the HTTP status code of the error are returned.
+func caddyNext(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	opts := L.OptTable(1, L.NewTable())
+	if rc.next == nil {
+		L.RaiseError("caddy.next: no next handler")
+	}
+	if rc.calledNext {
+		L.RaiseError("caddy.next: the next handler was already called")
+	}
+	if rc.wroteHeader {
+		L.RaiseError("caddy.next: the response header is already written")
+	}
+	rc.calledNext = true
+	rc.responded = true
+	buffer := lua.LVAsBool(opts.RawGetString("buffer"))
+
+	fail := func(err error) int {
+		if buffer {
+			L.Push(lua.LNil)
+		} else {
+			L.Push(lua.LFalse)
+		}
+		L.Push(lua.LString(err.Error()))
+		L.Push(lua.LNumber(errorStatus(err)))
+		return 3
+	}
+
+	l := rc.handler
+	if buffer {
+		rb := newResponseBuffer()
+		for name, vals := range rc.w.Header() {
+			rb.header[name] = append([]string(nil), vals...)
+		}
+		if err := l.serveNext(rb, rc.r, L, rc.next); err != nil {
+			return fail(err)
+		}
+		t := L.CreateTable(0, 3)
+		t.RawSetString("status", lua.LNumber(rb.statusCode()))
+		t.RawSetString("headers", headerToTable(L, rb.header))
+		t.RawSetString("body", lua.LString(rb.body.String()))
+		L.Push(t)
+		return 1
+	}
+
+	tw := &writeTracker{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: rc.w}}
+	err := l.serveNext(tw, rc.r, L, rc.next)
+	if err != nil {
+		return fail(err)
+	}
+	status := http.StatusOK
+	if tw.wrote {
+		rc.wroteHeader = true
+		status = tw.status
+	}
+	L.Push(lua.LTrue)
+	L.Push(lua.LNumber(status))
+	return 2
+}
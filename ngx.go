@@ -0,0 +1,809 @@
+package lua
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	lua "github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+)
+
+const ngxSharedDictTypeName = "caddy.ngx.shared_dict"
+
+// ngxStatusCodes are the status constants of the ngx module.
+var ngxStatusCodes = map[string]int{
+	"HTTP_OK":                    http.StatusOK,
+	"HTTP_CREATED":               http.StatusCreated,
+	"HTTP_NO_CONTENT":            http.StatusNoContent,
+	"HTTP_MOVED_PERMANENTLY":     http.StatusMovedPermanently,
+	"HTTP_MOVED_TEMPORARILY":     http.StatusFound,
+	"HTTP_SEE_OTHER":             http.StatusSeeOther,
+	"HTTP_NOT_MODIFIED":          http.StatusNotModified,
+	"HTTP_TEMPORARY_REDIRECT":    http.StatusTemporaryRedirect,
+	"HTTP_PERMANENT_REDIRECT":    http.StatusPermanentRedirect,
+	"HTTP_BAD_REQUEST":           http.StatusBadRequest,
+	"HTTP_UNAUTHORIZED":          http.StatusUnauthorized,
+	"HTTP_FORBIDDEN":             http.StatusForbidden,
+	"HTTP_NOT_FOUND":             http.StatusNotFound,
+	"HTTP_NOT_ALLOWED":           http.StatusMethodNotAllowed,
+	"HTTP_TOO_MANY_REQUESTS":     http.StatusTooManyRequests,
+	"HTTP_INTERNAL_SERVER_ERROR": http.StatusInternalServerError,
+	"HTTP_BAD_GATEWAY":           http.StatusBadGateway,
+	"HTTP_SERVICE_UNAVAILABLE":   http.StatusServiceUnavailable,
+	"HTTP_GATEWAY_TIMEOUT":       http.StatusGatewayTimeout,
+}
+
+// ngxLogLevels are the log level constants of the ngx module, from the most
+// to the least severe.
+var ngxLogLevels = []string{"STDERR", "EMERG", "ALERT", "CRIT", "ERR", "WARN", "NOTICE", "INFO", "DEBUG"}
+
+// preloadNgxModule registers the ngx module, loaded by scripts with
+// require("ngx"), a subset of the ngx API of OpenResty built on the request,
+// response, caddy.ctx, kv and re functions, so that the OpenResty scripts
+// can be ported with few changes (e.g. local ngx = require("ngx")):
+//
+//	ngx.var.name: the nginx variable name, see ngxVarIndex; the other names
+//	are the variables of the request (see caddy.placeholder), which can
+//	be set
+//	ngx.ctx: caddy.ctx
+//	ngx.status: the status of the response, which can be set
+//	ngx.header[name]: the response header name, a string or an array if it
+//	has several values, which can be set like response:set_header; the
+//	underscores of name are dashes
+//	ngx.req.get_method(), ngx.req.get_headers(), ngx.req.get_uri_args(): the
+//	method of the request, its headers, with lower case names, and its
+//	query string parameters, the repeated ones as arrays
+//	ngx.req.read_body(), ngx.req.get_body_data(): the body of the request,
+//	read like request:body
+//	ngx.req.set_header(name, value), ngx.req.clear_header(name),
+//	ngx.req.set_uri(path), ngx.req.set_uri_args(args): like request:set_header,
+//	request:set_path and request:set_query
+//	ngx.resp.get_headers(): the response headers, with lower case names
+//	ngx.print(...), ngx.say(...): write their arguments to the response,
+//	the arrays flattened, followed by a line break for ngx.say
+//	ngx.exit(status): ends the script, with the status of the response if
+//	it is 200 or more and the response header is not written, or without
+//	responding if it is ngx.OK (0)
+//	ngx.redirect(uri[, status]): responds with a redirection, 302 by
+//	default, and ends the script
+//	ngx.log(level, ...): logs its arguments with the logger of the handler
+//	ngx.now(), ngx.time(): the current time in seconds, with the
+//	milliseconds for ngx.now
+//	ngx.shared.DICT: the shared dictionary DICT, see ngxSharedDictMethods
+//	ngx.re.match, find, gsub and sub: see ngxRegexpFuncs
+//
+// along with ngx.OK, the ngx.HTTP_* status codes and the ngx.ERR, WARN,
+// INFO, ... log levels. Unlike OpenResty, the functions do not yield and
+// the end of the script by ngx.exit and ngx.redirect can be caught by pcall.
+func preloadNgxModule(L *lua.LState) {
+	L.PreloadModule("ngx", func(L *lua.LState) int {
+		mod := L.SetFuncs(L.NewTable(), ngxFuncs)
+		mod.RawSetString("OK", lua.LNumber(0))
+		for name, code := range ngxStatusCodes {
+			mod.RawSetString(name, lua.LNumber(code))
+		}
+		for i, name := range ngxLogLevels {
+			mod.RawSetString(name, lua.LNumber(i))
+		}
+		mod.RawSetString("var", newProxyTable(L, ngxVarIndex, ngxVarNewIndex))
+		mod.RawSetString("header", newProxyTable(L, ngxHeaderIndex, ngxHeaderNewIndex))
+		mod.RawSetString("req", L.SetFuncs(L.NewTable(), ngxReqFuncs))
+		mod.RawSetString("resp", L.SetFuncs(L.NewTable(), ngxRespFuncs))
+		mod.RawSetString("re", L.SetFuncs(L.NewTable(), ngxRegexpFuncs))
+		mod.RawSetString("shared", newProxyTable(L, ngxSharedIndex, nil))
+		if caddyMod, ok := L.GetGlobal("caddy").(*lua.LTable); ok {
+			mod.RawSetString("ctx", caddyMod.RawGetString("ctx"))
+		}
+
+		mt := L.NewTable()
+		mt.RawSetString("__index", L.NewFunction(ngxIndex))
+		mt.RawSetString("__newindex", L.NewFunction(ngxNewIndex))
+		L.SetMetatable(mod, mt)
+
+		dmt := L.NewTypeMetatable(ngxSharedDictTypeName)
+		L.SetField(dmt, "__index", L.SetFuncs(L.NewTable(), ngxSharedDictMethods))
+		L.Push(mod)
+		return 1
+	})
+}
+
+var ngxFuncs = map[string]lua.LGFunction{
+	"print":    ngxPrint,
+	"say":      ngxSay,
+	"exit":     ngxExit,
+	"redirect": ngxRedirect,
+	"log":      ngxLog,
+	"now":      ngxNow,
+	"time":     ngxTime,
+}
+
+var ngxReqFuncs = map[string]lua.LGFunction{
+	"get_method":    ngxReqGetMethod,
+	"get_headers":   ngxReqGetHeaders,
+	"get_uri_args":  ngxReqGetURIArgs,
+	"read_body":     ngxReqReadBody,
+	"get_body_data": ngxMethod(requestBody),
+	"set_header":    ngxMethod(requestSetHeader),
+	"clear_header":  ngxReqClearHeader,
+	"set_uri":       ngxMethod(requestSetPath),
+	"set_uri_args":  ngxMethod(requestSetQuery),
+}
+
+var ngxRespFuncs = map[string]lua.LGFunction{
+	"get_headers": ngxRespGetHeaders,
+}
+
+// ngxMethod returns the function that calls the method fn of the request or
+// of the response with its arguments, which have no self.
+func ngxMethod(fn lua.LGFunction) lua.LGFunction {
+	return func(L *lua.LState) int {
+		L.Insert(lua.LNil, 1)
+		return fn(L)
+	}
+}
+
+// newProxyTable returns an empty table whose fields are read by index and
+// set by newIndex, which raises an error if it is nil.
+func newProxyTable(L *lua.LState, index, newIndex lua.LGFunction) *lua.LTable {
+	mt := L.NewTable()
+	mt.RawSetString("__index", L.NewFunction(index))
+	if newIndex == nil {
+		newIndex = func(L *lua.LState) int {
+			L.RaiseError("the fields of this table cannot be set")
+			return 0
+		}
+	}
+	mt.RawSetString("__newindex", L.NewFunction(newIndex))
+	t := L.NewTable()
+	L.SetMetatable(t, mt)
+	return t
+}
+
+// ngxIndex implements the __index metamethod of the ngx module, for
+// ngx.status.
+func ngxIndex(L *lua.LState) int {
+	if L.CheckString(2) != "status" {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(lua.LNumber(checkRequestContext(L).status))
+	return 1
+}
+
+// ngxNewIndex implements the __newindex metamethod of the ngx module, which
+// sets ngx.status or the other fields.
+func ngxNewIndex(L *lua.LState) int {
+	if L.CheckString(2) != "status" {
+		L.RawSet(L.CheckTable(1), L.Get(2), L.Get(3))
+		return 0
+	}
+	L.Remove(2)
+	return responseSetStatus(L)
+}
+
+// ngxVarIndex implements the __index metamethod of ngx.var, which returns
+// the nginx variables:
+//
+//	uri, request_uri, args (or query_string), is_args, request_method,
+//	scheme, host, server_protocol, remote_addr, remote_port,
+//	content_type, content_length
+//	arg_NAME, http_NAME and cookie_NAME: the query string parameter, the
+//	request header (with dashes for the underscores) and the cookie NAME
+func ngxVarIndex(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	r := rc.r
+	name := L.CheckString(2)
+	raddr, rport, _ := net.SplitHostPort(r.RemoteAddr)
+	var v string
+	var ok bool
+	switch {
+	case strings.HasPrefix(name, "arg_"):
+		vals, set := r.URL.Query()[name[len("arg_"):]]
+		if set && len(vals) > 0 {
+			v, ok = vals[0], true
+		}
+	case strings.HasPrefix(name, "http_"):
+		v = r.Header.Get(strings.ReplaceAll(name[len("http_"):], "_", "-"))
+		ok = v != ""
+	case strings.HasPrefix(name, "cookie_"):
+		if c, err := r.Cookie(name[len("cookie_"):]); err == nil {
+			v, ok = c.Value, true
+		}
+	default:
+		ok = true
+		switch name {
+		case "uri":
+			v = r.URL.Path
+		case "request_uri":
+			v = r.RequestURI
+		case "args", "query_string":
+			v = r.URL.RawQuery
+		case "is_args":
+			if r.URL.RawQuery != "" {
+				v = "?"
+			}
+		case "request_method":
+			v = r.Method
+		case "scheme":
+			v = "http"
+			if r.TLS != nil {
+				v = "https"
+			}
+		case "host":
+			v = r.Host
+			if h, _, err := net.SplitHostPort(r.Host); err == nil {
+				v = h
+			}
+		case "server_protocol":
+			v = r.Proto
+		case "remote_addr":
+			v = raddr
+		case "remote_port":
+			v = rport
+		case "content_type":
+			v = r.Header.Get("Content-Type")
+		case "content_length":
+			v = r.Header.Get("Content-Length")
+		default:
+			v, ok = caddyhttp.GetVar(r.Context(), name).(string)
+		}
+	}
+	if !ok {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(lua.LString(v))
+	return 1
+}
+
+// ngxVarNewIndex implements the __newindex metamethod of ngx.var, which sets
+// the variables of the request.
+func ngxVarNewIndex(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	name := L.CheckString(2)
+	switch v := L.Get(3).(type) {
+	case *lua.LNilType:
+		caddyhttp.SetVar(rc.r.Context(), name, nil)
+	case lua.LString, lua.LNumber:
+		caddyhttp.SetVar(rc.r.Context(), name, lua.LVAsString(v))
+	default:
+		L.ArgError(3, "string, number or nil expected")
+	}
+	return 0
+}
+
+// ngxHeaderName returns the header name of the field of ngx.header.
+func ngxHeaderName(L *lua.LState) string {
+	return strings.ReplaceAll(L.CheckString(2), "_", "-")
+}
+
+// ngxHeaderIndex implements the __index metamethod of ngx.header.
+func ngxHeaderIndex(L *lua.LState) int {
+	vals := checkRequestContext(L).w.Header().Values(ngxHeaderName(L))
+	switch len(vals) {
+	case 0:
+		L.Push(lua.LNil)
+	case 1:
+		L.Push(lua.LString(vals[0]))
+	default:
+		L.Push(stringArray(L, vals))
+	}
+	return 1
+}
+
+// ngxHeaderNewIndex implements the __newindex metamethod of ngx.header.
+func ngxHeaderNewIndex(L *lua.LState) int {
+	L.Replace(2, lua.LString(ngxHeaderName(L)))
+	return responseSetHeader(L)
+}
+
+// lowerHeaderTable returns the table of the headers of h, with lower case
+// names.
+func lowerHeaderTable(L *lua.LState, h http.Header) *lua.LTable {
+	lower := make(http.Header, len(h))
+	for name, vals := range h {
+		name = strings.ToLower(name)
+		lower[name] = append(lower[name], vals...)
+	}
+	return headerToTable(L, lower)
+}
+
+// ngxReqGetMethod implements ngx.req.get_method().
+func ngxReqGetMethod(L *lua.LState) int {
+	L.Push(lua.LString(checkRequestContext(L).r.Method))
+	return 1
+}
+
+// ngxReqGetHeaders implements ngx.req.get_headers().
+func ngxReqGetHeaders(L *lua.LState) int {
+	L.Push(lowerHeaderTable(L, checkRequestContext(L).r.Header))
+	return 1
+}
+
+// ngxReqGetURIArgs implements ngx.req.get_uri_args().
+func ngxReqGetURIArgs(L *lua.LState) int {
+	query := checkRequestContext(L).r.URL.Query()
+	t := L.CreateTable(0, len(query))
+	for name, vals := range query {
+		switch len(vals) {
+		case 0:
+		case 1:
+			t.RawSetString(name, lua.LString(vals[0]))
+		default:
+			t.RawSetString(name, stringArray(L, vals))
+		}
+	}
+	L.Push(t)
+	return 1
+}
+
+// ngxReqReadBody implements ngx.req.read_body(), which reads the body like
+// request:body and raises an error if it fails.
+func ngxReqReadBody(L *lua.LState) int {
+	L.SetTop(0)
+	if ngxMethod(requestBody)(L) == 2 {
+		L.RaiseError("ngx.req.read_body: %s", L.Get(-1))
+	}
+	return 0
+}
+
+// ngxReqClearHeader implements ngx.req.clear_header(name).
+func ngxReqClearHeader(L *lua.LState) int {
+	L.SetTop(1)
+	L.Push(lua.LNil)
+	return ngxMethod(requestSetHeader)(L)
+}
+
+// ngxRespGetHeaders implements ngx.resp.get_headers().
+func ngxRespGetHeaders(L *lua.LState) int {
+	L.Push(lowerHeaderTable(L, checkRequestContext(L).w.Header()))
+	return 1
+}
+
+// ngxPrint implements ngx.print(...).
+func ngxPrint(L *lua.LState) int {
+	return ngxWrite(L, "")
+}
+
+// ngxSay implements ngx.say(...).
+func ngxSay(L *lua.LState) int {
+	return ngxWrite(L, "\n")
+}
+
+// ngxWrite writes the arguments of the call to the response, followed by
+// end.
+func ngxWrite(L *lua.LState, end string) int {
+	var sb strings.Builder
+	var add func(v lua.LValue)
+	add = func(v lua.LValue) {
+		switch v := v.(type) {
+		case *lua.LTable:
+			for i := 1; i <= v.Len(); i++ {
+				add(v.RawGetInt(i))
+			}
+		case lua.LString, lua.LNumber, lua.LBool, *lua.LNilType:
+			sb.WriteString(v.String())
+		default:
+			L.ArgError(1, "strings, numbers, booleans, nil or arrays of those expected, got "+v.Type().String())
+		}
+	}
+	for i := 1; i <= L.GetTop(); i++ {
+		add(L.Get(i))
+	}
+	sb.WriteString(end)
+	L.SetTop(0)
+	L.Push(lua.LNil)
+	L.Push(lua.LString(sb.String()))
+	return responseWrite(L)
+}
+
+// ngxExitStatus is the value of the error raised by ngx.exit to end the
+// script, with the status of the response or 0.
+type ngxExitStatus int
+
+// ngxExit implements ngx.exit(status).
+func ngxExit(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	status := L.CheckInt(1)
+	if status != 0 && (status < 200 || status > 999) {
+		L.ArgError(1, "ngx.OK or a status code of 200 or more expected")
+	}
+	if status != 0 && !rc.wroteHeader && !rc.headerPhase {
+		rc.status = status
+		rc.writeHeader()
+	}
+	ud := L.NewUserData()
+	ud.Value = ngxExitStatus(status)
+	L.Error(ud, 0)
+	return 0
+}
+
+// ngxRedirect implements ngx.redirect(uri[, status]).
+func ngxRedirect(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	uri := L.CheckString(1)
+	status := L.OptInt(2, http.StatusFound)
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		L.ArgError(2, "invalid redirection status code")
+	}
+	if rc.wroteHeader {
+		L.RaiseError("ngx.redirect: the response header is already written")
+	}
+	rc.w.Header().Set("Location", uri)
+	L.SetTop(0)
+	L.Push(lua.LNumber(status))
+	return ngxExit(L)
+}
+
+// ngxExitResult returns the value returned by the script that ended with
+// the error err of ngx.exit, and false if err is another error.
+func ngxExitResult(err error) (lua.LValue, bool) {
+	var apiErr *lua.ApiError
+	if !errors.As(err, &apiErr) {
+		return nil, false
+	}
+	ud, ok := apiErr.Object.(*lua.LUserData)
+	if !ok {
+		return nil, false
+	}
+	status, ok := ud.Value.(ngxExitStatus)
+	if !ok {
+		return nil, false
+	}
+	if status == 0 {
+		return lua.LNil, true
+	}
+	return lua.LString("done"), true
+}
+
+// ngxLog implements ngx.log(level, ...).
+func ngxLog(L *lua.LState) int {
+	level := L.CheckInt(1)
+	if level < 0 || level >= len(ngxLogLevels) {
+		L.ArgError(1, "invalid log level")
+	}
+	var sb strings.Builder
+	for i := 2; i <= L.GetTop(); i++ {
+		sb.WriteString(L.ToStringMeta(L.Get(i)).String())
+	}
+	logger := checkHandler(L).logger
+	switch name := ngxLogLevels[level]; name {
+	case "WARN":
+		logger.Warn(sb.String())
+	case "NOTICE", "INFO":
+		logger.Info(sb.String())
+	case "DEBUG":
+		logger.Debug(sb.String())
+	default:
+		logger.Error(sb.String(), zap.String("level", strings.ToLower(name)))
+	}
+	return 0
+}
+
+// ngxNow implements ngx.now().
+func ngxNow(L *lua.LState) int {
+	L.Push(lua.LNumber(float64(time.Now().UnixMilli()) / 1000))
+	return 1
+}
+
+// ngxTime implements ngx.time().
+func ngxTime(L *lua.LState) int {
+	L.Push(lua.LNumber(time.Now().Unix()))
+	return 1
+}
+
+// ngxSharedIndex implements the __index metamethod of ngx.shared, which
+// returns the shared dictionary of the name.
+func ngxSharedIndex(L *lua.LState) int {
+	ud := L.NewUserData()
+	ud.Value = "ngx.shared." + L.CheckString(2) + "."
+	L.SetMetatable(ud, L.GetTypeMetatable(ngxSharedDictTypeName))
+	L.Push(ud)
+	return 1
+}
+
+// ngxSharedDictMethods are the methods of the shared dictionaries of
+// ngx.shared, whose keys are stored in the kv store with the
+// "ngx.shared.DICT." prefix:
+//
+//	dict:get(key): the value of key, or nil
+//	dict:set(key, value[, exptime]): sets key, expiring after exptime
+//	seconds if set, and returns true; a nil value deletes key
+//	dict:add(key, value[, exptime]), dict:replace(key, value[, exptime]):
+//	like set, only if key is not set or is set, otherwise return false
+//	and "exists" or "not found"
+//	dict:incr(key, value[, init]): adds value to the number of key, or to
+//	init if key is not set, and returns the result, or nil and "not
+//	found" if key and init are not set
+//	dict:delete(key)
+//	dict:flush_all(): deletes the keys of the dictionary
+//	dict:get_keys(): the array of the keys of the dictionary
+var ngxSharedDictMethods = map[string]lua.LGFunction{
+	"get":       ngxSharedGet,
+	"set":       ngxSharedSet,
+	"add":       ngxSharedAdd,
+	"replace":   ngxSharedReplace,
+	"incr":      ngxSharedIncr,
+	"delete":    ngxSharedDelete,
+	"flush_all": ngxSharedFlushAll,
+	"get_keys":  ngxSharedGetKeys,
+}
+
+// checkSharedDict returns the key prefix of the shared dictionary at index 1
+// of the stack.
+func checkSharedDict(L *lua.LState) string {
+	ud := L.CheckUserData(1)
+	prefix, ok := ud.Value.(string)
+	if !ok {
+		L.ArgError(1, "shared dictionary expected")
+	}
+	return prefix
+}
+
+// ngxSharedGet implements dict:get(key).
+func ngxSharedGet(L *lua.LState) int {
+	prefix := checkSharedDict(L)
+	v, ok := checkKVStore(L).get(prefix + L.CheckString(2))
+	if !ok {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(fromGo(L, v))
+	return 1
+}
+
+// ngxSharedSet implements dict:set(key, value[, exptime]).
+func ngxSharedSet(L *lua.LState) int {
+	return ngxSharedStore(L, func(kv *kvRegistry, key string, v interface{}, ttl time.Duration) string {
+		kv.set(key, v, ttl)
+		return ""
+	})
+}
+
+// ngxSharedAdd implements dict:add(key, value[, exptime]).
+func ngxSharedAdd(L *lua.LState) int {
+	return ngxSharedStore(L, func(kv *kvRegistry, key string, v interface{}, ttl time.Duration) string {
+		if !kv.setIf(key, v, ttl, false) {
+			return "exists"
+		}
+		return ""
+	})
+}
+
+// ngxSharedReplace implements dict:replace(key, value[, exptime]).
+func ngxSharedReplace(L *lua.LState) int {
+	return ngxSharedStore(L, func(kv *kvRegistry, key string, v interface{}, ttl time.Duration) string {
+		if !kv.setIf(key, v, ttl, true) {
+			return "not found"
+		}
+		return ""
+	})
+}
+
+// ngxSharedStore stores the value of a set, add or replace call with store,
+// which returns the error message of the call if it does not store it.
+func ngxSharedStore(L *lua.LState, store func(kv *kvRegistry, key string, v interface{}, ttl time.Duration) string) int {
+	prefix := checkSharedDict(L)
+	key := prefix + L.CheckString(2)
+	kv := checkKVStore(L)
+	var v interface{}
+	if L.Get(3) != lua.LNil {
+		var err error
+		if v, err = toGo(L.Get(3)); err != nil {
+			L.ArgError(3, err.Error())
+		}
+	}
+	ttl := optSeconds(L, 4)
+	if v == nil {
+		kv.delete(key)
+		L.Push(lua.LTrue)
+		return 1
+	}
+	if msg := store(kv, key, v, ttl); msg != "" {
+		L.Push(lua.LFalse)
+		L.Push(lua.LString(msg))
+		return 2
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// ngxSharedIncr implements dict:incr(key, value[, init]).
+func ngxSharedIncr(L *lua.LState) int {
+	prefix := checkSharedDict(L)
+	key := prefix + L.CheckString(2)
+	delta := float64(L.CheckNumber(3))
+	var init *float64
+	if L.Get(4) != lua.LNil {
+		n := float64(L.CheckNumber(4))
+		init = &n
+	}
+	n, ok := checkKVStore(L).incrFrom(key, delta, init)
+	if !ok {
+		L.Push(lua.LNil)
+		L.Push(lua.LString("not found"))
+		return 2
+	}
+	L.Push(lua.LNumber(n))
+	return 1
+}
+
+// ngxSharedDelete implements dict:delete(key).
+func ngxSharedDelete(L *lua.LState) int {
+	prefix := checkSharedDict(L)
+	checkKVStore(L).delete(prefix + L.CheckString(2))
+	return 0
+}
+
+// ngxSharedFlushAll implements dict:flush_all().
+func ngxSharedFlushAll(L *lua.LState) int {
+	prefix := checkSharedDict(L)
+	kv := checkKVStore(L)
+	for _, key := range kv.keys(prefix) {
+		kv.delete(key)
+	}
+	return 0
+}
+
+// ngxSharedGetKeys implements dict:get_keys().
+func ngxSharedGetKeys(L *lua.LState) int {
+	prefix := checkSharedDict(L)
+	keys := checkKVStore(L).keys(prefix)
+	for i, key := range keys {
+		keys[i] = key[len(prefix):]
+	}
+	L.Push(stringArray(L, keys))
+	return 1
+}
+
+// ngxRegexpFuncs are the functions of ngx.re, which match the patterns of
+// the re module, cached the same way. The options of the calls support the
+// i, m and s flags, the others (e.g. j and o) are ignored, and an invalid
+// pattern returns nil and an error message:
+//
+//	ngx.re.match(subject, regex[, options]): the table of the captures of
+//	the first match, the whole match at index 0 and the named captures
+//	also by name, or nil
+//	ngx.re.find(subject, regex[, options]): the start and end positions of
+//	the first match, or nil
+//	ngx.re.gsub(subject, regex, replace[, options]): the subject with the
+//	matches replaced by replace, a string in which $0, $1 or ${name} are
+//	the captures, or a function called with the table of the captures,
+//	and the number of replacements
+//	ngx.re.sub(subject, regex, replace[, options]): like ngx.re.gsub, for
+//	the first match
+var ngxRegexpFuncs = map[string]lua.LGFunction{
+	"match": ngxRegexpMatch,
+	"find":  ngxRegexpFind,
+	"gsub":  ngxRegexpGsub,
+	"sub":   ngxRegexpSub,
+}
+
+// checkNgxRegexp returns the pattern at index 2 of the stack compiled with
+// the options at index opts, or pushes nil and the error message.
+func checkNgxRegexp(L *lua.LState, opts int) (*regexp.Regexp, bool) {
+	pattern := L.CheckString(2)
+	var flags string
+	for _, c := range L.OptString(opts, "") {
+		if strings.ContainsRune("ims", c) && !strings.ContainsRune(flags, c) {
+			flags += string(c)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	re, err := regexps.get(pattern)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return nil, false
+	}
+	return re, true
+}
+
+// ngxCaptures returns the table of the captures of the match of re at loc
+// in s.
+func ngxCaptures(L *lua.LState, re *regexp.Regexp, s string, loc []int) *lua.LTable {
+	t := L.CreateTable(re.NumSubexp(), 1)
+	names := re.SubexpNames()
+	for i := 0; i <= re.NumSubexp(); i++ {
+		v := lua.LValue(lua.LFalse)
+		if loc[2*i] >= 0 {
+			v = lua.LString(s[loc[2*i]:loc[2*i+1]])
+		}
+		t.RawSetInt(i, v)
+		if names[i] != "" {
+			t.RawSetString(names[i], v)
+		}
+	}
+	return t
+}
+
+// ngxRegexpMatch implements ngx.re.match(subject, regex[, options]).
+func ngxRegexpMatch(L *lua.LState) int {
+	s := L.CheckString(1)
+	re, ok := checkNgxRegexp(L, 3)
+	if !ok {
+		return 2
+	}
+	loc := re.FindStringSubmatchIndex(s)
+	if loc == nil {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(ngxCaptures(L, re, s, loc))
+	return 1
+}
+
+// ngxRegexpFind implements ngx.re.find(subject, regex[, options]).
+func ngxRegexpFind(L *lua.LState) int {
+	s := L.CheckString(1)
+	re, ok := checkNgxRegexp(L, 3)
+	if !ok {
+		return 2
+	}
+	loc := re.FindStringIndex(s)
+	if loc == nil {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(lua.LNumber(loc[0] + 1))
+	L.Push(lua.LNumber(loc[1]))
+	return 2
+}
+
+// ngxRegexpGsub implements ngx.re.gsub(subject, regex, replace[, options]).
+func ngxRegexpGsub(L *lua.LState) int {
+	return ngxRegexpReplace(L, -1)
+}
+
+// ngxRegexpSub implements ngx.re.sub(subject, regex, replace[, options]).
+func ngxRegexpSub(L *lua.LState) int {
+	return ngxRegexpReplace(L, 1)
+}
+
+// ngxRegexpReplace replaces the first n matches, or all of them if n is
+// negative.
+func ngxRegexpReplace(L *lua.LState, n int) int {
+	s := L.CheckString(1)
+	repl := L.Get(3)
+	switch repl.(type) {
+	case lua.LString, lua.LNumber, *lua.LFunction:
+	default:
+		L.ArgError(3, "string or function expected")
+	}
+	re, ok := checkNgxRegexp(L, 4)
+	if !ok {
+		return 2
+	}
+	locs := re.FindAllStringSubmatchIndex(s, n)
+
+	var b strings.Builder
+	var last int
+	for _, loc := range locs {
+		b.WriteString(s[last:loc[0]])
+		last = loc[1]
+		fn, ok := repl.(*lua.LFunction)
+		if !ok {
+			b.Write(re.ExpandString(nil, lua.LVAsString(repl), s, loc))
+			continue
+		}
+		L.Push(fn)
+		L.Push(ngxCaptures(L, re, s, loc))
+		L.Call(1, 1)
+		b.WriteString(lua.LVAsString(L.Get(-1)))
+		L.Pop(1)
+	}
+	b.WriteString(s[last:])
+	L.Push(lua.LString(b.String()))
+	L.Push(lua.LNumber(len(locs)))
+	return 2
+}
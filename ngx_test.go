@@ -0,0 +1,80 @@
+package lua
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestNgxModule(t *testing.T) {
+	tr, err := NewTester(&Lua{
+		Script: `
+			local ngx = require("ngx")
+			local uri = ngx.var.uri
+			if uri == "/vars" then
+				ngx.header.x_custom = "v"
+				ngx.say("hello ", ngx.var.arg_name, " ", ngx.var.http_x_a, " ", ngx.var.cookie_sess,
+					" ", ngx.req.get_method(), " ", ngx.req.get_headers()["x-a"], " ", ngx.var.is_args)
+			elseif uri == "/exit" then
+				ngx.exit(ngx.HTTP_FORBIDDEN)
+			elseif uri == "/next" then
+				ngx.req.set_header("X-B", "2")
+				ngx.exit(ngx.OK)
+			elseif uri == "/shared" then
+				local d = ngx.shared.test
+				d:flush_all()
+				d:set("a", 1)
+				local ok, err = d:add("a", 2)
+				local _, missing = d:incr("b", 1)
+				d:incr("a", 5)
+				ngx.print({d:get("a"), " ", tostring(ok), " ", err, " ", missing, " "})
+				ngx.say(table.concat(d:get_keys(), ","))
+			elseif uri == "/re" then
+				local m = ngx.re.match("ABC123", "([a-z]+)(?P<num>\\d+)", "i")
+				local s, n = ngx.re.gsub("a1b2", "\\d", function(m) return "<" .. m[0] .. ">" end)
+				ngx.say(m[0], " ", m[1], " ", m.num, " ", s, " ", n, " ", (ngx.re.sub("aaa", "a", "[$0]")))
+			elseif uri == "/redirect" then
+				ngx.redirect("/elsewhere")
+			end
+			response:write("not ended")`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	tr.Next = caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		_, err := w.Write([]byte("next " + r.Header.Get("X-B")))
+		return err
+	})
+
+	cases := []struct {
+		req    TestRequest
+		status int
+		body   string
+	}{
+		{TestRequest{Path: "/vars?name=bob", Header: http.Header{"X-A": {"1"}, "Cookie": {"sess=abc"}}},
+			http.StatusOK, "hello bob 1 abc GET 1 ?\nnot ended"},
+		{TestRequest{Path: "/exit"}, http.StatusForbidden, ""},
+		{TestRequest{Path: "/next"}, http.StatusOK, "next 2"},
+		{TestRequest{Path: "/shared"}, http.StatusOK, "6 false exists not found a\nnot ended"},
+		{TestRequest{Path: "/re"}, http.StatusOK, "ABC123 ABC 123 a<1>b<2> 2 [a]aa\nnot ended"},
+		{TestRequest{Path: "/redirect"}, http.StatusFound, ""},
+	}
+	for _, c := range cases {
+		res := tr.Do(c.req)
+		if res.Err != nil || res.Status != c.status || res.Body != c.body {
+			t.Errorf("%s: got %d %q (%v), want %d %q", c.req.Path, res.Status, res.Body, res.Err, c.status, c.body)
+		}
+		switch c.req.Path {
+		case "/vars?name=bob":
+			if v := res.Header.Get("X-Custom"); v != "v" {
+				t.Errorf("%s: got the X-Custom header %q", c.req.Path, v)
+			}
+		case "/redirect":
+			if v := res.Header.Get("Location"); v != "/elsewhere" {
+				t.Errorf("%s: got the Location header %q", c.req.Path, v)
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package lua
+
+import (
+	"path/filepath"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// packagePath returns the package.path of the handler's states, where
+// require looks for the Lua modules: the templates of the PackagePath
+// option, then the directories of the handler's scripts and its root, so
+// that scripts can require the modules next to them, then the default path
+// of gopher-lua (LUA_PATH if it is set).
+func (l *Lua) packagePath() string {
+	templates := append([]string(nil), l.PackagePath...)
+	seen := make(map[string]bool)
+	addDir := func(dir string) {
+		if dir == "" || seen[dir] {
+			return
+		}
+		seen[dir] = true
+		templates = append(templates,
+			filepath.Join(dir, "?.lua"),
+			filepath.Join(dir, "?", "init.lua"))
+	}
+	if l.Root != "" {
+		addDir(l.Root)
+	}
+	for _, path := range l.scriptPaths() {
+		if path != "" {
+			addDir(filepath.Dir(path))
+		}
+	}
+	return strings.Join(templates, lua.LuaPathSep)
+}
+
+// setPackagePath prepends the handler's package path to the package.path of
+// L.
+func (l *Lua) setPackagePath(L *lua.LState) {
+	if l.packagePathPrefix == "" {
+		return
+	}
+	pkg, ok := L.GetGlobal("package").(*lua.LTable)
+	if !ok {
+		return
+	}
+	path := l.packagePathPrefix
+	if def := lua.LVAsString(pkg.RawGetString("path")); def != "" {
+		path += lua.LuaPathSep + def
+	}
+	pkg.RawSetString("path", lua.LString(path))
+}
@@ -0,0 +1,145 @@
+package lua
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	lua "github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+)
+
+// Phases configures the scripts run at distinct points of the handling of
+// the request, in the same Lua state as the main script so that they can
+// share globals:
+//
+//   - Rewrite runs first, to modify the request
+//   - Access runs next, to allow or deny the request
+//   - the main script (the content phase) runs next if it is set, and the
+//     next handler is called
+//   - Header runs when the next handler writes the response header, to
+//     modify the headers and the status of its response
+//   - Log runs once the request was handled, even if it failed
+//
+// Like the main script, the rewrite and access scripts terminate the
+// handling of the request if they return false or "done", or write the
+// response. The header script receives a table with the status of the
+// response as first argument, reads the response headers with
+// response:header and response:header_values, and changes them with
+// response:set_header and response:set_status; it cannot write the response
+// body. The errors of the header and log scripts are logged, and their
+// return values are ignored.
+type Phases struct {
+	Rewrite string `json:"rewrite,omitempty"`
+	Access  string `json:"access,omitempty"`
+	Header  string `json:"header,omitempty"`
+	Log     string `json:"log,omitempty"`
+}
+
+// paths returns the paths of the phases' scripts.
+func (p *Phases) paths() []string {
+	return []string{p.Rewrite, p.Access, p.Header, p.Log}
+}
+
+// runPhases runs the rewrite, access and main scripts of the handler that
+// are set, in that order, and returns true if one of them terminated the
+// handling of the request.
+func (l *Lua) runPhases(L *lua.LState, r *http.Request) (bool, error) {
+	// the request context of a shared state is only bound to L while the
+	// coroutine of the request holds its lock
+	defer enterState(L)()
+	rc := checkRequestContext(L)
+	var paths []string
+	if l.Phases != nil {
+		paths = append(paths, l.Phases.Rewrite, l.Phases.Access)
+	}
+	for i, path := range append(paths, l.scriptPath(r)) {
+		// the path of the inline main script is empty, so the empty path
+		// only selects a script in the content phase.
+		if path == "" && (i < len(paths) || l.Script == "") {
+			continue
+		}
+		ret, err := l.runScript(L, r, path)
+		if err != nil {
+			return false, err
+		}
+		done, err := scriptDone(ret)
+		if err != nil {
+			return false, err
+		}
+		if done || rc.responded {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// headerPhaseWriter runs the header script of the handler when the response
+// header is written.
+type headerPhaseWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	l *Lua
+	L *lua.LState
+	r *http.Request
+
+	wroteHeader bool
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (hw *headerPhaseWriter) WriteHeader(status int) {
+	if hw.wroteHeader {
+		return
+	}
+	// the informational responses are sent as is
+	if status >= http.StatusOK {
+		hw.wroteHeader = true
+		status = hw.l.runHeaderPhase(hw.L, hw.r, status)
+	}
+	hw.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter.
+func (hw *headerPhaseWriter) Write(p []byte) (int, error) {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return hw.ResponseWriter.Write(p)
+}
+
+// runHeaderPhase runs the header script of the handler for the response
+// with status, and returns the status of the response.
+func (l *Lua) runHeaderPhase(L *lua.LState, r *http.Request, status int) int {
+	// the next handler writes the header while the other requests of a
+	// shared state run, so the state is entered before rc is read
+	defer enterState(L)()
+	rc := checkRequestContext(L)
+	rc.headerPhase = true
+	rc.status = 0
+	defer func() {
+		rc.headerPhase = false
+		rc.status = 0
+	}()
+
+	t := L.CreateTable(0, 1)
+	t.RawSetString("status", lua.LNumber(status))
+	if _, err := l.runScript(L, r, l.Phases.Header, t); err != nil {
+		l.logger.Error("running the header phase script",
+			zap.String("path", l.Phases.Header), zap.Error(err))
+		return status
+	}
+	if rc.status != 0 {
+		return rc.status
+	}
+	return status
+}
+
+// runLogPhase runs the log script of the handler if it is set.
+func (l *Lua) runLogPhase(L *lua.LState, r *http.Request) {
+	if l.Phases == nil || l.Phases.Log == "" {
+		return
+	}
+	defer enterState(L)()
+	if _, err := l.runScript(L, r, l.Phases.Log); err != nil {
+		l.logger.Error("running the log phase script",
+			zap.String("path", l.Phases.Log), zap.Error(err))
+	}
+}
@@ -0,0 +1,171 @@
+package lua
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	lua "github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+)
+
+// exprPlaceholderPrefix is the prefix of the names of the expression
+// placeholders.
+const exprPlaceholderPrefix = "lua:"
+
+// exprPlaceholdersVar is the variable of the requests whose replacer
+// provides the expression placeholders.
+const exprPlaceholdersVar = "lua_expression_placeholders"
+
+// setPlaceholders calls the global Lua functions configured in the
+// handler's Placeholders after the script ran, and sets their result as the
+// {lua.<name>} placeholder of the request, so that the handlers that follow
+// (e.g. a rate limiter) can use script-computed values in their
+// configuration.
+func (l *Lua) setPlaceholders(L *lua.LState, r *http.Request) error {
+	if len(l.Placeholders) == 0 {
+		return nil
+	}
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return nil
+	}
+
+	for name, fnName := range l.Placeholders {
+		fn, ok := L.GetGlobal(fnName).(*lua.LFunction)
+		if !ok {
+			return fmt.Errorf("placeholder %s: %s is not a function", name, fnName)
+		}
+		if err := L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}); err != nil {
+			return fmt.Errorf("placeholder %s: %w", name, err)
+		}
+		v := L.Get(-1)
+		L.Pop(1)
+
+		var s string
+		if v != lua.LNil {
+			s = v.String()
+		}
+		repl.Set("lua."+name, s)
+	}
+	return nil
+}
+
+// checkReplacer returns the replacer of the request, raising a Lua error if
+// there is none.
+func checkReplacer(L *lua.LState) *caddy.Replacer {
+	repl, ok := checkRequestContext(L).r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		L.RaiseError("the request has no placeholders")
+	}
+	return repl
+}
+
+// placeholderName returns the name of the placeholder at index n of the
+// stack, with its surrounding braces removed if present.
+func placeholderName(L *lua.LState, n int) string {
+	name := L.CheckString(n)
+	if len(name) > 2 && name[0] == '{' && name[len(name)-1] == '}' {
+		name = name[1 : len(name)-1]
+	}
+	return name
+}
+
+// caddyPlaceholder implements caddy.placeholder(name), which returns the
+// value of the placeholder (e.g. "http.request.uri") as a string, or nil if
+// it is unknown.
+func caddyPlaceholder(L *lua.LState) int {
+	repl := checkReplacer(L)
+	name := placeholderName(L, 1)
+	if _, ok := repl.Get(name); !ok {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(lua.LString(repl.ReplaceKnown("{"+name+"}", "")))
+	return 1
+}
+
+// caddySetPlaceholder implements caddy.set_placeholder(name, value), which
+// sets the placeholder for the handlers that follow, or removes it if value
+// is nil.
+func caddySetPlaceholder(L *lua.LState) int {
+	repl := checkReplacer(L)
+	name := placeholderName(L, 1)
+	switch v := L.Get(2).(type) {
+	case *lua.LNilType:
+		repl.Delete(name)
+	case lua.LString, lua.LNumber, lua.LBool:
+		repl.Set(name, v.String())
+	default:
+		L.ArgError(2, "string, number, boolean or nil expected")
+	}
+	return 0
+}
+
+// provideExpressions adds the {lua:"<expression>"} placeholders to the
+// replacer of r, so that they can be used anywhere placeholders are
+// accepted by the configuration of the handlers that run once the handler
+// started handling r, e.g.:
+//
+//	header X-Tenant "{lua:\"(request:header('X-Api-Key') or ''):sub(1, 8)\"}"
+//
+// The expression is evaluated against r each time the placeholder is
+// replaced, in a state with the libraries of the lua matcher (see
+// MatchLua), and its result is converted to a string, nil being the empty
+// string. It is either a Lua expression or a chunk that returns the value,
+// and the quotes around it are optional. It cannot contain a closing brace,
+// which ends the placeholder. The expressions are compiled once and cached
+// in the handler's cache of compiled scripts. The errors are logged and
+// replaced with the empty string.
+func (l *Lua) provideExpressions(r *http.Request) {
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok || caddyhttp.GetVar(r.Context(), exprPlaceholdersVar) != nil {
+		return
+	}
+	caddyhttp.SetVar(r.Context(), exprPlaceholdersVar, true)
+	repl.Map(func(key string) (interface{}, bool) {
+		if !strings.HasPrefix(key, exprPlaceholderPrefix) {
+			return nil, false
+		}
+		src := key[len(exprPlaceholderPrefix):]
+		if len(src) >= 2 && src[0] == '"' && src[len(src)-1] == '"' {
+			src = src[1 : len(src)-1]
+		}
+		return l.evalExpression(r, src), true
+	})
+}
+
+// evalExpression returns the result of the expression src evaluated
+// against r as a string.
+func (l *Lua) evalExpression(r *http.Request, src string) string {
+	proto, err := l.protoCache.expression(src)
+	if err != nil {
+		l.logger.Error("compiling the placeholder expression", zap.String("expression", src), zap.Error(err))
+		return ""
+	}
+
+	L := l.exprStates.get()
+	defer l.exprStates.put(L)
+	setRequestContext(L, &requestContext{r: r})
+	ctx := r.Context()
+	if l.ExecutionTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(l.ExecutionTimeout))
+		defer cancel()
+	}
+	L.SetContext(ctx)
+
+	ret, err := runProto(L, proto)
+	if err != nil {
+		l.logger.Error("running the placeholder expression", zap.String("expression", src), zap.Error(err))
+		return ""
+	}
+	if ret == lua.LNil {
+		return ""
+	}
+	return ret.String()
+}
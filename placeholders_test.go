@@ -0,0 +1,43 @@
+package lua
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestExpressionPlaceholders(t *testing.T) {
+	tr, err := NewTester(&Lua{Script: `
+		if request.path == "/script" then
+			response:write(caddy.placeholder('lua:"request.method .. \' \' .. request.path"'))
+		end`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	tr.Next = caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		_, err := io.WriteString(w, repl.ReplaceAll(
+			`{lua:"request:header('X-Tenant'):upper()"}|{lua:local n = 0 for i = 1, 3 do n = n + i end return n}|{lua:nil}|{lua:"error('boom')"}|{lua:"+"}`, "?"))
+		return err
+	})
+
+	res := tr.Do(TestRequest{Path: "/next", Header: http.Header{"X-Tenant": {"acme"}}})
+	if res.Err != nil || res.Body != "ACME|6|?|?|?" {
+		t.Errorf("got %q, %v, want the values of the expressions", res.Body, res.Err)
+	}
+	res = tr.Do(TestRequest{Method: http.MethodPost, Path: "/script"})
+	if res.Err != nil || res.Body != "POST /script" {
+		t.Errorf("got %q, %v, want the value of the expression", res.Body, res.Err)
+	}
+
+	// the expressions are compiled once
+	n := tr.handler.protoCache.len()
+	tr.Do(TestRequest{Path: "/next", Header: http.Header{"X-Tenant": {"acme"}}})
+	if tr.handler.protoCache.len() != n || n != 5 {
+		t.Errorf("got %d then %d cached expressions, want 5", n, tr.handler.protoCache.len())
+	}
+}
@@ -0,0 +1,171 @@
+package lua
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/prometheus/client_golang/prometheus"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	defaultStatePoolMaxSize = 32
+
+	// poolGlobalsKey is the registry key under which the globals of a pooled
+	// state are saved, to reset it when it is returned to the pool.
+	poolGlobalsKey = "caddy.pool_globals"
+)
+
+// StatePool configures the reuse of the Lua states across requests. Up to
+// MaxSize idle states (default 32) are kept to handle the next requests, and
+// MinSize states are created when the handler is provisioned. When a state
+// is returned to the pool, the globals defined or modified by the script are
+// reset, but the changes made to the fields of the standard library tables
+// and the modules loaded via require persist.
+type StatePool struct {
+	MinSize int `json:"min_size,omitempty"`
+	MaxSize int `json:"max_size,omitempty"`
+}
+
+// validate returns an error if the pool configuration is invalid.
+func (p *StatePool) validate() error {
+	if p.MinSize < 0 || p.MaxSize < 0 {
+		return errors.New("state_pool: the sizes must not be negative")
+	}
+	if p.MaxSize > 0 && p.MinSize > p.MaxSize {
+		return errors.New("state_pool: min_size must not be greater than max_size")
+	}
+	return nil
+}
+
+// unmarshalCaddyfile sets up the pool from the block's tokens.
+func (p *StatePool) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		field := d.Val()
+		var dst *int
+		switch field {
+		case "min_size":
+			dst = &p.MinSize
+		case "max_size":
+			dst = &p.MaxSize
+		default:
+			return d.Errf("state_pool %s: unknown configuration option", field)
+		}
+		if !d.NextArg() {
+			return d.Errf("state_pool %s: %w", field, d.ArgErr())
+		}
+		n, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return d.Errf("state_pool %s: %w", field, err)
+		}
+		if d.NextArg() {
+			return d.Errf("state_pool %s: %w", field, d.ArgErr())
+		}
+		*dst = n
+	}
+	return nil
+}
+
+// statePool holds the idle Lua states of a handler. A buffered channel is
+// used rather than a sync.Pool so that the idle states are not dropped by
+// the garbage collector and the pool sizes are honored.
+type statePool struct {
+	idle     chan *lua.LState
+	newState func() *lua.LState
+
+	// idleGauge and misses are the metrics of the pool, if it is
+	// instrumented.
+	idleGauge prometheus.Gauge
+	misses    prometheus.Counter
+}
+
+// newStatePool returns a pool of the states created by newState.
+func newStatePool(cfg *StatePool, newState func() *lua.LState) *statePool {
+	max := cfg.MaxSize
+	if max <= 0 {
+		max = defaultStatePoolMaxSize
+	}
+	p := &statePool{idle: make(chan *lua.LState, max), newState: newState}
+	for i := 0; i < cfg.MinSize && i < max; i++ {
+		p.idle <- p.newPooledState()
+	}
+	return p
+}
+
+// newPooledState returns a new Lua state with its globals saved.
+func (p *statePool) newPooledState() *lua.LState {
+	L := p.newState()
+	saved := L.NewTable()
+	L.G.Global.ForEach(func(k, v lua.LValue) {
+		saved.RawSet(k, v)
+	})
+	L.G.Registry.RawSetString(poolGlobalsKey, saved)
+	return L
+}
+
+// get returns an idle state, or a new one if there is none.
+func (p *statePool) get() *lua.LState {
+	select {
+	case L := <-p.idle:
+		p.observeIdle()
+		return L
+	default:
+		if p.misses != nil {
+			p.misses.Inc()
+		}
+		return p.newPooledState()
+	}
+}
+
+// observeIdle updates the idle states metric of the pool.
+func (p *statePool) observeIdle() {
+	if p.idleGauge != nil {
+		p.idleGauge.Set(float64(len(p.idle)))
+	}
+}
+
+// put resets L and returns it to the pool, or closes it if the pool is full.
+func (p *statePool) put(L *lua.LState) {
+	resetState(L)
+	select {
+	case p.idle <- L:
+		p.observeIdle()
+	default:
+		L.Close()
+	}
+}
+
+// close closes the idle states.
+func (p *statePool) close() {
+	for {
+		select {
+		case L := <-p.idle:
+			L.Close()
+		default:
+			return
+		}
+	}
+}
+
+// resetState restores the saved globals of L and unbinds it from the
+// request.
+func resetState(L *lua.LState) {
+	L.SetTop(0)
+	L.RemoveContext()
+	L.G.Registry.RawSetString(requestContextKey, lua.LNil)
+
+	saved := L.G.Registry.RawGetString(poolGlobalsKey).(*lua.LTable)
+	var added []lua.LValue
+	L.G.Global.ForEach(func(k, _ lua.LValue) {
+		if saved.RawGet(k) == lua.LNil {
+			added = append(added, k)
+		}
+	})
+	for _, k := range added {
+		L.G.Global.RawSet(k, lua.LNil)
+	}
+	saved.ForEach(func(k, v lua.LValue) {
+		L.G.Global.RawSet(k, v)
+	})
+}
@@ -0,0 +1,42 @@
+package lua
+
+import "testing"
+
+const benchScript = `
+	local greeting = "hello, " .. (request.query.name or "world")
+	response:set_header("Content-Type", "text/plain")
+	response:write(greeting)`
+
+// BenchmarkServeHTTP compares the requests handled by fresh states, pooled
+// states and the coroutines of a shared state.
+func BenchmarkServeHTTP(b *testing.B) {
+	cases := []struct {
+		name string
+		l    *Lua
+	}{
+		{"fresh", &Lua{Isolation: isolationPerRequest, Script: benchScript}},
+		{"pooled", &Lua{Isolation: isolationPooled, Script: benchScript}},
+		{"shared_coroutine", &Lua{Isolation: isolationSharedCoroutine, Script: benchScript}},
+	}
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			tr, err := NewTester(c.l)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer tr.Close()
+
+			req := TestRequest{Path: "/?name=bench"}
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if res := tr.Do(req); res.Err != nil || res.Body != "hello, bench" {
+						b.Errorf("got %q, %v", res.Body, res.Err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
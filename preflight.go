@@ -0,0 +1,269 @@
+package lua
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// defaultPreflightMethods are the methods allowed when none are configured
+// and none can be derived from the routes.
+var defaultPreflightMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+}
+
+// Preflight configures the automatic handling of OPTIONS requests, including
+// CORS preflight requests, which are answered without calling the next
+// handler and before JWT validation. The allowed methods are Methods if set,
+// otherwise the methods for which a route matches the request, e.g. via a
+// method matcher, or GET, HEAD, POST, PUT, PATCH and DELETE if none does.
+// The CORS headers are added if the Origin is one of AllowOrigins ("*" for
+// any), and the requested method and headers are allowed (AllowHeaders, "*"
+// for any).
+//
+// If Function is set, the scripts of the rewrite, access and content phases
+// run and the global Lua function of that name is called with a table with
+// the origin, method (the requested one), request_headers (an array),
+// allowed (true if the CORS headers were added), status (204) and headers
+// (the response headers) fields. It may change the status and headers, which
+// are then written, or return false to reject the request with a 403 status
+// code.
+type Preflight struct {
+	Methods          []string       `json:"methods,omitempty"`
+	AllowOrigins     []string       `json:"allow_origins,omitempty"`
+	AllowHeaders     []string       `json:"allow_headers,omitempty"`
+	AllowCredentials bool           `json:"allow_credentials,omitempty"`
+	MaxAge           caddy.Duration `json:"max_age,omitempty"`
+	Function         string         `json:"function,omitempty"`
+}
+
+// unmarshalCaddyfile sets up the preflight handling from the block's tokens.
+func (p *Preflight) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		field := d.Val()
+		var dst *[]string
+		switch field {
+		case "methods":
+			dst = &p.Methods
+		case "allow_origins":
+			dst = &p.AllowOrigins
+		case "allow_headers":
+			dst = &p.AllowHeaders
+
+		case "allow_credentials":
+			if d.NextArg() {
+				return d.Errf("preflight %s: %w", field, d.ArgErr())
+			}
+			p.AllowCredentials = true
+			continue
+
+		case "max_age":
+			var v string
+			if !d.Args(&v) || d.NextArg() {
+				return d.Errf("preflight %s: %w", field, d.ArgErr())
+			}
+			dur, err := caddy.ParseDuration(v)
+			if err != nil {
+				return d.Errf("preflight %s: %w", field, err)
+			}
+			p.MaxAge = caddy.Duration(dur)
+			continue
+
+		case "function":
+			if !d.Args(&p.Function) || d.NextArg() {
+				return d.Errf("preflight %s: %w", field, d.ArgErr())
+			}
+			continue
+
+		default:
+			return d.Errf("preflight %s: unknown configuration option", field)
+		}
+
+		args := d.RemainingArgs()
+		if len(args) == 0 {
+			return d.Errf("preflight %s: %w", field, d.ArgErr())
+		}
+		*dst = append(*dst, args...)
+	}
+	return nil
+}
+
+// preflightMethods returns the methods allowed for r.
+func (l *Lua) preflightMethods(r *http.Request) []string {
+	if len(l.Preflight.Methods) > 0 {
+		return l.Preflight.Methods
+	}
+
+	var methods []string
+	for _, m := range defaultPreflightMethods {
+		mr := *r
+		mr.Method = m
+		for _, rt := range l.Routes {
+			if rt.matcherSets.AnyMatch(&mr) {
+				methods = append(methods, m)
+				break
+			}
+		}
+	}
+	if len(methods) == 0 {
+		methods = defaultPreflightMethods
+	}
+	return methods
+}
+
+// servePreflight answers the OPTIONS request r.
+func (l *Lua) servePreflight(w http.ResponseWriter, r *http.Request) error {
+	cfg := l.Preflight
+	methods := l.preflightMethods(r)
+
+	h := make(http.Header)
+	h.Set("Allow", strings.Join(append(append([]string(nil), methods...), http.MethodOptions), ", "))
+
+	origin := r.Header.Get("Origin")
+	method := r.Header.Get("Access-Control-Request-Method")
+	var reqHeaders []string
+	for _, v := range r.Header.Values("Access-Control-Request-Headers") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				reqHeaders = append(reqHeaders, name)
+			}
+		}
+	}
+
+	allowed := origin != "" && method != "" &&
+		(containsString(cfg.AllowOrigins, "*") || containsString(cfg.AllowOrigins, origin)) &&
+		(method == http.MethodOptions || containsString(methods, method))
+	if allowed && !containsString(cfg.AllowHeaders, "*") {
+		for _, name := range reqHeaders {
+			if !containsFold(cfg.AllowHeaders, name) {
+				allowed = false
+				break
+			}
+		}
+	}
+	if origin != "" {
+		h.Set("Vary", "Origin")
+	}
+	if allowed {
+		if containsString(cfg.AllowOrigins, "*") && !cfg.AllowCredentials {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		if len(reqHeaders) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(reqHeaders, ", "))
+		}
+		if cfg.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if cfg.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(time.Duration(cfg.MaxAge)/time.Second)))
+		}
+	}
+
+	status := http.StatusNoContent
+	if cfg.Function != "" {
+		L := l.newState(w, r)
+		defer l.releaseState(L)
+		if _, err := l.runPhases(L, r); err != nil {
+			return err
+		}
+		if rc := checkRequestContext(L); rc.responded {
+			rc.writeHeader()
+			return nil
+		}
+
+		var ok bool
+		var err error
+		status, ok, err = callPreflightFunction(L, cfg.Function, origin, method, reqHeaders, allowed, h)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+			return nil
+		}
+	}
+
+	for name, vals := range h {
+		w.Header()[name] = vals
+	}
+	w.WriteHeader(status)
+	return nil
+}
+
+// callPreflightFunction calls the preflight function fnName in L, and
+// returns the status code, whether the request is accepted, and sets h to
+// the response headers.
+func callPreflightFunction(L *lua.LState, fnName, origin, method string, reqHeaders []string, allowed bool, h http.Header) (int, bool, error) {
+	fn, ok := L.GetGlobal(fnName).(*lua.LFunction)
+	if !ok {
+		return 0, false, fmt.Errorf("preflight: %s is not a function", fnName)
+	}
+
+	t := L.NewTable()
+	if origin != "" {
+		t.RawSetString("origin", lua.LString(origin))
+	}
+	if method != "" {
+		t.RawSetString("method", lua.LString(method))
+	}
+	rh := L.NewTable()
+	for _, name := range reqHeaders {
+		rh.Append(lua.LString(name))
+	}
+	t.RawSetString("request_headers", rh)
+	t.RawSetString("allowed", lua.LBool(allowed))
+	t.RawSetString("status", lua.LNumber(http.StatusNoContent))
+	hdrs := L.NewTable()
+	for name := range h {
+		hdrs.RawSetString(name, lua.LString(h.Get(name)))
+	}
+	t.RawSetString("headers", hdrs)
+
+	if err := L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, t); err != nil {
+		return 0, false, fmt.Errorf("preflight: %w", err)
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	if ret == lua.LFalse {
+		return 0, false, nil
+	}
+
+	status := http.StatusNoContent
+	if n, ok := t.RawGetString("status").(lua.LNumber); ok && n >= 100 && n <= 999 {
+		status = int(n)
+	}
+	for name := range h {
+		delete(h, name)
+	}
+	if hdrs, ok := t.RawGetString("headers").(*lua.LTable); ok {
+		hdrs.ForEach(func(k, v lua.LValue) {
+			if ks, ok := k.(lua.LString); ok && v != lua.LNil && v != lua.LFalse {
+				h.Set(string(ks), v.String())
+			}
+		})
+	}
+	return status, true, nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
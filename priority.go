@@ -0,0 +1,140 @@
+package lua
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// priorityGroup is the group of the Lua handlers of the routes of a route
+// list, e.g. the lua directives of a site block, that run in the order of
+// their priority rather than in the order of the routes. The group of a
+// handler is resolved from the routes of its server once it handles its
+// first request.
+//
+// The first handler of the group that a request reaches runs the handlers
+// of the group whose route matches the request, from the highest priority
+// to the lowest and in the order of the routes for the same priority, each
+// of them calling the next one as its next handler, and the last one
+// calling the next handler of the first one. The other handlers of the
+// group then pass the request to their next handler: the handlers of the
+// other routes that are between them run after the group. They share the
+// values of caddy.ctx, e.g. to pass the user authenticated by the first
+// handler to the others.
+type priorityGroup struct {
+	once sync.Once
+
+	// members are the handlers of the group sorted by priority, nil if
+	// none of them has a priority.
+	members []priorityMember
+	varName string
+}
+
+// priorityMember is a handler of a priority group and its route.
+type priorityMember struct {
+	route   caddyhttp.Route
+	handler *Lua
+}
+
+// resolve returns the group of the handler of pg, or nil if it has none,
+// looking for it in the routes of the server of r on the first call.
+func (pg *priorityGroup) resolve(r *http.Request) *priorityGroup {
+	pg.once.Do(func() {
+		srv, ok := r.Context().Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server)
+		if !ok {
+			return
+		}
+		routes := serverRouteLists(srv)
+		for _, rl := range routes {
+			if members := pg.membersOf(rl); members != nil {
+				pg.members = members
+				pg.varName = fmt.Sprintf("lua_priority_group_%p", members[0].handler.priorityGroup)
+				return
+			}
+		}
+	})
+	if pg.members == nil {
+		return nil
+	}
+	return pg
+}
+
+// membersOf returns the handlers of the routes of rl, sorted by priority,
+// if the handler of pg is one of them and one of them has a priority.
+func (pg *priorityGroup) membersOf(rl caddyhttp.RouteList) []priorityMember {
+	var members []priorityMember
+	found, prioritized := false, false
+	for _, rt := range rl {
+		// the routes of the lua directives have the lua handler only
+		if len(rt.Handlers) != 1 || rt.Group != "" || rt.Terminal {
+			continue
+		}
+		l, ok := rt.Handlers[0].(*Lua)
+		if !ok || l.priorityGroup == nil {
+			continue
+		}
+		found = found || l.priorityGroup == pg
+		prioritized = prioritized || l.Priority != 0
+		members = append(members, priorityMember{route: rt, handler: l})
+	}
+	if !found || !prioritized {
+		return nil
+	}
+	sort.SliceStable(members, func(i, j int) bool {
+		return members[i].handler.Priority > members[j].handler.Priority
+	})
+	return members
+}
+
+// serverRouteLists returns the route lists of srv and of its subroutes.
+func serverRouteLists(srv *caddyhttp.Server) []caddyhttp.RouteList {
+	var lists []caddyhttp.RouteList
+	var walk func(rl caddyhttp.RouteList)
+	walk = func(rl caddyhttp.RouteList) {
+		lists = append(lists, rl)
+		for _, rt := range rl {
+			for _, h := range rt.Handlers {
+				sr, ok := h.(*caddyhttp.Subroute)
+				if !ok {
+					continue
+				}
+				walk(sr.Routes)
+				if sr.Errors != nil {
+					walk(sr.Errors.Routes)
+				}
+			}
+		}
+	}
+	walk(srv.Routes)
+	if srv.Errors != nil {
+		walk(srv.Errors.Routes)
+	}
+	return lists
+}
+
+// serve runs the handlers of the group that r reaches first, or calls next
+// if the group already ran for r.
+func (pg *priorityGroup) serve(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if caddyhttp.GetVar(r.Context(), pg.varName) != nil {
+		return next.ServeHTTP(w, r)
+	}
+	caddyhttp.SetVar(r.Context(), pg.varName, true)
+
+	h := next
+	for i := len(pg.members) - 1; i >= 0; i-- {
+		m, mNext := pg.members[i], h
+		h = caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			if !m.route.MatcherSets.AnyMatch(r) {
+				if err, ok := caddyhttp.GetVar(r.Context(), caddyhttp.MatcherErrorVarKey).(error); ok {
+					return err
+				}
+				return mNext.ServeHTTP(w, r)
+			}
+			return m.handler.serve(w, r, mNext)
+		})
+	}
+	return h.ServeHTTP(w, r)
+}
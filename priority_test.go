@@ -0,0 +1,109 @@
+package lua
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// serveRoutes handles r with the routes of srv, like their compiled
+// middleware chain.
+func serveRoutes(t *testing.T, srv *caddyhttp.Server, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r = caddyhttp.PrepareRequest(r, caddy.NewReplacer(), w, srv)
+	var chain func(routes caddyhttp.RouteList) caddyhttp.Handler
+	chain = func(routes caddyhttp.RouteList) caddyhttp.Handler {
+		return caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			if len(routes) == 0 {
+				return nil
+			}
+			next := chain(routes[1:])
+			if !routes[0].MatcherSets.AnyMatch(r) {
+				return next.ServeHTTP(w, r)
+			}
+			return routes[0].Handlers[0].ServeHTTP(w, r, next)
+		})
+	}
+	// the lua routes are in the subroute of the site
+	sr := srv.Routes[0].Handlers[0].(*caddyhttp.Subroute)
+	if err := chain(sr.Routes).ServeHTTP(w, r); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestLuaPriority(t *testing.T) {
+	newHandler := func(name string, priority int) *Lua {
+		tr, err := NewTester(&Lua{Priority: priority, Script: `
+			caddy.ctx.order = (caddy.ctx.order or "") .. "` + name + `"
+			if caddy.ctx.order:len() == 3 then
+				response:write(caddy.ctx.order)
+				return "done"
+			end`})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { tr.Close() })
+		return tr.handler
+	}
+	route := func(l *Lua, paths ...string) caddyhttp.Route {
+		rt := caddyhttp.Route{Handlers: []caddyhttp.MiddlewareHandler{l}}
+		if len(paths) > 0 {
+			rt.MatcherSets = caddyhttp.MatcherSets{{caddyhttp.MatchPath(paths)}}
+		}
+		return rt
+	}
+
+	srv := &caddyhttp.Server{Routes: caddyhttp.RouteList{{
+		Handlers: []caddyhttp.MiddlewareHandler{&caddyhttp.Subroute{Routes: caddyhttp.RouteList{
+			route(newHandler("a", 0)),
+			route(newHandler("b", 10), "/b/*"),
+			route(newHandler("c", 5)),
+			route(newHandler("d", 5), "/d"),
+		}}},
+	}}}
+	cases := []struct {
+		path, want string
+	}{
+		// b does not match, the handlers run by priority and then in the
+		// order of the routes
+		{"/d", "cda"},
+		// a runs the group, b is the first
+		{"/b/x", "bca"},
+	}
+	for _, c := range cases {
+		if w := serveRoutes(t, srv, c.path); w.Body.String() != c.want {
+			t.Errorf("%s: got %q, want %q", c.path, w.Body.String(), c.want)
+		}
+	}
+
+	// without priorities, the handlers run in the order of the routes
+	srv = &caddyhttp.Server{Routes: caddyhttp.RouteList{{
+		Handlers: []caddyhttp.MiddlewareHandler{&caddyhttp.Subroute{Routes: caddyhttp.RouteList{
+			route(newHandler("a", 0)),
+			route(newHandler("b", 0)),
+			route(newHandler("c", 0)),
+		}}},
+	}}}
+	if w := serveRoutes(t, srv, "/"); w.Body.String() != "abc" {
+		t.Errorf("got %q, want the order of the routes", w.Body.String())
+	}
+}
+
+func TestLuaPriorityCaddyfile(t *testing.T) {
+	var l Lua
+	if err := l.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`lua {
+		priority -5
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+	if l.Priority != -5 {
+		t.Errorf("got the priority %d, want -5", l.Priority)
+	}
+}
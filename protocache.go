@@ -0,0 +1,218 @@
+package lua
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// defaultProtoCacheSize is the number of compiled scripts held by the cache
+// of a handler without a CacheSize.
+const defaultProtoCacheSize = 1000
+
+var errScriptIsDir = errors.New("is a directory")
+
+// protoCache is an LRU cache of the scripts compiled from files, used for
+// the scripts under the root of a handler and the modules loaded with
+// require, and of the expressions of the {lua:"<expression>"}
+// placeholders. A script is compiled again only if its contents change: when its
+// modification time or size differ from the cached ones, the file is read
+// and compiled only if its SHA-256 hash differs too, e.g. not when a deploy
+// rewrites the same file. If ttl is set, the cached scripts are used
+// without checking their file for ttl after they were last checked.
+type protoCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type protoEntry struct {
+	path    string
+	proto   *lua.FunctionProto
+	modTime time.Time
+	size    int64
+	hash    [sha256.Size]byte
+	checked time.Time
+}
+
+func newProtoCache(size int, ttl time.Duration) *protoCache {
+	if size <= 0 {
+		size = defaultProtoCacheSize
+	}
+	return &protoCache{
+		size:    size,
+		ttl:     ttl,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the compiled script at path, compiling it if it is not cached
+// or changed since it was.
+func (c *protoCache) get(path string) (*lua.FunctionProto, error) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var e *protoEntry
+	if elem := c.entries[path]; elem != nil {
+		c.lru.MoveToFront(elem)
+		e = elem.Value.(*protoEntry)
+		if c.ttl > 0 && now.Sub(e.checked) < c.ttl {
+			return e.proto, nil
+		}
+	}
+
+	fi, err := os.Stat(path)
+	if err == nil && fi.IsDir() {
+		err = fmt.Errorf("%s %w", path, errScriptIsDir)
+	}
+	if err != nil {
+		c.remove(path)
+		return nil, err
+	}
+	if e != nil && e.modTime.Equal(fi.ModTime()) && e.size == fi.Size() {
+		e.checked = now
+		return e.proto, nil
+	}
+
+	src, err := os.ReadFile(path)
+	if err != nil {
+		c.remove(path)
+		return nil, err
+	}
+	hash := sha256.Sum256(src)
+	if e == nil || e.hash != hash {
+		proto, err := compileReader(bytes.NewReader(src), path)
+		if err != nil {
+			return nil, fmt.Errorf("compiling %s: %w", path, err)
+		}
+		if e == nil {
+			e = &protoEntry{path: path}
+			c.entries[path] = c.lru.PushFront(e)
+			c.evict()
+		}
+		e.proto = proto
+		e.hash = hash
+	}
+	e.modTime = fi.ModTime()
+	e.size = fi.Size()
+	e.checked = now
+	return e.proto, nil
+}
+
+// exprCacheKey is the prefix of the keys of the cached expressions, which
+// cannot be the path of a file.
+const exprCacheKey = "\x00expr:"
+
+// expression returns the compiled expression src (see compileExpression),
+// compiling it if it is not cached. The expressions are cached with the
+// scripts, keyed by their source.
+func (c *protoCache) expression(src string) (*lua.FunctionProto, error) {
+	key := exprCacheKey + src
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem := c.entries[key]; elem != nil {
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*protoEntry).proto, nil
+	}
+	proto, err := compileExpression(src, "<expression>")
+	if err != nil {
+		return nil, err
+	}
+	c.entries[key] = c.lru.PushFront(&protoEntry{path: key, proto: proto})
+	c.evict()
+	return proto, nil
+}
+
+// len returns the number of cached scripts.
+func (c *protoCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// clear removes all the scripts from the cache.
+func (c *protoCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// remove removes the script at path from the cache. The cache must be
+// locked.
+func (c *protoCache) remove(path string) {
+	if elem := c.entries[path]; elem != nil {
+		c.lru.Remove(elem)
+		delete(c.entries, path)
+	}
+}
+
+// evict removes the least recently used scripts while the cache holds more
+// than its size. The cache must be locked.
+func (c *protoCache) evict() {
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back().Value.(*protoEntry).path)
+	}
+}
+
+// setRequireLoader replaces the loader of the Lua files of package.loaders
+// in L with one that finds the modules on package.path like it, but loads
+// them from the handler's cache of compiled scripts, so that the states do
+// not compile the modules they require again.
+func (l *Lua) setRequireLoader(L *lua.LState) {
+	loaders, ok := L.G.Registry.RawGetString("_LOADERS").(*lua.LTable)
+	if !ok || loaders.Len() < 2 {
+		return
+	}
+	loaders.RawSetInt(2, L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		path, msg := findModule(L, name)
+		if path == "" {
+			L.Push(lua.LString(msg))
+			return 1
+		}
+		proto, err := l.protoCache.get(path)
+		if err != nil {
+			L.RaiseError("%s", err)
+		}
+		L.Push(L.NewFunctionFromProto(proto))
+		return 1
+	}))
+}
+
+// findModule returns the path of the first file matching the module name
+// on package.path, or an empty path and the message of the files tried.
+func findModule(L *lua.LState, name string) (string, string) {
+	name = strings.ReplaceAll(name, ".", string(os.PathSeparator))
+	pkg, _ := L.GetGlobal("package").(*lua.LTable)
+	if pkg == nil {
+		return "", "package is not a table"
+	}
+	var messages []string
+	for _, template := range strings.Split(lua.LVAsString(pkg.RawGetString("path")), lua.LuaPathSep) {
+		path := strings.ReplaceAll(template, lua.LuaPathMark, name)
+		fi, err := os.Stat(path)
+		if err == nil && !fi.IsDir() {
+			return path, ""
+		}
+		if err == nil {
+			err = fmt.Errorf("%s %w", path, errScriptIsDir)
+		}
+		messages = append(messages, err.Error())
+	}
+	return "", strings.Join(messages, "\n\t")
+}
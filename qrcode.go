@@ -0,0 +1,45 @@
+package lua
+
+import (
+	"fmt"
+
+	"github.com/skip2/go-qrcode"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	defaultQRCodeSize = 256
+	maxQRCodeSize     = 4096
+)
+
+var qrRecoveryLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// caddyQRCode implements caddy.qrcode(data[, size[, level]]), which returns
+// the PNG image of the QR code encoding data, size pixels wide (256 by
+// default), with the error recovery level L, M (the default), Q or H. It
+// returns nil and an error message if data is too long to be encoded.
+func caddyQRCode(L *lua.LState) int {
+	data := L.CheckString(1)
+	size := L.OptInt(2, defaultQRCodeSize)
+	if size < 1 || size > maxQRCodeSize {
+		L.ArgError(2, fmt.Sprintf("size must be between 1 and %d", maxQRCodeSize))
+	}
+	level, ok := qrRecoveryLevels[L.OptString(3, "M")]
+	if !ok {
+		L.ArgError(3, "level must be one of L, M, Q or H")
+	}
+
+	png, err := qrcode.Encode(data, level, size)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LString(png))
+	return 1
+}
@@ -0,0 +1,277 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// defaultQuotaWindow is the window of the quotas without a Window.
+const defaultQuotaWindow = time.Minute
+
+// The names of the quotas, which are the values of the quota label of the
+// rejection metrics.
+const (
+	quotaMaxExecutions = "max_executions"
+	quotaMaxCPUTime    = "max_cpu_time"
+	quotaMaxConcurrent = "max_concurrent"
+	quotaMemoryLimit   = "memory_limit"
+)
+
+// Quota configures the quotas of the tenants of the handler, so that the
+// scripts of a tenant cannot starve the other tenants sharing the instance.
+// The tenant of a request is the value of the Tenant placeholder, e.g.
+// "{http.request.host}" or "{lua:\"request:header('X-Tenant')\"}", all the
+// requests being of the same tenant if it is empty.
+//
+// Within each Window (1m by default), the scripts of at most MaxExecutions
+// requests of a tenant run, for at most MaxCPUTime in total, and those of at
+// most MaxConcurrent requests of the tenant run at once. The requests beyond
+// the quotas are rejected with RejectStatus (429 by default) and a
+// Retry-After header before their scripts run, and a script that runs for
+// longer than what remains of the MaxCPUTime of its tenant is stopped and
+// responds with that status. MemoryLimit limits the size of the Lua state of
+// each script of the tenants like the handler's memory_limit, the lowest of
+// both applying.
+//
+// The CPU time of a script is the time that it runs, including the time
+// spent in caddy.next like the execution_timeout, as gopher-lua does not
+// account for the CPU time of the scripts. The concurrency quota applies in
+// addition to the handler's max_concurrent, before the request waits for
+// one of its slots. The usage of the tenants is held by the handler, so it
+// restarts when the configuration is reloaded, and is exposed by the
+// tenant_executions_total, tenant_cpu_seconds_total and
+// tenant_quota_rejections_total metrics, labeled with the name of the
+// handler and the tenant.
+type Quota struct {
+	Tenant        string         `json:"tenant,omitempty"`
+	Window        caddy.Duration `json:"window,omitempty"`
+	MaxExecutions int            `json:"max_executions,omitempty"`
+	MaxCPUTime    caddy.Duration `json:"max_cpu_time,omitempty"`
+	MaxConcurrent int            `json:"max_concurrent,omitempty"`
+	MemoryLimit   int64          `json:"memory_limit,omitempty"`
+	RejectStatus  int            `json:"reject_status,omitempty"`
+}
+
+// validate returns an error if the configuration is not valid.
+func (q *Quota) validate() error {
+	if q.Window < 0 || q.MaxExecutions < 0 || q.MaxCPUTime < 0 || q.MaxConcurrent < 0 || q.MemoryLimit < 0 {
+		return errors.New("quota: window, max_executions, max_cpu_time, max_concurrent and memory_limit must not be negative")
+	}
+	if q.RejectStatus != 0 && (q.RejectStatus < 400 || q.RejectStatus > 599) {
+		return fmt.Errorf("quota: reject_status must be between 400 and 599, got %d", q.RejectStatus)
+	}
+	return nil
+}
+
+// unmarshalCaddyfile sets up the quotas from the block's tokens.
+func (q *Quota) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		field := d.Val()
+		var v string
+		if !d.Args(&v) || d.NextArg() {
+			return d.Errf("quota %s: %w", field, d.ArgErr())
+		}
+		var err error
+		switch field {
+		case "tenant":
+			q.Tenant = v
+		case "window":
+			err = parseCaddyDuration(v, &q.Window)
+		case "max_executions":
+			q.MaxExecutions, err = strconv.Atoi(v)
+		case "max_cpu_time":
+			err = parseCaddyDuration(v, &q.MaxCPUTime)
+		case "max_concurrent":
+			q.MaxConcurrent, err = strconv.Atoi(v)
+		case "memory_limit":
+			var n uint64
+			n, err = humanize.ParseBytes(v)
+			q.MemoryLimit = int64(n)
+		case "reject_status":
+			q.RejectStatus, err = strconv.Atoi(v)
+		default:
+			return d.Errf("quota %s: unknown configuration option", field)
+		}
+		if err != nil {
+			return d.Errf("quota %s: %w", field, err)
+		}
+	}
+	return nil
+}
+
+// tenantQuotas is the runtime state of a Quota: the usage of the tenants of
+// the handler in their current window.
+type tenantQuotas struct {
+	cfg     *Quota
+	handler string
+	window  time.Duration
+	status  int
+
+	mu      sync.Mutex
+	tenants map[string]*tenantUsage
+	swept   time.Time
+}
+
+// tenantUsage is the usage of a tenant in its current window, which started
+// at start.
+type tenantUsage struct {
+	quotas *tenantQuotas
+	name   string
+
+	// the fields are guarded by the mutex of quotas
+	start      time.Time
+	executions int
+	cpu        time.Duration
+	running    int
+}
+
+// tenantRequest is the request of a tenant being handled.
+type tenantRequest struct {
+	usage *tenantUsage
+
+	// running is set while a script of the request runs, whose time
+	// includes the time of the scripts that run during caddy.next, e.g. the
+	// header script.
+	running bool
+}
+
+// newTenantQuotas returns the quotas configured by cfg for the handler name.
+func newTenantQuotas(cfg *Quota, name string) *tenantQuotas {
+	tq := &tenantQuotas{
+		cfg:     cfg,
+		handler: name,
+		window:  time.Duration(cfg.Window),
+		status:  cfg.RejectStatus,
+		tenants: make(map[string]*tenantUsage),
+	}
+	if tq.window == 0 {
+		tq.window = defaultQuotaWindow
+	}
+	if tq.status == 0 {
+		tq.status = http.StatusTooManyRequests
+	}
+	return tq
+}
+
+// acquire counts the execution of the scripts of r for its tenant, and
+// returns the tenant's request and the function that releases its
+// concurrency slot, which may be called more than once. If the tenant
+// exceeded a quota, it sets the Retry-After header of w and returns the
+// error that rejects the request.
+func (tq *tenantQuotas) acquire(w http.ResponseWriter, r *http.Request) (*tenantRequest, func(), error) {
+	var name string
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		name = repl.ReplaceAll(tq.cfg.Tenant, "")
+	}
+	now := time.Now()
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	tq.sweep(now)
+	u := tq.tenants[name]
+	if u == nil {
+		u = &tenantUsage{quotas: tq, name: name, start: now}
+		tq.tenants[name] = u
+	}
+	if now.Sub(u.start) >= tq.window {
+		u.start, u.executions, u.cpu = now, 0, 0
+	}
+
+	var exceeded string
+	retryAfter := time.Second
+	switch {
+	case tq.cfg.MaxConcurrent > 0 && u.running >= tq.cfg.MaxConcurrent:
+		exceeded = quotaMaxConcurrent
+	case tq.cfg.MaxExecutions > 0 && u.executions >= tq.cfg.MaxExecutions:
+		exceeded, retryAfter = quotaMaxExecutions, u.start.Add(tq.window).Sub(now)
+	case tq.cfg.MaxCPUTime > 0 && u.cpu >= time.Duration(tq.cfg.MaxCPUTime):
+		exceeded, retryAfter = quotaMaxCPUTime, u.start.Add(tq.window).Sub(now)
+	}
+	if exceeded != "" {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(retryAfter.Seconds())))))
+		return nil, nil, u.exceeded(exceeded)
+	}
+
+	u.executions++
+	u.running++
+	observeTenantExecution(tq.handler, name)
+	var once sync.Once
+	return &tenantRequest{usage: u}, func() {
+		once.Do(func() {
+			tq.mu.Lock()
+			defer tq.mu.Unlock()
+			u.running--
+		})
+	}, nil
+}
+
+// sweep removes the tenants whose window ended and that have no running
+// request, at most once per window. The quotas must be locked.
+func (tq *tenantQuotas) sweep(now time.Time) {
+	if now.Sub(tq.swept) < tq.window {
+		return
+	}
+	tq.swept = now
+	for name, u := range tq.tenants {
+		if u.running == 0 && now.Sub(u.start) >= tq.window {
+			delete(tq.tenants, name)
+		}
+	}
+}
+
+// exceeded records the rejection of a request of the tenant that exceeded
+// the quota, and returns its error.
+func (u *tenantUsage) exceeded(quota string) error {
+	observeTenantRejection(u.quotas.handler, u.name, quota)
+	return caddyhttp.Error(u.quotas.status, fmt.Errorf("the tenant %q exceeded its %s quota", u.name, quota))
+}
+
+// remaining returns the CPU time that remains to the tenant in its window,
+// and false if it has no CPU time quota.
+func (u *tenantUsage) remaining() (time.Duration, bool) {
+	if u.quotas.cfg.MaxCPUTime <= 0 {
+		return 0, false
+	}
+	u.quotas.mu.Lock()
+	defer u.quotas.mu.Unlock()
+	return time.Duration(u.quotas.cfg.MaxCPUTime) - u.cpu, true
+}
+
+// addCPUTime adds d to the CPU time of the tenant in its window.
+func (u *tenantUsage) addCPUTime(d time.Duration) {
+	u.quotas.mu.Lock()
+	u.cpu += d
+	u.quotas.mu.Unlock()
+	observeTenantCPUTime(u.quotas.handler, u.name, d)
+}
+
+// memoryLimit returns the memory limit of the scripts of the tenant, given
+// the limit of the handler.
+func (u *tenantUsage) memoryLimit(limit int64) int64 {
+	if q := u.quotas.cfg.MemoryLimit; q > 0 && (limit <= 0 || q < limit) {
+		return q
+	}
+	return limit
+}
+
+// boundTenant returns the tenant's request of the request bound to L, or nil
+// if it has none.
+func boundTenant(L *lua.LState) *tenantRequest {
+	if ud, ok := L.G.Registry.RawGetString(requestContextKey).(*lua.LUserData); ok {
+		if rc, ok := ud.Value.(*requestContext); ok {
+			return rc.tenant
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package lua
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestTenantQuotas(t *testing.T) {
+	for _, isolation := range []string{isolationPerRequest, isolationPooled, isolationSharedCoroutine} {
+		t.Run(isolation, func(t *testing.T) {
+			tr, err := NewTester(&Lua{
+				Isolation: isolation,
+				Quota: &Quota{
+					Tenant:        "{http.request.header.X-Tenant}",
+					MaxExecutions: 3,
+					MaxCPUTime:    caddy.Duration(500 * time.Millisecond),
+					MemoryLimit:   256 << 10,
+				},
+				Script: `
+					if request.path == "/slow" then
+						while true do end
+					elseif request.path == "/big" then
+						local t = {}
+						for i = 1, 1e6 do t[i] = "value " .. i end
+					end
+					response:write("ok")`,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tr.Close()
+			tenant := func(name, path string) TestRequest {
+				return TestRequest{Path: path, Header: http.Header{"X-Tenant": {name}}}
+			}
+
+			cases := []struct {
+				name   string
+				req    TestRequest
+				status int
+			}{
+				{"within", tenant("a", "/"), http.StatusOK},
+				{"within", tenant("a", "/"), http.StatusOK},
+				{"memory", tenant("a", "/big"), http.StatusInternalServerError},
+				{"executions", tenant("a", "/"), http.StatusTooManyRequests},
+				{"other tenant", tenant("b", "/"), http.StatusOK},
+				{"cpu time", tenant("c", "/slow"), http.StatusTooManyRequests},
+				{"cpu time spent", tenant("c", "/"), http.StatusTooManyRequests},
+				{"other tenant", tenant("b", "/"), http.StatusOK},
+			}
+			for _, c := range cases {
+				res := tr.Do(c.req)
+				if res.Status != c.status {
+					t.Errorf("%s: got %d (%v), want %d", c.name, res.Status, res.Err, c.status)
+				}
+				if c.status == http.StatusTooManyRequests && res.Header.Get("Retry-After") == "" && c.name != "cpu time" {
+					t.Errorf("%s: got the headers %v, want a Retry-After header", c.name, res.Header)
+				}
+			}
+		})
+	}
+}
+
+func TestTenantQuotasConcurrency(t *testing.T) {
+	tq := newTenantQuotas(&Quota{MaxConcurrent: 1, MaxExecutions: 2}, "test")
+	newRequest := func() (*http.Request, *httptest.ResponseRecorder) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		return caddyhttp.PrepareRequest(r, caddy.NewReplacer(), w, nil), w
+	}
+
+	r, w := newRequest()
+	_, release, err := tq.acquire(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w = newRequest()
+	if _, _, err := tq.acquire(w, r); err == nil || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("got %v, %v, want the concurrency quota error", err, w.Header())
+	}
+	release()
+	release()
+	r, w = newRequest()
+	if _, release, err = tq.acquire(w, r); err != nil {
+		t.Fatalf("got %v once the request was released", err)
+	}
+	release()
+	r, w = newRequest()
+	if _, _, err := tq.acquire(w, r); err == nil {
+		t.Error("got no error, want the executions quota error")
+	}
+}
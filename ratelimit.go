@@ -0,0 +1,184 @@
+package lua
+
+import (
+	"math"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// rateLimits holds the state of the rate limiters of the ratelimit module,
+// shared by all the scripts of the handlers without a runtime like the kv
+// store but in a distinct key space.
+var rateLimits = &kvRegistry{m: make(map[string]kvEntry)}
+
+// slidingWindow is the state of a sliding window rate limiter: the number
+// of requests allowed in the current fixed window and in the previous one.
+// The count over the sliding window is estimated by weighting the previous
+// count by the part of the sliding window that overlaps it.
+type slidingWindow struct {
+	start time.Time
+	prev  int
+	curr  int
+}
+
+// allow reports whether a request at now is allowed under limit requests per
+// window, and returns the remaining number of requests allowed and the time
+// after which the next request would be allowed if it is not.
+func (sw *slidingWindow) allow(now time.Time, limit int, window time.Duration) (bool, int, time.Duration) {
+	if sw.start.IsZero() {
+		sw.start = now
+	}
+	if elapsed := now.Sub(sw.start); elapsed >= window {
+		if elapsed >= 2*window {
+			sw.prev = 0
+		} else {
+			sw.prev = sw.curr
+		}
+		sw.curr = 0
+		sw.start = sw.start.Add(elapsed / window * window)
+	}
+
+	weight := 1 - float64(now.Sub(sw.start))/float64(window)
+	count := float64(sw.prev)*weight + float64(sw.curr)
+	if count+1 <= float64(limit) {
+		sw.curr++
+		return true, int(float64(limit) - count - 1), 0
+	}
+
+	// the estimated count decreases as the previous window slides out,
+	// find when it allows one more request.
+	end := sw.start.Add(window)
+	var at time.Time
+	if free := float64(limit - 1 - sw.curr); free >= 0 && sw.prev > 0 {
+		at = sw.start.Add(time.Duration((1 - free/float64(sw.prev)) * float64(window)))
+	} else {
+		at = end.Add(time.Duration((1 - float64(limit-1)/float64(sw.curr)) * float64(window)))
+	}
+	return false, 0, at.Sub(now)
+}
+
+// tokenBucket is the state of a token bucket rate limiter.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take reports whether n tokens can be taken at now from a bucket that
+// refills at rate tokens per second up to burst tokens, and returns the
+// remaining tokens and the time after which n tokens would be available if
+// they are not.
+func (tb *tokenBucket) take(now time.Time, rate, burst, n float64) (bool, int, time.Duration) {
+	if tb.last.IsZero() {
+		tb.tokens = burst
+	} else {
+		tb.tokens = math.Min(burst, tb.tokens+now.Sub(tb.last).Seconds()*rate)
+	}
+	tb.last = now
+
+	if tb.tokens >= n {
+		tb.tokens -= n
+		return true, int(tb.tokens), 0
+	}
+	return false, int(tb.tokens), time.Duration((n - tb.tokens) / rate * float64(time.Second))
+}
+
+// preloadRateLimitModule registers the ratelimit module, loaded by scripts
+// with require("ratelimit"), which implements rate limiters shared by all
+// the requests and handlers of the process, or of the runtime of the
+// handler, keyed by values computed by the script (e.g. an API key and the
+// path):
+//
+//	ratelimit.allow(key, limit, window): counts a request for key and
+//	reports whether it is allowed under limit requests per window seconds,
+//	using a sliding window
+//	ratelimit.take(key, rate, burst[, n]): takes n tokens (default 1) for key
+//	from a token bucket that refills at rate tokens per second up to burst
+//	tokens, and reports whether they were available
+//
+// Both return a boolean, the remaining number of requests or tokens and the
+// number of seconds after which the request would be allowed, 0 if it is.
+// Requests that are not allowed are not counted.
+func preloadRateLimitModule(L *lua.LState) {
+	L.PreloadModule("ratelimit", func(L *lua.LState) int {
+		L.Push(L.SetFuncs(L.NewTable(), rateLimitFuncs))
+		return 1
+	})
+}
+
+var rateLimitFuncs = map[string]lua.LGFunction{
+	"allow": rateLimitAllow,
+	"take":  rateLimitTake,
+}
+
+// rateLimitAllow implements ratelimit.allow(key, limit, window).
+func rateLimitAllow(L *lua.LState) int {
+	key := L.CheckString(1)
+	limit := L.CheckInt(2)
+	if limit <= 0 {
+		L.ArgError(2, "the limit must be positive")
+	}
+	window := optSeconds(L, 3)
+	if window <= 0 {
+		L.ArgError(3, "the window must be positive")
+	}
+
+	var (
+		ok         bool
+		remaining  int
+		retryAfter time.Duration
+	)
+	now := time.Now()
+	checkRateLimits(L).update("allow:"+key, 2*window, func(v interface{}) interface{} {
+		sw, _ := v.(*slidingWindow)
+		if sw == nil {
+			sw = new(slidingWindow)
+		}
+		ok, remaining, retryAfter = sw.allow(now, limit, window)
+		return sw
+	})
+	return pushRateLimitResult(L, ok, remaining, retryAfter)
+}
+
+// rateLimitTake implements ratelimit.take(key, rate, burst[, n]).
+func rateLimitTake(L *lua.LState) int {
+	key := L.CheckString(1)
+	rate := float64(L.CheckNumber(2))
+	if rate <= 0 {
+		L.ArgError(2, "the rate must be positive")
+	}
+	burst := float64(L.CheckNumber(3))
+	if burst <= 0 {
+		L.ArgError(3, "the burst must be positive")
+	}
+	n := float64(L.OptNumber(4, 1))
+	if n <= 0 || n > burst {
+		L.ArgError(4, "the number of tokens must be positive and at most burst")
+	}
+
+	var (
+		ok         bool
+		remaining  int
+		retryAfter time.Duration
+	)
+	now := time.Now()
+	// the bucket is full again after burst/rate seconds, it can then be
+	// forgotten.
+	ttl := time.Duration(burst / rate * float64(time.Second))
+	checkRateLimits(L).update("take:"+key, ttl, func(v interface{}) interface{} {
+		tb, _ := v.(*tokenBucket)
+		if tb == nil {
+			tb = new(tokenBucket)
+		}
+		ok, remaining, retryAfter = tb.take(now, rate, burst, n)
+		return tb
+	})
+	return pushRateLimitResult(L, ok, remaining, retryAfter)
+}
+
+func pushRateLimitResult(L *lua.LState, ok bool, remaining int, retryAfter time.Duration) int {
+	L.Push(lua.LBool(ok))
+	L.Push(lua.LNumber(remaining))
+	L.Push(lua.LNumber(retryAfter.Seconds()))
+	return 3
+}
@@ -0,0 +1,303 @@
+package lua
+
+import (
+	"container/list"
+	"regexp"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// regexpCacheSize is the number of compiled patterns held by the cache of
+// the re module.
+const regexpCacheSize = 1000
+
+// regexps caches the patterns compiled by the re module, shared by all the
+// states, so that the scripts do not compile them on each request.
+var regexps = newRegexpCache(regexpCacheSize)
+
+// preloadRegexpModule registers the re module, loaded by scripts with
+// require("re"), which matches the regular expressions of Go's regexp
+// package (the RE2 syntax, with a matching time linear in the size of the
+// subject), e.g. to validate or rewrite the paths:
+//
+//	re.test(pattern, s): true if s matches pattern
+//	re.match(pattern, s[, init]): the captures of the first match of
+//	pattern in s, or the whole match if pattern has no captures, or nil
+//	re.find(pattern, s[, init]): the start and end positions of the first
+//	match followed by its captures, or nil
+//	re.find_all(pattern, s[, n]): the array of the matches, or of the
+//	arrays of their captures if pattern has captures, at most n if n >= 0
+//	re.gsub(pattern, s, repl[, n]): s with its matches (the first n if n is
+//	set) replaced by repl, and the number of replacements
+//	re.split(pattern, s[, n]): the array of the substrings of s between the
+//	matches of pattern, at most n if n >= 0
+//	re.quote(s): the pattern that matches the literal s
+//
+// Like the functions of the string library, init is the position where the
+// search starts, negative to count from the end, and the positions are
+// those of the bytes, starting at 1. The captures that do not participate
+// in the match are nil.
+//
+// The repl of re.gsub is a string in which $1 or ${name} are the captures
+// and $$ is a literal $, a table indexed by the first capture (or the whole
+// match), or a function called with the captures (or the whole match). The
+// match is kept if the table or the function return nil or false.
+//
+// The patterns are compiled once and cached. An invalid pattern raises an
+// argument error.
+func preloadRegexpModule(L *lua.LState) {
+	L.PreloadModule("re", func(L *lua.LState) int {
+		L.Push(L.SetFuncs(L.NewTable(), regexpFuncs))
+		return 1
+	})
+}
+
+var regexpFuncs = map[string]lua.LGFunction{
+	"test":     regexpTest,
+	"match":    regexpMatch,
+	"find":     regexpFind,
+	"find_all": regexpFindAll,
+	"gsub":     regexpGsub,
+	"split":    regexpSplit,
+	"quote":    regexpQuote,
+}
+
+// regexpCache is an LRU cache of compiled patterns.
+type regexpCache struct {
+	size int
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type regexpEntry struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+func newRegexpCache(size int) *regexpCache {
+	return &regexpCache{
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the compiled pattern, compiling it if it is not cached.
+func (c *regexpCache) get(pattern string) (*regexp.Regexp, error) {
+	c.mu.Lock()
+	if elem := c.entries[pattern]; elem != nil {
+		c.lru.MoveToFront(elem)
+		c.mu.Unlock()
+		return elem.Value.(*regexpEntry).re, nil
+	}
+	c.mu.Unlock()
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem := c.entries[pattern]; elem != nil {
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*regexpEntry).re, nil
+	}
+	c.entries[pattern] = c.lru.PushFront(&regexpEntry{pattern: pattern, re: re})
+	for c.lru.Len() > c.size {
+		elem := c.lru.Back()
+		c.lru.Remove(elem)
+		delete(c.entries, elem.Value.(*regexpEntry).pattern)
+	}
+	return re, nil
+}
+
+// checkRegexp returns the compiled pattern at index n of the stack, raising
+// an argument error if it is invalid.
+func checkRegexp(L *lua.LState, n int) *regexp.Regexp {
+	re, err := regexps.get(L.CheckString(n))
+	if err != nil {
+		L.ArgError(n, err.Error())
+	}
+	return re
+}
+
+// checkInit returns the offset in s of the init position at index n of the
+// stack, or -1 if it is past the end of s.
+func checkInit(L *lua.LState, n int, s string) int {
+	init := L.OptInt(n, 1)
+	switch {
+	case init < 0:
+		init += len(s) + 1
+		if init < 1 {
+			init = 1
+		}
+	case init == 0:
+		init = 1
+	case init > len(s)+1:
+		return -1
+	}
+	return init - 1
+}
+
+// pushCaptures pushes the captures of the match loc of re in s, or the whole
+// match if re has no captures, and returns their number.
+func pushCaptures(L *lua.LState, re *regexp.Regexp, s string, loc []int) int {
+	if re.NumSubexp() == 0 {
+		L.Push(lua.LString(s[loc[0]:loc[1]]))
+		return 1
+	}
+	for i := 1; i <= re.NumSubexp(); i++ {
+		L.Push(submatch(s, loc, i))
+	}
+	return re.NumSubexp()
+}
+
+// submatch returns the capture i of the match loc in s, or nil if it does not
+// participate in the match.
+func submatch(s string, loc []int, i int) lua.LValue {
+	if loc[2*i] < 0 {
+		return lua.LNil
+	}
+	return lua.LString(s[loc[2*i]:loc[2*i+1]])
+}
+
+// regexpTest implements re.test(pattern, s).
+func regexpTest(L *lua.LState) int {
+	re := checkRegexp(L, 1)
+	L.Push(lua.LBool(re.MatchString(L.CheckString(2))))
+	return 1
+}
+
+// regexpMatch implements re.match(pattern, s[, init]).
+func regexpMatch(L *lua.LState) int {
+	re := checkRegexp(L, 1)
+	s := L.CheckString(2)
+	off := checkInit(L, 3, s)
+	if off < 0 {
+		L.Push(lua.LNil)
+		return 1
+	}
+	loc := re.FindStringSubmatchIndex(s[off:])
+	if loc == nil {
+		L.Push(lua.LNil)
+		return 1
+	}
+	return pushCaptures(L, re, s[off:], loc)
+}
+
+// regexpFind implements re.find(pattern, s[, init]).
+func regexpFind(L *lua.LState) int {
+	re := checkRegexp(L, 1)
+	s := L.CheckString(2)
+	off := checkInit(L, 3, s)
+	if off < 0 {
+		L.Push(lua.LNil)
+		return 1
+	}
+	loc := re.FindStringSubmatchIndex(s[off:])
+	if loc == nil {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(lua.LNumber(off + loc[0] + 1))
+	L.Push(lua.LNumber(off + loc[1]))
+	for i := 1; i <= re.NumSubexp(); i++ {
+		L.Push(submatch(s[off:], loc, i))
+	}
+	return 2 + re.NumSubexp()
+}
+
+// regexpFindAll implements re.find_all(pattern, s[, n]).
+func regexpFindAll(L *lua.LState) int {
+	re := checkRegexp(L, 1)
+	s := L.CheckString(2)
+	locs := re.FindAllStringSubmatchIndex(s, L.OptInt(3, -1))
+	t := L.CreateTable(len(locs), 0)
+	for _, loc := range locs {
+		if re.NumSubexp() == 0 {
+			t.Append(lua.LString(s[loc[0]:loc[1]]))
+			continue
+		}
+		caps := L.CreateTable(re.NumSubexp(), 0)
+		for i := 1; i <= re.NumSubexp(); i++ {
+			caps.RawSetInt(i, submatch(s, loc, i))
+		}
+		t.Append(caps)
+	}
+	L.Push(t)
+	return 1
+}
+
+// regexpGsub implements re.gsub(pattern, s, repl[, n]).
+func regexpGsub(L *lua.LState) int {
+	re := checkRegexp(L, 1)
+	s := L.CheckString(2)
+	repl := L.Get(3)
+	switch repl.(type) {
+	case lua.LString, lua.LNumber, *lua.LTable, *lua.LFunction:
+	default:
+		L.ArgError(3, "string, table or function expected")
+	}
+	locs := re.FindAllStringSubmatchIndex(s, L.OptInt(4, -1))
+
+	var b strings.Builder
+	var last int
+	for _, loc := range locs {
+		b.WriteString(s[last:loc[0]])
+		last = loc[1]
+		match := s[loc[0]:loc[1]]
+
+		var v lua.LValue
+		switch repl := repl.(type) {
+		case *lua.LTable:
+			key := lua.LValue(lua.LString(match))
+			if re.NumSubexp() > 0 {
+				key = submatch(s, loc, 1)
+			}
+			v = L.GetTable(repl, key)
+		case *lua.LFunction:
+			top := L.GetTop()
+			L.Push(repl)
+			n := pushCaptures(L, re, s, loc)
+			L.Call(n, 1)
+			v = L.Get(-1)
+			L.SetTop(top)
+		default:
+			b.Write(re.ExpandString(nil, lua.LVAsString(repl), s, loc))
+			continue
+		}
+
+		switch v := v.(type) {
+		case lua.LString, lua.LNumber:
+			b.WriteString(lua.LVAsString(v))
+		default:
+			if lua.LVAsBool(v) {
+				L.RaiseError("invalid replacement value (a %s)", v.Type())
+			}
+			b.WriteString(match)
+		}
+	}
+	b.WriteString(s[last:])
+	L.Push(lua.LString(b.String()))
+	L.Push(lua.LNumber(len(locs)))
+	return 2
+}
+
+// regexpSplit implements re.split(pattern, s[, n]).
+func regexpSplit(L *lua.LState) int {
+	re := checkRegexp(L, 1)
+	s := L.CheckString(2)
+	L.Push(stringArray(L, re.Split(s, L.OptInt(3, -1))))
+	return 1
+}
+
+// regexpQuote implements re.quote(s).
+func regexpQuote(L *lua.LState) int {
+	L.Push(lua.LString(regexp.QuoteMeta(L.CheckString(1))))
+	return 1
+}
@@ -0,0 +1,385 @@
+package lua
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	defaultRedisPoolSize = 10
+	defaultRedisTimeout  = 5 * time.Second
+
+	// maxRedisBulkSize is the maximum size of a bulk string read from the
+	// server.
+	maxRedisBulkSize = 512 << 20
+)
+
+// Redis configures the Redis client of the redis module, used by scripts to
+// send commands to a Redis server:
+//
+//	local redis = require("redis")
+//	local v, err = redis.call("GET", key)
+//
+// The command's arguments are converted to strings. The reply is returned as
+// a string (status and bulk replies), a number (integer replies), nil (nil
+// replies) or an array (with false for nil elements), or nil and an error
+// message if the command failed.
+//
+// Up to PoolSize connections (default 10) are opened to Address, and kept
+// open between requests. If Password is set, the connections are
+// authenticated, and the database DB is selected if it is not 0. Each command
+// fails if it takes longer than Timeout (default 5s), or if the request is
+// canceled.
+type Redis struct {
+	Address  string         `json:"address,omitempty"`
+	Password string         `json:"password,omitempty"`
+	DB       int            `json:"db,omitempty"`
+	PoolSize int            `json:"pool_size,omitempty"`
+	Timeout  caddy.Duration `json:"timeout,omitempty"`
+}
+
+// unmarshalCaddyfile sets up the Redis client from the block's tokens.
+func (rd *Redis) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		field := d.Val()
+		var v string
+		if !d.Args(&v) || d.NextArg() {
+			return d.Errf("redis %s: %w", field, d.ArgErr())
+		}
+		var err error
+		switch field {
+		case "address":
+			rd.Address = v
+		case "password":
+			rd.Password = v
+		case "db":
+			rd.DB, err = strconv.Atoi(v)
+		case "pool_size":
+			rd.PoolSize, err = strconv.Atoi(v)
+		case "timeout":
+			err = parseCaddyDuration(v, &rd.Timeout)
+		default:
+			return d.Errf("redis %s: unknown configuration option", field)
+		}
+		if err != nil {
+			return d.Errf("redis %s: %w", field, err)
+		}
+	}
+	return nil
+}
+
+// validate returns an error if the Redis configuration is invalid.
+func (rd *Redis) validate() error {
+	if rd.Address == "" {
+		return errors.New("redis: the address configuration option is required")
+	}
+	if rd.PoolSize < 0 || rd.DB < 0 {
+		return errors.New("redis: pool_size and db must not be negative")
+	}
+	return nil
+}
+
+// redisPool is a pool of connections to a Redis server.
+type redisPool struct {
+	cfg     *Redis
+	timeout time.Duration
+	slots   chan struct{} // a token per connection that can be opened
+	idle    chan *redisConn
+	closed  int32 // atomic
+}
+
+func newRedisPool(cfg *Redis) *redisPool {
+	size := cfg.PoolSize
+	if size == 0 {
+		size = defaultRedisPoolSize
+	}
+	timeout := time.Duration(cfg.Timeout)
+	if timeout <= 0 {
+		timeout = defaultRedisTimeout
+	}
+	p := &redisPool{
+		cfg:     cfg,
+		timeout: timeout,
+		slots:   make(chan struct{}, size),
+		idle:    make(chan *redisConn, size),
+	}
+	for i := 0; i < size; i++ {
+		p.slots <- struct{}{}
+	}
+	return p
+}
+
+// do sends the command args to the server and returns its reply.
+func (p *redisPool) do(ctx context.Context, args []string) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	c, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	reply, err := c.do(deadline, args)
+	p.put(c, err)
+	return reply, err
+}
+
+// get returns an idle connection, or opens a new one if the pool is not
+// full, waiting until one is available otherwise.
+func (p *redisPool) get(ctx context.Context) (*redisConn, error) {
+	select {
+	case c := <-p.idle:
+		return c, nil
+	default:
+	}
+	select {
+	case c := <-p.idle:
+		return c, nil
+	case <-p.slots:
+		c, err := p.dial(ctx)
+		if err != nil {
+			p.slots <- struct{}{}
+			return nil, err
+		}
+		return c, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// put returns c to the pool, or closes it if the command failed with a
+// network or protocol error, in which case the connection may not be usable.
+func (p *redisPool) put(c *redisConn, err error) {
+	var rerr redisError
+	if (err != nil && !errors.As(err, &rerr)) || atomic.LoadInt32(&p.closed) == 1 {
+		c.conn.Close()
+		p.slots <- struct{}{}
+		return
+	}
+	p.idle <- c
+}
+
+// dial opens a connection to the server, authenticated and with the
+// database selected.
+func (p *redisPool) dial(ctx context.Context) (*redisConn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+
+	deadline, _ := ctx.Deadline()
+	if p.cfg.Password != "" {
+		if _, err := c.do(deadline, []string{"AUTH", p.cfg.Password}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if p.cfg.DB != 0 {
+		if _, err := c.do(deadline, []string{"SELECT", strconv.Itoa(p.cfg.DB)}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// close closes the idle connections, and the connections in use once they
+// are returned to the pool.
+func (p *redisPool) close() {
+	atomic.StoreInt32(&p.closed, 1)
+	for {
+		select {
+		case c := <-p.idle:
+			c.conn.Close()
+			p.slots <- struct{}{}
+		default:
+			return
+		}
+	}
+}
+
+// redisError is an error reply of the server.
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// redisConn is a connection to a Redis server speaking the RESP protocol.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// do sends the command args and reads its reply, failing after deadline.
+func (c *redisConn) do(deadline time.Time, args []string) (interface{}, error) {
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// readReply reads a reply: a string, an int64, nil, a []interface{} or a
+// redisError.
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 || n > maxRedisBulkSize {
+			return nil, fmt.Errorf("redis: invalid bulk length %q", line[1:])
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("redis: invalid array length %q", line[1:])
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		vals := make([]interface{}, n)
+		for i := range vals {
+			v, err := c.readReply()
+			var rerr redisError
+			if errors.As(err, &rerr) {
+				v = rerr
+			} else if err != nil {
+				return nil, err
+			}
+			vals[i] = v
+		}
+		return vals, nil
+	default:
+		return nil, fmt.Errorf("redis: invalid reply %q", line)
+	}
+}
+
+func (c *redisConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: invalid reply line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+// preloadRedisModule registers the redis module, loaded by scripts with
+// require("redis").
+func preloadRedisModule(L *lua.LState) {
+	L.PreloadModule("redis", func(L *lua.LState) int {
+		L.Push(L.SetFuncs(L.NewTable(), redisFuncs))
+		return 1
+	})
+}
+
+var redisFuncs = map[string]lua.LGFunction{
+	"call": redisCall,
+}
+
+// redisCall implements redis.call(cmd, args...).
+func redisCall(L *lua.LState) int {
+	pool := checkHandler(L).redis
+	if pool == nil {
+		L.RaiseError("redis.call: no redis server is configured")
+	}
+
+	args := make([]string, 0, L.GetTop())
+	args = append(args, L.CheckString(1))
+	for i := 2; i <= L.GetTop(); i++ {
+		switch v := L.Get(i).(type) {
+		case lua.LString, lua.LNumber:
+			args = append(args, v.String())
+		case lua.LBool:
+			args = append(args, strconv.FormatBool(bool(v)))
+		default:
+			L.ArgError(i, "string, number or boolean expected")
+		}
+	}
+
+	ctx := checkContext(L)
+	var reply interface{}
+	var err error
+	unlocked(L, func() { reply, err = pool.do(ctx, args) })
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(redisReplyToLua(L, reply))
+	return 1
+}
+
+// redisReplyToLua converts a reply to a Lua value.
+func redisReplyToLua(L *lua.LState, reply interface{}) lua.LValue {
+	switch v := reply.(type) {
+	case nil:
+		return lua.LNil
+	case string:
+		return lua.LString(v)
+	case int64:
+		return lua.LNumber(v)
+	case redisError:
+		// an error in an array reply
+		return lua.LString(v)
+	case []interface{}:
+		t := L.CreateTable(len(v), 0)
+		for _, e := range v {
+			if e == nil {
+				t.Append(lua.LFalse)
+				continue
+			}
+			t.Append(redisReplyToLua(L, e))
+		}
+		return t
+	default:
+		return lua.LString(fmt.Sprint(v))
+	}
+}
@@ -0,0 +1,159 @@
+package lua
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// bodyFilterChunkSize is the size of the chunks of the body passed to the
+// body filter functions.
+const bodyFilterChunkSize = 32 * 1024
+
+// RequestBodyFilter configures a global Lua function defined by the script
+// that rewrites the request body before it is passed to the next handler
+// (e.g. reverse_proxy). The function is called with each chunk of the body
+// as it is read and a boolean that is true on the last call (with a
+// possibly empty chunk), and returns the data to send in place of the chunk
+// (a string, or nil to send nothing). Data can be held back by returning
+// nothing until the last call, e.g. to rewrite a JSON body as a whole.
+//
+// The filtered body is streamed with chunked encoding unless Buffer is set,
+// in which case it is fully filtered before calling the next handler so that
+// the request has an exact Content-Length.
+type RequestBodyFilter struct {
+	Function string `json:"function,omitempty"`
+	Buffer   bool   `json:"buffer,omitempty"`
+}
+
+var errBodyFilterDone = errors.New("the Lua handler has returned, the body filter is no longer available")
+
+// luaBodyFilter is an io.ReadCloser that filters the data read from src
+// through a Lua function. As the body may be read from another goroutine
+// (e.g. by the HTTP transport of a reverse proxy), access to the Lua state
+// is serialized and stops when the handler returns.
+type luaBodyFilter struct {
+	src   io.ReadCloser
+	chunk []byte
+
+	mu      sync.Mutex
+	L       *lua.LState
+	fn      *lua.LFunction
+	pending []byte
+	done    bool
+}
+
+func newLuaBodyFilter(L *lua.LState, fn *lua.LFunction, src io.ReadCloser) *luaBodyFilter {
+	return &luaBodyFilter{
+		src:   src,
+		chunk: make([]byte, bodyFilterChunkSize),
+		L:     L,
+		fn:    fn,
+	}
+}
+
+// Read implements io.Reader.
+func (f *luaBodyFilter) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for len(f.pending) == 0 {
+		if f.done {
+			return 0, io.EOF
+		}
+		if f.L == nil {
+			return 0, errBodyFilterDone
+		}
+
+		n, err := f.src.Read(f.chunk)
+		last := err == io.EOF
+		if err != nil && !last {
+			return 0, err
+		}
+		if n == 0 && !last {
+			continue
+		}
+		out, err := f.call(f.chunk[:n], last)
+		if err != nil {
+			return 0, err
+		}
+		f.pending = out
+		f.done = last
+	}
+
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+// call runs the filter function on chunk and returns its output.
+func (f *luaBodyFilter) call(chunk []byte, last bool) ([]byte, error) {
+	defer enterState(f.L)()
+	err := f.L.CallByParam(lua.P{Fn: f.fn, NRet: 1, Protect: true}, lua.LString(chunk), lua.LBool(last))
+	if err != nil {
+		return nil, fmt.Errorf("request body filter: %w", err)
+	}
+	ret := f.L.Get(-1)
+	f.L.Pop(1)
+
+	switch ret := ret.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LString:
+		return []byte(ret), nil
+	default:
+		return nil, fmt.Errorf("request body filter: expected a string or nil, got a %s", ret.Type())
+	}
+}
+
+// Close implements io.Closer.
+func (f *luaBodyFilter) Close() error {
+	return f.src.Close()
+}
+
+// detach prevents any further call to the Lua state.
+func (f *luaBodyFilter) detach() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.L = nil
+}
+
+// filterRequestBody replaces the body of r with the output of the
+// configured request body filter. The returned function must be called
+// once the Lua state is no longer usable.
+func (l *Lua) filterRequestBody(L *lua.LState, r *http.Request) (detach func(), err error) {
+	detach = func() {}
+	if l.RequestBodyFilter == nil || r.Body == nil || r.Body == http.NoBody {
+		return detach, nil
+	}
+
+	cfg := l.RequestBodyFilter
+	fn, ok := L.GetGlobal(cfg.Function).(*lua.LFunction)
+	if !ok {
+		return detach, fmt.Errorf("request body filter: %s is not a function", cfg.Function)
+	}
+	f := newLuaBodyFilter(L, fn, r.Body)
+
+	if cfg.Buffer {
+		defer f.detach()
+		b, err := io.ReadAll(f)
+		if err != nil {
+			return detach, err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(b))
+		r.ContentLength = int64(len(b))
+		r.Header.Set("Content-Length", strconv.Itoa(len(b)))
+		return detach, nil
+	}
+
+	r.Body = f
+	r.ContentLength = -1
+	r.Header.Del("Content-Length")
+	return f.detach, nil
+}
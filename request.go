@@ -0,0 +1,316 @@
+package lua
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	requestTypeName    = "caddy.request"
+	bodyReaderTypeName = "caddy.body_reader"
+
+	// defaultMaxRequestBodySize is the maximum size of the request body that
+	// request:body() reads in memory when the handler has no max_body_size.
+	defaultMaxRequestBodySize = 10 << 20
+
+	// defaultBodyChunkSize is the size of the chunks read by the body reader
+	// when read is called without a size.
+	defaultBodyChunkSize = 32 << 10
+)
+
+// openRequestLib registers the request global in L, which exposes the
+// request being handled. Its fields are read from the request when they are
+// accessed, so that they reflect the changes made by other functions (e.g.
+// caddy.forward_auth):
+//
+//	request.method, request.url, request.path, request.host, request.proto,
+//	request.remote_addr: strings
+//	request.query: table of the first value of each query string parameter
+//	request.headers: table of the value of each header, or array of values
+//	request:header(name): first value of the header, or nil
+//	request:header_values(name): array of the values of the header
+//	request:query_values(name): array of the values of the parameter
+//	request:cookies(): table of the value of each cookie
+//	request:cookie(name): value of the cookie, or nil
+//	request:body(): the body as a string, or nil and an error message
+//	request:body_reader(): a reader of the body, see below
+//	request:set_body(s): replaces the body seen by the next handler
+//	request:spool_body([opts]): reads the body in memory, or in a temporary
+//	file if it is larger than the spool_threshold, see requestSpoolBody
+//	request:form(): table of the first value of each field of the
+//	urlencoded body, or nil and an error message
+//	request:form_values(name): array of the values of the field
+//	request:multipart([opts]): an iterator over the parts of the multipart
+//	body, see requestMultipart
+//	request:tls(): the state of the TLS connection, or nil, see requestTLS
+//	request:client_ip(): the address of the client, read from the
+//	X-Forwarded-For header (or the client_ip_headers) if the request comes
+//	from one of the trusted_proxies, see Lua.clientIP
+//	request:is_trusted_proxy([ip]): whether ip, or the address of the peer
+//	without ip, is one of the trusted_proxies
+//	request:set_method(method), request:set_path(path), request:set_host(host):
+//	change the request seen by the next handler, e.g. reverse_proxy, which
+//	uses the host as the Host header. The path is unescaped and starts
+//	with "/".
+//	request:set_query(query): replaces the query string with the raw query,
+//	without "?", or with a table of the value, or array of values, of each
+//	parameter
+//	request:set_header(name, value): sets the header to the string or the
+//	array of strings, or deletes it if value is nil
+//
+// The fields of the request and its placeholders reflect the changes, except
+// the placeholders of the original request such as
+// {http.request.orig_uri}. The setters raise an argument error if the value
+// is not valid.
+//
+// The body reader streams the body in chunks with reader:read([n]), which
+// returns a string of up to n bytes (default 32KB), nil at the end of the
+// body, or nil and an error message. Unlike request:body(), the body reader
+// consumes the body: the next handler only receives the part that was not
+// read, unless the body is replaced with request:set_body().
+func openRequestLib(L *lua.LState) {
+	mt := L.NewTypeMetatable(requestTypeName)
+	L.SetField(mt, "__index", L.NewFunction(requestIndex))
+
+	brmt := L.NewTypeMetatable(bodyReaderTypeName)
+	L.SetField(brmt, "__index", L.SetFuncs(L.NewTable(), bodyReaderMethods))
+
+	pmt := L.NewTypeMetatable(multipartPartTypeName)
+	L.SetField(pmt, "__index", L.NewFunction(multipartPartIndex))
+
+	umt := L.NewTypeMetatable(uploadTypeName)
+	L.SetField(umt, "__index", L.NewFunction(uploadIndex))
+
+	ud := L.NewUserData()
+	L.SetMetatable(ud, mt)
+	L.SetGlobal("request", ud)
+}
+
+var requestMethods = map[string]lua.LGFunction{
+	"header":           requestHeader,
+	"header_values":    requestHeaderValues,
+	"query_values":     requestQueryValues,
+	"cookies":          requestCookies,
+	"cookie":           requestCookie,
+	"body":             requestBody,
+	"body_reader":      requestBodyReader,
+	"set_body":         requestSetBody,
+	"spool_body":       requestSpoolBody,
+	"form":             requestForm,
+	"form_values":      requestFormValues,
+	"multipart":        requestMultipart,
+	"tls":              requestTLS,
+	"client_ip":        requestClientIP,
+	"is_trusted_proxy": requestIsTrustedProxy,
+	"set_method":       requestSetMethod,
+	"set_path":         requestSetPath,
+	"set_query":        requestSetQuery,
+	"set_host":         requestSetHost,
+	"set_header":       requestSetHeader,
+}
+
+// requestIndex implements the __index metamethod of the request.
+func requestIndex(L *lua.LState) int {
+	key := L.CheckString(2)
+	if fn := requestMethods[key]; fn != nil {
+		L.Push(L.NewFunction(fn))
+		return 1
+	}
+
+	r := checkRequestContext(L).r
+	switch key {
+	case "method":
+		L.Push(lua.LString(r.Method))
+	case "url":
+		u := *r.URL
+		u.Host = r.Host
+		u.Scheme = "http"
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+		L.Push(lua.LString(u.String()))
+	case "path":
+		L.Push(lua.LString(r.URL.Path))
+	case "host":
+		L.Push(lua.LString(r.Host))
+	case "proto":
+		L.Push(lua.LString(r.Proto))
+	case "remote_addr":
+		L.Push(lua.LString(r.RemoteAddr))
+	case "query":
+		t := L.NewTable()
+		for name, vals := range r.URL.Query() {
+			if len(vals) > 0 {
+				t.RawSetString(name, lua.LString(vals[0]))
+			}
+		}
+		L.Push(t)
+	case "headers":
+		L.Push(headerToTable(L, r.Header))
+	default:
+		L.Push(lua.LNil)
+	}
+	return 1
+}
+
+// stringArray returns a Lua array of the strings in list.
+func stringArray(L *lua.LState, list []string) *lua.LTable {
+	t := L.CreateTable(len(list), 0)
+	for _, s := range list {
+		t.Append(lua.LString(s))
+	}
+	return t
+}
+
+// requestHeader implements request:header(name).
+func requestHeader(L *lua.LState) int {
+	vals := checkRequestContext(L).r.Header.Values(L.CheckString(2))
+	if len(vals) == 0 {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(lua.LString(vals[0]))
+	return 1
+}
+
+// requestHeaderValues implements request:header_values(name).
+func requestHeaderValues(L *lua.LState) int {
+	L.Push(stringArray(L, checkRequestContext(L).r.Header.Values(L.CheckString(2))))
+	return 1
+}
+
+// requestQueryValues implements request:query_values(name).
+func requestQueryValues(L *lua.LState) int {
+	L.Push(stringArray(L, checkRequestContext(L).r.URL.Query()[L.CheckString(2)]))
+	return 1
+}
+
+// requestBody implements request:body(). The body is read in memory, up to
+// the handler's max_body_size (default 10MB), and remains available to the
+// next handler.
+func requestBody(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	if rc.body == nil {
+		var body []byte
+		var err error
+		unlocked(L, func() { body, err = readRequestBody(rc.r, rc.maxBodySize()) })
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		rc.body = body
+	}
+	L.Push(lua.LString(rc.body))
+	return 1
+}
+
+// requestBodyReader implements request:body_reader().
+func requestBodyReader(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	ud := L.NewUserData()
+	ud.Value = rc
+	L.SetMetatable(ud, L.GetTypeMetatable(bodyReaderTypeName))
+	L.Push(ud)
+	return 1
+}
+
+// requestSetBody implements request:set_body(s).
+func requestSetBody(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	body := []byte(L.CheckString(2))
+	if rc.r.Body != nil {
+		rc.r.Body.Close()
+	}
+	rc.r.Body = io.NopCloser(bytes.NewReader(body))
+	rc.r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	rc.r.ContentLength = int64(len(body))
+	rc.r.TransferEncoding = nil
+	rc.r.Header.Del("Transfer-Encoding")
+	rc.r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	rc.body = body
+	return 0
+}
+
+var bodyReaderMethods = map[string]lua.LGFunction{
+	"read": bodyReaderRead,
+}
+
+// bodyReaderRead implements reader:read([n]).
+func bodyReaderRead(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	rc, ok := ud.Value.(*requestContext)
+	if !ok {
+		L.ArgError(1, "body reader expected")
+	}
+	n := L.OptInt(2, defaultBodyChunkSize)
+	if n <= 0 {
+		L.ArgError(2, "size must be positive")
+	}
+	if max := rc.maxBodySize(); int64(n) > max {
+		n = int(max)
+	}
+
+	if rc.r.Body == nil || rc.r.Body == http.NoBody {
+		L.Push(lua.LNil)
+		return 1
+	}
+	// the body read so far is no longer the body seen by the next handler
+	rc.body = nil
+	buf := make([]byte, n)
+	var read int
+	var err error
+	unlocked(L, func() { read, err = io.ReadFull(rc.r.Body, buf) })
+	if read > 0 {
+		L.Push(lua.LString(buf[:read]))
+		return 1
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LNil)
+	return 1
+}
+
+// maxBodySize returns the maximum size of the request body read in memory.
+func (rc *requestContext) maxBodySize() int64 {
+	if rc.handler != nil && rc.handler.MaxBodySize > 0 {
+		return rc.handler.MaxBodySize
+	}
+	return defaultMaxRequestBodySize
+}
+
+// readRequestBody reads the body of r, up to max bytes, and replaces it with
+// a reader of the same content.
+func readRequestBody(r *http.Request, max int64) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return []byte{}, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, max+1))
+	r.Body = readCloser{
+		Reader: io.MultiReader(bytes.NewReader(body), r.Body),
+		Closer: r.Body,
+	}
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > max {
+		return nil, fmt.Errorf("request body is larger than %d bytes", max)
+	}
+	return body, nil
+}
+
+// readCloser combines a Reader with the Closer of another value.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,110 @@
+package lua
+
+import (
+	"net/url"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+	"golang.org/x/net/http/httpguts"
+)
+
+// requestSetMethod implements request:set_method(method).
+func requestSetMethod(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	method := L.CheckString(2)
+	if !httpguts.ValidHeaderFieldName(method) {
+		L.ArgError(2, "invalid method")
+	}
+	rc.r.Method = method
+	return 0
+}
+
+// requestSetPath implements request:set_path(path).
+func requestSetPath(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	path := L.CheckString(2)
+	if !strings.HasPrefix(path, "/") {
+		L.ArgError(2, "the path must start with /")
+	}
+	rc.r.URL.Path = path
+	rc.r.URL.RawPath = ""
+	rc.r.RequestURI = rc.r.URL.RequestURI()
+	return 0
+}
+
+// requestSetQuery implements request:set_query(query).
+func requestSetQuery(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	var query string
+	switch v := L.Get(2).(type) {
+	case lua.LString:
+		query = strings.TrimPrefix(string(v), "?")
+		if _, err := url.ParseQuery(query); err != nil {
+			L.ArgError(2, err.Error())
+		}
+	case *lua.LTable:
+		vals := make(url.Values)
+		v.ForEach(func(k, val lua.LValue) {
+			name := k.String()
+			if arr, ok := val.(*lua.LTable); ok {
+				for i := 1; i <= arr.Len(); i++ {
+					vals.Add(name, arr.RawGetInt(i).String())
+				}
+				return
+			}
+			vals.Add(name, val.String())
+		})
+		query = vals.Encode()
+	default:
+		L.ArgError(2, "string or table expected")
+	}
+	rc.r.URL.RawQuery = query
+	rc.r.URL.ForceQuery = false
+	rc.r.RequestURI = rc.r.URL.RequestURI()
+	return 0
+}
+
+// requestSetHost implements request:set_host(host).
+func requestSetHost(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	host := L.CheckString(2)
+	if host == "" || !httpguts.ValidHostHeader(host) {
+		L.ArgError(2, "invalid host")
+	}
+	rc.r.Host = host
+	return 0
+}
+
+// requestSetHeader implements request:set_header(name, value).
+func requestSetHeader(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	name := L.CheckString(2)
+	if !httpguts.ValidHeaderFieldName(name) {
+		L.ArgError(2, "invalid header name")
+	}
+
+	var vals []string
+	switch v := L.Get(3).(type) {
+	case *lua.LNilType:
+		rc.r.Header.Del(name)
+		return 0
+	case *lua.LTable:
+		for i := 1; i <= v.Len(); i++ {
+			vals = append(vals, v.RawGetInt(i).String())
+		}
+	case lua.LString, lua.LNumber:
+		vals = []string{lua.LVAsString(v)}
+	default:
+		L.ArgError(3, "string, array or nil expected")
+	}
+	for _, val := range vals {
+		if !httpguts.ValidHeaderFieldValue(val) {
+			L.ArgError(3, "invalid header value")
+		}
+	}
+	rc.r.Header.Del(name)
+	for _, val := range vals {
+		rc.r.Header.Add(name, val)
+	}
+	return 0
+}
@@ -0,0 +1,104 @@
+package lua
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// tlsVersionNames are the names of the TLS versions.
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// requestTLS implements request:tls(), which returns the state of the TLS
+// connection of the request, or nil if it is not made over TLS, e.g. to
+// authorize the clients by their certificate:
+//
+//	version: e.g. "TLS 1.3"
+//	cipher_suite: e.g. "TLS_AES_128_GCM_SHA256"
+//	server_name: the SNI sent by the client
+//	alpn: the negotiated protocol, e.g. "h2"
+//	resumed: true if the session was resumed
+//	client_certificates: the array of the certificates sent by the client,
+//	the leaf first
+//	verified: true if the client certificate was verified by the server
+//	verified_chains: the array of the verified chains of the client
+//	certificate, each an array of certificates from the leaf to the root
+//
+// The certificates are tables with their subject and issuer (the
+// distinguished names as strings), common_name, serial (in hexadecimal),
+// not_before and not_after (Unix timestamps), dns_names, email_addresses,
+// ip_addresses and uris (arrays of strings), fingerprint (the hexadecimal
+// SHA-256 of the certificate) and pem.
+func requestTLS(L *lua.LState) int {
+	cs := checkRequestContext(L).r.TLS
+	if cs == nil {
+		L.Push(lua.LNil)
+		return 1
+	}
+
+	t := L.CreateTable(0, 8)
+	version, ok := tlsVersionNames[cs.Version]
+	if !ok {
+		version = fmt.Sprintf("0x%04x", cs.Version)
+	}
+	t.RawSetString("version", lua.LString(version))
+	t.RawSetString("cipher_suite", lua.LString(tls.CipherSuiteName(cs.CipherSuite)))
+	t.RawSetString("server_name", lua.LString(cs.ServerName))
+	t.RawSetString("alpn", lua.LString(cs.NegotiatedProtocol))
+	t.RawSetString("resumed", lua.LBool(cs.DidResume))
+	t.RawSetString("client_certificates", certificateArray(L, cs.PeerCertificates))
+	t.RawSetString("verified", lua.LBool(len(cs.VerifiedChains) > 0))
+	chains := L.CreateTable(len(cs.VerifiedChains), 0)
+	for _, chain := range cs.VerifiedChains {
+		chains.Append(certificateArray(L, chain))
+	}
+	t.RawSetString("verified_chains", chains)
+	L.Push(t)
+	return 1
+}
+
+// certificateArray returns the Lua array of the tables of certs.
+func certificateArray(L *lua.LState, certs []*x509.Certificate) *lua.LTable {
+	t := L.CreateTable(len(certs), 0)
+	for _, cert := range certs {
+		t.Append(certificateTable(L, cert))
+	}
+	return t
+}
+
+// certificateTable returns the Lua table of the fields of cert.
+func certificateTable(L *lua.LState, cert *x509.Certificate) *lua.LTable {
+	t := L.CreateTable(0, 12)
+	t.RawSetString("subject", lua.LString(cert.Subject.String()))
+	t.RawSetString("issuer", lua.LString(cert.Issuer.String()))
+	t.RawSetString("common_name", lua.LString(cert.Subject.CommonName))
+	t.RawSetString("serial", lua.LString(cert.SerialNumber.Text(16)))
+	t.RawSetString("not_before", lua.LNumber(cert.NotBefore.Unix()))
+	t.RawSetString("not_after", lua.LNumber(cert.NotAfter.Unix()))
+	t.RawSetString("dns_names", stringArray(L, cert.DNSNames))
+	t.RawSetString("email_addresses", stringArray(L, cert.EmailAddresses))
+	ips := make([]string, 0, len(cert.IPAddresses))
+	for _, ip := range cert.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	t.RawSetString("ip_addresses", stringArray(L, ips))
+	uris := make([]string, 0, len(cert.URIs))
+	for _, u := range cert.URIs {
+		uris = append(uris, u.String())
+	}
+	t.RawSetString("uris", stringArray(L, uris))
+	sum := sha256.Sum256(cert.Raw)
+	t.RawSetString("fingerprint", lua.LString(hex.EncodeToString(sum[:])))
+	t.RawSetString("pem", lua.LString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+	return t
+}
@@ -0,0 +1,151 @@
+package lua
+
+import (
+	"net/http"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const responseTypeName = "caddy.response"
+
+// openResponseLib registers the response global in L, which writes the
+// response of the request being handled. Once the script set the status or
+// wrote to the response, the handler is terminal: the next handler is not
+// called, and the response is sent with the status (default 200) and the
+// headers set by the script. Headers set without writing the response are
+// added to the response of the next handler.
+//
+//	response:header(name): the first value of the response header name, or
+//	nil
+//	response:header_values(name): the array of the values of the response
+//	header name
+//	response:set_status(code)
+//	response:set_header(name, value): value is a string, an array of
+//	strings, or nil to remove the header
+//	response:set_cookie(opts): adds a Set-Cookie header, see
+//	responseSetCookie for the options
+//	response:write(s...)
+//	response:flush()
+//	response:sse(): starts a Server-Sent Events stream, see responseSSE
+//	response:serve_file(path[, opts]): responds with a file under the
+//	handler's file_root, see responseServeFile
+func openResponseLib(L *lua.LState) {
+	mt := L.NewTypeMetatable(responseTypeName)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), responseMethods))
+	openSSEType(L)
+
+	ud := L.NewUserData()
+	L.SetMetatable(ud, mt)
+	L.SetGlobal("response", ud)
+}
+
+var responseMethods = map[string]lua.LGFunction{
+	"header":        responseHeader,
+	"header_values": responseHeaderValues,
+	"set_status":    responseSetStatus,
+	"set_header":    responseSetHeader,
+	"set_cookie":    responseSetCookie,
+	"write":         responseWrite,
+	"flush":         responseFlush,
+	"sse":           responseSSE,
+	"serve_file":    responseServeFile,
+}
+
+// writeHeader writes the status of the response set by the script if it is
+// not written yet.
+func (rc *requestContext) writeHeader() {
+	if rc.wroteHeader {
+		return
+	}
+	if rc.status == 0 {
+		rc.status = http.StatusOK
+	}
+	rc.w.WriteHeader(rc.status)
+	rc.wroteHeader = true
+	rc.responded = true
+}
+
+// responseHeader implements response:header(name).
+func responseHeader(L *lua.LState) int {
+	vals := checkRequestContext(L).w.Header().Values(L.CheckString(2))
+	if len(vals) == 0 {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(lua.LString(vals[0]))
+	return 1
+}
+
+// responseHeaderValues implements response:header_values(name).
+func responseHeaderValues(L *lua.LState) int {
+	L.Push(stringArray(L, checkRequestContext(L).w.Header().Values(L.CheckString(2))))
+	return 1
+}
+
+// responseSetStatus implements response:set_status(code).
+func responseSetStatus(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	code := L.CheckInt(2)
+	if code < 100 || code > 999 {
+		L.ArgError(2, "invalid status code")
+	}
+	if rc.wroteHeader {
+		L.RaiseError("response:set_status: the response header is already written")
+	}
+	rc.status = code
+	rc.responded = true
+	return 0
+}
+
+// responseSetHeader implements response:set_header(name, value).
+func responseSetHeader(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	name := L.CheckString(2)
+	if rc.wroteHeader {
+		L.RaiseError("response:set_header: the response header is already written")
+	}
+
+	h := rc.w.Header()
+	switch v := L.Get(3).(type) {
+	case *lua.LNilType:
+		h.Del(name)
+	case *lua.LTable:
+		h.Del(name)
+		for i := 1; i <= v.Len(); i++ {
+			h.Add(name, v.RawGetInt(i).String())
+		}
+	case lua.LString, lua.LNumber:
+		h.Set(name, v.String())
+	default:
+		L.ArgError(3, "string, array of strings or nil expected")
+	}
+	return 0
+}
+
+// responseWrite implements response:write(s...).
+func responseWrite(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	if rc.headerPhase {
+		L.RaiseError("response:write: the response cannot be written by the header script")
+	}
+	rc.writeHeader()
+	for i := 2; i <= L.GetTop(); i++ {
+		if _, err := rc.w.Write([]byte(L.CheckString(i))); err != nil {
+			L.RaiseError("response:write: %s", err)
+		}
+	}
+	return 0
+}
+
+// responseFlush implements response:flush().
+func responseFlush(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	if rc.headerPhase {
+		L.RaiseError("response:flush: the response cannot be written by the header script")
+	}
+	rc.writeHeader()
+	if f, ok := rc.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return 0
+}
@@ -0,0 +1,96 @@
+package lua
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Route maps a set of request matchers to the script that handles the
+// requests they match.
+type Route struct {
+	MatcherSetsRaw caddyhttp.RawMatcherSets `json:"match,omitempty" caddy:"namespace=http.matchers"`
+	HandlerPath    string                   `json:"handler_path,omitempty"`
+
+	matcherSets caddyhttp.MatcherSets
+}
+
+// provision loads the route's matchers.
+func (rt *Route) provision(ctx caddy.Context) error {
+	mods, err := ctx.LoadModule(rt, "MatcherSetsRaw")
+	if err != nil {
+		return fmt.Errorf("loading matcher modules: %w", err)
+	}
+	return rt.matcherSets.FromInterface(mods)
+}
+
+// parseMatcherDefinition parses the named matcher definition that starts at
+// the current token of d (e.g. "@api path /api/*", or a block of matchers)
+// and adds it to defs.
+func parseMatcherDefinition(d *caddyfile.Dispenser, defs map[string]caddy.ModuleMap) error {
+	name := d.Val()
+	if _, ok := defs[name]; ok {
+		return d.Errf("matcher is defined more than once: %s", name)
+	}
+	defs[name] = make(caddy.ModuleMap)
+
+	// concatenate the tokens of multiple instances of the same matcher, as
+	// the Caddyfile adapter does for site-level matcher definitions.
+	tokensByMatcherName := make(map[string][]caddyfile.Token)
+	for nesting := d.Nesting(); d.NextArg() || d.NextBlock(nesting); {
+		matcherName := d.Val()
+		tokensByMatcherName[matcherName] = append(tokensByMatcherName[matcherName], d.NextSegment()...)
+	}
+	for matcherName, tokens := range tokensByMatcherName {
+		mod, err := caddy.GetModule("http.matchers." + matcherName)
+		if err != nil {
+			return d.Errf("getting matcher module '%s': %v", matcherName, err)
+		}
+		unm, ok := mod.New().(caddyfile.Unmarshaler)
+		if !ok {
+			return d.Errf("matcher module '%s' is not a Caddyfile unmarshaler", matcherName)
+		}
+		if err := unm.UnmarshalCaddyfile(caddyfile.NewDispenser(tokens)); err != nil {
+			return err
+		}
+		rm, ok := unm.(caddyhttp.RequestMatcher)
+		if !ok {
+			return d.Errf("matcher module '%s' is not a request matcher", matcherName)
+		}
+		defs[name][matcherName] = caddyconfig.JSON(rm, nil)
+	}
+	return nil
+}
+
+// parseRoute parses the arguments of a route option, which are a matcher
+// token (a named matcher defined in the same block, a path or "*") and the
+// path of the script that handles the matching requests.
+func parseRoute(d *caddyfile.Dispenser, defs map[string]caddy.ModuleMap) (Route, error) {
+	var token, path string
+	if !d.Args(&token, &path) || d.NextArg() {
+		return Route{}, d.ArgErr()
+	}
+
+	var rt Route
+	rt.HandlerPath = path
+	switch {
+	case token == "*":
+	case strings.HasPrefix(token, "/"):
+		rt.MatcherSetsRaw = caddyhttp.RawMatcherSets{
+			{"path": caddyconfig.JSON(caddyhttp.MatchPath{token}, nil)},
+		}
+	case strings.HasPrefix(token, "@"):
+		ms, ok := defs[token]
+		if !ok {
+			return Route{}, d.Errf("unrecognized matcher name: %s", token)
+		}
+		rt.MatcherSetsRaw = caddyhttp.RawMatcherSets{ms}
+	default:
+		return Route{}, d.Errf("invalid matcher token: %s", token)
+	}
+	return rt, nil
+}
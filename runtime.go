@@ -0,0 +1,181 @@
+package lua
+
+import (
+	"encoding/json"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// luaRuntimes holds the named runtimes of the handlers (the runtime
+// configuration option), keyed by name. The handlers of a runtime share:
+//
+//   - the kv store and the rate limiters of the ratelimit module, distinct
+//     from those of the other runtimes and of the handlers without a
+//     runtime, which share the process-wide ones
+//   - the database and redis connection pools, for the handlers configured
+//     with the same database or redis options
+//
+// So that sites share state by naming the same runtime, or isolate it by
+// naming distinct ones. The Lua states, and thus the globals, are never
+// shared, as a state cannot be used by concurrent requests: each handler
+// has its own states and state_pool, with the globals of its init script.
+//
+// A runtime lives while it has handlers, so its kv store is kept when the
+// configuration is reloaded with handlers of the same runtime, which are
+// provisioned before the previous ones are cleaned up. Its connection pools
+// are closed once no handler uses their configuration.
+var luaRuntimes = &runtimeRegistry{m: make(map[string]*luaRuntime)}
+
+// luaRuntime is a named runtime shared by handlers.
+type luaRuntime struct {
+	name       string
+	kv         *kvRegistry
+	rateLimits *kvRegistry
+
+	// guarded by the mutex of the registry
+	handlers  int
+	resources map[string]*sharedResource
+}
+
+// sharedResource is a resource of a runtime, such as a connection pool,
+// shared by the handlers of the runtime with the same configuration.
+type sharedResource struct {
+	value interface{}
+	close func()
+	refs  int
+}
+
+// runtimeRegistry is a concurrency-safe set of luaRuntime keyed by name.
+type runtimeRegistry struct {
+	mu sync.Mutex
+	m  map[string]*luaRuntime
+}
+
+// acquire returns the runtime name, creating it if it does not exist.
+func (rr *runtimeRegistry) acquire(name string) *luaRuntime {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rt := rr.m[name]
+	if rt == nil {
+		rt = &luaRuntime{
+			name:       name,
+			kv:         &kvRegistry{m: make(map[string]kvEntry)},
+			rateLimits: &kvRegistry{m: make(map[string]kvEntry)},
+			resources:  make(map[string]*sharedResource),
+		}
+		rr.m[name] = rt
+	}
+	rt.handlers++
+	return rt
+}
+
+// release releases the resources of keys acquired by a handler of rt, and
+// the runtime if it has no other handler.
+func (rr *runtimeRegistry) release(rt *luaRuntime, keys []string) {
+	rr.mu.Lock()
+	var closers []func()
+	for _, key := range keys {
+		res := rt.resources[key]
+		if res == nil {
+			continue
+		}
+		if res.refs--; res.refs == 0 {
+			delete(rt.resources, key)
+			closers = append(closers, res.close)
+		}
+	}
+	if rt.handlers--; rt.handlers == 0 && rr.m[rt.name] == rt {
+		delete(rr.m, rt.name)
+	}
+	rr.mu.Unlock()
+
+	for _, close := range closers {
+		close()
+	}
+}
+
+// share returns the key and the value of the resource of kind configured by
+// cfg, opening it with open if the runtime does not have it.
+func (rr *runtimeRegistry) share(rt *luaRuntime, kind string, cfg interface{}, open func() (interface{}, func(), error)) (string, interface{}, error) {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return "", nil, err
+	}
+	key := kind + ":" + string(b)
+
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if res := rt.resources[key]; res != nil {
+		res.refs++
+		return key, res.value, nil
+	}
+	v, close, err := open()
+	if err != nil {
+		return "", nil, err
+	}
+	rt.resources[key] = &sharedResource{value: v, close: close, refs: 1}
+	return key, v, nil
+}
+
+// checkKVStore returns the kv store of the handler of L.
+func checkKVStore(L *lua.LState) *kvRegistry {
+	if rt := checkHandler(L).runtime; rt != nil {
+		return rt.kv
+	}
+	return kvStore
+}
+
+// checkRateLimits returns the state of the rate limiters of the handler of
+// L.
+func checkRateLimits(L *lua.LState) *kvRegistry {
+	if rt := checkHandler(L).runtime; rt != nil {
+		return rt.rateLimits
+	}
+	return rateLimits
+}
+
+// openRedis sets up the redis pool of the handler, shared by the handlers
+// of its runtime with the same options.
+func (l *Lua) openRedis() error {
+	if l.runtime == nil {
+		l.redis = newRedisPool(l.Redis)
+		return nil
+	}
+	key, v, err := luaRuntimes.share(l.runtime, "redis", l.Redis, func() (interface{}, func(), error) {
+		p := newRedisPool(l.Redis)
+		return p, p.close, nil
+	})
+	if err != nil {
+		return err
+	}
+	l.redis = v.(*redisPool)
+	l.shared = append(l.shared, key)
+	return nil
+}
+
+// openDatabase sets up the database of the handler, shared by the handlers
+// of its runtime with the same options.
+func (l *Lua) openDatabase() error {
+	if l.runtime == nil {
+		db, err := openDatabase(l.Database)
+		if err != nil {
+			return err
+		}
+		l.db = db
+		return nil
+	}
+	key, v, err := luaRuntimes.share(l.runtime, "database", l.Database, func() (interface{}, func(), error) {
+		db, err := openDatabase(l.Database)
+		if err != nil {
+			return nil, nil, err
+		}
+		return db, func() { db.close() }, nil
+	})
+	if err != nil {
+		return err
+	}
+	l.db = v.(*sqlDB)
+	l.shared = append(l.shared, key)
+	return nil
+}
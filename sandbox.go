@@ -0,0 +1,186 @@
+package lua
+
+import (
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// sandboxFeatures are the features of the Lua standard library and of the
+// handler that the sandbox disables unless they are allowed.
+var sandboxFeatures = []string{
+	"os", "io", "debug", "load", "require", "handler",
+	"socket", "http", "storage", "db", "redis", "dns",
+	"fetch_local", "serve_file", "template_files",
+}
+
+// sandboxModules are the modules of the handler that do I/O, which are
+// sandbox features of the same name.
+var sandboxModules = []string{"socket", "http", "storage", "db", "redis", "dns"}
+
+// safeOSFuncs are the functions of the os library available in the sandbox
+// when os is not allowed.
+var safeOSFuncs = []string{"clock", "date", "difftime", "time"}
+
+// Sandbox restricts the Lua standard library and the functions of the
+// handler available to scripts, to prevent scripts from less-trusted authors
+// from accessing the filesystem, the network and the process. Unless they
+// are listed in Allow, it disables:
+//
+//   - os: the os library, except os.clock, os.date, os.difftime and os.time
+//   - io: the io library
+//   - debug: the debug library
+//   - load: the dofile, load, loadfile and loadstring functions
+//   - require: the loading of modules from files with require, the modules
+//     provided by the handler (e.g. json) remain available, except those
+//     below
+//   - handler: caddy.handler, as handler modules such as file_server can
+//     access the filesystem
+//   - socket, http, storage, db, redis and dns: the modules of the same
+//     names, which require cannot load
+//   - http: also caddy.forward_auth and the JWKS URLs of jwt.verify, which
+//     send requests to other services
+//   - fetch_local: caddy.fetch_local and caddy.subrequest, which send
+//     requests to the other routes of the server
+//   - serve_file: response:serve_file
+//   - template_files: template.render, which reads the template files, the
+//     rest of the template module remains available
+//
+// The sandbox also applies to the init script.
+type Sandbox struct {
+	Allow []string `json:"allow,omitempty"`
+}
+
+// validate returns an error if the sandbox configuration is invalid.
+func (sb *Sandbox) validate() error {
+	for _, name := range sb.Allow {
+		if !containsString(sandboxFeatures, name) {
+			return fmt.Errorf("sandbox: unknown feature %q", name)
+		}
+	}
+	return nil
+}
+
+// unmarshalCaddyfile sets up the sandbox from the option's tokens.
+func (sb *Sandbox) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	sb.Allow = append(sb.Allow, d.RemainingArgs()...)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch field := d.Val(); field {
+		case "allow":
+			names := d.RemainingArgs()
+			if len(names) == 0 {
+				return d.Errf("sandbox %s: %w", field, d.ArgErr())
+			}
+			sb.Allow = append(sb.Allow, names...)
+
+		default:
+			return d.Errf("sandbox %s: unknown configuration option", field)
+		}
+	}
+	return nil
+}
+
+// apply disables the features of L that are not allowed.
+func (sb *Sandbox) apply(L *lua.LState) {
+	allowed := func(name string) bool {
+		return containsString(sb.Allow, name)
+	}
+
+	if !allowed("os") {
+		safe := L.NewTable()
+		if osLib, ok := L.GetGlobal("os").(*lua.LTable); ok {
+			for _, name := range safeOSFuncs {
+				safe.RawSetString(name, osLib.RawGetString(name))
+			}
+		}
+		L.SetGlobal("os", safe)
+		setLoaded(L, "os", safe)
+	}
+	if !allowed("io") {
+		L.SetGlobal("io", lua.LNil)
+		setLoaded(L, "io", lua.LNil)
+	}
+	if !allowed("debug") {
+		L.SetGlobal("debug", lua.LNil)
+		setLoaded(L, "debug", lua.LNil)
+	}
+	if !allowed("load") {
+		for _, name := range []string{"dofile", "load", "loadfile", "loadstring"} {
+			L.SetGlobal(name, lua.LNil)
+		}
+	}
+	if mod, ok := L.GetGlobal("caddy").(*lua.LTable); ok {
+		if !allowed("handler") {
+			mod.RawSetString("handler", lua.LNil)
+		}
+		if !allowed("http") {
+			mod.RawSetString("forward_auth", lua.LNil)
+		}
+		if !allowed("fetch_local") {
+			mod.RawSetString("fetch_local", lua.LNil)
+			mod.RawSetString("subrequest", lua.LNil)
+		}
+	}
+	if !allowed("serve_file") {
+		if methods, ok := L.GetField(L.GetTypeMetatable(responseTypeName), "__index").(*lua.LTable); ok {
+			methods.RawSetString("serve_file", lua.LNil)
+		}
+	}
+	preload, _ := L.GetField(L.GetField(L.Get(lua.EnvironIndex), "package"), "preload").(*lua.LTable)
+	if preload != nil {
+		for _, name := range sandboxModules {
+			if !allowed(name) {
+				preload.RawSetString(name, lua.LNil)
+			}
+		}
+		if !allowed("template_files") {
+			setModuleFunc(L, preload, "template", "render", lua.LNil)
+		}
+		if !allowed("http") {
+			setModuleFunc(L, preload, "jwt", "verify", L.NewFunction(sandboxedJWTVerify))
+		}
+	}
+	if !allowed("require") {
+		// keep only the loader of package.preload
+		if loaders, ok := L.G.Registry.RawGetString("_LOADERS").(*lua.LTable); ok {
+			for i := loaders.Len(); i > 1; i-- {
+				loaders.RawSetInt(i, lua.LNil)
+			}
+		}
+	}
+}
+
+// setModuleFunc sets the function fn of the module name of preload once it is
+// loaded, if the module exists.
+func setModuleFunc(L *lua.LState, preload *lua.LTable, name, fn string, v lua.LValue) {
+	loader, ok := preload.RawGetString(name).(*lua.LFunction)
+	if !ok {
+		return
+	}
+	preload.RawSetString(name, L.NewFunction(func(L *lua.LState) int {
+		L.Push(loader)
+		L.Call(0, 1)
+		if mod, ok := L.Get(-1).(*lua.LTable); ok {
+			mod.RawSetString(fn, v)
+		}
+		return 1
+	}))
+}
+
+// sandboxedJWTVerify implements jwt.verify when the http feature is not
+// allowed, which refuses the JWKS URLs.
+func sandboxedJWTVerify(L *lua.LState) int {
+	if isJWKSURL(L.CheckString(2)) {
+		L.ArgError(2, "the JWKS URLs are disabled by the sandbox")
+	}
+	return jwtVerify(L)
+}
+
+// setLoaded sets the value of the module name in package.loaded, so that it
+// cannot be retrieved with require.
+func setLoaded(L *lua.LState, name string, v lua.LValue) {
+	if loaded, ok := L.G.Registry.RawGetString("_LOADED").(*lua.LTable); ok {
+		loaded.RawSetString(name, v)
+	}
+}
@@ -0,0 +1,75 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+// sandboxProbe is a script that writes the features of the sandbox that are
+// available, in the order of sandboxFeatures.
+const sandboxProbe = `
+	local function module(name)
+		return (pcall(require, name))
+	end
+	local template = require("template")
+	-- the http feature also covers the outbound requests of caddy.forward_auth
+	-- and jwt.verify, the unreachable key set is an error, not a refusal
+	local outbound = {
+		caddy.forward_auth ~= nil,
+		(pcall(require("jwt").verify, "x", "http://127.0.0.1:1/jwks")),
+	}
+	for _, ok in ipairs(outbound) do
+		assert(ok == module("http"), "the http feature is partially disabled")
+	end
+	local available = {
+		os = os.getenv ~= nil,
+		io = io ~= nil,
+		debug = debug ~= nil,
+		load = load ~= nil,
+		-- the loading of files is not probed
+		require = true,
+		handler = caddy.handler ~= nil,
+		socket = module("socket"),
+		http = module("http"),
+		storage = module("storage"),
+		db = module("db"),
+		redis = module("redis"),
+		dns = module("dns"),
+		fetch_local = caddy.fetch_local ~= nil and caddy.subrequest ~= nil,
+		serve_file = response.serve_file ~= nil,
+		template_files = template.render ~= nil,
+	}
+	assert(template.render_string ~= nil, "template.render_string is disabled")
+	local names = {}
+	for _, name in ipairs(FEATURES) do
+		if available[name] then table.insert(names, name) end
+	end
+	response:write(table.concat(names, " "))`
+
+func TestSandboxFeatures(t *testing.T) {
+	cases := []struct {
+		allow []string
+		want  string
+	}{
+		{nil, "require"},
+		{[]string{"socket", "storage", "http"}, "require socket http storage"},
+		{sandboxFeatures, strings.Join(sandboxFeatures, " ")},
+	}
+	for _, c := range cases {
+		tr, err := NewTester(&Lua{
+			Sandbox: &Sandbox{Allow: c.allow},
+			Script:  `FEATURES = {"` + strings.Join(sandboxFeatures, `", "`) + `"}` + sandboxProbe,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := tr.Do(TestRequest{})
+		tr.Close()
+		if res.Err != nil {
+			t.Fatalf("%v: %s", c.allow, res.Err)
+		}
+		if res.Body != c.want {
+			t.Errorf("%v: got %q, want %q", c.allow, res.Body, c.want)
+		}
+	}
+}
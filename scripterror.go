@@ -0,0 +1,149 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	lua "github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+)
+
+// statePanickedKey is the registry key set when a Go function called by a
+// script of the state panicked, in which case the state is not reused.
+const statePanickedKey = "caddy.panicked"
+
+// scriptError is the error of a script that failed at runtime.
+type scriptError struct {
+	msg       string
+	traceback string
+}
+
+func (e *scriptError) Error() string { return e.msg }
+
+// scriptFailed returns the error of the script at path that failed with err
+// while handling r. The runtime errors of the scripts are logged with their
+// traceback, and returned as handler errors with the error_status of the
+// handler (default 500). The errors of canceled requests, e.g. when the
+// client went away, are returned as is. The panics of the Go functions
+// called by the scripts, recovered by gopher-lua, are runtime errors whose
+// traceback has the Go stack.
+func (l *Lua) scriptFailed(r *http.Request, path string, err error) error {
+	var apiErr *lua.ApiError
+	if !errors.As(err, &apiErr) || r.Context().Err() != nil {
+		return err
+	}
+	if path == "" {
+		path = "<script>"
+	}
+	se := &scriptError{msg: apiErr.Object.String(), traceback: apiErr.StackTrace}
+	msg := "script failed"
+	if apiErr.Type == lua.ApiErrorPanic {
+		se.msg = "panic: " + se.msg
+		msg = "script panicked"
+	}
+	l.logger.Error(msg,
+		zap.String("path", path),
+		zap.String("error", se.msg),
+		zap.String("traceback", se.traceback))
+	if l.info != nil {
+		l.info.recordError(path, se)
+	}
+
+	status := l.ErrorStatus
+	if status == 0 {
+		status = http.StatusInternalServerError
+	}
+	return caddyhttp.Error(status, se)
+}
+
+// markPanicked records in L that a Go function called by its script
+// panicked, if err is such a panic.
+func markPanicked(L *lua.LState, err error) {
+	var apiErr *lua.ApiError
+	if errors.As(err, &apiErr) && apiErr.Type == lua.ApiErrorPanic {
+		L.G.Registry.RawSetString(statePanickedKey, lua.LTrue)
+	}
+}
+
+// statePanicked reports whether a Go function called by the scripts of L
+// panicked, which may have left L in an inconsistent state.
+func statePanicked(L *lua.LState) bool {
+	return L.G.Registry.RawGetString(statePanickedKey) == lua.LTrue
+}
+
+// recovered returns the error of the panic rcv of the handler while it
+// handled r, outside of the scripts, and logs it with its stack.
+func (l *Lua) recovered(r *http.Request, rcv interface{}) error {
+	l.logger.Error("handler panicked",
+		zap.String("uri", r.RequestURI),
+		zap.Any("panic", rcv),
+		zap.ByteString("stack", debug.Stack()))
+	return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("panic: %v", rcv))
+}
+
+// handleScriptError handles the error err of the scripts that handled r in
+// L. The error handler script of the handler runs first if it is set, and
+// the response header is not written yet. It receives a table with the
+// message, traceback (empty if err is not a runtime error) and status of
+// the error, and the path of the request, as first argument. It handles the
+// error if it writes the response, e.g. to render an error page, which has
+// the status of the error by default. Otherwise, or if it fails, err is
+// written by writeDebugError.
+func (l *Lua) handleScriptError(L *lua.LState, w http.ResponseWriter, r *http.Request, err error) error {
+	rc := checkRequestContext(L)
+	if l.ErrorHandlerPath == "" || rc.wroteHeader || r.Context().Err() != nil {
+		return l.writeDebugError(w, rc, err)
+	}
+
+	msg := err.Error()
+	var herr caddyhttp.HandlerError
+	if errors.As(err, &herr) && herr.Err != nil {
+		msg = herr.Err.Error()
+	}
+	t := L.CreateTable(0, 4)
+	t.RawSetString("message", lua.LString(msg))
+	var se *scriptError
+	if errors.As(err, &se) {
+		t.RawSetString("traceback", lua.LString(se.traceback))
+	} else {
+		t.RawSetString("traceback", lua.LString(""))
+	}
+	t.RawSetString("status", lua.LNumber(errorStatus(err)))
+	t.RawSetString("path", lua.LString(r.URL.Path))
+
+	// the error handler decides of the response, sent with the status of
+	// the error unless it sets another one.
+	rc.status = errorStatus(err)
+	rc.responded = false
+	if _, hErr := l.runScript(L, r, l.ErrorHandlerPath, t); hErr != nil {
+		l.logger.Error("running the error handler script",
+			zap.String("path", l.ErrorHandlerPath), zap.Error(hErr))
+		return l.writeDebugError(w, rc, err)
+	}
+	if !rc.responded {
+		return l.writeDebugError(w, rc, err)
+	}
+	rc.writeHeader()
+	return nil
+}
+
+// writeDebugError writes the message and traceback of err to w if it is the
+// error of a script, debug is enabled and the response header is not written
+// yet, in which case it returns nil. Otherwise it returns err.
+func (l *Lua) writeDebugError(w http.ResponseWriter, rc *requestContext, err error) error {
+	var se *scriptError
+	if !l.Debug || rc.wroteHeader || !errors.As(err, &se) {
+		return err
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Del("Content-Length")
+	w.WriteHeader(errorStatus(err))
+	rc.wroteHeader = true
+	_, err = w.Write([]byte(se.msg + "\n\n" + se.traceback + "\n"))
+	return err
+}
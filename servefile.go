@@ -0,0 +1,89 @@
+package lua
+
+import (
+	"errors"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// responseServeFile implements response:serve_file(path[, opts]), which
+// responds with the file at path under the handler's file_root, streamed
+// from the disk, so that the scripts can gate the downloads without reading
+// the files in memory. It uses http.ServeContent, so it supports the range
+// requests and the conditional requests (with the If-Modified-Since header,
+// or If-None-Match if the script set the ETag header), and detects the
+// content type from the extension or the content of the file. The options
+// are:
+//
+//	content_type: the Content-Type of the response, instead of detecting it
+//	download: true or a file name, to send the file as an attachment to
+//	save, with the base name of path or the file name
+//
+// The path is relative to file_root, and cannot escape it. It returns true
+// once the file is sent, or nil and an error message if the file cannot be
+// opened, e.g. if it does not exist, in which case the script can respond
+// with a 404 status. The headers set by the script are sent, but not the
+// status, which is set by http.ServeContent.
+func responseServeFile(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	name := L.CheckString(2)
+	opts := L.OptTable(3, L.NewTable())
+	if rc.headerPhase {
+		L.RaiseError("response:serve_file: the response cannot be written by the header script")
+	}
+	if rc.wroteHeader {
+		L.RaiseError("response:serve_file: the response header is already written")
+	}
+	root := rc.handler.FileRoot
+	if root == "" {
+		L.RaiseError("response:serve_file: the handler has no file_root")
+	}
+
+	name = path.Clean("/" + name)
+	f, err := os.Open(filepath.Join(root, filepath.FromSlash(name)))
+	if err != nil {
+		// the error names the file relative to the root
+		var pe *fs.PathError
+		if errors.As(err, &pe) {
+			pe.Path = name
+		}
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err == nil && fi.IsDir() {
+		err = errors.New(name + " is a directory")
+	}
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	h := rc.w.Header()
+	if ct := lua.LVAsString(opts.RawGetString("content_type")); ct != "" {
+		h.Set("Content-Type", ct)
+	}
+	switch v := opts.RawGetString("download").(type) {
+	case lua.LString:
+		h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": string(v)}))
+	case lua.LBool:
+		if v {
+			h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(name)}))
+		}
+	}
+
+	rc.wroteHeader = true
+	rc.responded = true
+	unlocked(L, func() { http.ServeContent(rc.w, rc.r, fi.Name(), fi.ModTime(), f) })
+	L.Push(lua.LTrue)
+	return 1
+}
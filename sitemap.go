@@ -0,0 +1,261 @@
+package lua
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	sitemapTypeName = "caddy.sitemap"
+
+	// maxSitemapURLs is the maximum number of URLs in a sitemap, as defined
+	// by the sitemaps protocol.
+	maxSitemapURLs = 50000
+
+	sitemapXMLNS = "http://www.sitemaps.org/schemas/sitemap/0.9"
+)
+
+// sitemapURL is a url entry of a sitemap.
+type sitemapURL struct {
+	Loc        string `xml:"loc"`
+	LastMod    string `xml:"lastmod,omitempty"`
+	ChangeFreq string `xml:"changefreq,omitempty"`
+	Priority   string `xml:"priority,omitempty"`
+}
+
+// sitemap accumulates the URLs of a sitemap, split in pages of at most
+// maxURLs entries.
+type sitemap struct {
+	maxURLs int
+	urls    []sitemapURL
+}
+
+// pages returns the number of pages of the sitemap, at least 1.
+func (sm *sitemap) pages() int {
+	if len(sm.urls) == 0 {
+		return 1
+	}
+	return (len(sm.urls) + sm.maxURLs - 1) / sm.maxURLs
+}
+
+// xml returns the urlset document of the 1-based page.
+func (sm *sitemap) xml(page int) ([]byte, error) {
+	start := (page - 1) * sm.maxURLs
+	end := start + sm.maxURLs
+	if end > len(sm.urls) {
+		end = len(sm.urls)
+	}
+	doc := struct {
+		XMLName xml.Name     `xml:"urlset"`
+		XMLNS   string       `xml:"xmlns,attr"`
+		URLs    []sitemapURL `xml:"url"`
+	}{XMLNS: sitemapXMLNS, URLs: sm.urls[start:end]}
+	return marshalXMLDoc(doc)
+}
+
+// index returns the sitemapindex document that references all pages, their
+// URL being locFormat with %d replaced by the page number.
+func (sm *sitemap) index(locFormat string) ([]byte, error) {
+	type entry struct {
+		Loc string `xml:"loc"`
+	}
+	doc := struct {
+		XMLName  xml.Name `xml:"sitemapindex"`
+		XMLNS    string   `xml:"xmlns,attr"`
+		Sitemaps []entry  `xml:"sitemap"`
+	}{XMLNS: sitemapXMLNS}
+	for i := 1; i <= sm.pages(); i++ {
+		doc.Sitemaps = append(doc.Sitemaps, entry{Loc: strings.ReplaceAll(locFormat, "%d", strconv.Itoa(i))})
+	}
+	return marshalXMLDoc(doc)
+}
+
+func marshalXMLDoc(doc interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+var sitemapFuncs = map[string]lua.LGFunction{
+	"new": sitemapNew,
+}
+
+var sitemapMethods = map[string]lua.LGFunction{
+	"add":   sitemapAdd,
+	"count": sitemapCount,
+	"pages": sitemapPages,
+	"xml":   sitemapXML,
+	"index": sitemapIndex,
+}
+
+// openSitemapType registers the metatable of the sitemap userdata in L.
+func openSitemapType(L *lua.LState) {
+	mt := L.NewTypeMetatable(sitemapTypeName)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), sitemapMethods))
+}
+
+func checkSitemap(L *lua.LState) *sitemap {
+	ud := L.CheckUserData(1)
+	sm, ok := ud.Value.(*sitemap)
+	if !ok {
+		L.ArgError(1, "sitemap expected")
+	}
+	return sm
+}
+
+// sitemapNew implements caddy.sitemap.new([max_urls]), which returns an
+// empty sitemap split in pages of max_urls entries (50000 by default, the
+// maximum allowed).
+func sitemapNew(L *lua.LState) int {
+	n := L.OptInt(1, maxSitemapURLs)
+	if n < 1 || n > maxSitemapURLs {
+		L.ArgError(1, fmt.Sprintf("max_urls must be between 1 and %d", maxSitemapURLs))
+	}
+	ud := L.NewUserData()
+	ud.Value = &sitemap{maxURLs: n}
+	L.SetMetatable(ud, L.GetTypeMetatable(sitemapTypeName))
+	L.Push(ud)
+	return 1
+}
+
+// sitemapAdd implements sitemap:add(url[, lastmod[, changefreq[, priority]]]).
+// The lastmod is either a string in the W3C datetime format or a Unix
+// timestamp.
+func sitemapAdd(L *lua.LState) int {
+	sm := checkSitemap(L)
+	u := sitemapURL{Loc: L.CheckString(2)}
+	switch v := L.Get(3).(type) {
+	case lua.LNumber:
+		u.LastMod = time.Unix(int64(v), 0).UTC().Format(time.RFC3339)
+	case lua.LString:
+		u.LastMod = string(v)
+	case *lua.LNilType:
+	default:
+		L.ArgError(3, "string or number expected")
+	}
+	u.ChangeFreq = L.OptString(4, "")
+	if L.Get(5) != lua.LNil {
+		p := float64(L.CheckNumber(5))
+		if p < 0 || p > 1 {
+			L.ArgError(5, "priority must be between 0 and 1")
+		}
+		u.Priority = strconv.FormatFloat(p, 'f', -1, 64)
+	}
+	sm.urls = append(sm.urls, u)
+	return 0
+}
+
+// sitemapCount implements sitemap:count(), the number of URLs added.
+func sitemapCount(L *lua.LState) int {
+	L.Push(lua.LNumber(len(checkSitemap(L).urls)))
+	return 1
+}
+
+// sitemapPages implements sitemap:pages(), the number of pages.
+func sitemapPages(L *lua.LState) int {
+	L.Push(lua.LNumber(checkSitemap(L).pages()))
+	return 1
+}
+
+// sitemapXML implements sitemap:xml([page]), which returns the XML document
+// of the 1-based page (1 by default).
+func sitemapXML(L *lua.LState) int {
+	sm := checkSitemap(L)
+	page := L.OptInt(2, 1)
+	if page < 1 || page > sm.pages() {
+		L.ArgError(2, fmt.Sprintf("page must be between 1 and %d", sm.pages()))
+	}
+	b, err := sm.xml(page)
+	if err != nil {
+		L.RaiseError("caddy.sitemap: %s", err)
+	}
+	L.Push(lua.LString(b))
+	return 1
+}
+
+// sitemapIndex implements sitemap:index(loc_format), which returns the XML
+// sitemap index of all pages, loc_format being the URL of the pages with %d
+// standing for the page number (e.g. "https://example.com/sitemap-%d.xml").
+func sitemapIndex(L *lua.LState) int {
+	sm := checkSitemap(L)
+	b, err := sm.index(L.CheckString(2))
+	if err != nil {
+		L.RaiseError("caddy.sitemap: %s", err)
+	}
+	L.Push(lua.LString(b))
+	return 1
+}
+
+// caddyRobots implements caddy.robots(rules), which returns a robots.txt
+// document. The array part of rules holds the groups, tables with a
+// user_agent (string or array of strings, "*" by default), and allow and
+// disallow arrays of paths and an optional crawl_delay in seconds. Its
+// sitemaps field is an optional array of sitemap URLs.
+func caddyRobots(L *lua.LState) int {
+	rules := L.CheckTable(1)
+	var sb strings.Builder
+
+	for i := 1; i <= rules.Len(); i++ {
+		g, ok := rules.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			L.ArgError(1, fmt.Sprintf("group %d: table expected", i))
+		}
+		if i > 1 {
+			sb.WriteByte('\n')
+		}
+		agents := stringList(g.RawGetString("user_agent"))
+		if len(agents) == 0 {
+			agents = []string{"*"}
+		}
+		for _, ua := range agents {
+			fmt.Fprintf(&sb, "User-agent: %s\n", ua)
+		}
+		for _, p := range stringList(g.RawGetString("allow")) {
+			fmt.Fprintf(&sb, "Allow: %s\n", p)
+		}
+		for _, p := range stringList(g.RawGetString("disallow")) {
+			fmt.Fprintf(&sb, "Disallow: %s\n", p)
+		}
+		if n, ok := g.RawGetString("crawl_delay").(lua.LNumber); ok {
+			fmt.Fprintf(&sb, "Crawl-delay: %s\n", n)
+		}
+	}
+
+	sitemaps := stringList(rules.RawGetString("sitemaps"))
+	if len(sitemaps) > 0 && sb.Len() > 0 {
+		sb.WriteByte('\n')
+	}
+	for _, u := range sitemaps {
+		fmt.Fprintf(&sb, "Sitemap: %s\n", u)
+	}
+	L.Push(lua.LString(sb.String()))
+	return 1
+}
+
+// stringList returns v as a list of strings, v being either a string or an
+// array of strings. Line breaks are removed from the strings.
+func stringList(v lua.LValue) []string {
+	clean := strings.NewReplacer("\r", "", "\n", "").Replace
+	switch v := v.(type) {
+	case lua.LString:
+		return []string{clean(string(v))}
+	case *lua.LTable:
+		list := make([]string, 0, v.Len())
+		for i := 1; i <= v.Len(); i++ {
+			list = append(list, clean(lua.LVAsString(v.RawGetInt(i))))
+		}
+		return list
+	}
+	return nil
+}
@@ -0,0 +1,370 @@
+package lua
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	socketTypeName = "caddy.socket"
+
+	defaultSocketTimeout = 5 * time.Second
+
+	// maxSocketReadSize is the maximum size of the data returned by
+	// sock:receive, so that a server cannot make the script read an
+	// unbounded amount of data in memory.
+	maxSocketReadSize = 10 << 20
+
+	// maxDatagramSize is the size of the buffer of the UDP datagrams.
+	maxDatagramSize = 64 << 10
+)
+
+var errSocketClosed = errors.New("closed")
+
+// preloadSocketModule registers the socket module, loaded by scripts with
+// require("socket"), which opens TCP and UDP connections to speak custom
+// protocols to backends (e.g. memcached or statsd):
+//
+//	socket.tcp(host, port[, opts]): connects to the TCP server, with TLS if
+//	opts.tls is true (opts.server_name sets the server name, the host by
+//	default)
+//	socket.udp(host, port[, opts]): returns a socket sending datagrams to
+//	host and port, and receiving the datagrams it replies
+//
+// Both return the socket, or nil and an error message. The opts table
+// supports timeout, the timeout in seconds of the connection and of each
+// operation (default 5s). The socket has the methods:
+//
+//	sock:send(data): sends data (a datagram for UDP), and returns the number
+//	of bytes sent
+//	sock:receive([pattern]): receives a line without its end of line with
+//	"*l" (the default of TCP sockets), all the data until the server closes
+//	the connection with "*a", or n bytes with a number n. UDP sockets
+//	receive a datagram.
+//	sock:receive_until(delim): receives the data up to delim, which is not
+//	returned
+//	sock:settimeout(seconds): sets the timeout of the next operations
+//	sock:close()
+//
+// The methods return nil and an error message on failure ("timeout" if the
+// operation took too long, "closed" if the connection is closed), and
+// sock:receive and sock:receive_until also return the data received before
+// the failure. The operations only block the script, and fail if the
+// request is canceled. The data received is limited to 10MB per operation,
+// and the sockets that remain open are closed once the request is handled.
+func preloadSocketModule(L *lua.LState) {
+	mt := L.NewTypeMetatable(socketTypeName)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), socketMethods))
+
+	L.PreloadModule("socket", func(L *lua.LState) int {
+		L.Push(L.SetFuncs(L.NewTable(), socketFuncs))
+		return 1
+	})
+}
+
+var socketFuncs = map[string]lua.LGFunction{
+	"tcp": socketDial("tcp"),
+	"udp": socketDial("udp"),
+}
+
+var socketMethods = map[string]lua.LGFunction{
+	"send":          socketSend,
+	"receive":       socketReceive,
+	"receive_until": socketReceiveUntil,
+	"settimeout":    socketSetTimeout,
+	"close":         socketClose,
+}
+
+// luaSocket is a connection opened by a script.
+type luaSocket struct {
+	network string
+	conn    net.Conn
+	br      *bufio.Reader
+	timeout time.Duration
+	closed  bool
+}
+
+// socketDial returns the function that opens the sockets of network.
+func socketDial(network string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		rc := checkRequestContext(L)
+		host := L.CheckString(1)
+		port := L.CheckInt(2)
+		opts := L.OptTable(3, L.NewTable())
+
+		timeout := defaultSocketTimeout
+		if v, ok := opts.RawGetString("timeout").(lua.LNumber); ok && v > 0 {
+			timeout = time.Duration(float64(v) * float64(time.Second))
+		}
+		ctx := checkContext(L)
+
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		dialCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		useTLS := network == "tcp" && lua.LVAsBool(opts.RawGetString("tls"))
+		serverName := lua.LVAsString(opts.RawGetString("server_name"))
+		if serverName == "" {
+			serverName = host
+		}
+		var conn net.Conn
+		var err error
+		unlocked(L, func() {
+			var d net.Dialer
+			conn, err = d.DialContext(dialCtx, network, addr)
+			if err == nil && useTLS {
+				tc := tls.Client(conn, &tls.Config{ServerName: serverName})
+				if err = tc.HandshakeContext(dialCtx); err != nil {
+					conn.Close()
+				}
+				conn = tc
+			}
+		})
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(socketErrorMessage(err)))
+			return 2
+		}
+
+		sock := &luaSocket{
+			network: network,
+			conn:    conn,
+			br:      bufio.NewReader(conn),
+			timeout: timeout,
+		}
+		rc.sockets = append(rc.sockets, sock)
+		ud := L.NewUserData()
+		ud.Value = sock
+		L.SetMetatable(ud, L.GetTypeMetatable(socketTypeName))
+		L.Push(ud)
+		return 1
+	}
+}
+
+// do runs the operation op on the socket within its timeout, interrupting
+// it if the script of L is canceled. The other requests of the shared state
+// of L run while op blocks.
+func (s *luaSocket) do(L *lua.LState, op func() error) error {
+	ctx := checkContext(L)
+	if s.closed {
+		return errSocketClosed
+	}
+	if err := s.conn.SetDeadline(time.Now().Add(s.timeout)); err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// unblock the operation
+			s.conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	var err error
+	unlocked(L, func() { err = op() })
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (s *luaSocket) close() {
+	if !s.closed {
+		s.closed = true
+		s.conn.Close()
+	}
+}
+
+// closeSockets closes the sockets opened by the script that remain open.
+func (rc *requestContext) closeSockets() {
+	for _, s := range rc.sockets {
+		s.close()
+	}
+	rc.sockets = nil
+}
+
+// socketErrorMessage returns the message of err returned to the scripts.
+func socketErrorMessage(err error) string {
+	var ne net.Error
+	switch {
+	case errors.As(err, &ne) && ne.Timeout(), errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed), errors.Is(err, errSocketClosed):
+		return "closed"
+	}
+	return err.Error()
+}
+
+func checkSocket(L *lua.LState) *luaSocket {
+	if s, ok := L.CheckUserData(1).Value.(*luaSocket); ok {
+		return s
+	}
+	L.ArgError(1, "socket expected")
+	return nil
+}
+
+// pushSocketError pushes nil, the message of err and, if partial is not
+// nil, the data received before err.
+func pushSocketError(L *lua.LState, err error, partial []byte) int {
+	L.Push(lua.LNil)
+	L.Push(lua.LString(socketErrorMessage(err)))
+	if partial == nil {
+		return 2
+	}
+	L.Push(lua.LString(partial))
+	return 3
+}
+
+// socketSend implements sock:send(data).
+func socketSend(L *lua.LState) int {
+	s := checkSocket(L)
+	data := L.CheckString(2)
+	var n int
+	err := s.do(L, func() (err error) {
+		n, err = io.WriteString(s.conn, data)
+		return err
+	})
+	if err != nil {
+		return pushSocketError(L, err, nil)
+	}
+	L.Push(lua.LNumber(n))
+	return 1
+}
+
+// socketReceive implements sock:receive([pattern]).
+func socketReceive(L *lua.LState) int {
+	s := checkSocket(L)
+	if s.network == "udp" {
+		buf := make([]byte, maxDatagramSize)
+		var n int
+		err := s.do(L, func() (err error) {
+			n, err = s.conn.Read(buf)
+			return err
+		})
+		if err != nil {
+			return pushSocketError(L, err, nil)
+		}
+		L.Push(lua.LString(buf[:n]))
+		return 1
+	}
+
+	var data []byte
+	var err error
+	switch pattern := L.Get(2).(type) {
+	case *lua.LNilType:
+		data, err = s.readUntil(L, []byte("\n"), true)
+	case lua.LNumber:
+		n := int(pattern)
+		if n < 0 || n > maxSocketReadSize {
+			L.ArgError(2, "invalid number of bytes")
+		}
+		data = make([]byte, n)
+		var read int
+		err = s.do(L, func() (err error) {
+			read, err = io.ReadFull(s.br, data)
+			return err
+		})
+		data = data[:read]
+	case lua.LString:
+		switch pattern {
+		case "*l":
+			data, err = s.readUntil(L, []byte("\n"), true)
+		case "*a":
+			err = s.do(L, func() (err error) {
+				data, err = io.ReadAll(io.LimitReader(s.br, maxSocketReadSize+1))
+				return err
+			})
+			if err == nil && len(data) > maxSocketReadSize {
+				err = fmt.Errorf("more than %d bytes received", maxSocketReadSize)
+			}
+		default:
+			L.ArgError(2, `"*l", "*a" or a number expected`)
+		}
+	default:
+		L.ArgError(2, `"*l", "*a" or a number expected`)
+	}
+	if err != nil {
+		return pushSocketError(L, err, data)
+	}
+	L.Push(lua.LString(data))
+	return 1
+}
+
+// socketReceiveUntil implements sock:receive_until(delim).
+func socketReceiveUntil(L *lua.LState) int {
+	s := checkSocket(L)
+	delim := L.CheckString(2)
+	if delim == "" {
+		L.ArgError(2, "the delimiter must not be empty")
+	}
+	if s.network == "udp" {
+		L.RaiseError("sock:receive_until: not supported by UDP sockets")
+	}
+	data, err := s.readUntil(L, []byte(delim), false)
+	if err != nil {
+		return pushSocketError(L, err, data)
+	}
+	L.Push(lua.LString(data))
+	return 1
+}
+
+// readUntil reads the data up to delim, and returns it without delim, and
+// without a trailing "\r" if line is set.
+func (s *luaSocket) readUntil(L *lua.LState, delim []byte, line bool) ([]byte, error) {
+	var data []byte
+	err := s.do(L, func() error {
+		last := delim[len(delim)-1]
+		for {
+			b, err := s.br.ReadSlice(last)
+			data = append(data, b...)
+			if len(data) > maxSocketReadSize {
+				return fmt.Errorf("more than %d bytes received", maxSocketReadSize)
+			}
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if bytes.HasSuffix(data, delim) {
+				return nil
+			}
+		}
+	})
+	if err != nil {
+		return data, err
+	}
+	data = data[:len(data)-len(delim)]
+	if line {
+		data = bytes.TrimSuffix(data, []byte("\r"))
+	}
+	return data, nil
+}
+
+// socketSetTimeout implements sock:settimeout(seconds).
+func socketSetTimeout(L *lua.LState) int {
+	s := checkSocket(L)
+	secs := float64(L.CheckNumber(2))
+	if secs <= 0 {
+		L.ArgError(2, "the timeout must be positive")
+	}
+	s.timeout = time.Duration(secs * float64(time.Second))
+	return 0
+}
+
+// socketClose implements sock:close().
+func socketClose(L *lua.LState) int {
+	checkSocket(L).close()
+	return 0
+}
@@ -0,0 +1,210 @@
+package lua
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const sseTypeName = "caddy.sse"
+
+// openSSEType registers the type of the Server-Sent Events streams.
+func openSSEType(L *lua.LState) {
+	mt := L.NewTypeMetatable(sseTypeName)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), sseMethods))
+}
+
+var sseMethods = map[string]lua.LGFunction{
+	"send":      sseSend,
+	"keepalive": sseKeepalive,
+}
+
+// sseStream is the Server-Sent Events stream of a response. Its writes are
+// serialized, as the keepalive comments are written by another goroutine.
+type sseStream struct {
+	mu   sync.Mutex
+	w    http.ResponseWriter
+	stop chan struct{}
+}
+
+// write writes p to the stream and flushes it, unless stop is closed.
+func (s *sseStream) write(p string, stop <-chan struct{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-stop:
+		return nil
+	default:
+	}
+	if _, err := s.w.Write([]byte(p)); err != nil {
+		return err
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// keepalive writes a comment to the stream every interval until it is
+// stopped, done is closed or a write fails. A zero interval only stops the
+// previous keepalive.
+func (s *sseStream) keepalive(interval time.Duration, done <-chan struct{}) {
+	s.stopKeepalive()
+	if interval <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	s.stop = stop
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := s.write(":\n\n", stop); err != nil {
+					return
+				}
+			case <-stop:
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// stopKeepalive stops the keepalive of the stream if it has one. Nothing
+// is written by the keepalive once it returns.
+func (s *sseStream) stopKeepalive() {
+	if s.stop == nil {
+		return
+	}
+	s.mu.Lock()
+	close(s.stop)
+	s.mu.Unlock()
+	s.stop = nil
+}
+
+// stopSSE stops the keepalive of the Server-Sent Events stream of the
+// response if it has one, so that nothing is written once the handler
+// returned.
+func (rc *requestContext) stopSSE() {
+	if rc.sse != nil {
+		rc.sse.stopKeepalive()
+	}
+}
+
+// responseSSE implements response:sse(), which starts a Server-Sent Events
+// stream: the response header is written with the text/event-stream
+// content type, and the stream is returned with the methods:
+//
+//	stream:send(event, data[, id]): sends an event, flushed immediately.
+//	event is the type of the event, or nil for the default "message" type;
+//	data is a string, sent as one data line per line, or a table encoded as
+//	JSON. Returns true, or nil and an error message (e.g. once the client
+//	went away).
+//	stream:keepalive(interval): sends a comment every interval seconds
+//	while the script runs, so that the proxies do not close an idle
+//	stream; 0 stops it
+//
+// Calling it again returns the same stream. The response must not be
+// written with response:write while a keepalive is running.
+func responseSSE(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	if rc.headerPhase {
+		L.RaiseError("response:sse: the response cannot be written by the header script")
+	}
+	if rc.sse == nil {
+		if rc.wroteHeader {
+			L.RaiseError("response:sse: the response header is already written")
+		}
+		h := rc.w.Header()
+		h.Set("Content-Type", "text/event-stream")
+		h.Set("Cache-Control", "no-cache")
+		// disables the buffering of nginx-like proxies
+		h.Set("X-Accel-Buffering", "no")
+		h.Del("Content-Length")
+		rc.writeHeader()
+		rc.sse = &sseStream{w: rc.w}
+		if f, ok := rc.w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	ud := L.NewUserData()
+	ud.Value = rc.sse
+	L.SetMetatable(ud, L.GetTypeMetatable(sseTypeName))
+	L.Push(ud)
+	return 1
+}
+
+func checkSSEStream(L *lua.LState) *sseStream {
+	if s, ok := L.CheckUserData(1).Value.(*sseStream); ok {
+		return s
+	}
+	L.ArgError(1, "sse stream expected")
+	return nil
+}
+
+// sseSend implements stream:send(event, data[, id]).
+func sseSend(L *lua.LState) int {
+	s := checkSSEStream(L)
+	event := L.OptString(2, "")
+	id := L.OptString(4, "")
+
+	var data string
+	switch v := L.CheckAny(3).(type) {
+	case *lua.LTable:
+		gv, err := toGo(v)
+		if err != nil {
+			L.ArgError(3, err.Error())
+		}
+		b, err := json.Marshal(gv)
+		if err != nil {
+			L.ArgError(3, err.Error())
+		}
+		data = string(b)
+	case lua.LString, lua.LNumber:
+		data = v.String()
+	default:
+		L.ArgError(3, "string or table expected")
+	}
+	if strings.ContainsAny(event+id, "\r\n") {
+		L.ArgError(2, "the event and id must not contain line breaks")
+	}
+
+	var b strings.Builder
+	if id != "" {
+		fmt.Fprintf(&b, "id: %s\n", id)
+	}
+	if event != "" {
+		fmt.Fprintf(&b, "event: %s\n", event)
+	}
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteByte('\n')
+
+	if err := s.write(b.String(), nil); err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// sseKeepalive implements stream:keepalive(interval).
+func sseKeepalive(L *lua.LState) int {
+	s := checkSSEStream(L)
+	rc := checkRequestContext(L)
+	interval := time.Duration(float64(L.CheckNumber(2)) * float64(time.Second))
+	s.keepalive(interval, rc.r.Context().Done())
+	return 0
+}
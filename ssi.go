@@ -0,0 +1,458 @@
+package lua
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// ssiErrorMessage is output in place of a directive that fails.
+const ssiErrorMessage = "[an error occurred while processing this directive]"
+
+// SSI configures the processing of server-side includes in the responses
+// of the next handler. Responses with one of the configured Types (text/html
+// by default, with support for a trailing * wildcard) and without a
+// Content-Encoding are buffered and the following directives are processed:
+//
+//	<!--#include virtual="/path" -->   include the response of a local
+//	                                   request to /path (or file="path")
+//	<!--#echo var="name" [encoding="entity|url|none"] -->
+//	<!--#set var="name" value="text" -->
+//	<!--#if expr="..." --> <!--#elif expr="..." --> <!--#else --> <!--#endif -->
+//
+// Includes are resolved via internal requests through the server's routes,
+// relative to the path of the request. Variables are those set with the set
+// directive, then those returned by the global Lua function Function (called
+// with the variable's name, nil meaning unset), then DOCUMENT_URI and
+// QUERY_STRING. In values and expressions, $name and ${name} are replaced by
+// the variable's value. An expression is either a string, true if not
+// empty, or two strings compared with = or !=, and may be negated with !.
+type SSI struct {
+	Types    []string `json:"types,omitempty"`
+	Function string   `json:"function,omitempty"`
+}
+
+// unmarshalCaddyfile sets up the SSI processing from the block's tokens.
+func (s *SSI) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch field := d.Val(); field {
+		case "types":
+			s.Types = append(s.Types, d.RemainingArgs()...)
+			if len(s.Types) == 0 {
+				return d.Errf("ssi %s: %w", field, d.ArgErr())
+			}
+
+		case "function":
+			if !d.Args(&s.Function) || d.NextArg() {
+				return d.Errf("ssi %s: %w", field, d.ArgErr())
+			}
+
+		default:
+			return d.Errf("ssi %s: unknown configuration option", field)
+		}
+	}
+	return nil
+}
+
+// ssiWriter buffers the response body written to it and processes its
+// server-side includes once it is complete.
+type ssiWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	cfg *SSI
+	L   *lua.LState
+	r   *http.Request
+
+	wroteHeader bool
+	active      bool
+	status      int
+	buf         bytes.Buffer
+	vars        map[string]string
+}
+
+func newSSIWriter(w http.ResponseWriter, r *http.Request, cfg *SSI, L *lua.LState) *ssiWriter {
+	return &ssiWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		cfg:                   cfg,
+		L:                     L,
+		r:                     r,
+		vars:                  make(map[string]string),
+	}
+}
+
+// WriteHeader implements http.ResponseWriter. The header of processed
+// responses is only written when the body is complete.
+func (sw *ssiWriter) WriteHeader(status int) {
+	if sw.wroteHeader {
+		return
+	}
+	sw.wroteHeader = true
+
+	h := sw.Header()
+	sw.active = status != http.StatusNoContent && status != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" && contentTypeMatches(h.Get("Content-Type"), sw.cfg.Types, "text/html")
+	if !sw.active {
+		sw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	sw.status = status
+	h.Del("Content-Length")
+	h.Del("Etag")
+	h.Del("Last-Modified")
+	h.Del("Accept-Ranges")
+}
+
+// Write implements http.ResponseWriter.
+func (sw *ssiWriter) Write(p []byte) (int, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	if !sw.active {
+		return sw.ResponseWriter.Write(p)
+	}
+	return sw.buf.Write(p)
+}
+
+// Flush implements http.Flusher. Processed responses are only flushed when
+// the body is complete.
+func (sw *ssiWriter) Flush() {
+	if !sw.active {
+		sw.ResponseWriterWrapper.Flush()
+	}
+}
+
+// finish processes the buffered body and writes the response.
+func (sw *ssiWriter) finish() error {
+	if !sw.active {
+		return nil
+	}
+	out, err := sw.process(sw.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	sw.ResponseWriter.WriteHeader(sw.status)
+	_, err = sw.ResponseWriter.Write(out)
+	return err
+}
+
+// ssiCond is the state of an if directive.
+type ssiCond struct {
+	parent bool // the enclosing block is output
+	taken  bool // a branch of the if was taken
+	active bool // the current branch is output
+}
+
+// process returns src with its directives processed.
+func (sw *ssiWriter) process(src []byte) ([]byte, error) {
+	var (
+		out   bytes.Buffer
+		conds []ssiCond
+	)
+	emitting := func() bool {
+		return len(conds) == 0 || conds[len(conds)-1].active
+	}
+
+	for {
+		start := bytes.Index(src, []byte("<!--#"))
+		if start < 0 {
+			break
+		}
+		end := bytes.Index(src[start:], []byte("-->"))
+		if end < 0 {
+			break
+		}
+		if emitting() {
+			out.Write(src[:start])
+		}
+		directive := string(src[start+len("<!--#") : start+end])
+		src = src[start+end+len("-->"):]
+
+		name, attrs, ok := parseSSIDirective(directive)
+		if !ok {
+			if emitting() {
+				out.WriteString(ssiErrorMessage)
+			}
+			continue
+		}
+
+		switch name {
+		case "if":
+			cond := ssiCond{parent: emitting()}
+			if cond.parent {
+				v, err := sw.eval(attrs["expr"])
+				if err != nil {
+					return nil, err
+				}
+				cond.active, cond.taken = v, v
+			}
+			conds = append(conds, cond)
+			continue
+
+		case "elif", "else":
+			if len(conds) == 0 {
+				out.WriteString(ssiErrorMessage)
+				continue
+			}
+			cond := &conds[len(conds)-1]
+			cond.active = false
+			if cond.parent && !cond.taken {
+				v := true
+				if name == "elif" {
+					var err error
+					if v, err = sw.eval(attrs["expr"]); err != nil {
+						return nil, err
+					}
+				}
+				cond.active, cond.taken = v, v
+			}
+			continue
+
+		case "endif":
+			if len(conds) == 0 {
+				out.WriteString(ssiErrorMessage)
+				continue
+			}
+			conds = conds[:len(conds)-1]
+			continue
+		}
+
+		if !emitting() {
+			continue
+		}
+		s, err := sw.execute(name, attrs)
+		if err != nil {
+			return nil, err
+		}
+		out.WriteString(s)
+	}
+	if emitting() {
+		out.Write(src)
+	}
+	return out.Bytes(), nil
+}
+
+// execute runs the include, echo or set directive and returns its output.
+func (sw *ssiWriter) execute(name string, attrs map[string]string) (string, error) {
+	switch name {
+	case "include":
+		uri := attrs["virtual"]
+		if uri == "" {
+			uri = attrs["file"]
+		}
+		if uri == "" {
+			return ssiErrorMessage, nil
+		}
+		if !strings.HasPrefix(uri, "/") {
+			uri = path.Join(path.Dir(sw.r.URL.Path), uri)
+		}
+		resp, err := fetchLocal(sw.r, fetchOptions{uri: uri})
+		if err != nil || resp.statusCode() >= 400 {
+			return ssiErrorMessage, nil
+		}
+		return resp.body.String(), nil
+
+	case "echo":
+		v, ok, err := sw.lookup(attrs["var"])
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			v = "(none)"
+		}
+		switch attrs["encoding"] {
+		case "", "entity":
+			return html.EscapeString(v), nil
+		case "url":
+			return url.QueryEscape(v), nil
+		case "none":
+			return v, nil
+		}
+		return ssiErrorMessage, nil
+
+	case "set":
+		if attrs["var"] == "" {
+			return ssiErrorMessage, nil
+		}
+		v, err := sw.substitute(attrs["value"])
+		if err != nil {
+			return "", err
+		}
+		sw.vars[attrs["var"]] = v
+		return "", nil
+	}
+	return ssiErrorMessage, nil
+}
+
+// lookup returns the value of the variable name and whether it is set.
+func (sw *ssiWriter) lookup(name string) (string, bool, error) {
+	if v, ok := sw.vars[name]; ok {
+		return v, true, nil
+	}
+	if sw.cfg.Function != "" {
+		defer enterState(sw.L)()
+		fn, ok := sw.L.GetGlobal(sw.cfg.Function).(*lua.LFunction)
+		if !ok {
+			return "", false, fmt.Errorf("ssi: %s is not a function", sw.cfg.Function)
+		}
+		if err := sw.L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, lua.LString(name)); err != nil {
+			return "", false, fmt.Errorf("ssi: %w", err)
+		}
+		ret := sw.L.Get(-1)
+		sw.L.Pop(1)
+		if ret != lua.LNil {
+			return lua.LVAsString(ret), true, nil
+		}
+	}
+	switch name {
+	case "DOCUMENT_URI":
+		return sw.r.URL.Path, true, nil
+	case "QUERY_STRING":
+		return sw.r.URL.RawQuery, true, nil
+	}
+	return "", false, nil
+}
+
+// substitute replaces the $name and ${name} variables in s by their value,
+// unset variables being replaced by the empty string. A backslash escapes a
+// dollar sign.
+func (sw *ssiWriter) substitute(s string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) && s[i+1] == '$' {
+			sb.WriteByte('$')
+			i++
+			continue
+		}
+		if c != '$' {
+			sb.WriteByte(c)
+			continue
+		}
+
+		var name string
+		if i+1 < len(s) && s[i+1] == '{' {
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				sb.WriteString(s[i:])
+				break
+			}
+			name = s[i+2 : i+end]
+			i += end
+		} else {
+			j := i + 1
+			for j < len(s) && isSSIVarChar(s[j]) {
+				j++
+			}
+			name = s[i+1 : j]
+			i = j - 1
+		}
+		if name == "" {
+			sb.WriteByte('$')
+			continue
+		}
+		v, _, err := sw.lookup(name)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(v)
+	}
+	return sb.String(), nil
+}
+
+func isSSIVarChar(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+// eval evaluates the expression of an if or elif directive.
+func (sw *ssiWriter) eval(expr string) (bool, error) {
+	expr = strings.TrimSpace(expr)
+	negate := strings.HasPrefix(expr, "!")
+	if negate {
+		expr = strings.TrimSpace(expr[1:])
+	}
+
+	var v bool
+	if left, right, op := splitSSIComparison(expr); op != "" {
+		l, err := sw.substitute(unquoteSSI(left))
+		if err != nil {
+			return false, err
+		}
+		r, err := sw.substitute(unquoteSSI(right))
+		if err != nil {
+			return false, err
+		}
+		v = (l == r) == (op == "=")
+	} else {
+		s, err := sw.substitute(unquoteSSI(expr))
+		if err != nil {
+			return false, err
+		}
+		v = s != ""
+	}
+	return v != negate, nil
+}
+
+// splitSSIComparison splits expr around its = or != operator, returning an
+// empty op if it is not a comparison.
+func splitSSIComparison(expr string) (left, right, op string) {
+	if i := strings.Index(expr, "!="); i >= 0 {
+		return strings.TrimSpace(expr[:i]), strings.TrimSpace(expr[i+2:]), "!="
+	}
+	if i := strings.Index(expr, "="); i >= 0 {
+		return strings.TrimSpace(expr[:i]), strings.TrimSpace(expr[i+1:]), "="
+	}
+	return "", "", ""
+}
+
+// unquoteSSI removes the single quotes around s, if any.
+func unquoteSSI(s string) string {
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// parseSSIDirective parses the name and attributes of a directive, e.g.
+// `include virtual="/footer.html" `.
+func parseSSIDirective(s string) (name string, attrs map[string]string, ok bool) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexAny(s, " \t\r\n")
+	if i < 0 {
+		return s, nil, s != ""
+	}
+	name, s = s[:i], s[i:]
+
+	attrs = make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if s == "" {
+			return name, attrs, true
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 || eq+1 >= len(s) {
+			return "", nil, false
+		}
+		key, q := strings.TrimSpace(s[:eq]), s[eq+1]
+		if q != '"' && q != '\'' {
+			return "", nil, false
+		}
+		end := strings.IndexByte(s[eq+2:], q)
+		if end < 0 {
+			return "", nil, false
+		}
+		attrs[key] = s[eq+2 : eq+2+end]
+		s = s[eq+2+end+1:]
+	}
+}
+
+// interface guards
+var (
+	_ caddyhttp.HTTPInterfaces = (*ssiWriter)(nil)
+)
@@ -0,0 +1,197 @@
+package lua
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// requestContextKey is the registry key under which the requestContext of
+// the request being handled is stored.
+const requestContextKey = "caddy.request_context"
+
+// backgroundHandlerKey is the registry key under which the handler of the
+// states that run outside of the requests is stored.
+const backgroundHandlerKey = "caddy.background_handler"
+
+// requestContext is the per-request data available to the Go functions
+// exposed to Lua scripts.
+type requestContext struct {
+	w       http.ResponseWriter
+	r       *http.Request
+	handler *Lua
+	next    caddyhttp.Handler
+
+	// responded is set when a function wrote the response on behalf of the
+	// script, in which case the next handler is not called.
+	responded bool
+
+	// status is the status code set by the script, written with the
+	// response header once wroteHeader is set.
+	status      int
+	wroteHeader bool
+
+	// calledNext is set once the script called the next handler.
+	calledNext bool
+
+	// headerPhase is set while the header script runs, which cannot write
+	// the response.
+	headerPhase bool
+
+	healthChecks []healthCheck
+	jwtClaims    map[string]interface{}
+	headerCase   []string
+	body         []byte
+
+	// tenant is the request of the tenant of the handler's Quota, if any.
+	tenant *tenantRequest
+
+	// sse is set once the script started a Server-Sent Events stream.
+	sse *sseStream
+
+	// sockets are the sockets opened by the script, closed once the request
+	// is handled.
+	sockets []*luaSocket
+
+	// uploads are the uploads spooled by the script, whose temporary files
+	// are removed once the request is handled.
+	uploads []*upload
+
+	// cacheRecorder is set when the response is recorded to be cached, in
+	// which case it is also w.
+	cacheRecorder *cacheRecorder
+}
+
+// newState returns a Lua state with the Caddy libraries loaded and bound to
+// the request, taken from the handler's pool if it has one, or a coroutine
+// of its shared state in the shared_coroutine isolation mode. It must be
+// released with releaseState once the request is handled.
+func (l *Lua) newState(w http.ResponseWriter, r *http.Request) *lua.LState {
+	var L *lua.LState
+	switch {
+	case l.pool != nil:
+		L = l.pool.get()
+	case l.sharedState != nil:
+		L = l.sharedState.acquire()
+	default:
+		L = l.newBaseState()
+	}
+	setRequestContext(L, &requestContext{w: w, r: r, handler: l})
+	return L
+}
+
+// releaseState returns L to the handler's pool or to its shared state, or
+// closes it if the handler has neither. The states in which a Go function
+// panicked are not reused.
+func (l *Lua) releaseState(L *lua.LState) {
+	panicked := statePanicked(L)
+	switch {
+	case l.pool != nil && !panicked:
+		l.pool.put(L)
+	case l.sharedState != nil:
+		l.sharedState.release(L, panicked)
+	default:
+		L.Close()
+	}
+}
+
+// stateOptions returns the options of the handler's Lua states. The sizes
+// that are not set default to the ones of gopher-lua. The Go stack is added
+// to the traceback of the panics of the Go functions.
+func (l *Lua) stateOptions() lua.Options {
+	return lua.Options{
+		CallStackSize:       l.CallStackSize,
+		RegistrySize:        l.RegistrySize,
+		RegistryMaxSize:     l.RegistryMaxSize,
+		RegistryGrowStep:    l.RegistryGrowStep,
+		MinimizeStackMemory: l.MinimizeStackMemory,
+		IncludeGoStackTrace: true,
+	}
+}
+
+// newBaseState returns a new Lua state with the Caddy libraries loaded, and
+// the handler's sandbox applied.
+func (l *Lua) newBaseState() *lua.LState {
+	L := lua.NewState(l.stateOptions())
+	openCaddyLib(L)
+	openRequestLib(L)
+	openResponseLib(L)
+	preloadJSONModule(L)
+	preloadHTTPModule(L)
+	preloadKVModule(L)
+	preloadRateLimitModule(L)
+	preloadRedisModule(L)
+	preloadDBModule(L)
+	preloadTemplateModule(L)
+	preloadJWTModule(L)
+	preloadCryptoModule(L)
+	preloadMetricsModule(L)
+	preloadSocketModule(L)
+	preloadTimerModule(L)
+	preloadStorageModule(L)
+	preloadTraceModule(L)
+	preloadRegexpModule(L)
+	preloadAuthModule(L)
+	preloadDNSModule(L)
+	preloadCompressModule(L)
+	preloadUtilModule(L)
+	preloadNgxModule(L)
+	l.setPackagePath(L)
+	l.setRequireLoader(L)
+	l.setConfigTable(L)
+	l.setInitGlobals(L)
+	if l.Sandbox != nil {
+		l.Sandbox.apply(L)
+	}
+	return L
+}
+
+// setRequestContext binds rc to L.
+func setRequestContext(L *lua.LState, rc *requestContext) {
+	ud := L.NewUserData()
+	ud.Value = rc
+	L.G.Registry.RawSetString(requestContextKey, ud)
+}
+
+// setBackgroundHandler binds the handler l to L, a state that runs scripts
+// outside of the requests (e.g. the timers' states), so that the modules
+// that use the handler's resources, such as redis and db, are available.
+func setBackgroundHandler(L *lua.LState, l *Lua) {
+	ud := L.NewUserData()
+	ud.Value = l
+	L.G.Registry.RawSetString(backgroundHandlerKey, ud)
+}
+
+// checkHandler returns the handler of the request bound to L, or the
+// background handler of L, raising a Lua error if there is neither.
+func checkHandler(L *lua.LState) *Lua {
+	if ud, ok := L.G.Registry.RawGetString(backgroundHandlerKey).(*lua.LUserData); ok {
+		if l, ok := ud.Value.(*Lua); ok {
+			return l
+		}
+	}
+	return checkRequestContext(L).handler
+}
+
+// checkContext returns the context of the script running in L: the context
+// of L, or the context of the request if L has none.
+func checkContext(L *lua.LState) context.Context {
+	if ctx := stateContext(L); ctx != nil {
+		return ctx
+	}
+	return checkRequestContext(L).r.Context()
+}
+
+// checkRequestContext returns the requestContext bound to L, raising a Lua
+// error if there is none (e.g. outside of a request).
+func checkRequestContext(L *lua.LState) *requestContext {
+	if ud, ok := L.G.Registry.RawGetString(requestContextKey).(*lua.LUserData); ok {
+		if rc, ok := ud.Value.(*requestContext); ok {
+			return rc
+		}
+	}
+	L.RaiseError("no request is being handled")
+	return nil
+}
@@ -0,0 +1,85 @@
+package lua
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestStateOptionsCaddyfile(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`lua {
+		call_stack_size 64
+		registry_size 512
+		registry_max_size 4096
+		registry_grow_step 16
+		minimize_stack_memory
+	}`)
+	var l Lua
+	if err := l.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	got := l.stateOptions()
+	want := lua.Options{
+		CallStackSize:       64,
+		RegistrySize:        512,
+		RegistryMaxSize:     4096,
+		RegistryGrowStep:    16,
+		MinimizeStackMemory: true,
+		IncludeGoStackTrace: true,
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	d = caddyfile.NewTestDispenser(`lua {
+		minimize_stack_memory true
+	}`)
+	if err := new(Lua).UnmarshalCaddyfile(d); err == nil {
+		t.Error("minimize_stack_memory: got no error with an argument")
+	}
+}
+
+func TestStateOptionsApplied(t *testing.T) {
+	const script = `
+		local function depth(n)
+			if n == 0 then return 0 end
+			return 1 + depth(n - 1)
+		end
+		local t = {}
+		for i = 1, 4000 do t[i] = i end
+		response:write(tostring(pcall(depth, 100)) .. " " .. tostring(pcall(table.unpack or unpack, t)))`
+
+	cases := []struct {
+		name string
+		l    Lua
+		want string
+	}{
+		{"defaults", Lua{}, "true true"},
+		{"call_stack_size", Lua{CallStackSize: 50}, "false true"},
+		{"registry_max_size", Lua{RegistrySize: 1024, RegistryMaxSize: 2048}, "true false"},
+		{"registry_grow_step", Lua{RegistrySize: 1024, RegistryMaxSize: 8192, RegistryGrowStep: 64}, "true true"},
+		{"minimize_stack_memory", Lua{CallStackSize: 50, MinimizeStackMemory: true}, "false true"},
+	}
+	for _, isolation := range []string{isolationPerRequest, isolationPooled, isolationSharedCoroutine} {
+		for _, c := range cases {
+			l := c.l
+			l.Isolation = isolation
+			l.Script = script
+			tr, err := NewTester(&l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// twice, for the states that are reused
+			for i := 0; i < 2; i++ {
+				res := tr.Do(TestRequest{})
+				if res.Err != nil {
+					t.Errorf("%s %s: %s", isolation, c.name, res.Err)
+				} else if res.Body != c.want {
+					t.Errorf("%s %s: got %q, want %q", isolation, c.name, res.Body, c.want)
+				}
+			}
+			tr.Close()
+		}
+	}
+}
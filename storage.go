@@ -0,0 +1,208 @@
+package lua
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/caddyserver/certmagic"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// storagePrefix is the prefix of the keys of the storage module in Caddy's
+// storage, which keeps the scripts away from the certificates and the
+// keyrings.
+const storagePrefix = "lua/storage/"
+
+// preloadStorageModule registers the storage module, loaded by scripts with
+// require("storage"). It gives access to the storage configured for Caddy
+// (the file system by default, or e.g. Redis or S3 with a storage module),
+// for state that is durable and, with a shared storage, shared by the
+// instances of a cluster:
+//
+//	storage.get(key): the value of key, or nil if it does not exist
+//	storage.set(key, value): stores the string value under key
+//	storage.delete(key): deletes key
+//	storage.exists(key): true if key exists
+//	storage.list(prefix[, recursive]): the array of the keys under prefix,
+//	and of the keys under those if recursive is true
+//	storage.stat(key): a table with the key, size, modified (a Unix
+//	timestamp) and terminal (false for keys that contain other keys)
+//	storage.with_lock(key, fn, args...): calls fn with args while holding
+//	the lock of key, shared by all the instances using the storage, and
+//	returns its results
+//
+// The keys are paths separated by "/" and are namespaced to the lua/storage
+// prefix of the storage. The functions return nil and an error message on
+// failure, except with_lock which raises the errors of fn once the lock is
+// released. They wait for the storage within the request's context.
+func preloadStorageModule(L *lua.LState) {
+	L.PreloadModule("storage", func(L *lua.LState) int {
+		L.Push(L.SetFuncs(L.NewTable(), storageFuncs))
+		return 1
+	})
+}
+
+var storageFuncs = map[string]lua.LGFunction{
+	"get":       storageGet,
+	"set":       storageSet,
+	"delete":    storageDelete,
+	"exists":    storageExists,
+	"list":      storageList,
+	"stat":      storageStat,
+	"with_lock": storageWithLock,
+}
+
+// checkStorageKey returns the storage key of the key at index n of the
+// stack, raising an argument error if it is invalid.
+func checkStorageKey(L *lua.LState, n int) string {
+	key := L.CheckString(n)
+	clean := path.Clean("/" + key)
+	if key == "" || clean != "/"+strings.TrimSuffix(key, "/") {
+		L.ArgError(n, "invalid key")
+	}
+	return storagePrefix + clean[1:]
+}
+
+// pushStorageError pushes nil and the message of err.
+func pushStorageError(L *lua.LState, err error) int {
+	L.Push(lua.LNil)
+	L.Push(lua.LString(err.Error()))
+	return 2
+}
+
+// storageGet implements storage.get(key).
+func storageGet(L *lua.LState) int {
+	l := checkHandler(L)
+	ctx, key := checkContext(L), checkStorageKey(L, 1)
+	var b []byte
+	var err error
+	unlocked(L, func() { b, err = l.storage.Load(ctx, key) })
+	if errors.Is(err, fs.ErrNotExist) {
+		L.Push(lua.LNil)
+		return 1
+	}
+	if err != nil {
+		return pushStorageError(L, err)
+	}
+	L.Push(lua.LString(b))
+	return 1
+}
+
+// storageSet implements storage.set(key, value).
+func storageSet(L *lua.LState) int {
+	l := checkHandler(L)
+	ctx, key, value := checkContext(L), checkStorageKey(L, 1), []byte(L.CheckString(2))
+	var err error
+	unlocked(L, func() { err = l.storage.Store(ctx, key, value) })
+	if err != nil {
+		return pushStorageError(L, err)
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// storageDelete implements storage.delete(key).
+func storageDelete(L *lua.LState) int {
+	l := checkHandler(L)
+	ctx, key := checkContext(L), checkStorageKey(L, 1)
+	var err error
+	unlocked(L, func() { err = l.storage.Delete(ctx, key) })
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return pushStorageError(L, err)
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// storageExists implements storage.exists(key).
+func storageExists(L *lua.LState) int {
+	l := checkHandler(L)
+	ctx, key := checkContext(L), checkStorageKey(L, 1)
+	var exists bool
+	unlocked(L, func() { exists = l.storage.Exists(ctx, key) })
+	L.Push(lua.LBool(exists))
+	return 1
+}
+
+// storageList implements storage.list(prefix[, recursive]).
+func storageList(L *lua.LState) int {
+	l := checkHandler(L)
+	prefix := storagePrefix
+	if L.CheckString(1) != "" {
+		prefix = checkStorageKey(L, 1)
+	}
+	ctx, recursive := checkContext(L), L.OptBool(2, false)
+	var keys []string
+	var err error
+	unlocked(L, func() { keys, err = l.storage.List(ctx, strings.TrimSuffix(prefix, "/"), recursive) })
+	if errors.Is(err, fs.ErrNotExist) {
+		keys, err = nil, nil
+	}
+	if err != nil {
+		return pushStorageError(L, err)
+	}
+	for i, k := range keys {
+		keys[i] = strings.TrimPrefix(k, storagePrefix)
+	}
+	L.Push(stringArray(L, keys))
+	return 1
+}
+
+// storageStat implements storage.stat(key).
+func storageStat(L *lua.LState) int {
+	l := checkHandler(L)
+	ctx, key := checkContext(L), checkStorageKey(L, 1)
+	var info certmagic.KeyInfo
+	var err error
+	unlocked(L, func() { info, err = l.storage.Stat(ctx, key) })
+	if err != nil {
+		return pushStorageError(L, err)
+	}
+	t := L.CreateTable(0, 4)
+	t.RawSetString("key", lua.LString(strings.TrimPrefix(info.Key, storagePrefix)))
+	t.RawSetString("size", lua.LNumber(info.Size))
+	t.RawSetString("modified", lua.LNumber(info.Modified.Unix()))
+	t.RawSetString("terminal", lua.LBool(info.IsTerminal))
+	L.Push(t)
+	return 1
+}
+
+// storageWithLock implements storage.with_lock(key, fn, args...).
+func storageWithLock(L *lua.LState) int {
+	l := checkHandler(L)
+	key := checkStorageKey(L, 1)
+	fn := L.CheckFunction(2)
+	ctx := checkContext(L)
+	var lerr error
+	unlocked(L, func() { lerr = l.storage.Lock(ctx, key) })
+	if lerr != nil {
+		return pushStorageError(L, lerr)
+	}
+
+	args := make([]lua.LValue, 0, L.GetTop()-2)
+	for i := 3; i <= L.GetTop(); i++ {
+		args = append(args, L.Get(i))
+	}
+	top := L.GetTop()
+	L.Push(fn)
+	for _, arg := range args {
+		L.Push(arg)
+	}
+	err := L.PCall(len(args), lua.MultRet, nil)
+	// unlock even if the request is canceled, so that the lock is not held
+	// until it expires
+	if uerr := l.storage.Unlock(context.Background(), key); uerr != nil && err == nil {
+		L.SetTop(top)
+		return pushStorageError(L, uerr)
+	}
+	if err != nil {
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			L.Error(apiErr.Object, 0)
+		}
+		L.RaiseError("%s", err)
+	}
+	return L.GetTop() - top
+}
@@ -0,0 +1,256 @@
+package lua
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// SubFilter configures the substitution of strings in the response bodies
+// of the next handler. The body is filtered as it is streamed, only holding
+// back as many bytes as needed to match the longest string. Only responses
+// with one of the configured Types (text/html by default, with support for
+// a trailing * wildcard, e.g. text/*) and without a Content-Encoding are
+// filtered. The Accept-Encoding and Range headers of the request are removed
+// so that the next handler sends uncompressed, full responses.
+type SubFilter struct {
+	Types []string        `json:"types,omitempty"`
+	Rules []SubFilterRule `json:"rules,omitempty"`
+}
+
+// SubFilterRule replaces the occurrences of Find with Replace, or with the
+// string returned by the global Lua function Function, which is called with
+// the matched string. When several rules match at the same position, the
+// first one wins.
+type SubFilterRule struct {
+	Find     string `json:"find,omitempty"`
+	Replace  string `json:"replace,omitempty"`
+	Function string `json:"function,omitempty"`
+}
+
+// validate returns an error if the sub filter configuration is invalid.
+func (sf *SubFilter) validate() error {
+	if len(sf.Rules) == 0 {
+		return fmt.Errorf("sub_filter: at least one rule is required")
+	}
+	for i, rule := range sf.Rules {
+		if rule.Find == "" {
+			return fmt.Errorf("sub_filter rule %d: the find string is required", i)
+		}
+		if rule.Replace != "" && rule.Function != "" {
+			return fmt.Errorf("sub_filter rule %d: replace and function are mutually exclusive", i)
+		}
+	}
+	return nil
+}
+
+// unmarshalCaddyfile sets up the sub filter from the block's tokens.
+func (sf *SubFilter) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch field := d.Val(); field {
+		case "types":
+			sf.Types = append(sf.Types, d.RemainingArgs()...)
+			if len(sf.Types) == 0 {
+				return d.Errf("sub_filter %s: %w", field, d.ArgErr())
+			}
+
+		case "replace":
+			var rule SubFilterRule
+			if !d.Args(&rule.Find, &rule.Replace) || d.NextArg() {
+				return d.Errf("sub_filter %s: %w", field, d.ArgErr())
+			}
+			sf.Rules = append(sf.Rules, rule)
+
+		case "call":
+			var rule SubFilterRule
+			if !d.Args(&rule.Find, &rule.Function) || d.NextArg() {
+				return d.Errf("sub_filter %s: %w", field, d.ArgErr())
+			}
+			sf.Rules = append(sf.Rules, rule)
+
+		default:
+			return d.Errf("sub_filter %s: unknown configuration option", field)
+		}
+	}
+	return nil
+}
+
+// matchesType returns true if the response with header h must be filtered.
+func (sf *SubFilter) matchesType(h http.Header) bool {
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	return contentTypeMatches(h.Get("Content-Type"), sf.Types, "text/html")
+}
+
+// contentTypeMatches returns true if the media type of contentType is one of
+// types, which may end with a * wildcard. If types is empty, def is used.
+func contentTypeMatches(contentType string, types []string, def string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if len(types) == 0 {
+		types = []string{def}
+	}
+	for _, t := range types {
+		if t == mt || (strings.HasSuffix(t, "*") && strings.HasPrefix(mt, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// subFilterWriter applies a SubFilter to the response body written to it.
+type subFilterWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	filter *SubFilter
+	L      *lua.LState
+	fns    []*lua.LFunction
+	maxLen int
+
+	wroteHeader bool
+	active      bool
+	tail        []byte
+	err         error
+}
+
+// newSubFilterWriter returns a writer that filters the body written to w
+// through the rules of sf, resolving the rules' functions in L.
+func newSubFilterWriter(w http.ResponseWriter, sf *SubFilter, L *lua.LState) (*subFilterWriter, error) {
+	sw := &subFilterWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		filter:                sf,
+		L:                     L,
+		fns:                   make([]*lua.LFunction, len(sf.Rules)),
+	}
+	for i, rule := range sf.Rules {
+		if len(rule.Find) > sw.maxLen {
+			sw.maxLen = len(rule.Find)
+		}
+		if rule.Function == "" {
+			continue
+		}
+		fn, ok := L.GetGlobal(rule.Function).(*lua.LFunction)
+		if !ok {
+			return nil, fmt.Errorf("sub_filter: %s is not a function", rule.Function)
+		}
+		sw.fns[i] = fn
+	}
+	return sw, nil
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (sw *subFilterWriter) WriteHeader(status int) {
+	if sw.wroteHeader {
+		return
+	}
+	sw.wroteHeader = true
+	sw.active = status != http.StatusNoContent && status != http.StatusNotModified &&
+		sw.filter.matchesType(sw.Header())
+	if sw.active {
+		sw.Header().Del("Content-Length")
+		sw.Header().Del("Etag")
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter.
+func (sw *subFilterWriter) Write(p []byte) (int, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	if !sw.active {
+		return sw.ResponseWriter.Write(p)
+	}
+	if sw.err != nil {
+		return 0, sw.err
+	}
+
+	data := append(sw.tail, p...)
+	out, rest, err := sw.substitute(data)
+	if err != nil {
+		sw.err = err
+		return 0, err
+	}
+
+	// hold back the bytes that may be the start of a match
+	keep := sw.maxLen - 1
+	if keep > len(rest) {
+		keep = len(rest)
+	}
+	out = append(out, rest[:len(rest)-keep]...)
+	sw.tail = append([]byte(nil), rest[len(rest)-keep:]...)
+
+	if _, err := sw.ResponseWriter.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// substitute replaces all matches in data and returns the substituted
+// output along with the remaining data after the last match.
+func (sw *subFilterWriter) substitute(data []byte) (out, rest []byte, err error) {
+	for {
+		idx, rule := -1, -1
+		for i, r := range sw.filter.Rules {
+			if j := bytes.Index(data, []byte(r.Find)); j >= 0 && (idx < 0 || j < idx) {
+				idx, rule = j, i
+			}
+		}
+		if idx < 0 {
+			return out, data, nil
+		}
+
+		repl, err := sw.replacement(rule)
+		if err != nil {
+			return nil, nil, err
+		}
+		out = append(out, data[:idx]...)
+		out = append(out, repl...)
+		data = data[idx+len(sw.filter.Rules[rule].Find):]
+	}
+}
+
+// replacement returns the replacement string of the rule at index i.
+func (sw *subFilterWriter) replacement(i int) (string, error) {
+	rule := sw.filter.Rules[i]
+	fn := sw.fns[i]
+	if fn == nil {
+		return rule.Replace, nil
+	}
+	defer enterState(sw.L)()
+	if err := sw.L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, lua.LString(rule.Find)); err != nil {
+		return "", fmt.Errorf("sub_filter: %w", err)
+	}
+	ret := sw.L.Get(-1)
+	sw.L.Pop(1)
+	if ret == lua.LNil {
+		return "", nil
+	}
+	return ret.String(), nil
+}
+
+// finish writes the data held back at the end of the body.
+func (sw *subFilterWriter) finish() error {
+	if sw.err != nil {
+		return sw.err
+	}
+	if !sw.active || len(sw.tail) == 0 {
+		return nil
+	}
+	_, err := sw.ResponseWriter.Write(sw.tail)
+	sw.tail = nil
+	return err
+}
+
+// interface guards
+var (
+	_ caddyhttp.HTTPInterfaces = (*subFilterWriter)(nil)
+)
@@ -0,0 +1,624 @@
+package lua
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template/parse"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	lua "github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+)
+
+const (
+	// luaTemplateExt is the extension of the files rendered as Lua
+	// templates, the others are rendered as Go html/template templates.
+	luaTemplateExt = ".etlua"
+
+	// maxTemplateDepth is the maximum depth of the layouts and partials of a
+	// template, which stops the cycles.
+	maxTemplateDepth = 16
+)
+
+// preloadTemplateModule registers the template module, loaded by scripts
+// with require("template"), which renders templates with a data table:
+//
+//	template.render(name, data): renders the template file name, relative
+//	to the handler's template_root
+//	template.render_string(src, data[, engine]): renders the template src,
+//	with the "go" (default) or "lua" engine
+//
+// Both return the rendered string, or nil and an error message. The files
+// with the .etlua extension are Lua templates, where <%= expr %> outputs the
+// HTML-escaped value of expr, <%- expr %> outputs it unescaped and <% code %>
+// runs Lua code, with the fields of data available as globals. The other
+// files are Go html/template templates, executed with the data table
+// converted to a map (e.g. {{.title}}). The template files are parsed once,
+// and parsed again when their modification time changes, or when the
+// handler's watch option sees a change under the template_root.
+//
+// The template files can extend a layout and include partials, which are
+// other template files of the same root, and of the same engine for the
+// layouts. A Go template extends a layout with {{extends "layout.html"}} as
+// its first action, and overrides the {{block}} actions of the layout with
+// its {{define}} actions; the rest of its content is ignored. It includes a
+// partial with {{partial "name.html" [data]}}, which renders the partial
+// with data, the data of the template by default, and can only include Go
+// templates. A Lua template extends a layout by calling
+// extends("layout.etlua") and defines its blocks with
+// block(name, function() ... end), which outputs the block of the template
+// that extends it if there is one, or the content of the function:
+//
+//	<% extends("layout.etlua") %>
+//	<% block("content", function() %><p><%= message %></p><% end) %>
+//
+// It includes a partial with <%- partial("name.etlua"[, data]) %>. The
+// templates of render_string can use blocks, but not layouts and partials.
+func preloadTemplateModule(L *lua.LState) {
+	L.PreloadModule("template", func(L *lua.LState) int {
+		L.Push(L.SetFuncs(L.NewTable(), templateFuncs))
+		return 1
+	})
+}
+
+var templateFuncs = map[string]lua.LGFunction{
+	"render":        templateRender,
+	"render_string": templateRenderString,
+}
+
+// templateRender implements template.render(name, data).
+func templateRender(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	name := L.CheckString(1)
+	data := L.OptTable(2, L.NewTable())
+	if rc.handler.templates == nil {
+		L.RaiseError("template.render: no template_root is configured")
+	}
+
+	tmpl, err := rc.handler.templates.get(name)
+	if err != nil {
+		return pushTemplateError(L, err)
+	}
+	s, err := tmpl.render(L, data, rc.handler.templates)
+	if err != nil {
+		return pushTemplateError(L, err)
+	}
+	L.Push(lua.LString(s))
+	return 1
+}
+
+// templateRenderString implements template.render_string(src, data[, engine]).
+func templateRenderString(L *lua.LState) int {
+	src := L.CheckString(1)
+	data := L.OptTable(2, L.NewTable())
+
+	var tmpl *parsedTemplate
+	var err error
+	switch engine := L.OptString(3, "go"); engine {
+	case "go":
+		tmpl, err = parseGoTemplate("template", src)
+	case "lua":
+		tmpl, err = parseLuaTemplate("template", src)
+	default:
+		L.ArgError(3, `engine must be "go" or "lua"`)
+	}
+	if err != nil {
+		return pushTemplateError(L, err)
+	}
+	// the templates of strings cannot read the template files
+	s, err := tmpl.render(L, data, nil)
+	if err != nil {
+		return pushTemplateError(L, err)
+	}
+	L.Push(lua.LString(s))
+	return 1
+}
+
+func pushTemplateError(L *lua.LState, err error) int {
+	L.Push(lua.LNil)
+	L.Push(lua.LString(err.Error()))
+	return 2
+}
+
+// parsedTemplate is a Go or Lua template ready to be rendered. The Go
+// templates are not executed, but their clones are, so that they can be
+// combined with their layouts.
+type parsedTemplate struct {
+	name   string
+	goTmpl *template.Template
+	proto  *lua.FunctionProto
+
+	// extends is the name of the layout of a Go template.
+	extends string
+}
+
+var errNoTemplateFiles = errors.New("layouts and partials require a template file rendered by template.render")
+
+// goTemplateFuncs are the functions of the Go templates when they are
+// parsed. The partial function is replaced when they are rendered.
+var goTemplateFuncs = template.FuncMap{
+	"extends": func(string) string { return "" },
+	"partial": func(string, ...interface{}) (template.HTML, error) { return "", errNoTemplateFiles },
+}
+
+// render renders the template with data. The layouts and the partials are
+// loaded from tc, nil if the template is not a file.
+func (t *parsedTemplate) render(L *lua.LState, data *lua.LTable, tc *templateCache) (string, error) {
+	r := &templateRenderer{L: L, tc: tc}
+	return r.render(t, data, 0)
+}
+
+// templateRenderer renders templates with their layouts and partials.
+type templateRenderer struct {
+	L  *lua.LState
+	tc *templateCache
+}
+
+// load returns the template file name, included at depth.
+func (r *templateRenderer) load(name string, depth int) (*parsedTemplate, error) {
+	if r.tc == nil {
+		return nil, errNoTemplateFiles
+	}
+	if depth > maxTemplateDepth {
+		return nil, fmt.Errorf("%s: more than %d nested layouts and partials", name, maxTemplateDepth)
+	}
+	return r.tc.get(name)
+}
+
+// render renders t with data at depth.
+func (r *templateRenderer) render(t *parsedTemplate, data *lua.LTable, depth int) (string, error) {
+	if t.goTmpl == nil {
+		return r.renderLua(t, data, depth)
+	}
+	v, err := toGo(data)
+	if err != nil {
+		return "", err
+	}
+	if s, ok := v.([]interface{}); ok && len(s) == 0 {
+		v = map[string]interface{}{}
+	}
+	return r.renderGo(t, v, depth)
+}
+
+// renderGo renders the Go template t with its layouts. The layout at the
+// root of the chain is executed, with the templates defined by the
+// templates that extend it.
+func (r *templateRenderer) renderGo(t *parsedTemplate, data interface{}, depth int) (string, error) {
+	chain := []*parsedTemplate{t}
+	for p := t; p.extends != ""; {
+		parent, err := r.load(p.extends, depth+len(chain))
+		if err != nil {
+			return "", err
+		}
+		if parent.goTmpl == nil {
+			return "", fmt.Errorf("%s: the layout %s is not a Go template", p.name, p.extends)
+		}
+		chain = append(chain, parent)
+		p = parent
+	}
+	tmpl, err := chain[len(chain)-1].goTmpl.Clone()
+	if err != nil {
+		return "", err
+	}
+	for i := len(chain) - 2; i >= 0; i-- {
+		for _, def := range chain[i].goTmpl.Templates() {
+			if def.Name() == chain[i].goTmpl.Name() || def.Tree == nil {
+				continue
+			}
+			// the trees are copied since they are modified when escaped
+			if _, err := tmpl.AddParseTree(def.Name(), def.Tree.Copy()); err != nil {
+				return "", err
+			}
+		}
+	}
+	tmpl.Funcs(template.FuncMap{
+		"partial": func(name string, args ...interface{}) (template.HTML, error) {
+			p, err := r.load(name, depth+1)
+			if err != nil {
+				return "", err
+			}
+			if p.goTmpl == nil {
+				return "", fmt.Errorf("partial %s: a Go template can only include Go templates", name)
+			}
+			pdata := data
+			if len(args) > 0 {
+				pdata = args[0]
+			}
+			s, err := r.renderGo(p, pdata, depth+1)
+			// the partial is escaped when it is rendered
+			return template.HTML(s), err
+		},
+	})
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// renderLua renders the Lua template t with its layouts.
+func (r *templateRenderer) renderLua(t *parsedTemplate, data *lua.LTable, depth int) (string, error) {
+	L := r.L
+	lr := &luaTemplateRender{templateRenderer: r, data: data, depth: depth, blocks: make(map[string]string)}
+
+	// the fields of data are the globals of the template, which falls back
+	// to the globals of the state.
+	env := L.NewTable()
+	data.ForEach(func(k, v lua.LValue) { env.RawSet(k, v) })
+	env.RawSetString("block", L.NewFunction(lr.block))
+	env.RawSetString("extends", L.NewFunction(lr.extends))
+	env.RawSetString("partial", L.NewFunction(lr.partial))
+	mt := L.NewTable()
+	mt.RawSetString("__index", L.G.Global)
+	L.SetMetatable(env, mt)
+
+	s, err := lr.run(t, env)
+	// the blocks of the template are rendered by its layouts
+	for err == nil && lr.layout != "" {
+		name := lr.layout
+		lr.layout = ""
+		lr.depth++
+		var layout *parsedTemplate
+		if layout, err = r.load(name, lr.depth); err != nil {
+			break
+		}
+		if layout.proto == nil {
+			return "", fmt.Errorf("%s: the layout %s is not a Lua template", t.name, name)
+		}
+		s, err = lr.run(layout, env)
+	}
+	if err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+// luaTemplateRender is the rendering of a Lua template, whose layouts share
+// its blocks.
+type luaTemplateRender struct {
+	*templateRenderer
+	data  *lua.LTable
+	depth int
+
+	// bufs are the outputs of the template and of the blocks being rendered.
+	bufs   []*strings.Builder
+	blocks map[string]string
+	layout string
+}
+
+// run runs the template t with env and returns its output.
+func (lr *luaTemplateRender) run(t *parsedTemplate, env *lua.LTable) (string, error) {
+	L := lr.L
+	n := len(lr.bufs)
+	lr.bufs = append(lr.bufs, new(strings.Builder))
+	defer func() { lr.bufs = lr.bufs[:n] }()
+
+	fn := L.NewFunctionFromProto(t.proto)
+	fn.Env = env
+	if err := L.CallByParam(lua.P{Fn: fn, NRet: 0, Protect: true}, L.NewFunction(templateEscape), L.NewFunction(lr.write)); err != nil {
+		return "", err
+	}
+	return lr.bufs[n].String(), nil
+}
+
+// write is the function called by the Lua templates to output a string.
+func (lr *luaTemplateRender) write(L *lua.LState) int {
+	lr.bufs[len(lr.bufs)-1].WriteString(L.ToStringMeta(L.Get(1)).String())
+	return 0
+}
+
+// block implements block(name[, fn]) of the Lua templates.
+func (lr *luaTemplateRender) block(L *lua.LState) int {
+	name := L.CheckString(1)
+	fn := L.OptFunction(2, nil)
+	s, ok := lr.blocks[name]
+	if !ok && fn != nil {
+		n := len(lr.bufs)
+		lr.bufs = append(lr.bufs, new(strings.Builder))
+		L.Push(fn)
+		L.Call(0, 0)
+		s = lr.bufs[n].String()
+		lr.bufs = lr.bufs[:n]
+		lr.blocks[name] = s
+	}
+	lr.bufs[len(lr.bufs)-1].WriteString(s)
+	return 0
+}
+
+// extends implements extends(name) of the Lua templates.
+func (lr *luaTemplateRender) extends(L *lua.LState) int {
+	lr.layout = L.CheckString(1)
+	return 0
+}
+
+// partial implements partial(name[, data]) of the Lua templates.
+func (lr *luaTemplateRender) partial(L *lua.LState) int {
+	name := L.CheckString(1)
+	data := L.OptTable(2, lr.data)
+	p, err := lr.load(name, lr.depth+1)
+	if err != nil {
+		L.RaiseError("partial %s: %s", name, err)
+	}
+	s, err := lr.render(p, data, lr.depth+1)
+	if err != nil {
+		L.RaiseError("partial %s: %s", name, err)
+	}
+	L.Push(lua.LString(s))
+	return 1
+}
+
+// templateEscape is the function called by the Lua templates to output the
+// HTML-escaped value of an expression.
+func templateEscape(L *lua.LState) int {
+	v := L.Get(1)
+	if v == lua.LNil {
+		L.Push(lua.LString(""))
+		return 1
+	}
+	L.Push(lua.LString(html.EscapeString(L.ToStringMeta(v).String())))
+	return 1
+}
+
+func parseGoTemplate(name, src string) (*parsedTemplate, error) {
+	tmpl, err := template.New(name).Funcs(goTemplateFuncs).Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return &parsedTemplate{name: name, goTmpl: tmpl, extends: goTemplateExtends(tmpl)}, nil
+}
+
+// goTemplateExtends returns the name of the layout of tmpl, set by its
+// first action if it calls extends.
+func goTemplateExtends(tmpl *template.Template) string {
+	if tmpl.Tree == nil {
+		return ""
+	}
+	for _, node := range tmpl.Tree.Root.Nodes {
+		switch node := node.(type) {
+		case *parse.TextNode:
+			if len(bytes.TrimSpace(node.Text)) == 0 {
+				continue
+			}
+		case *parse.ActionNode:
+			if cmds := node.Pipe.Cmds; len(cmds) == 1 && len(cmds[0].Args) == 2 {
+				id, ok := cmds[0].Args[0].(*parse.IdentifierNode)
+				layout, isString := cmds[0].Args[1].(*parse.StringNode)
+				if ok && isString && id.Ident == "extends" {
+					return layout.Text
+				}
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+func parseLuaTemplate(name, src string) (*parsedTemplate, error) {
+	code, err := compileLuaTemplate(src)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	proto, err := compileString(code, name)
+	if err != nil {
+		return nil, err
+	}
+	return &parsedTemplate{name: name, proto: proto}, nil
+}
+
+// compileLuaTemplate translates the Lua template src to a Lua chunk that
+// receives the escape and the write functions as arguments, and outputs the
+// template with the write function.
+func compileLuaTemplate(src string) (string, error) {
+	var b strings.Builder
+	b.WriteString("local _esc, _w = ...\n")
+	for len(src) > 0 {
+		i := strings.Index(src, "<%")
+		if i < 0 {
+			fmt.Fprintf(&b, "_w(%s)\n", luaQuote(src))
+			break
+		}
+		if i > 0 {
+			fmt.Fprintf(&b, "_w(%s)\n", luaQuote(src[:i]))
+		}
+		src = src[i+2:]
+		j := strings.Index(src, "%>")
+		if j < 0 {
+			return "", errors.New("unclosed <% tag")
+		}
+		tag := src[:j]
+		src = src[j+2:]
+		switch {
+		case strings.HasPrefix(tag, "="):
+			fmt.Fprintf(&b, "_w(_esc(%s))\n", tag[1:])
+		case strings.HasPrefix(tag, "-"):
+			fmt.Fprintf(&b, "_w(tostring(%s))\n", tag[1:])
+		default:
+			b.WriteString(tag)
+			b.WriteByte('\n')
+		}
+	}
+	return b.String(), nil
+}
+
+// luaQuote returns s as a quoted Lua string literal.
+func luaQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c < ' ' || c == 0x7f:
+			fmt.Fprintf(&b, `\%03d`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// templateCache holds the parsed template files under the template root of
+// a handler.
+type templateCache struct {
+	root   string
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	entries map[string]templateEntry
+
+	// gen is incremented when the entries are dropped, so that the
+	// templates parsed before are not cached.
+	gen int
+
+	// watched is set while the template root is watched, in which case the
+	// modification time of the templates is not checked when they are
+	// rendered.
+	watched bool
+}
+
+type templateEntry struct {
+	tmpl    *parsedTemplate
+	modTime time.Time
+}
+
+func newTemplateCache(root string) *templateCache {
+	return &templateCache{root: root, entries: make(map[string]templateEntry)}
+}
+
+// get returns the parsed template file name, parsing it if it is not parsed
+// yet or changed since it was.
+func (tc *templateCache) get(name string) (*parsedTemplate, error) {
+	path := caddyhttp.SanitizedPathJoin(tc.root, "/"+name)
+	tc.mu.Lock()
+	e, ok := tc.entries[path]
+	watched, gen := tc.watched, tc.gen
+	tc.mu.Unlock()
+	if ok && watched {
+		return e.tmpl, nil
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if ok && e.modTime.Equal(fi.ModTime()) {
+		return e.tmpl, nil
+	}
+	tmpl, err := parseTemplateFile(path, name)
+	if err != nil {
+		return nil, err
+	}
+	tc.mu.Lock()
+	if tc.gen == gen {
+		tc.entries[path] = templateEntry{tmpl: tmpl, modTime: fi.ModTime()}
+	}
+	tc.mu.Unlock()
+	return tmpl, nil
+}
+
+// parseTemplateFile parses the template file at path, named name.
+func parseTemplateFile(path, name string) (*parsedTemplate, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(path) == luaTemplateExt {
+		return parseLuaTemplate(name, string(b))
+	}
+	return parseGoTemplate(name, string(b))
+}
+
+// watch starts checking the files under the template root every interval.
+// When one of them changes, is added or is removed, the parsed templates
+// are dropped, and the changed files are parsed to log their errors.
+func (tc *templateCache) watch(interval time.Duration, logger *zap.Logger) {
+	modTimes := tc.scan()
+	tc.mu.Lock()
+	tc.watched = true
+	tc.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tc.cancel = cancel
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				modTimes = tc.reload(modTimes, logger)
+			}
+		}
+	}()
+}
+
+// stop stops watching the template root.
+func (tc *templateCache) stop() {
+	if tc.cancel != nil {
+		tc.cancel()
+	}
+}
+
+// scan returns the modification time of the files under the template root.
+func (tc *templateCache) scan() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	filepath.WalkDir(tc.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if fi, err := d.Info(); err == nil {
+			modTimes[path] = fi.ModTime()
+		}
+		return nil
+	})
+	return modTimes
+}
+
+// reload drops the parsed templates if the files under the template root
+// are not the ones of modTimes, and returns their current modification
+// time.
+func (tc *templateCache) reload(modTimes map[string]time.Time, logger *zap.Logger) map[string]time.Time {
+	current := tc.scan()
+	var changed []string
+	for path, mt := range current {
+		if prev, ok := modTimes[path]; !ok || !prev.Equal(mt) {
+			changed = append(changed, path)
+		}
+	}
+	if len(changed) == 0 && len(current) == len(modTimes) {
+		return modTimes
+	}
+
+	// the layouts and partials of the templates may have changed
+	tc.mu.Lock()
+	tc.entries = make(map[string]templateEntry)
+	tc.gen++
+	tc.mu.Unlock()
+	for _, path := range changed {
+		name, err := filepath.Rel(tc.root, path)
+		if err == nil {
+			_, err = parseTemplateFile(path, filepath.ToSlash(name))
+		}
+		if err != nil {
+			logger.Error("parsing template", zap.String("path", path), zap.Error(err))
+		}
+	}
+	logger.Info("reloaded templates", zap.String("root", tc.root), zap.Int("changed", len(changed)))
+	return current
+}
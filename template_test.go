@@ -0,0 +1,134 @@
+package lua
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// writeTemplates writes the template files to dir.
+func writeTemplates(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, src := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// renderScript renders the template of the request path with the data of
+// the title query parameter.
+const renderScript = `
+	local template = require("template")
+	local s, err = template.render(request.path:sub(2), {title = request.query.title})
+	response:write(s or err)`
+
+func TestTemplateLayouts(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplates(t, dir, map[string]string{
+		"layouts/base.html": `<title>{{block "title" .}}default{{end}}</title>{{partial "partials/nav.html"}}<main>{{block "content" .}}{{end}}</main>`,
+		"layouts/page.html": `{{extends "layouts/base.html"}}{{define "content"}}<article>{{block "body" .}}{{end}}</article>{{end}}`,
+		"partials/nav.html": `<nav>{{.title}}</nav>`,
+		"home.html":         `{{extends "layouts/page.html"}}{{define "title"}}{{.title}}{{end}}{{define "body"}}<p>{{.title}}</p>{{end}}`,
+		"loop.html":         `{{extends "loop.html"}}`,
+		"mixed.html":        `{{extends "layouts/base.etlua"}}`,
+
+		"layouts/base.etlua": `<title><% block("title", function() %>default<% end) %></title><%- partial("partials/nav.etlua") %><main><% block("content") %></main>`,
+		"partials/nav.etlua": `<nav><%= title %></nav>`,
+		"home.etlua":         `<% extends("layouts/base.etlua") %><% block("content", function() %><p><%= title %></p><% end) %>ignored`,
+	})
+	tr, err := NewTester(&Lua{TemplateRoot: dir, Script: renderScript})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	cases := []struct {
+		path, want string
+	}{
+		{"/home.html?title=<hi>", `<title>&lt;hi&gt;</title><nav>&lt;hi&gt;</nav><main><article><p>&lt;hi&gt;</p></article></main>`},
+		{"/layouts/base.html?title=x", `<title>default</title><nav>x</nav><main></main>`},
+		{"/home.etlua?title=<hi>", `<title>default</title><nav>&lt;hi&gt;</nav><main><p>&lt;hi&gt;</p></main>`},
+		{"/loop.html", "more than 16 nested layouts and partials"},
+		{"/mixed.html", "the layout layouts/base.etlua is not a Go template"},
+	}
+	for _, c := range cases {
+		res := tr.Do(TestRequest{Path: c.path})
+		if res.Err != nil {
+			t.Fatalf("%s: %s", c.path, res.Err)
+		}
+		if !strings.Contains(res.Body, c.want) {
+			t.Errorf("%s: got %q, want %q", c.path, res.Body, c.want)
+		}
+	}
+}
+
+func TestTemplateRenderStringNoFiles(t *testing.T) {
+	tr, err := NewTester(&Lua{TemplateRoot: t.TempDir(), Script: `
+		local template = require("template")
+		local _, goErr = template.render_string('{{partial "x.html"}}', {})
+		local lua = template.render_string('<% block("b", function() %>block<% end) %>', {}, "lua")
+		local _, luaErr = template.render_string('<%- partial("x.etlua") %>', {}, "lua")
+		response:write(table.concat({goErr, lua, luaErr}, "|"))`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	res := tr.Do(TestRequest{})
+	parts := strings.Split(res.Body, "|")
+	if len(parts) != 3 || !strings.Contains(parts[0], errNoTemplateFiles.Error()) ||
+		parts[1] != "block" || !strings.Contains(parts[2], errNoTemplateFiles.Error()) {
+		t.Errorf("got %q, %v", res.Body, res.Err)
+	}
+}
+
+func TestTemplateWatch(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplates(t, dir, map[string]string{
+		"layout.html": `v1 {{block "content" .}}{{end}}`,
+		"page.html":   `{{extends "layout.html"}}{{define "content"}}page{{end}}`,
+	})
+	tr, err := NewTester(&Lua{TemplateRoot: dir, Watch: caddy.Duration(10 * time.Millisecond), Script: renderScript})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	if res := tr.Do(TestRequest{Path: "/page.html"}); res.Body != "v1 page" {
+		t.Fatalf("got %q, %v", res.Body, res.Err)
+	}
+	// the modification time changes even if the file is written in the
+	// same tick of the clock
+	path := filepath.Join(dir, "layout.html")
+	writeTemplates(t, dir, map[string]string{"layout.html": `v2 {{block "content" .}}{{end}}`})
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res := tr.Do(TestRequest{Path: "/page.html"})
+		if res.Body == "v2 page" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %q, want the changed layout", res.Body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tc := tr.handler.templates
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.gen == 0 {
+		t.Error("the watcher did not drop the parsed templates")
+	}
+}
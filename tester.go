@@ -0,0 +1,194 @@
+package lua
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// Tester runs a Lua handler on fabricated requests, outside of a server, so
+// that its scripts can be unit tested, e.g. in the Go tests of the programs
+// that embed the handler, or with the lua-test command:
+//
+//	tr, err := lua.NewTester(&lua.Lua{HandlerPath: "api.lua"})
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer tr.Close()
+//	res := tr.Do(lua.TestRequest{Method: "GET", Path: "/users/1"})
+//	if res.Status != 200 {
+//		t.Errorf("got %d", res.Status)
+//	}
+//
+// The handler is provisioned without a Caddy configuration: its storage is
+// a temporary directory removed by Close, and it logs to the standard
+// error, from the info level. The requests are handled by the same handler,
+// so that they share its state, e.g. its kv store, and so are the internal
+// requests of caddy.fetch_local and caddy.subrequest, for which the handler
+// is the whole server.
+type Tester struct {
+	// Next is the next handler of the handler, called if the scripts do not
+	// respond or call caddy.next. The default one responds with a 200 status
+	// and an empty body.
+	Next caddyhttp.Handler
+
+	handler    *Lua
+	cancel     context.CancelFunc
+	storageDir string
+}
+
+// TestRequest is a request fabricated by a Tester.
+type TestRequest struct {
+	// Method is the method of the request, GET by default.
+	Method string
+
+	// Path is the path and query of the request, "/" by default.
+	Path string
+
+	// Host is the host of the request, localhost by default.
+	Host string
+
+	Header http.Header
+	Body   string
+
+	// RemoteAddr is the address of the client, 127.0.0.1:1234 by default.
+	RemoteAddr string
+}
+
+// TestResponse is the response of the handler of a Tester to a request.
+type TestResponse struct {
+	Status int
+	Header http.Header
+	Body   string
+
+	// CalledNext reports whether the request reached the next handler.
+	CalledNext bool
+
+	// Err is the error returned by the handler, e.g. the error of a script,
+	// whose status is the Status of the response.
+	Err error
+}
+
+// NewTester provisions and validates the handler l, configured like with
+// the JSON configuration, and returns its Tester.
+func NewTester(l *Lua) (*Tester, error) {
+	dir, err := os.MkdirTemp("", "caddy-lua-test-")
+	if err != nil {
+		return nil, err
+	}
+	logCfg := zap.NewDevelopmentConfig()
+	logCfg.Level = zap.NewAtomicLevelAt(zap.InfoLevel)
+	logCfg.DisableStacktrace = true
+	logger, err := logCfg.Build()
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t := &Tester{handler: l, cancel: cancel, storageDir: dir}
+	if err := l.provision(ctx, &certmagic.FileStorage{Path: dir}, logger); err != nil {
+		t.Close()
+		return nil, err
+	}
+	if err := l.Validate(); err != nil {
+		t.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// Do handles the request req and returns the response.
+func (t *Tester) Do(req TestRequest) *TestResponse {
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	target := req.Path
+	if target == "" {
+		target = "/"
+	}
+	r := httptest.NewRequest(method, target, strings.NewReader(req.Body))
+	if req.Host != "" {
+		r.Host = req.Host
+	} else {
+		r.Host = "localhost"
+	}
+	if req.RemoteAddr != "" {
+		r.RemoteAddr = req.RemoteAddr
+	} else {
+		r.RemoteAddr = "127.0.0.1:1234"
+	}
+	for name, vals := range req.Header {
+		r.Header[http.CanonicalHeaderKey(name)] = append([]string(nil), vals...)
+	}
+
+	w := httptest.NewRecorder()
+	res := new(TestResponse)
+	err := t.serve(w, r, func() { res.CalledNext = true })
+
+	result := w.Result()
+	res.Status = result.StatusCode
+	res.Header = result.Header
+	if b, rerr := io.ReadAll(result.Body); rerr == nil {
+		res.Body = string(b)
+	}
+	if err != nil {
+		// the error is handled by the server, which responds with its
+		// status unless the response is written
+		res.Err = err
+		if !w.Flushed && w.Body.Len() == 0 {
+			res.Status = errorStatus(err)
+		}
+	}
+	return res
+}
+
+// serve handles r with the handler, calling called once the request reaches
+// the next handler.
+func (t *Tester) serve(w http.ResponseWriter, r *http.Request, called func()) error {
+	r = caddyhttp.PrepareRequest(r, caddy.NewReplacer(), w, nil)
+	r = r.WithContext(context.WithValue(r.Context(), caddyhttp.ServerCtxKey, testServer{t}))
+	next := t.Next
+	if next == nil {
+		next = caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			return nil
+		})
+	}
+	return t.handler.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		called()
+		return next.ServeHTTP(w, r)
+	}))
+}
+
+// testServer is the server of the requests of a Tester, which handles their
+// internal requests.
+type testServer struct {
+	t *Tester
+}
+
+// ServeHTTP implements http.Handler, responding with the status of the
+// error of the handler, if any, like the server.
+func (s testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := s.t.serve(w, r, func() {}); err != nil {
+		w.WriteHeader(errorStatus(err))
+	}
+}
+
+// Close cleans up the handler and removes its storage.
+func (t *Tester) Close() error {
+	t.cancel()
+	err := t.handler.Cleanup()
+	if rerr := os.RemoveAll(t.storageDir); err == nil {
+		err = rerr
+	}
+	return err
+}
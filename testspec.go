@@ -0,0 +1,256 @@
+package lua
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// RunTestFile runs the tests of the spec file at path, and writes their
+// results to w. The spec file is a Lua script that returns a table with the
+// configuration of the handler, as in JSON, and the array of its tests:
+//
+//	return {
+//		handler = {handler_path = "api.lua", file_root = "public"},
+//		tests = {
+//			{
+//				name = "get a user",
+//				method = "GET", path = "/users/1",
+//				headers = {Accept = "application/json"},
+//				expect = {
+//					status = 200,
+//					headers = {["Content-Type"] = "application/json"},
+//					body_contains = '"id":1',
+//				},
+//			},
+//			{
+//				name = "falls through",
+//				path = "/static/app.js",
+//				expect = {next = true},
+//				check = function(res)
+//					return res.headers["Cache-Control"] == nil, "cached"
+//				end,
+//			},
+//		},
+//	}
+//
+// A test fabricates a request with its method (default GET), path (default
+// "/", with the query), host, headers, body and remote_addr, and runs the
+// handler on it. It then checks the expectations of its expect table:
+//
+//	status: the status of the response
+//	body: the body of the response
+//	body_contains: a string in the body of the response
+//	body_matches: a regular expression (Go's syntax) matching the body
+//	headers: a table of the header values of the response, false for a
+//	header that must not be set
+//	next: whether the request reaches the next handler, which responds with
+//	a 200 status and an empty body
+//	error: true, or a string in the error message, if the handler must
+//	return an error, e.g. the error of a script
+//
+// and calls its check function, if any, with the response, a table with the
+// status, headers, body, next and error (nil without an error). The check
+// fails the test if it raises an error or returns false, the second value
+// being the message.
+//
+// A test fails if the handler returns an error that it does not expect. The
+// tests run in order on the same handler, so that they share its state, e.g.
+// its kv store. The spec file runs in a Lua state of its own, with the
+// standard libraries and the json module, and not in the states of the
+// handler. If filter is not nil, only the tests whose name matches it run.
+//
+// RunTestFile returns the numbers of the tests that passed and failed, and
+// an error if the spec file or the handler cannot be loaded.
+func RunTestFile(path string, filter *regexp.Regexp, w io.Writer) (passed, failed int, err error) {
+	L := lua.NewState()
+	defer L.Close()
+	preloadJSONModule(L)
+	if err := L.DoFile(path); err != nil {
+		return 0, 0, err
+	}
+	spec, ok := L.Get(-1).(*lua.LTable)
+	if !ok {
+		return 0, 0, fmt.Errorf("%s: the spec file must return a table", path)
+	}
+
+	var l Lua
+	cfg, err := toGo(spec.RawGetString("handler"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s: handler: %w", path, err)
+	}
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s: handler: %w", path, err)
+	}
+	if err := json.Unmarshal(b, &l); err != nil {
+		return 0, 0, fmt.Errorf("%s: handler: %w", path, err)
+	}
+	tests, ok := spec.RawGetString("tests").(*lua.LTable)
+	if !ok {
+		return 0, 0, fmt.Errorf("%s: tests: an array of tests is required", path)
+	}
+
+	tr, err := NewTester(&l)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s: %w", path, err)
+	}
+	defer tr.Close()
+
+	for i := 1; i <= tests.Len(); i++ {
+		test, ok := tests.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			return passed, failed, fmt.Errorf("%s: tests[%d]: a table is required", path, i)
+		}
+		name := lua.LVAsString(test.RawGetString("name"))
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		if filter != nil && !filter.MatchString(name) {
+			continue
+		}
+
+		start := time.Now()
+		failures := runTestCase(L, tr, test)
+		elapsed := time.Since(start).Seconds()
+		if len(failures) == 0 {
+			passed++
+			fmt.Fprintf(w, "--- PASS: %s (%.2fs)\n", name, elapsed)
+			continue
+		}
+		failed++
+		fmt.Fprintf(w, "--- FAIL: %s (%.2fs)\n", name, elapsed)
+		for _, f := range failures {
+			fmt.Fprintf(w, "    %s\n", f)
+		}
+	}
+	return passed, failed, nil
+}
+
+// runTestCase runs the test of the spec file and returns the descriptions
+// of its failed expectations.
+func runTestCase(L *lua.LState, tr *Tester, test *lua.LTable) []string {
+	req := TestRequest{
+		Method:     lua.LVAsString(test.RawGetString("method")),
+		Path:       lua.LVAsString(test.RawGetString("path")),
+		Host:       lua.LVAsString(test.RawGetString("host")),
+		Body:       lua.LVAsString(test.RawGetString("body")),
+		RemoteAddr: lua.LVAsString(test.RawGetString("remote_addr")),
+	}
+	if t, ok := test.RawGetString("headers").(*lua.LTable); ok {
+		req.Header = make(http.Header)
+		tableToHeader(t, req.Header)
+	}
+	res := tr.Do(req)
+	expect, _ := test.RawGetString("expect").(*lua.LTable)
+	if expect == nil {
+		expect = L.NewTable()
+	}
+
+	var failures []string
+	failf := func(format string, args ...interface{}) {
+		failures = append(failures, fmt.Sprintf(format, args...))
+	}
+
+	switch want := expect.RawGetString("error").(type) {
+	case lua.LBool:
+		if want && res.Err == nil {
+			failf("error: got none")
+		} else if !want && res.Err != nil {
+			failf("error: %s", res.Err)
+		}
+	case lua.LString:
+		if res.Err == nil {
+			failf("error: got none, want %q", want)
+		} else if !strings.Contains(res.Err.Error(), string(want)) {
+			failf("error: %q does not contain %q", res.Err, want)
+		}
+	default:
+		if res.Err != nil {
+			failf("error: %s", res.Err)
+		}
+	}
+	if want, ok := expect.RawGetString("status").(lua.LNumber); ok && res.Status != int(want) {
+		failf("status: got %d, want %d", res.Status, int(want))
+	}
+	if want, ok := expect.RawGetString("next").(lua.LBool); ok && res.CalledNext != bool(want) {
+		failf("next: got %t, want %t", res.CalledNext, bool(want))
+	}
+	if want, ok := expect.RawGetString("body").(lua.LString); ok && res.Body != string(want) {
+		failf("body: got %q, want %q", res.Body, want)
+	}
+	if want, ok := expect.RawGetString("body_contains").(lua.LString); ok && !strings.Contains(res.Body, string(want)) {
+		failf("body: %q does not contain %q", res.Body, want)
+	}
+	if want, ok := expect.RawGetString("body_matches").(lua.LString); ok {
+		if re, err := regexps.get(string(want)); err != nil {
+			failf("body_matches: %s", err)
+		} else if !re.MatchString(res.Body) {
+			failf("body: %q does not match %q", res.Body, want)
+		}
+	}
+	if want, ok := expect.RawGetString("headers").(*lua.LTable); ok {
+		var mismatches []string
+		want.ForEach(func(k, v lua.LValue) {
+			name := k.String()
+			got, set := res.Header[http.CanonicalHeaderKey(name)]
+			switch v := v.(type) {
+			case lua.LBool:
+				if set && !bool(v) {
+					mismatches = append(mismatches, fmt.Sprintf("header %s: got %q, want none", name, got))
+				} else if !set && bool(v) {
+					mismatches = append(mismatches, fmt.Sprintf("header %s: got none", name))
+				}
+			default:
+				if !set {
+					mismatches = append(mismatches, fmt.Sprintf("header %s: got none, want %q", name, v.String()))
+				} else if got[0] != v.String() {
+					mismatches = append(mismatches, fmt.Sprintf("header %s: got %q, want %q", name, got[0], v.String()))
+				}
+			}
+		})
+		// ForEach iterates in no particular order
+		sort.Strings(mismatches)
+		failures = append(failures, mismatches...)
+	}
+	if check, ok := test.RawGetString("check").(*lua.LFunction); ok {
+		if msg, ok := runTestCheck(L, check, res); !ok {
+			failf("check: %s", msg)
+		}
+	}
+	return failures
+}
+
+// runTestCheck calls the check function of a test with the response res,
+// and returns false and a message if the check fails.
+func runTestCheck(L *lua.LState, check *lua.LFunction, res *TestResponse) (string, bool) {
+	t := L.CreateTable(0, 5)
+	t.RawSetString("status", lua.LNumber(res.Status))
+	t.RawSetString("headers", headerToTable(L, res.Header))
+	t.RawSetString("body", lua.LString(res.Body))
+	t.RawSetString("next", lua.LBool(res.CalledNext))
+	if res.Err != nil {
+		t.RawSetString("error", lua.LString(res.Err.Error()))
+	}
+
+	top := L.GetTop()
+	defer L.SetTop(top)
+	if err := L.CallByParam(lua.P{Fn: check, NRet: 2, Protect: true}, t); err != nil {
+		return err.Error(), false
+	}
+	if lua.LVIsFalse(L.Get(-2)) {
+		msg := lua.LVAsString(L.Get(-1))
+		if msg == "" {
+			msg = "returned false"
+		}
+		return msg, false
+	}
+	return "", true
+}
@@ -0,0 +1,98 @@
+package lua
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRunTestFile(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "api.lua")
+	if err := os.WriteFile(script, []byte(`
+		if request.path == "/static/app.js" then return end
+		if request.path == "/fail" then error("broken") end
+		response:set_header("Content-Type", "application/json")
+		response:write('{"id":1,"method":"' .. request.method .. '"}')
+		return "done"`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	spec := filepath.Join(dir, "api_spec.lua")
+	if err := os.WriteFile(spec, []byte(fmt.Sprintf(`
+		return {
+			handler = {handler_path = %q},
+			tests = {
+				{
+					name = "get a user",
+					path = "/users/1",
+					expect = {
+						status = 200,
+						headers = {["Content-Type"] = "application/json", ["Cache-Control"] = false},
+						body_contains = '"id":1',
+						body_matches = '"method":"GET"',
+					},
+				},
+				{name = "falls through", path = "/static/app.js", expect = {next = true}},
+				{name = "script error", path = "/fail", expect = {error = "broken"}},
+				{
+					name = "wrong expectations",
+					method = "POST",
+					path = "/users/1",
+					expect = {status = 201, body = "x"},
+					check = function(res) return res.body == "", "the body is not empty" end,
+				},
+				{name = "unexpected error", path = "/fail"},
+			},
+		}`, script)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	passed, failed, err := RunTestFile(spec, nil, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if passed != 3 || failed != 2 {
+		t.Errorf("got %d passed and %d failed, want 3 and 2:\n%s", passed, failed, out.String())
+	}
+	for _, want := range []string{
+		"--- PASS: get a user",
+		"--- PASS: falls through",
+		"--- FAIL: wrong expectations",
+		"    status: got 200, want 201",
+		`    body: got "{\"id\":1,\"method\":\"POST\"}", want "x"`,
+		"    check: the body is not empty",
+		"--- FAIL: unexpected error",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("the output does not contain %q:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	passed, failed, err = RunTestFile(spec, regexp.MustCompile("^falls"), &out)
+	if err != nil || passed != 1 || failed != 0 {
+		t.Errorf("filter: got %d, %d, %v:\n%s", passed, failed, err, out.String())
+	}
+}
+
+func TestRunTestFileInvalidSpec(t *testing.T) {
+	dir := t.TempDir()
+	cases := map[string]string{
+		"not a table": `return 42`,
+		"no tests":    `return {handler = {script = "return"}}`,
+		"bad handler": `return {handler = {handler_path = "missing.lua"}, tests = {}}`,
+	}
+	for name, src := range cases {
+		spec := filepath.Join(dir, strings.ReplaceAll(name, " ", "_")+".lua")
+		if err := os.WriteFile(spec, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := RunTestFile(spec, nil, new(strings.Builder)); err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package lua
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+)
+
+const (
+	timerTypeName = "caddy.timer"
+
+	// defaultMaxTimers is the maximum number of pending and recurring
+	// timers of a handler without a max_timers.
+	defaultMaxTimers = 1024
+
+	// defaultTimerTimeout is the timeout of the functions of the timers of
+	// a handler without an execution_timeout.
+	defaultTimerTimeout = 30 * time.Second
+)
+
+var errTooManyTimers = errors.New("too many timers")
+
+// preloadTimerModule registers the timer module, loaded by scripts with
+// require("timer"), which runs functions in the background, after the
+// response is sent, e.g. to refresh a cache, ship logs or send a delayed
+// webhook:
+//
+//	timer.at(delay, fn, args...): calls fn with args after delay seconds
+//	timer.every(interval, fn, args...): calls fn with args every interval
+//	seconds, until it is canceled or the handler is unloaded
+//
+// Both return the timer, with the method cancel(), or nil and an error
+// message if the handler has max_timers (default 1024) pending and
+// recurring timers. The calls of a recurring timer do not overlap.
+//
+// The functions run in their own Lua state, with the handler's modules and
+// the caddy table but no request, and are stopped after the handler's
+// execution_timeout (default 30s). Their upvalues and args are copied to
+// that state, and thus must be nil, booleans, numbers, strings, tables or
+// Lua functions whose values and upvalues satisfy the same condition, or
+// values of the modules and of the caddy table, which are looked up in that
+// state. The errors of the functions are logged, and the pending timers are
+// dropped when the handler is unloaded.
+func preloadTimerModule(L *lua.LState) {
+	mt := L.NewTypeMetatable(timerTypeName)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"cancel": timerCancel,
+	}))
+
+	L.PreloadModule("timer", func(L *lua.LState) int {
+		// not a package variable, which would be initialized in a cycle
+		// with newBaseState
+		L.Push(L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"at":    timerStart(false),
+			"every": timerStart(true),
+		}))
+		return 1
+	})
+}
+
+// timerStart returns the function that starts the timers, recurring if
+// every is true.
+func timerStart(every bool) lua.LGFunction {
+	return func(L *lua.LState) int {
+		l := checkHandler(L)
+		secs := float64(L.CheckNumber(1))
+		if secs < 0 || every && secs <= 0 {
+			L.ArgError(1, "invalid delay")
+		}
+		lfn := L.CheckFunction(2)
+		if lfn.IsG {
+			L.ArgError(2, "Lua function expected")
+		}
+		c := newValueCopier(L, l.libraries)
+		fn, err := c.function(lfn)
+		if err != nil {
+			L.ArgError(2, err.Error())
+		}
+		args := make([]interface{}, 0, L.GetTop()-2)
+		for i := 3; i <= L.GetTop(); i++ {
+			v, err := c.copy(L.Get(i))
+			if err != nil {
+				L.ArgError(i, err.Error())
+			}
+			args = append(args, v)
+		}
+
+		t, err := l.timers.start(time.Duration(secs*float64(time.Second)), every, fn, args)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		ud := L.NewUserData()
+		ud.Value = t
+		L.SetMetatable(ud, L.GetTypeMetatable(timerTypeName))
+		L.Push(ud)
+		return 1
+	}
+}
+
+// timerCancel implements timer:cancel().
+func timerCancel(L *lua.LState) int {
+	t, ok := L.CheckUserData(1).Value.(*luaTimer)
+	if !ok {
+		L.ArgError(1, "timer expected")
+	}
+	t.cancel()
+	return 0
+}
+
+// timerManager runs the timers of a handler.
+type timerManager struct {
+	handler *Lua
+	max     int
+	ctx     context.Context
+	stop    context.CancelFunc
+	wg      sync.WaitGroup
+
+	mu    sync.Mutex
+	count int
+}
+
+func newTimerManager(l *Lua) *timerManager {
+	max := l.MaxTimers
+	if max <= 0 {
+		max = defaultMaxTimers
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &timerManager{handler: l, max: max, ctx: ctx, stop: cancel}
+}
+
+// luaTimer is a timer started by a script.
+type luaTimer struct {
+	once     sync.Once
+	canceled chan struct{}
+}
+
+func (t *luaTimer) cancel() {
+	t.once.Do(func() { close(t.canceled) })
+}
+
+// start starts the timer that calls fn with args after delay, or every delay
+// if every is true.
+func (tm *timerManager) start(delay time.Duration, every bool, fn *functionCopy, args []interface{}) (*luaTimer, error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if tm.ctx.Err() != nil {
+		return nil, errors.New("the handler is stopped")
+	}
+	if tm.count >= tm.max {
+		return nil, errTooManyTimers
+	}
+	tm.count++
+	tm.wg.Add(1)
+
+	t := &luaTimer{canceled: make(chan struct{})}
+	go func() {
+		defer tm.done()
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+			case <-t.canceled:
+				return
+			case <-tm.ctx.Done():
+				return
+			}
+			tm.run(fn, args)
+			if !every {
+				return
+			}
+			timer.Reset(delay)
+		}
+	}()
+	return t, nil
+}
+
+func (tm *timerManager) done() {
+	tm.mu.Lock()
+	tm.count--
+	tm.mu.Unlock()
+	tm.wg.Done()
+}
+
+// run calls fn with args in a new state.
+func (tm *timerManager) run(fn *functionCopy, args []interface{}) {
+	l := tm.handler
+	timeout := time.Duration(l.ExecutionTimeout)
+	if timeout <= 0 {
+		timeout = defaultTimerTimeout
+	}
+	ctx, cancel := context.WithTimeout(tm.ctx, timeout)
+	defer cancel()
+
+	L := l.newBaseState()
+	defer L.Close()
+	setBackgroundHandler(L, l)
+	L.SetContext(ctx)
+
+	m := newValueMaker(L)
+	largs := make([]lua.LValue, 0, len(args))
+	for _, arg := range args {
+		largs = append(largs, m.value(arg))
+	}
+	f := m.function(fn)
+	if err := L.CallByParam(lua.P{Fn: f, NRet: 0, Protect: true}, largs...); err != nil && tm.ctx.Err() == nil {
+		l.logger.Error("running the timer function",
+			zap.String("source", fn.proto.SourceName),
+			zap.Int("line", fn.proto.LineDefined),
+			zap.Error(err))
+	}
+}
+
+// close cancels the timers and waits for the running ones to return.
+func (tm *timerManager) close() {
+	tm.mu.Lock()
+	tm.stop()
+	tm.mu.Unlock()
+	tm.wg.Wait()
+}
@@ -0,0 +1,157 @@
+package lua
+
+import (
+	"context"
+	"net/http"
+
+	lua "github.com/yuin/gopher-lua"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the tracer of the spans started by the scripts.
+const tracerName = "github.com/mna/caddy-lua"
+
+// tracePropagator propagates the trace context to the requests sent by the
+// scripts, with the propagators of Caddy's tracing module.
+var tracePropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// preloadTraceModule registers the trace module, loaded by scripts with
+// require("trace"), which integrates the scripts in the distributed traces
+// of Caddy's tracing directive:
+//
+//	trace.id(): the hexadecimal trace ID of the request, or nil if it is not
+//	traced
+//	trace.span_id(): the hexadecimal ID of the current span, or nil
+//	trace.set_attribute(key, value): sets the attribute of the current span
+//	to the string, number or boolean value
+//	trace.add_event(name[, attributes]): adds the event to the current span,
+//	with the attributes of the table
+//	trace.span(name, fn, args...): calls fn with args in a new span, the
+//	current one while fn runs, and returns its results. The span records
+//	the error of fn, which is raised again.
+//
+// The current span is the span of the request, created by the tracing
+// directive, or the innermost trace.span. Its context is propagated in the
+// traceparent and baggage headers of the requests sent with the http
+// module. Without the tracing directive, the functions do nothing.
+func preloadTraceModule(L *lua.LState) {
+	L.PreloadModule("trace", func(L *lua.LState) int {
+		L.Push(L.SetFuncs(L.NewTable(), traceFuncs))
+		return 1
+	})
+}
+
+var traceFuncs = map[string]lua.LGFunction{
+	"id":            traceID,
+	"span_id":       traceSpanID,
+	"set_attribute": traceSetAttribute,
+	"add_event":     traceAddEvent,
+	"span":          traceSpan,
+}
+
+// currentSpan returns the current span of the script running in L.
+func currentSpan(L *lua.LState) trace.Span {
+	return trace.SpanFromContext(checkContext(L))
+}
+
+// injectTraceContext sets the headers of h that propagate the trace context
+// of ctx, if it has one.
+func injectTraceContext(ctx context.Context, h http.Header) {
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		tracePropagator.Inject(ctx, propagation.HeaderCarrier(h))
+	}
+}
+
+// traceID implements trace.id().
+func traceID(L *lua.LState) int {
+	sc := currentSpan(L).SpanContext()
+	if !sc.HasTraceID() {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(lua.LString(sc.TraceID().String()))
+	return 1
+}
+
+// traceSpanID implements trace.span_id().
+func traceSpanID(L *lua.LState) int {
+	sc := currentSpan(L).SpanContext()
+	if !sc.HasSpanID() {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(lua.LString(sc.SpanID().String()))
+	return 1
+}
+
+// checkAttribute returns the attribute of key and of the value at index n of
+// the stack.
+func checkAttribute(L *lua.LState, key string, n int) attribute.KeyValue {
+	switch v := L.Get(n).(type) {
+	case lua.LString:
+		return attribute.String(key, string(v))
+	case lua.LNumber:
+		if f := float64(v); f == float64(int64(f)) {
+			return attribute.Int64(key, int64(f))
+		}
+		return attribute.Float64(key, float64(v))
+	case lua.LBool:
+		return attribute.Bool(key, bool(v))
+	}
+	L.ArgError(n, "string, number or boolean expected")
+	return attribute.KeyValue{}
+}
+
+// traceSetAttribute implements trace.set_attribute(key, value).
+func traceSetAttribute(L *lua.LState) int {
+	key := L.CheckString(1)
+	currentSpan(L).SetAttributes(checkAttribute(L, key, 2))
+	return 0
+}
+
+// traceAddEvent implements trace.add_event(name[, attributes]).
+func traceAddEvent(L *lua.LState) int {
+	name := L.CheckString(1)
+	var attrs []attribute.KeyValue
+	if t := L.OptTable(2, nil); t != nil {
+		t.ForEach(func(k, v lua.LValue) {
+			L.Push(v)
+			attrs = append(attrs, checkAttribute(L, k.String(), L.GetTop()))
+			L.Pop(1)
+		})
+	}
+	currentSpan(L).AddEvent(name, trace.WithAttributes(attrs...))
+	return 0
+}
+
+// traceSpan implements trace.span(name, fn, args...).
+func traceSpan(L *lua.LState) int {
+	name := L.CheckString(1)
+	fn := L.CheckFunction(2)
+
+	prev := checkContext(L)
+	ctx, span := trace.SpanFromContext(prev).TracerProvider().Tracer(tracerName).Start(prev, name)
+	L.SetContext(ctx)
+
+	top := L.GetTop()
+	L.Push(fn)
+	for i := 3; i <= top; i++ {
+		L.Push(L.Get(i))
+	}
+	err := L.PCall(top-2, lua.MultRet, nil)
+	L.SetContext(prev)
+	if err != nil {
+		var obj lua.LValue = lua.LString(err.Error())
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			obj = apiErr.Object
+		}
+		span.SetStatus(codes.Error, obj.String())
+		span.End()
+		L.Error(obj, 0)
+	}
+	span.End()
+	return L.GetTop() - top
+}
@@ -0,0 +1,101 @@
+package lua
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// trafficSplits holds the traffic split of all provisioned handlers that
+// define a green version of their script, keyed by handler name.
+var trafficSplits = &trafficRegistry{m: make(map[string]*trafficSplit)}
+
+// trafficSplit distributes requests between the blue (handler_path) and
+// green (green_handler_path) versions of a handler's script. The green
+// percentage can be changed at runtime via the admin API.
+type trafficSplit struct {
+	name  string
+	blue  string
+	green string
+
+	greenPercent int32 // accessed atomically
+}
+
+// trafficStatus is the admin API representation of a trafficSplit.
+type trafficStatus struct {
+	Name         string `json:"name"`
+	Blue         string `json:"blue"`
+	Green        string `json:"green"`
+	GreenPercent int    `json:"green_percent"`
+}
+
+// path returns the script path to use for a request.
+func (ts *trafficSplit) path() string {
+	pct := atomic.LoadInt32(&ts.greenPercent)
+	if pct >= 100 || (pct > 0 && rand.Int31n(100) < pct) {
+		return ts.green
+	}
+	return ts.blue
+}
+
+// setGreenPercent atomically changes the percentage of requests served by
+// the green script.
+func (ts *trafficSplit) setGreenPercent(pct int) error {
+	if pct < 0 || pct > 100 {
+		return fmt.Errorf("green_percent must be between 0 and 100, got %d", pct)
+	}
+	atomic.StoreInt32(&ts.greenPercent, int32(pct))
+	return nil
+}
+
+func (ts *trafficSplit) status() trafficStatus {
+	return trafficStatus{
+		Name:         ts.name,
+		Blue:         ts.blue,
+		Green:        ts.green,
+		GreenPercent: int(atomic.LoadInt32(&ts.greenPercent)),
+	}
+}
+
+// trafficRegistry is a concurrency-safe set of trafficSplit keyed by name.
+type trafficRegistry struct {
+	mu sync.Mutex
+	m  map[string]*trafficSplit
+}
+
+// register adds ts to the registry, replacing any existing split with the
+// same name (e.g. from the configuration being replaced by a reload).
+func (tr *trafficRegistry) register(ts *trafficSplit) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.m[ts.name] = ts
+}
+
+// unregister removes ts from the registry if it is still the registered
+// split for its name.
+func (tr *trafficRegistry) unregister(ts *trafficSplit) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.m[ts.name] == ts {
+		delete(tr.m, ts.name)
+	}
+}
+
+func (tr *trafficRegistry) get(name string) *trafficSplit {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.m[name]
+}
+
+func (tr *trafficRegistry) list() []trafficStatus {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	list := make([]trafficStatus, 0, len(tr.m))
+	for _, ts := range tr.m {
+		list = append(list, ts.status())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
@@ -0,0 +1,313 @@
+package lua
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	uploadTypeName = "caddy.upload"
+
+	// defaultSpoolThreshold is the size above which the uploads are spooled
+	// to a temporary file when the handler has no spool_threshold.
+	defaultSpoolThreshold = 1 << 20
+)
+
+// upload is a request body or a multipart part read by request:spool_body()
+// or part:spool(), kept in memory if it is not larger than the spool
+// threshold, and in a temporary file otherwise. The files are removed once
+// the request is handled.
+type upload struct {
+	data []byte
+	file *os.File
+	size int64
+
+	// offset is the position of the reader of the upload.
+	offset int64
+	closed bool
+
+	filename    string
+	contentType string
+}
+
+// spoolUpload reads the content returned by read, which returns nil at the
+// end, in memory up to threshold bytes, and in a temporary file of dir
+// beyond. The upload is added to the uploads of rc.
+func (rc *requestContext) spoolUpload(read func() ([]byte, error), threshold int64, dir string) (*upload, error) {
+	u := new(upload)
+	for {
+		b, err := read()
+		if err == nil && b != nil {
+			err = u.write(b, threshold, dir)
+		}
+		if err != nil {
+			u.remove()
+			return nil, err
+		}
+		if b == nil {
+			break
+		}
+	}
+	rc.uploads = append(rc.uploads, u)
+	return u, nil
+}
+
+// write appends b to the upload, moving its content to a temporary file in
+// dir once it is larger than threshold.
+func (u *upload) write(b []byte, threshold int64, dir string) error {
+	if u.file == nil && u.size+int64(len(b)) > threshold {
+		f, err := os.CreateTemp(dir, "caddy-lua-upload-")
+		if err != nil {
+			return err
+		}
+		u.file = f
+		if _, err := f.Write(u.data); err != nil {
+			return err
+		}
+		u.data = nil
+	}
+	if u.file != nil {
+		if _, err := u.file.Write(b); err != nil {
+			return err
+		}
+	} else {
+		u.data = append(u.data, b...)
+	}
+	u.size += int64(len(b))
+	return nil
+}
+
+// reader returns a reader of the content of the upload from offset.
+func (u *upload) reader(offset int64) (io.Reader, error) {
+	if u.closed {
+		return nil, errors.New("the upload is removed once the request is handled")
+	}
+	if u.file != nil {
+		return io.NewSectionReader(u.file, offset, u.size-offset), nil
+	}
+	return io.NewSectionReader(bytes.NewReader(u.data), offset, u.size-offset), nil
+}
+
+// remove removes the temporary file of the upload, if any.
+func (u *upload) remove() {
+	u.closed = true
+	u.data = nil
+	if u.file != nil {
+		u.file.Close()
+		os.Remove(u.file.Name())
+	}
+}
+
+// removeUploads removes the temporary files of the uploads of the request.
+func (rc *requestContext) removeUploads() {
+	for _, u := range rc.uploads {
+		u.remove()
+	}
+	rc.uploads = nil
+}
+
+// spoolOptions returns the spool threshold and directory of opts, which
+// default to the handler's spool_threshold (1MB by default) and spool_dir
+// (the temporary directory by default).
+func (rc *requestContext) spoolOptions(opts *lua.LTable) (int64, string) {
+	threshold := int64(lua.LVAsNumber(opts.RawGetString("spool_threshold")))
+	var dir string
+	if rc.handler != nil {
+		if threshold <= 0 {
+			threshold = rc.handler.SpoolThreshold
+		}
+		dir = rc.handler.SpoolDir
+	}
+	if threshold <= 0 {
+		threshold = defaultSpoolThreshold
+	}
+	return threshold, dir
+}
+
+// requestSpoolBody implements request:spool_body([opts]), which reads the
+// body like part:spool() and returns its upload, or nil and an error
+// message. The opts table supports spool_threshold and max_size, the
+// maximum size of the body (default to the handler's max_body_size). Like
+// the body reader, it consumes the body.
+func requestSpoolBody(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	opts := L.OptTable(2, L.NewTable())
+	threshold, dir := rc.spoolOptions(opts)
+	max := int64(lua.LVAsNumber(opts.RawGetString("max_size")))
+	if max <= 0 {
+		max = rc.maxBodySize()
+	}
+
+	// the body read so far is no longer the body seen by the next handler
+	rc.body = nil
+	var size int64
+	read := func() ([]byte, error) {
+		if rc.r.Body == nil || rc.r.Body == http.NoBody {
+			return nil, nil
+		}
+		buf := make([]byte, defaultBodyChunkSize)
+		n, err := io.ReadFull(rc.r.Body, buf)
+		if size += int64(n); size > max {
+			return nil, fmt.Errorf("request body is larger than %d bytes", max)
+		}
+		if n > 0 {
+			return buf[:n], nil
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		return nil, nil
+	}
+	var u *upload
+	var err error
+	unlocked(L, func() { u, err = rc.spoolUpload(read, threshold, dir) })
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	u.contentType = rc.r.Header.Get("Content-Type")
+	L.Push(newUploadValue(L, u))
+	return 1
+}
+
+// multipartPartSpool implements part:spool(), which reads the part within
+// the max_file_size of the multipart reader and returns its upload, or nil
+// and an error message. The parts larger than the spool_threshold of the
+// multipart options are written to a temporary file.
+func multipartPartSpool(L *lua.LState) int {
+	mp := checkMultipartPart(L)
+	rc := checkRequestContext(L)
+	read := func() ([]byte, error) { return mp.readPart(defaultBodyChunkSize) }
+	var u *upload
+	var err error
+	unlocked(L, func() { u, err = rc.spoolUpload(read, mp.reader.spoolThreshold, mp.reader.spoolDir) })
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	u.filename = mp.part.FileName()
+	u.contentType = mp.part.Header.Get("Content-Type")
+	L.Push(newUploadValue(L, u))
+	return 1
+}
+
+// newUploadValue returns the Lua value of u, with the fields:
+//
+//	path: the path of the temporary file, nil if the upload is in memory
+//	size: the size of the upload in bytes
+//	filename: the file name of the part, nil for a body or a field
+//	content_type: the content type of the part or of the body
+//	read([n]): reads up to n bytes (default 32KB) from the previous read,
+//	or nil at the end
+//	body(): the whole upload as a string
+//
+// Both methods return nil and an error message on failure, e.g. once the
+// request is handled.
+func newUploadValue(L *lua.LState, u *upload) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = u
+	L.SetMetatable(ud, L.GetTypeMetatable(uploadTypeName))
+	return ud
+}
+
+var uploadMethods = map[string]lua.LGFunction{
+	"read": uploadRead,
+	"body": uploadBody,
+}
+
+// uploadIndex implements the __index metamethod of the uploads.
+func uploadIndex(L *lua.LState) int {
+	u := checkUpload(L)
+	key := L.CheckString(2)
+	if fn := uploadMethods[key]; fn != nil {
+		L.Push(L.NewFunction(fn))
+		return 1
+	}
+	switch key {
+	case "path":
+		if u.file != nil {
+			L.Push(lua.LString(u.file.Name()))
+		} else {
+			L.Push(lua.LNil)
+		}
+	case "size":
+		L.Push(lua.LNumber(u.size))
+	case "filename":
+		if u.filename != "" {
+			L.Push(lua.LString(u.filename))
+		} else {
+			L.Push(lua.LNil)
+		}
+	case "content_type":
+		L.Push(lua.LString(u.contentType))
+	default:
+		L.Push(lua.LNil)
+	}
+	return 1
+}
+
+func checkUpload(L *lua.LState) *upload {
+	if u, ok := L.CheckUserData(1).Value.(*upload); ok {
+		return u
+	}
+	L.ArgError(1, "upload expected")
+	return nil
+}
+
+// uploadRead implements upload:read([n]).
+func uploadRead(L *lua.LState) int {
+	u := checkUpload(L)
+	n := L.OptInt(2, defaultBodyChunkSize)
+	if n <= 0 {
+		L.ArgError(2, "size must be positive")
+	}
+	r, err := u.reader(u.offset)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	buf := make([]byte, n)
+	var read int
+	unlocked(L, func() { read, err = io.ReadFull(r, buf) })
+	u.offset += int64(read)
+	if read > 0 {
+		L.Push(lua.LString(buf[:read]))
+		return 1
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LNil)
+	return 1
+}
+
+// uploadBody implements upload:body().
+func uploadBody(L *lua.LState) int {
+	u := checkUpload(L)
+	r, err := u.reader(0)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	var b []byte
+	unlocked(L, func() { b, err = io.ReadAll(r) })
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LString(b))
+	return 1
+}
@@ -0,0 +1,106 @@
+package lua
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUploadSpool(t *testing.T) {
+	dir := t.TempDir()
+	tr, err := NewTester(&Lua{
+		SpoolThreshold: 16,
+		SpoolDir:       dir,
+		Script: `
+			local out = {}
+			local function add(u)
+				local f = u.path and assert(io.open(u.path)):read("*a")
+				local chunks = {}
+				while true do
+					local chunk, err = u:read(8)
+					if not chunk then
+						assert(not err, err)
+						break
+					end
+					chunks[#chunks + 1] = chunk
+				end
+				out[#out + 1] = table.concat({tostring(u.filename), u.size, tostring(u.path ~= nil),
+					tostring(f == nil or f == u:body()), table.concat(chunks) == u:body() and "ok" or "bad"}, " ")
+				if u.path then out[#out + 1] = u.path end
+			end
+			if request.path == "/body" then
+				local u, err = request:spool_body({max_size = 64})
+				if not u then
+					response:write(err)
+					return
+				end
+				add(u)
+			else
+				for part in request:multipart() do
+					add(assert(part:spool()))
+				end
+			end
+			response:write(table.concat(out, "\n"))`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if err := mw.WriteField("field", "small"); err != nil {
+		t.Fatal(err)
+	}
+	fw, err := mw.CreateFormFile("file", "upload.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte(strings.Repeat("x", 100)))
+	mw.Close()
+
+	res := tr.Do(TestRequest{
+		Method: http.MethodPost,
+		Header: http.Header{"Content-Type": {mw.FormDataContentType()}},
+		Body:   buf.String(),
+	})
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	lines := strings.Split(res.Body, "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %q, want the small field, the file and its path", res.Body)
+	}
+	if want := "nil 5 false true ok"; lines[0] != want {
+		t.Errorf("field: got %q, want %q", lines[0], want)
+	}
+	if want := "upload.txt 100 true true ok"; lines[1] != want {
+		t.Errorf("file: got %q, want %q", lines[1], want)
+	}
+	if filepath.Dir(lines[2]) != dir {
+		t.Errorf("got the path %s, want a file of %s", lines[2], dir)
+	}
+	// the temporary files are removed once the request is handled
+	if _, err := os.Stat(lines[2]); !os.IsNotExist(err) {
+		t.Errorf("got %v, want the file to be removed", err)
+	}
+
+	res = tr.Do(TestRequest{Method: http.MethodPost, Path: "/body", Body: strings.Repeat("y", 32)})
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	if lines := strings.Split(res.Body, "\n"); len(lines) != 2 || lines[0] != "nil 32 true true ok" {
+		t.Errorf("body: got %q", res.Body)
+	}
+	res = tr.Do(TestRequest{Method: http.MethodPost, Path: "/body", Body: strings.Repeat("y", 65)})
+	if want := "request body is larger than 64 bytes"; res.Body != want {
+		t.Errorf("got %q, want %q", res.Body, want)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("got %d files, %v, want the spool directory to be empty", len(entries), err)
+	}
+}
@@ -0,0 +1,161 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	lua "github.com/yuin/gopher-lua"
+)
+
+var errNoUpstreams = errors.New("the script returned no upstreams")
+
+func init() {
+	caddy.RegisterModule(LuaUpstreams{})
+}
+
+// LuaUpstreams is a source of the upstreams of the reverse_proxy where a Lua
+// script returns the upstreams of each request, e.g. to route the requests
+// of each tenant to its backends or to roll out a canary:
+//
+//	reverse_proxy {
+//		dynamic lua `caddy.ab.bucket(request.remote_addr, {stable = 95, canary = 5}) == "canary" and {"10.0.0.9:8080"} or {"10.0.0.1:8080", "10.0.0.2:8080"}`
+//	}
+//
+// The script returns the array of the upstreams, each the network address to
+// dial (e.g. "10.0.0.1:8080") or a table with the dial address and the
+// max_requests allowed at once, from which the load balancing policy of the
+// reverse_proxy selects. If the script returns nil or fails, the error is
+// logged and the static upstreams of the reverse_proxy are used instead. The
+// inline Script may be an expression or a chunk with a return statement, and
+// Path is the path of a script file. Like for the lua matcher, the script
+// has access to the request global, the json and kv modules and a subset of
+// the caddy table (ab, ctx and placeholder). It runs for each attempt of
+// the reverse_proxy, so that retries may select other upstreams.
+type LuaUpstreams struct {
+	Script string `json:"script,omitempty"`
+	Path   string `json:"path,omitempty"`
+
+	proto *lua.FunctionProto
+	pool  *statePool
+}
+
+// CaddyModule returns the Caddy module information.
+func (LuaUpstreams) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.upstreams.lua",
+		New: func() caddy.Module { return new(LuaUpstreams) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (u *LuaUpstreams) Provision(ctx caddy.Context) error {
+	if (u.Script == "") == (u.Path == "") {
+		return errors.New("exactly one of the script or path configuration options is required")
+	}
+
+	var err error
+	if u.Path != "" {
+		if u.proto, err = compileFile(u.Path); err != nil {
+			return fmt.Errorf("compiling %s: %w", u.Path, err)
+		}
+	} else if u.proto, err = compileExpression(u.Script, "<upstreams>"); err != nil {
+		return fmt.Errorf("compiling the upstreams script: %w", err)
+	}
+	u.pool = newStatePool(new(StatePool), newMatcherState)
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (u *LuaUpstreams) Cleanup() error {
+	if u.pool != nil {
+		u.pool.close()
+	}
+	return nil
+}
+
+// GetUpstreams implements reverseproxy.UpstreamSource.
+func (u *LuaUpstreams) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
+	L := u.pool.get()
+	defer u.pool.put(L)
+	setRequestContext(L, &requestContext{r: r})
+	L.SetContext(r.Context())
+
+	ret, err := runProto(L, u.proto)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := ret.(*lua.LTable)
+	if !ok {
+		if ret == lua.LNil {
+			return nil, errNoUpstreams
+		}
+		return nil, fmt.Errorf("the script must return an array of upstreams, got %s", ret.Type())
+	}
+
+	upstreams := make([]*reverseproxy.Upstream, 0, t.Len())
+	for i := 1; i <= t.Len(); i++ {
+		switch v := t.RawGetInt(i).(type) {
+		case lua.LString:
+			upstreams = append(upstreams, &reverseproxy.Upstream{Dial: string(v)})
+		case *lua.LTable:
+			dial := lua.LVAsString(v.RawGetString("dial"))
+			if dial == "" {
+				return nil, fmt.Errorf("upstream %d: the dial address is required", i)
+			}
+			upstreams = append(upstreams, &reverseproxy.Upstream{
+				Dial:        dial,
+				MaxRequests: int(lua.LVAsNumber(v.RawGetString("max_requests"))),
+			})
+		default:
+			return nil, fmt.Errorf("upstream %d: string or table expected, got %s", i, v.Type())
+		}
+	}
+	return upstreams, nil
+}
+
+// UnmarshalCaddyfile sets up the upstream source from Caddyfile tokens.
+// Syntax:
+//
+//	dynamic lua [<script>] {
+//		script <script>
+//		path   <path>
+//	}
+func (u *LuaUpstreams) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			u.Script = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			field := d.Val()
+			var dst *string
+			switch field {
+			case "script":
+				dst = &u.Script
+			case "path":
+				dst = &u.Path
+			default:
+				return d.Errf("%s: unknown configuration option", field)
+			}
+			if !d.Args(dst) || d.NextArg() {
+				return d.Errf("%s: %w", field, d.ArgErr())
+			}
+		}
+	}
+	return nil
+}
+
+// interface guards
+var (
+	_ caddy.Provisioner           = (*LuaUpstreams)(nil)
+	_ caddy.CleanerUpper          = (*LuaUpstreams)(nil)
+	_ reverseproxy.UpstreamSource = (*LuaUpstreams)(nil)
+	_ caddyfile.Unmarshaler       = (*LuaUpstreams)(nil)
+)
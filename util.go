@@ -0,0 +1,217 @@
+package lua
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// crockfordAlphabet is the Crockford base32 alphabet of the ULIDs.
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// processStart is the origin of util.monotonic.
+var processStart = time.Now()
+
+// timeLayouts are the names of the layouts of util.format_time and
+// util.parse_time.
+var timeLayouts = map[string]string{
+	"rfc3339":     time.RFC3339,
+	"rfc3339nano": time.RFC3339Nano,
+	"http":        http.TimeFormat,
+}
+
+// preloadUtilModule registers the util module, loaded by scripts with
+// require("util"), with the identifiers and the time functions that the
+// scripts often need:
+//
+//	util.uuid(): a random UUID (version 4)
+//	util.uuid7(): a UUID of version 7, which sorts by creation time, to the
+//	millisecond
+//	util.ulid(): a ULID, which sorts by creation time, to the millisecond
+//	util.now(): the current Unix time in seconds, with a fractional part
+//	util.monotonic(): the seconds elapsed on a monotonic clock, not changed
+//	by the adjustments of the system time, to measure durations
+//	util.format_time([t[, layout]]): the Unix time t (default now) in UTC,
+//	formatted with the layout
+//	util.parse_time(s[, layout]): the Unix time of s parsed with the
+//	layout, or with RFC 3339 or the HTTP date formats if it has none, or
+//	nil and an error message
+//	util.parse_duration(s): the seconds of the duration s, e.g. "1h30m" or
+//	"2d", or nil and an error message
+//	util.format_duration(secs): the duration in seconds formatted like
+//	"1h30m0s"
+//
+// The layouts are "rfc3339" (the default), "rfc3339nano", "http" (the format
+// of the Date header) or the layouts of Go's time package, e.g.
+// "2006-01-02".
+func preloadUtilModule(L *lua.LState) {
+	L.PreloadModule("util", func(L *lua.LState) int {
+		L.Push(L.SetFuncs(L.NewTable(), utilFuncs))
+		return 1
+	})
+}
+
+var utilFuncs = map[string]lua.LGFunction{
+	"uuid":            utilUUID,
+	"uuid7":           utilUUID7,
+	"ulid":            utilULID,
+	"now":             utilNow,
+	"monotonic":       utilMonotonic,
+	"format_time":     utilFormatTime,
+	"parse_time":      utilParseTime,
+	"parse_duration":  utilParseDuration,
+	"format_duration": utilFormatDuration,
+}
+
+// randomID returns 16 bytes, whose first 6 are the Unix time in milliseconds
+// if timed is true, and the others random.
+func randomID(L *lua.LState, timed bool) [16]byte {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		L.RaiseError("reading random bytes: %s", err)
+	}
+	if timed {
+		var ms [8]byte
+		binary.BigEndian.PutUint64(ms[:], uint64(time.Now().UnixMilli()))
+		copy(id[:6], ms[2:])
+	}
+	return id
+}
+
+// formatUUID returns the canonical form of the UUID id of version v.
+func formatUUID(id [16]byte, v byte) string {
+	id[6] = id[6]&0x0f | v<<4
+	id[8] = id[8]&0x3f | 0x80
+	var b [36]byte
+	hex.Encode(b[0:8], id[0:4])
+	b[8] = '-'
+	hex.Encode(b[9:13], id[4:6])
+	b[13] = '-'
+	hex.Encode(b[14:18], id[6:8])
+	b[18] = '-'
+	hex.Encode(b[19:23], id[8:10])
+	b[23] = '-'
+	hex.Encode(b[24:], id[10:])
+	return string(b[:])
+}
+
+// utilUUID implements util.uuid().
+func utilUUID(L *lua.LState) int {
+	L.Push(lua.LString(formatUUID(randomID(L, false), 4)))
+	return 1
+}
+
+// utilUUID7 implements util.uuid7().
+func utilUUID7(L *lua.LState) int {
+	L.Push(lua.LString(formatUUID(randomID(L, true), 7)))
+	return 1
+}
+
+// utilULID implements util.ulid().
+func utilULID(L *lua.LState) int {
+	id := randomID(L, true)
+	// the 128 bits are encoded in 26 characters of 5 bits, the first one
+	// having 2 leading zero bits
+	var b [26]byte
+	for i := range b {
+		var v byte
+		for bit := i*5 - 2; bit < i*5+3; bit++ {
+			v <<= 1
+			if bit >= 0 && id[bit/8]&(0x80>>(bit%8)) != 0 {
+				v |= 1
+			}
+		}
+		b[i] = crockfordAlphabet[v]
+	}
+	L.Push(lua.LString(b[:]))
+	return 1
+}
+
+// utilNow implements util.now().
+func utilNow(L *lua.LState) int {
+	L.Push(lua.LNumber(float64(time.Now().UnixNano()) / 1e9))
+	return 1
+}
+
+// utilMonotonic implements util.monotonic().
+func utilMonotonic(L *lua.LState) int {
+	L.Push(lua.LNumber(time.Since(processStart).Seconds()))
+	return 1
+}
+
+// optLayout returns the layout at index n of the stack, or def.
+func optLayout(L *lua.LState, n int, def string) string {
+	layout := L.OptString(n, def)
+	if named, ok := timeLayouts[layout]; ok {
+		return named
+	}
+	return layout
+}
+
+// unixTime returns the time of the Unix time t in seconds.
+func unixTime(t float64) time.Time {
+	sec, frac := math.Modf(t)
+	return time.Unix(int64(sec), int64(frac*1e9))
+}
+
+// utilFormatTime implements util.format_time([t[, layout]]).
+func utilFormatTime(L *lua.LState) int {
+	t := time.Now()
+	if v, ok := L.Get(1).(lua.LNumber); ok {
+		t = unixTime(float64(v))
+	} else if L.Get(1) != lua.LNil {
+		L.ArgError(1, "number expected")
+	}
+	L.Push(lua.LString(t.UTC().Format(optLayout(L, 2, "rfc3339"))))
+	return 1
+}
+
+// utilParseTime implements util.parse_time(s[, layout]).
+func utilParseTime(L *lua.LState) int {
+	s := L.CheckString(1)
+	var (
+		t   time.Time
+		err error
+	)
+	if L.Get(2) == lua.LNil {
+		if t, err = time.Parse(time.RFC3339, s); err != nil {
+			if ht, herr := http.ParseTime(s); herr == nil {
+				t, err = ht, nil
+			}
+		}
+	} else {
+		t, err = time.Parse(optLayout(L, 2, ""), s)
+	}
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LNumber(float64(t.UnixNano()) / 1e9))
+	return 1
+}
+
+// utilParseDuration implements util.parse_duration(s).
+func utilParseDuration(L *lua.LState) int {
+	d, err := caddy.ParseDuration(L.CheckString(1))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LNumber(d.Seconds()))
+	return 1
+}
+
+// utilFormatDuration implements util.format_duration(secs).
+func utilFormatDuration(L *lua.LState) int {
+	secs := float64(L.CheckNumber(1))
+	L.Push(lua.LString(time.Duration(secs * float64(time.Second)).String()))
+	return 1
+}
@@ -0,0 +1,277 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// maxRefDepth is the depth of the fields of the libraries and modules that
+// are referenced by their path rather than copied, e.g. 2 for
+// caddy.cache.get.
+const maxRefDepth = 2
+
+// valueCopier copies Lua values out of a state, to create them again in
+// other states: the scalars, the tables (with their metatable) and the Lua
+// functions (with their upvalues) are copied, keeping the references they
+// share and their cycles, while the libraries and the loaded modules, such
+// as string.format or the json module, are referenced by their path and
+// looked up (or required) in the other states. Go functions and userdata
+// cannot be copied otherwise.
+type valueCopier struct {
+	refs   map[lua.LValue]valueRef
+	tables map[*lua.LTable]*tableCopy
+	funcs  map[*lua.LFunction]*functionCopy
+}
+
+// valueRef is the path of a value of a library or of a module: the name of
+// the global, or of the module if module is set, followed by the names of
+// the fields.
+type valueRef struct {
+	module bool
+	path   []string
+}
+
+// tableCopy is the copy of a table.
+type tableCopy struct {
+	keys   []interface{}
+	values []interface{}
+	meta   interface{}
+}
+
+// functionCopy is the copy of a Lua function.
+type functionCopy struct {
+	proto *lua.FunctionProto
+
+	// upvalues are the copies of the upvalues of the function.
+	upvalues []interface{}
+}
+
+// newValueCopier returns a copier of the values of L, in which the values of
+// the globals named in libraries and of the loaded modules are referenced.
+func newValueCopier(L *lua.LState, libraries []string) *valueCopier {
+	c := &valueCopier{
+		refs:   make(map[lua.LValue]valueRef),
+		tables: make(map[*lua.LTable]*tableCopy),
+		funcs:  make(map[*lua.LFunction]*functionCopy),
+	}
+	// the modules first, which are required if they are not loaded rather
+	// than looked up in package.loaded
+	c.indexModules(L)
+	for _, name := range libraries {
+		if name != "_G" {
+			c.index(L.GetGlobal(name), valueRef{path: []string{name}}, 0)
+		}
+	}
+	return c
+}
+
+// indexModules records the paths of the modules loaded in L, e.g. after
+// running a script that requires modules.
+func (c *valueCopier) indexModules(L *lua.LState) {
+	if loaded, ok := L.G.Registry.RawGetString("_LOADED").(*lua.LTable); ok {
+		loaded.ForEach(func(k, v lua.LValue) {
+			if name, ok := k.(lua.LString); ok && name != "_G" {
+				c.index(v, valueRef{module: true, path: []string{string(name)}}, 0)
+			}
+		})
+	}
+}
+
+// index records the path of v, and of its fields down to maxRefDepth.
+func (c *valueCopier) index(v lua.LValue, ref valueRef, depth int) {
+	switch v.(type) {
+	case *lua.LTable, *lua.LFunction:
+	default:
+		return
+	}
+	if _, ok := c.refs[v]; ok {
+		return
+	}
+	c.refs[v] = ref
+	t, ok := v.(*lua.LTable)
+	if !ok || depth >= maxRefDepth {
+		return
+	}
+	t.ForEach(func(k, fv lua.LValue) {
+		if name, ok := k.(lua.LString); ok {
+			path := append(append([]string(nil), ref.path...), string(name))
+			c.index(fv, valueRef{module: ref.module, path: path}, depth+1)
+		}
+	})
+}
+
+// copy returns the copy of v.
+func (c *valueCopier) copy(v lua.LValue) (interface{}, error) {
+	switch v := v.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		return float64(v), nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LTable:
+		if ref, ok := c.refs[v]; ok {
+			return ref, nil
+		}
+		return c.table(v)
+	case *lua.LFunction:
+		if ref, ok := c.refs[v]; ok {
+			return ref, nil
+		}
+		if v.IsG {
+			return nil, errors.New("Go functions cannot be copied")
+		}
+		return c.function(v)
+	}
+	return nil, fmt.Errorf("cannot copy a Lua %s", v.Type())
+}
+
+func (c *valueCopier) table(t *lua.LTable) (*tableCopy, error) {
+	if tc := c.tables[t]; tc != nil {
+		return tc, nil
+	}
+	tc := new(tableCopy)
+	c.tables[t] = tc
+	var err error
+	t.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+		var ck, cv interface{}
+		if ck, err = c.copy(k); err != nil {
+			return
+		}
+		if cv, err = c.copy(v); err != nil {
+			err = fmt.Errorf("the field %s cannot be copied: %w", k, err)
+			return
+		}
+		tc.keys = append(tc.keys, ck)
+		tc.values = append(tc.values, cv)
+	})
+	if err == nil && t.Metatable != lua.LNil {
+		if tc.meta, err = c.copy(t.Metatable); err != nil {
+			err = fmt.Errorf("the metatable cannot be copied: %w", err)
+		}
+	}
+	return tc, err
+}
+
+func (c *valueCopier) function(fn *lua.LFunction) (*functionCopy, error) {
+	if fc := c.funcs[fn]; fc != nil {
+		return fc, nil
+	}
+	fc := &functionCopy{proto: fn.Proto, upvalues: make([]interface{}, len(fn.Upvalues))}
+	c.funcs[fn] = fc
+	for i, uv := range fn.Upvalues {
+		v, err := c.copy(uv.Value())
+		if err != nil {
+			name := "?"
+			if i < len(fn.Proto.DbgUpvalues) {
+				name = fn.Proto.DbgUpvalues[i]
+			}
+			return nil, fmt.Errorf("the upvalue %s cannot be copied: %w", name, err)
+		}
+		fc.upvalues[i] = v
+	}
+	return fc, nil
+}
+
+// valueMaker creates the copies of values in a state, once for the copies
+// that are shared.
+type valueMaker struct {
+	L      *lua.LState
+	tables map[*tableCopy]*lua.LTable
+	funcs  map[*functionCopy]*lua.LFunction
+}
+
+func newValueMaker(L *lua.LState) *valueMaker {
+	return &valueMaker{
+		L:      L,
+		tables: make(map[*tableCopy]*lua.LTable),
+		funcs:  make(map[*functionCopy]*lua.LFunction),
+	}
+}
+
+// value returns the value of the copy v.
+func (m *valueMaker) value(v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case *tableCopy:
+		if t := m.tables[v]; t != nil {
+			return t
+		}
+		t := m.L.CreateTable(0, len(v.keys))
+		m.tables[v] = t
+		for i, k := range v.keys {
+			t.RawSet(m.value(k), m.value(v.values[i]))
+		}
+		if v.meta != nil {
+			t.Metatable = m.value(v.meta)
+		}
+		return t
+	case *functionCopy:
+		return m.function(v)
+	case valueRef:
+		return m.ref(v)
+	}
+	return fromGo(m.L, v)
+}
+
+// function returns the function of the copy fc.
+func (m *valueMaker) function(fc *functionCopy) *lua.LFunction {
+	if fn := m.funcs[fc]; fn != nil {
+		return fn
+	}
+	fn := m.L.NewFunctionFromProto(fc.proto)
+	m.funcs[fc] = fn
+	for i, v := range fc.upvalues {
+		uv := &lua.Upvalue{}
+		uv.SetValue(m.value(v))
+		fn.Upvalues[i] = uv
+	}
+	return fn
+}
+
+// ref returns the value at the path of ref, requiring its module if it is
+// not loaded yet, or nil if there is none.
+func (m *valueMaker) ref(ref valueRef) lua.LValue {
+	L := m.L
+	var v lua.LValue
+	if ref.module {
+		if loaded, ok := L.G.Registry.RawGetString("_LOADED").(*lua.LTable); ok {
+			v = loaded.RawGetString(ref.path[0])
+		}
+		if v == nil || v == lua.LNil {
+			err := L.CallByParam(lua.P{Fn: L.GetGlobal("require"), NRet: 1, Protect: true}, lua.LString(ref.path[0]))
+			if err != nil {
+				return lua.LNil
+			}
+			v = L.Get(-1)
+			L.Pop(1)
+		}
+	} else {
+		v = L.GetGlobal(ref.path[0])
+	}
+	for _, name := range ref.path[1:] {
+		t, ok := v.(*lua.LTable)
+		if !ok {
+			return lua.LNil
+		}
+		v = t.RawGetString(name)
+	}
+	return v
+}
+
+// globalNames returns the names of the globals of L.
+func globalNames(L *lua.LState) []string {
+	var names []string
+	L.G.Global.ForEach(func(k, _ lua.LValue) {
+		if name, ok := k.(lua.LString); ok {
+			names = append(names, string(name))
+		}
+	})
+	return names
+}
@@ -0,0 +1,48 @@
+package lua
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// expandVars returns the handler's Vars with their global placeholders
+// (e.g. {env.API_KEY} or {system.hostname}) replaced. Unknown placeholders
+// are kept as is, so that values may contain braces.
+func (l *Lua) expandVars() map[string]string {
+	if len(l.Vars) == 0 {
+		return nil
+	}
+	repl := caddy.NewReplacer()
+	vars := make(map[string]string, len(l.Vars))
+	for name, v := range l.Vars {
+		vars[name] = repl.ReplaceKnown(v, "")
+	}
+	return vars
+}
+
+// setConfigTable sets the global config table of L, which holds the
+// handler's Vars so that the same script can be configured differently by
+// each handler, e.g. with the API keys or the upstream URLs of a site. The
+// table is read-only: assigning a field raises an error. As it is a proxy
+// of the values, its fields are accessed by name and cannot be iterated
+// with pairs.
+func (l *Lua) setConfigTable(L *lua.LState) {
+	values := L.CreateTable(0, len(l.vars))
+	for name, v := range l.vars {
+		values.RawSetString(name, lua.LString(v))
+	}
+
+	t := L.NewTable()
+	mt := L.CreateTable(0, 3)
+	mt.RawSetString("__index", values)
+	mt.RawSetString("__newindex", L.NewFunction(configNewIndex))
+	mt.RawSetString("__metatable", lua.LFalse)
+	L.SetMetatable(t, mt)
+	L.SetGlobal("config", t)
+}
+
+// configNewIndex implements the __newindex metamethod of config.
+func configNewIndex(L *lua.LState) int {
+	L.RaiseError("config is read-only")
+	return 0
+}
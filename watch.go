@@ -0,0 +1,138 @@
+package lua
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+)
+
+// defaultWatchInterval is the interval at which the script files are checked
+// for changes when the watch option has no interval.
+const defaultWatchInterval = time.Second
+
+// scriptSet holds the compiled scripts of a handler, keyed by path.
+type scriptSet struct {
+	protos atomic.Value // map[string]*lua.FunctionProto
+	cancel context.CancelFunc
+
+	// mu serializes the updates of protos.
+	mu sync.Mutex
+}
+
+func newScriptSet(protos map[string]*lua.FunctionProto) *scriptSet {
+	s := new(scriptSet)
+	s.protos.Store(protos)
+	return s
+}
+
+// get returns the compiled script at path.
+func (s *scriptSet) get(path string) *lua.FunctionProto {
+	return s.protos.Load().(map[string]*lua.FunctionProto)[path]
+}
+
+// paths returns the sorted paths of the script files.
+func (s *scriptSet) paths() []string {
+	var paths []string
+	for path := range s.protos.Load().(map[string]*lua.FunctionProto) {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// recompile compiles all the script files again. If one of them fails to
+// compile, the previous versions are kept and the error is returned.
+func (s *scriptSet) recompile() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	protos := s.protos.Load().(map[string]*lua.FunctionProto)
+	updated := make(map[string]*lua.FunctionProto, len(protos))
+	for path, proto := range protos {
+		if path != "" {
+			var err error
+			if proto, err = compileFile(path); err != nil {
+				return fmt.Errorf("compiling %s: %w", path, err)
+			}
+		}
+		updated[path] = proto
+	}
+	s.protos.Store(updated)
+	return nil
+}
+
+// watch starts recompiling the script files when their modification time
+// changes, checking them every interval. If a script fails to compile, the
+// error is logged and the previous version is kept.
+func (s *scriptSet) watch(interval time.Duration, logger *zap.Logger) {
+	modTimes := make(map[string]time.Time)
+	for path := range s.protos.Load().(map[string]*lua.FunctionProto) {
+		if fi, err := os.Stat(path); err == nil {
+			modTimes[path] = fi.ModTime()
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				s.reload(modTimes, logger)
+			}
+		}
+	}()
+}
+
+// stop stops watching the script files.
+func (s *scriptSet) stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// reload recompiles the script files whose modification time is not the one
+// in modTimes.
+func (s *scriptSet) reload(modTimes map[string]time.Time, logger *zap.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	protos := s.protos.Load().(map[string]*lua.FunctionProto)
+	var updated map[string]*lua.FunctionProto
+	for path, mt := range modTimes {
+		fi, err := os.Stat(path)
+		if err != nil || fi.ModTime().Equal(mt) {
+			continue
+		}
+		modTimes[path] = fi.ModTime()
+
+		proto, err := compileFile(path)
+		if err != nil {
+			logger.Error("recompiling script, keeping the previous version",
+				zap.String("path", path), zap.Error(err))
+			continue
+		}
+		if updated == nil {
+			updated = make(map[string]*lua.FunctionProto, len(protos))
+			for p, proto := range protos {
+				updated[p] = proto
+			}
+		}
+		updated[path] = proto
+		logger.Info("recompiled script", zap.String("path", path))
+	}
+	if updated != nil {
+		s.protos.Store(updated)
+	}
+}
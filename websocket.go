@@ -0,0 +1,223 @@
+package lua
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"golang.org/x/net/websocket"
+)
+
+const websocketTypeName = "caddy.websocket"
+
+// openWebSocketType registers the type of the WebSocket connections.
+func openWebSocketType(L *lua.LState) {
+	mt := L.NewTypeMetatable(websocketTypeName)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), websocketMethods))
+}
+
+var websocketMethods = map[string]lua.LGFunction{
+	"send":    websocketSend,
+	"receive": websocketReceive,
+	"close":   websocketClose,
+}
+
+// caddyWebSocket implements caddy.websocket(fn[, opts]), which upgrades the
+// connection to a WebSocket and calls fn with the connection, closed when fn
+// returns:
+//
+//	ws:send(s[, "binary"]): sends s in a text (default) or binary frame,
+//	returns true, or nil and an error message
+//	ws:receive([timeout]): returns the next message and its type ("text" or
+//	"binary"), or nil and an error message ("closed" once the client
+//	closed the connection, "timeout" if no message was received in timeout
+//	seconds)
+//	ws:close()
+//
+// The pings of the client are answered automatically. The opts table
+// supports origins, an array of the origins allowed to connect in addition
+// to the request's host (e.g. "https://example.com", "*" for any), and
+// max_message_size, the maximum size in bytes of the received messages
+// (default 32MB). It returns true once fn returned, or nil and an error
+// message if the request is not a WebSocket handshake. The execution_timeout
+// of the handler applies to the whole connection.
+func caddyWebSocket(L *lua.LState) int {
+	rc := checkRequestContext(L)
+	fn := L.CheckFunction(1)
+	opts := L.OptTable(2, L.NewTable())
+	if rc.wroteHeader {
+		L.RaiseError("caddy.websocket: the response header is already written")
+	}
+
+	if !strings.EqualFold(rc.r.Header.Get("Upgrade"), "websocket") {
+		L.Push(lua.LNil)
+		L.Push(lua.LString("not a websocket handshake"))
+		return 2
+	}
+	if _, ok := rc.w.(http.Hijacker); !ok || rc.r.ProtoMajor != 1 {
+		L.Push(lua.LNil)
+		L.Push(lua.LString("the connection cannot be upgraded"))
+		return 2
+	}
+
+	var origins []string
+	if t := optTable(opts.RawGetString("origins")); t != nil {
+		t.ForEach(func(_, v lua.LValue) { origins = append(origins, v.String()) })
+	}
+	maxSize := int(lua.LVAsNumber(opts.RawGetString("max_message_size")))
+
+	var callErr error
+	srv := websocket.Server{
+		Handshake: func(cfg *websocket.Config, r *http.Request) error {
+			return checkWebSocketOrigin(r, origins)
+		},
+		Handler: func(conn *websocket.Conn) {
+			defer enterState(L)()
+			conn.MaxPayloadBytes = maxSize
+			if ctx := stateContext(L); ctx != nil {
+				// unblock the reads and writes once the script is canceled
+				stop := make(chan struct{})
+				defer close(stop)
+				go func() {
+					select {
+					case <-ctx.Done():
+						conn.Close()
+					case <-stop:
+					}
+				}()
+			}
+			ud := L.NewUserData()
+			ud.Value = conn
+			L.SetMetatable(ud, L.GetTypeMetatable(websocketTypeName))
+			callErr = L.CallByParam(lua.P{Fn: fn, NRet: 0, Protect: true}, ud)
+		},
+	}
+	rc.wroteHeader = true
+	rc.responded = true
+	unlocked(L, func() { srv.ServeHTTP(rc.w, rc.r) })
+	// a canceled request is a client that went away, not a script error
+	if callErr != nil && rc.r.Context().Err() == nil {
+		L.RaiseError("caddy.websocket: %s", callErr)
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// checkWebSocketOrigin returns an error if the Origin of the handshake r is
+// set and is neither the request's host nor one of origins.
+func checkWebSocketOrigin(r *http.Request, origins []string) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// not a browser
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return nil
+	}
+	for _, o := range origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return nil
+		}
+	}
+	return errors.New("origin not allowed")
+}
+
+func checkWebSocket(L *lua.LState) *websocket.Conn {
+	if conn, ok := L.CheckUserData(1).Value.(*websocket.Conn); ok {
+		return conn
+	}
+	L.ArgError(1, "websocket expected")
+	return nil
+}
+
+// websocketSend implements ws:send(s[, "binary"]).
+func websocketSend(L *lua.LState) int {
+	conn := checkWebSocket(L)
+	s := L.CheckString(2)
+
+	var err error
+	switch frameType := L.OptString(3, "text"); frameType {
+	case "text":
+		err = websocket.Message.Send(conn, s)
+	case "binary":
+		err = websocket.Message.Send(conn, []byte(s))
+	default:
+		L.ArgError(3, `"text" or "binary" expected`)
+	}
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// websocketReceive implements ws:receive([timeout]).
+func websocketReceive(L *lua.LState) int {
+	conn := checkWebSocket(L)
+	var deadline time.Time
+	if timeout := optSeconds(L, 2); timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	var msg webSocketMessage
+	var err error
+	unlocked(L, func() { err = webSocketCodec.Receive(conn, &msg) })
+	if err != nil {
+		var netErr interface{ Timeout() bool }
+		msg := err.Error()
+		switch {
+		case errors.Is(err, io.EOF):
+			msg = "closed"
+		case errors.As(err, &netErr) && netErr.Timeout():
+			msg = "timeout"
+		}
+		L.Push(lua.LNil)
+		L.Push(lua.LString(msg))
+		return 2
+	}
+	L.Push(lua.LString(msg.data))
+	if msg.binary {
+		L.Push(lua.LString("binary"))
+	} else {
+		L.Push(lua.LString("text"))
+	}
+	return 2
+}
+
+// webSocketMessage is a message received from a WebSocket.
+type webSocketMessage struct {
+	data   []byte
+	binary bool
+}
+
+// webSocketCodec receives the messages with their type, which
+// websocket.Message does not report.
+var webSocketCodec = websocket.Codec{
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		msg := v.(*webSocketMessage)
+		msg.data = data
+		msg.binary = payloadType == websocket.BinaryFrame
+		return nil
+	},
+}
+
+// websocketClose implements ws:close().
+func websocketClose(L *lua.LState) int {
+	checkWebSocket(L).Close()
+	return 0
+}
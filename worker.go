@@ -0,0 +1,441 @@
+package lua
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// isolationProcess is the isolation mode in which the requests run in
+// worker processes (see workerPool).
+const isolationProcess = "process"
+
+// workerCommand returns the command that starts a worker process, the
+// lua-worker command of the running Caddy binary.
+var workerCommand = func() (*exec.Cmd, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return exec.Command(exe, "lua-worker"), nil
+}
+
+// workerPool runs the requests of a handler in the process isolation mode
+// in Workers worker processes (the number of CPUs by default), so that a
+// script that crashes or exhausts the memory of its process does not take
+// down the Caddy process. Each worker is a lua-worker process of the Caddy
+// binary that provisions the handler from its configuration, with the
+// default isolation mode, and handles one request at a time: the other
+// requests wait for a worker. A worker that exits or fails to respond is
+// replaced by a new one for the next request, and the request fails with a
+// 502 error. A canceled request stops its worker.
+//
+// The workers communicate with the handler over their standard input and
+// output: the request is sent with its body, read up to the handler's
+// max_body_size, and the response of the worker is written once it is
+// complete, so the responses are not streamed (e.g. neither SSE nor
+// WebSocket work). The next handler is called by the handler when the
+// script of a worker calls it, with the request as modified by the script,
+// and its response is sent back to the worker. The workers do not share
+// their globals, kv stores, timers or caddy.ctx values with each other nor
+// with the Caddy process, the TLS state of the connection is not available
+// to their scripts, and the placeholders and variables set by the handlers
+// that ran before are not sent to them.
+type workerPool struct {
+	config  workerConfig
+	maxBody int64
+	logger  *zap.Logger
+
+	// idle holds the idle workers, nil for the workers to start again.
+	idle chan *worker
+}
+
+// workerConfig is the configuration sent to a worker when it starts.
+type workerConfig struct {
+	Handler      []byte
+	Destinations []HTTPDestination
+}
+
+// workerRequest is a request sent to a worker, or a request of a worker to
+// call the next handler.
+type workerRequest struct {
+	Method     string
+	Target     string
+	Host       string
+	RemoteAddr string
+	Header     http.Header
+	Body       []byte
+}
+
+// workerResponse is the response of a worker, the response of the next
+// handler sent to a worker, or the request of a worker to call the next
+// handler if Next is set. The worker started if the first response of a
+// worker has no Error.
+type workerResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+
+	// Error is the error returned by the handler, whose status is Status.
+	Error string
+
+	Next *workerRequest
+}
+
+// worker is a worker process.
+type worker struct {
+	cmd    *exec.Cmd
+	enc    *gob.Encoder
+	dec    *gob.Decoder
+	stdin  io.Closer
+	exited chan struct{}
+}
+
+// newWorkerPool starts the workers of the handler l.
+func newWorkerPool(l *Lua) (*workerPool, error) {
+	cfg, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	n := l.Workers
+	if n == 0 {
+		n = runtime.NumCPU()
+	}
+	p := &workerPool{
+		config:  workerConfig{Handler: cfg, Destinations: l.globalDestinations},
+		maxBody: l.MaxBodySize,
+		logger:  l.logger,
+		idle:    make(chan *worker, n),
+	}
+	for i := 0; i < n; i++ {
+		wk, err := p.start()
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		p.idle <- wk
+	}
+	return p, nil
+}
+
+// start starts a worker and waits until it provisioned the handler.
+func (p *workerPool) start() (*worker, error) {
+	cmd, err := workerCommand()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	wk := &worker{
+		cmd:    cmd,
+		enc:    gob.NewEncoder(stdin),
+		dec:    gob.NewDecoder(stdout),
+		stdin:  stdin,
+		exited: make(chan struct{}),
+	}
+	go func() {
+		err := cmd.Wait()
+		close(wk.exited)
+		p.logger.Debug("the worker process exited", zap.Int("pid", cmd.Process.Pid), zap.Error(err))
+	}()
+
+	var ready workerResponse
+	if err := wk.enc.Encode(&p.config); err == nil {
+		err = wk.dec.Decode(&ready)
+	}
+	if err == nil && ready.Error != "" {
+		err = errors.New(ready.Error)
+	}
+	if err != nil {
+		wk.kill()
+		return nil, fmt.Errorf("starting the worker process: %w", err)
+	}
+	return wk, nil
+}
+
+// kill stops the worker.
+func (wk *worker) kill() {
+	wk.stdin.Close()
+	wk.cmd.Process.Kill()
+}
+
+// close stops the idle workers.
+func (p *workerPool) close() {
+	for {
+		select {
+		case wk := <-p.idle:
+			if wk != nil {
+				wk.kill()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// serve handles r in a worker, calling next if its script calls it.
+func (p *workerPool) serve(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	ctx := r.Context()
+	var wk *worker
+	select {
+	case wk = <-p.idle:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if wk != nil {
+		select {
+		case <-wk.exited:
+			wk = nil
+		default:
+		}
+	}
+	if wk == nil {
+		var err error
+		if wk, err = p.start(); err != nil {
+			p.idle <- nil
+			return caddyhttp.Error(http.StatusBadGateway, err)
+		}
+	}
+
+	// the worker is stopped if the request is canceled
+	stop, canceled := make(chan struct{}), false
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ctx.Done():
+			canceled = true
+			wk.kill()
+		case <-stop:
+		}
+	}()
+	res, err := p.exchange(wk, r, next)
+	close(stop)
+	wg.Wait()
+
+	if err != nil || canceled {
+		wk.kill()
+		p.idle <- nil
+		if canceled {
+			return ctx.Err()
+		}
+		p.logger.Error("the worker process failed", zap.Int("pid", wk.cmd.Process.Pid), zap.Error(err))
+		return caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("the worker process failed: %w", err))
+	}
+	p.idle <- wk
+	return res.write(w)
+}
+
+// exchange sends r to the worker and returns its response, calling next for
+// the worker in the meantime.
+func (p *workerPool) exchange(wk *worker, r *http.Request, next caddyhttp.Handler) (*workerResponse, error) {
+	target := r.RequestURI
+	if target == "" {
+		target = r.URL.RequestURI()
+	}
+	req := workerRequest{
+		Method:     r.Method,
+		Target:     target,
+		Host:       r.Host,
+		RemoteAddr: r.RemoteAddr,
+		Header:     r.Header,
+	}
+	if r.Body != nil {
+		body := io.Reader(r.Body)
+		if p.maxBody > 0 {
+			// the worker fails the reads of the larger bodies
+			body = io.LimitReader(body, p.maxBody+1)
+		}
+		var err error
+		if req.Body, err = io.ReadAll(body); err != nil {
+			return nil, caddyhttp.Error(http.StatusBadRequest, err)
+		}
+	}
+	if err := wk.enc.Encode(&req); err != nil {
+		return nil, err
+	}
+	for {
+		var res workerResponse
+		if err := wk.dec.Decode(&res); err != nil {
+			return nil, err
+		}
+		if res.Next == nil {
+			return &res, nil
+		}
+		nres, err := serveWorkerNext(r, res.Next, next)
+		if err != nil {
+			return nil, err
+		}
+		if err := wk.enc.Encode(nres); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// serveWorkerNext calls next with r modified like the request req of a
+// worker, and returns its response.
+func serveWorkerNext(r *http.Request, req *workerRequest, next caddyhttp.Handler) (*workerResponse, error) {
+	u, err := url.ParseRequestURI(req.Target)
+	if err != nil {
+		return nil, err
+	}
+	nr := r.Clone(r.Context())
+	nr.Method = req.Method
+	nr.URL = u
+	nr.RequestURI = req.Target
+	nr.Host = req.Host
+	nr.Header = req.Header
+	nr.Body = io.NopCloser(bytes.NewReader(req.Body))
+	nr.ContentLength = int64(len(req.Body))
+
+	rec := httptest.NewRecorder()
+	err = next.ServeHTTP(rec, nr)
+	return newWorkerResponse(rec, err), nil
+}
+
+// newWorkerResponse returns the response recorded by rec, of the handler
+// that returned err.
+func newWorkerResponse(rec *httptest.ResponseRecorder, err error) *workerResponse {
+	res := &workerResponse{Status: rec.Code, Header: rec.Header(), Body: rec.Body.Bytes()}
+	if err != nil {
+		res.Error = err.Error()
+		if !rec.Flushed && rec.Body.Len() == 0 {
+			res.Status = errorStatus(err)
+		}
+	}
+	return res
+}
+
+// write writes the response to w, or returns its error if it has one and
+// no body.
+func (res *workerResponse) write(w http.ResponseWriter) error {
+	if res.Error != "" && len(res.Body) == 0 {
+		return caddyhttp.Error(res.Status, errors.New(res.Error))
+	}
+	for k, vals := range res.Header {
+		w.Header()[k] = vals
+	}
+	w.WriteHeader(res.Status)
+	_, err := w.Write(res.Body)
+	return err
+}
+
+// runWorker runs a worker process that reads its configuration and the
+// requests from in, and writes its responses to out.
+func runWorker(in io.Reader, out io.Writer) error {
+	dec, enc := gob.NewDecoder(in), gob.NewEncoder(out)
+	var cfg workerConfig
+	if err := dec.Decode(&cfg); err != nil {
+		return err
+	}
+	t, err := newWorkerTester(cfg)
+	if err != nil {
+		enc.Encode(&workerResponse{Error: err.Error()})
+		return err
+	}
+	defer t.Close()
+	if err := enc.Encode(&workerResponse{}); err != nil {
+		return err
+	}
+
+	t.Next = caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		req := workerRequest{
+			Method:     r.Method,
+			Target:     r.URL.RequestURI(),
+			Host:       r.Host,
+			RemoteAddr: r.RemoteAddr,
+			Header:     r.Header,
+		}
+		var err error
+		if req.Body, err = io.ReadAll(r.Body); err != nil {
+			return err
+		}
+		if err := enc.Encode(&workerResponse{Next: &req}); err != nil {
+			return err
+		}
+		var res workerResponse
+		if err := dec.Decode(&res); err != nil {
+			return err
+		}
+		return res.write(w)
+	})
+	for {
+		var req workerRequest
+		if err := dec.Decode(&req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		w := httptest.NewRecorder()
+		err := t.serve(w, newWorkerHTTPRequest(&req), func() {})
+		if err := enc.Encode(newWorkerResponse(w, err)); err != nil {
+			return err
+		}
+	}
+}
+
+// newWorkerHTTPRequest returns the request req received by a worker.
+func newWorkerHTTPRequest(req *workerRequest) *http.Request {
+	r := httptest.NewRequest(req.Method, req.Target, bytes.NewReader(req.Body))
+	r.Host = req.Host
+	r.RemoteAddr = req.RemoteAddr
+	r.Header = req.Header
+	if r.Header == nil {
+		r.Header = make(http.Header)
+	}
+	return r
+}
+
+// newWorkerTester returns the Tester that handles the requests of a worker
+// with the handler configured by cfg.
+func newWorkerTester(cfg workerConfig) (*Tester, error) {
+	l := new(Lua)
+	if err := json.Unmarshal(cfg.Handler, l); err != nil {
+		return nil, err
+	}
+	l.Isolation, l.Workers = "", 0
+	l.globalDestinations = cfg.Destinations
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t := &Tester{handler: l, cancel: cancel}
+	if err := l.provision(ctx, caddy.DefaultStorage, logger.Named("http.handlers.lua.worker")); err != nil {
+		t.Close()
+		return nil, err
+	}
+	if err := l.Validate(); err != nil {
+		t.Close()
+		return nil, err
+	}
+	return t, nil
+}
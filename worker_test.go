@@ -0,0 +1,102 @@
+package lua
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// TestWorkerHelperProcess is the worker process of the tests of the process
+// isolation mode, started by useTestWorkers.
+func TestWorkerHelperProcess(t *testing.T) {
+	if os.Getenv("CADDY_LUA_TEST_WORKER") != "1" {
+		return
+	}
+	if err := runWorker(os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// useTestWorkers makes the handlers start the test binary as their worker
+// processes for the duration of the test.
+func useTestWorkers(t *testing.T) {
+	prev := workerCommand
+	workerCommand = func() (*exec.Cmd, error) {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestWorkerHelperProcess$", "-test.v=false")
+		cmd.Env = append(os.Environ(), "CADDY_LUA_TEST_WORKER=1")
+		return cmd, nil
+	}
+	t.Cleanup(func() { workerCommand = prev })
+}
+
+func TestProcessIsolation(t *testing.T) {
+	useTestWorkers(t)
+	tr, err := NewTester(&Lua{
+		Isolation: isolationProcess,
+		Workers:   1,
+		Script: `
+			local count = require("kv").incr("count")
+			if request.path == "/crash" then
+				os.exit(3)
+			elseif request.path == "/next" then
+				request:set_header("X-Worker", "yes")
+				return
+			elseif request.path == "/error" then
+				error("boom")
+			end
+			local body = request:body()
+			response:set_header("X-Count", tostring(count))
+			response:write(request.method .. " " .. request.path .. " " .. body)`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	tr.Next = caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusAccepted)
+		_, err := io.WriteString(w, "next "+r.Header.Get("X-Worker"))
+		return err
+	})
+
+	res := tr.Do(TestRequest{Method: http.MethodPost, Path: "/a?b=c", Body: "body"})
+	if res.Err != nil || res.Status != http.StatusOK || res.Body != "POST /a body" {
+		t.Errorf("got %d %q (%v), want the response of the worker", res.Status, res.Body, res.Err)
+	}
+	res = tr.Do(TestRequest{Path: "/next"})
+	if res.Err != nil || res.Status != http.StatusAccepted || res.Body != "next yes" {
+		t.Errorf("got %d %q (%v), want the response of the next handler", res.Status, res.Body, res.Err)
+	}
+	res = tr.Do(TestRequest{Path: "/error"})
+	if res.Err == nil || res.Status != http.StatusInternalServerError {
+		t.Errorf("got %d %q (%v), want the error of the script", res.Status, res.Body, res.Err)
+	}
+
+	// the worker keeps its kv store until it crashes
+	res = tr.Do(TestRequest{})
+	if res.Header.Get("X-Count") != "4" {
+		t.Errorf("got the count %q, want 4", res.Header.Get("X-Count"))
+	}
+	res = tr.Do(TestRequest{Path: "/crash"})
+	if res.Status != http.StatusBadGateway {
+		t.Errorf("got %d %q (%v), want the error of the worker", res.Status, res.Body, res.Err)
+	}
+	res = tr.Do(TestRequest{})
+	if res.Err != nil || res.Header.Get("X-Count") != "1" {
+		t.Errorf("got %d, the count %q (%v), want the response of a new worker", res.Status, res.Header.Get("X-Count"), res.Err)
+	}
+}
+
+func TestProcessIsolationConfigError(t *testing.T) {
+	useTestWorkers(t)
+	_, err := NewTester(&Lua{Isolation: isolationProcess, Workers: 1, Script: "if"})
+	if err == nil {
+		t.Fatal("got no error, want the error of the worker")
+	}
+}